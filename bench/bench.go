@@ -0,0 +1,331 @@
+// ◄◄◄ bench/bench.go ►►►
+// Copyright © 2012 Jason Summers
+
+// Package bench measures how fast fpresize resizes images, for a set of
+// representative workloads: photos, thumbnails, enlargements, 16-bit and
+// grayscale images, and images with transparency.
+//
+// The source images are generated, so the results don't depend on any
+// image files, and can be compared between computers and between versions
+// of fpresize. Throughput is reported in megapixels per second.
+//
+// The standard workloads can also be run by "go test -bench .", in this
+// package's directory.
+package bench
+
+import "errors"
+import "fmt"
+import "image"
+import "image/color"
+import "io"
+import "strings"
+import "time"
+import "github.com/jsummers/fpresize"
+
+// A Workload describes one kind of resize operation.
+type Workload struct {
+	Name string
+
+	// The size of the source image, and of the target image.
+	SrcW, SrcH int
+	DstW, DstH int
+
+	// The type of the source image: "nrgba", "rgba", "nrgba64", "gray",
+	// "ycbcr", or "sprite" (an NRGBA image that is mostly transparent).
+	Source string
+
+	// The Resize* method to use: "nrgba" (ResizeToNRGBA), "rgba", "nrgba64",
+	// "rgba64", "ycbcr", "image" (ResizeToImage, allowing a grayscale
+	// target image), or "linear" (ResizeToLinear).
+	Target string
+
+	// The name of the filter (see fpresize.FilterByName), or "" for the
+	// default.
+	Filter string
+}
+
+// StandardWorkloads is the set of workloads used when no others are given.
+var StandardWorkloads = []Workload{
+	{Name: "photo", SrcW: 3000, SrcH: 2000, DstW: 1200, DstH: 800, Source: "ycbcr", Target: "rgba"},
+	{Name: "thumbnail", SrcW: 3000, SrcH: 2000, DstW: 150, DstH: 100, Source: "ycbcr", Target: "rgba"},
+	{Name: "photo-lanczos3", SrcW: 3000, SrcH: 2000, DstW: 1200, DstH: 800, Source: "ycbcr",
+		Target: "ycbcr", Filter: "lanczos3"},
+	{Name: "enlarge", SrcW: 400, SrcH: 300, DstW: 1600, DstH: 1200, Source: "nrgba", Target: "nrgba",
+		Filter: "mitchell"},
+	{Name: "deep", SrcW: 2000, SrcH: 1500, DstW: 800, DstH: 600, Source: "nrgba64", Target: "nrgba64"},
+	{Name: "gray", SrcW: 2000, SrcH: 1500, DstW: 800, DstH: 600, Source: "gray", Target: "image"},
+	{Name: "transparent", SrcW: 2000, SrcH: 1500, DstW: 800, DstH: 600, Source: "rgba", Target: "rgba"},
+	{Name: "sprite", SrcW: 2000, SrcH: 1500, DstW: 800, DstH: 600, Source: "sprite", Target: "nrgba"},
+	{Name: "linear", SrcW: 2000, SrcH: 1500, DstW: 800, DstH: 600, Source: "nrgba", Target: "linear"},
+}
+
+// Options controls how the workloads are run. A nil *Options means the
+// defaults.
+type Options struct {
+	// Each workload is run until it has been run at least MinRuns times,
+	// and for at least MinTime. The defaults are 3 and 1 second.
+	MinRuns int
+	MinTime time.Duration
+
+	// If not nil, Configure is called with each FPObject before it is used,
+	// so that other settings (such as the number of workers) can be
+	// changed.
+	Configure func(fp *fpresize.FPObject)
+}
+
+// Result is the measured speed of one workload.
+type Result struct {
+	Workload Workload
+	Runs     int
+
+	// The time taken by the fastest run, which is the least affected by
+	// other activity on the computer, and the mean time of all the runs.
+	// Each run includes converting the source image, resizing it, and
+	// converting it to the target format. It doesn't include generating the
+	// source image.
+	Best time.Duration
+	Mean time.Duration
+
+	// The throughput of the fastest run, in megapixels of the source image
+	// per second.
+	MPPerSec float64
+}
+
+// A simple deterministic pseudo-random number generator, so that the
+// source images are the same every time.
+type lcg uint32
+
+func (r *lcg) next() uint32 {
+	*r = *r*1664525 + 1013904223
+	return uint32(*r >> 8)
+}
+
+// Returns the color of pixel (x,y) of a w×h image that looks somewhat like
+// a photo: smooth color gradients, some sharp edges, and a little noise.
+func photoColor(x, y, w, h int, r *lcg) color.NRGBA {
+	fx, fy := float64(x)/float64(w), float64(y)/float64(h)
+	v := [3]float64{fx, fy, 1.0 - (fx+fy)/2.0}
+	if (x/97+y/61)%3 == 0 {
+		// Stripes, with sharp edges
+		v[0], v[1] = v[1], 1.0-v[0]
+	}
+	var c [3]uint8
+	for k := range v {
+		n := float64(r.next()%32) / 255.0
+		s := v[k]*0.85 + n
+		if s > 1.0 {
+			s = 1.0
+		}
+		c[k] = uint8(s * 255.0)
+	}
+	return color.NRGBA{c[0], c[1], c[2], 255}
+}
+
+// MakeSource generates the source image for a workload.
+func MakeSource(wl *Workload) (image.Image, error) {
+	w, h := wl.SrcW, wl.SrcH
+	if w < 1 || h < 1 {
+		return nil, errors.New("bench: invalid source size")
+	}
+	rect := image.Rect(0, 0, w, h)
+	r := lcg(1)
+
+	switch wl.Source {
+	case "nrgba", "sprite":
+		im := image.NewNRGBA(rect)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				if wl.Source == "sprite" {
+					// A few opaque objects, on a transparent background
+					if (x*4/w+y*3/h)%3 != 0 || (x*8/w)%2 != 0 {
+						continue
+					}
+				}
+				im.SetNRGBA(x, y, photoColor(x, y, w, h, &r))
+			}
+		}
+		return im, nil
+	case "rgba":
+		// An image with varying transparency
+		im := image.NewRGBA(rect)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				c := photoColor(x, y, w, h, &r)
+				c.A = uint8(255 * x / w)
+				im.Set(x, y, c)
+			}
+		}
+		return im, nil
+	case "nrgba64":
+		im := image.NewNRGBA64(rect)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				c := photoColor(x, y, w, h, &r)
+				im.SetNRGBA64(x, y, color.NRGBA64{uint16(c.R)<<8 | uint16(r.next()&0xff),
+					uint16(c.G)<<8 | uint16(r.next()&0xff), uint16(c.B)<<8 | uint16(r.next()&0xff), 0xffff})
+			}
+		}
+		return im, nil
+	case "gray":
+		im := image.NewGray(rect)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				im.Set(x, y, photoColor(x, y, w, h, &r))
+			}
+		}
+		return im, nil
+	case "ycbcr":
+		// 4:2:0 subsampling, as in most JPEG files
+		im := image.NewYCbCr(rect, image.YCbCrSubsampleRatio420)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				c := photoColor(x, y, w, h, &r)
+				yy, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+				im.Y[im.YOffset(x, y)] = yy
+				if x%2 == 0 && y%2 == 0 {
+					im.Cb[im.COffset(x, y)] = cb
+					im.Cr[im.COffset(x, y)] = cr
+				}
+			}
+		}
+		return im, nil
+	}
+	return nil, fmt.Errorf("bench: unknown source type %+q", wl.Source)
+}
+
+// Resizes src once, according to wl.
+func runOnce(wl *Workload, src image.Image, opts *Options) error {
+	fp := fpresize.New(src)
+	if wl.Filter != "" {
+		err := fp.SetFilterByName(wl.Filter)
+		if err != nil {
+			return err
+		}
+	}
+	fp.SetTargetBounds(image.Rect(0, 0, wl.DstW, wl.DstH))
+	if opts.Configure != nil {
+		opts.Configure(fp)
+	}
+
+	var err error
+	switch wl.Target {
+	case "nrgba":
+		_, err = fp.ResizeToNRGBA()
+	case "rgba":
+		_, err = fp.ResizeToRGBA()
+	case "nrgba64":
+		_, err = fp.ResizeToNRGBA64()
+	case "rgba64":
+		_, err = fp.ResizeToRGBA64()
+	case "ycbcr":
+		_, err = fp.ResizeToYCbCr()
+	case "image":
+		_, err = fp.ResizeToImage(fpresize.ResizeFlagGrayOK)
+	case "linear":
+		_, err = fp.ResizeToLinear()
+	default:
+		err = fmt.Errorf("bench: unknown target type %+q", wl.Target)
+	}
+	return err
+}
+
+// Run measures the speed of one workload. opts may be nil.
+func Run(wl *Workload, opts *Options) (*Result, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	minRuns, minTime := opts.MinRuns, opts.MinTime
+	if minRuns < 1 {
+		minRuns = 3
+	}
+	if minTime <= 0 {
+		minTime = time.Second
+	}
+	if wl.DstW < 1 || wl.DstH < 1 {
+		return nil, errors.New("bench: invalid target size")
+	}
+
+	src, err := MakeSource(wl)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Result{Workload: *wl}
+	var total time.Duration
+	for res.Runs < minRuns || total < minTime {
+		start := time.Now()
+		err = runOnce(wl, src, opts)
+		if err != nil {
+			return nil, err
+		}
+		d := time.Since(start)
+		if res.Runs == 0 || d < res.Best {
+			res.Best = d
+		}
+		total += d
+		res.Runs++
+	}
+	res.Mean = total / time.Duration(res.Runs)
+	if res.Best > 0 {
+		res.MPPerSec = float64(wl.SrcW) * float64(wl.SrcH) / 1.0e6 / res.Best.Seconds()
+	}
+	return res, nil
+}
+
+// RunAll measures the speed of each workload (nil means
+// StandardWorkloads), in order. If progress is not nil, it is called with
+// each result as soon as it is available.
+func RunAll(wls []Workload, opts *Options, progress func(r *Result)) ([]*Result, error) {
+	if wls == nil {
+		wls = StandardWorkloads
+	}
+	results := make([]*Result, 0, len(wls))
+	for i := range wls {
+		res, err := Run(&wls[i], opts)
+		if err != nil {
+			return results, fmt.Errorf("%s: %v", wls[i].Name, err)
+		}
+		results = append(results, res)
+		if progress != nil {
+			progress(res)
+		}
+	}
+	return results, nil
+}
+
+// Describes a workload's configuration, for WriteReport.
+func (wl *Workload) describe() string {
+	filter := wl.Filter
+	if filter == "" {
+		filter = "default"
+	}
+	return fmt.Sprintf("%dx%d %s -> %dx%d %s, %s", wl.SrcW, wl.SrcH, wl.Source,
+		wl.DstW, wl.DstH, wl.Target, filter)
+}
+
+// WriteReport writes a table of results to w, one line per workload.
+func WriteReport(w io.Writer, results []*Result) error {
+	nameW := len("workload")
+	for _, r := range results {
+		if len(r.Workload.Name) > nameW {
+			nameW = len(r.Workload.Name)
+		}
+	}
+	_, err := fmt.Fprintf(w, "%-*s %9s %10s %10s  %s\n", nameW, "workload", "MP/s", "best", "mean",
+		"configuration")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", strings.Repeat("-", nameW+34+len("configuration")))
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		_, err = fmt.Fprintf(w, "%-*s %9.2f %10s %10s  %s\n", nameW, r.Workload.Name, r.MPPerSec,
+			r.Best.Round(time.Microsecond*100), r.Mean.Round(time.Microsecond*100), r.Workload.describe())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// ◄◄◄ bench/bench_test.go ►►►
+
+// Tests for the bench package.
+
+package bench
+
+import "bytes"
+import "strings"
+import "testing"
+
+func TestRun(t *testing.T) {
+	var wls []Workload
+	for _, wl := range StandardWorkloads {
+		// Much smaller versions of the standard workloads
+		wl.SrcW, wl.SrcH = wl.SrcW/50, wl.SrcH/50
+		wl.DstW, wl.DstH = wl.DstW/50+1, wl.DstH/50+1
+		wls = append(wls, wl)
+	}
+
+	var n int
+	results, err := RunAll(wls, &Options{MinRuns: 2, MinTime: 1}, func(r *Result) { n++ })
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(results) != len(wls) || n != len(wls) {
+		t.Fatalf("Wrong number of results")
+	}
+	for _, r := range results {
+		if r.Runs < 2 || r.Best <= 0 || r.Best > r.Mean || r.MPPerSec <= 0.0 {
+			t.Errorf("%s: bad result %+v", r.Workload.Name, r)
+		}
+	}
+
+	var buf bytes.Buffer
+	err = WriteReport(&buf, results)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	for _, wl := range wls {
+		if !strings.Contains(buf.String(), wl.Name+" ") {
+			t.Errorf("Report has no line for %s", wl.Name)
+		}
+	}
+
+	_, err = Run(&Workload{Name: "bad", SrcW: 10, SrcH: 10, DstW: 5, DstH: 5, Source: "cmyk", Target: "rgba"}, nil)
+	if err == nil {
+		t.Errorf("Unknown source type: expected an error")
+	}
+}
+
+func BenchmarkStandard(b *testing.B) {
+	for i := range StandardWorkloads {
+		wl := &StandardWorkloads[i]
+		src, err := MakeSource(wl)
+		if err != nil {
+			b.Fatalf("%s", err.Error())
+		}
+		b.Run(wl.Name, func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				err := runOnce(wl, src, &Options{})
+				if err != nil {
+					b.Fatalf("%s", err.Error())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,466 @@
+// ◄◄◄ colorspace/colorspace.go ►►►
+// Copyright © 2012 Jason Summers
+
+// Package colorspace converts images between RGB colorspaces that are
+// defined by their primaries and transfer functions (such as sRGB, Display
+// P3, and Adobe RGB), as part of an fpresize resize.
+//
+// The conversion is done by fpresize's color converters: the input
+// converter decodes the source colorspace and converts it to the target
+// colorspace's primaries, in linear light, and the output converter encodes
+// the result using the target colorspace's transfer function. Conversions
+// are done with matrices, not with ICC lookup tables, so the rendering
+// intents are approximations of what an ICC color management system does.
+package colorspace
+
+import "math"
+import "github.com/jsummers/fpresize"
+
+// Chromaticity is a CIE 1931 xy chromaticity.
+type Chromaticity struct {
+	X, Y float64
+}
+
+// Space describes an RGB colorspace.
+type Space struct {
+	Name string
+	// The chromaticities of the primaries, and of the white point.
+	Red, Green, Blue, White Chromaticity
+	// Decode converts an encoded sample to linear light, and Encode does
+	// the reverse. Both work on a scale of 0 to 1.
+	Decode, Encode func(v float64) float64
+	// The luminance of the darkest black that the colorspace can
+	// represent (RGB 0,0,0), relative to white. This is 0 for the
+	// predefined colorspaces, but may not be for a colorspace that
+	// describes a printer or a display.
+	BlackPoint float64
+	// The approximate gamma of Decode (see fpresize.ColorspaceInfo), and
+	// the colorspace's ITU-T H.273 code points, if it has them. These are
+	// only used to describe the colorspace, by Info.
+	Gamma                       float64
+	CICPPrimaries, CICPTransfer uint8
+}
+
+// The D65 white point.
+var D65 = Chromaticity{0.3127, 0.3290}
+
+// The D50 white point, which is used by ICC profiles' connection space.
+var D50 = Chromaticity{0.3457, 0.3585}
+
+// SRGB is the sRGB colorspace.
+var SRGB = &Space{
+	Name:          "sRGB",
+	Red:           Chromaticity{0.64, 0.33},
+	Green:         Chromaticity{0.30, 0.60},
+	Blue:          Chromaticity{0.15, 0.06},
+	White:         D65,
+	Decode:        SRGBDecode,
+	Encode:        SRGBEncode,
+	Gamma:         2.2,
+	CICPPrimaries: 1,
+	CICPTransfer:  13,
+}
+
+// DisplayP3 is Apple's Display P3 colorspace, which has the DCI-P3
+// primaries and the sRGB transfer function.
+var DisplayP3 = &Space{
+	Name:          "Display P3",
+	Red:           Chromaticity{0.680, 0.320},
+	Green:         Chromaticity{0.265, 0.690},
+	Blue:          Chromaticity{0.150, 0.060},
+	White:         D65,
+	Decode:        SRGBDecode,
+	Encode:        SRGBEncode,
+	Gamma:         2.2,
+	CICPPrimaries: 12,
+	CICPTransfer:  13,
+}
+
+// AdobeRGB is the Adobe RGB (1998) colorspace.
+var AdobeRGB = &Space{
+	Name:   "Adobe RGB (1998)",
+	Red:    Chromaticity{0.64, 0.33},
+	Green:  Chromaticity{0.21, 0.71},
+	Blue:   Chromaticity{0.15, 0.06},
+	White:  D65,
+	Decode: func(v float64) float64 { return gammaDecode(v, 563.0/256.0) },
+	Encode: func(v float64) float64 { return gammaEncode(v, 563.0/256.0) },
+	Gamma:  563.0 / 256.0,
+}
+
+// Rec2020 is the ITU-R BT.2020 colorspace.
+var Rec2020 = &Space{
+	Name:          "Rec. 2020",
+	Red:           Chromaticity{0.708, 0.292},
+	Green:         Chromaticity{0.170, 0.797},
+	Blue:          Chromaticity{0.131, 0.046},
+	White:         D65,
+	Decode:        rec709Decode,
+	Encode:        rec709Encode,
+	Gamma:         1.0 / 0.45,
+	CICPPrimaries: 9,
+	CICPTransfer:  14,
+}
+
+// ProPhotoRGB is the ProPhoto RGB (ROMM RGB) colorspace. Its white point is
+// D50.
+var ProPhotoRGB = &Space{
+	Name:   "ProPhoto RGB",
+	Red:    Chromaticity{0.7347, 0.2653},
+	Green:  Chromaticity{0.1596, 0.8404},
+	Blue:   Chromaticity{0.0366, 0.0001},
+	White:  D50,
+	Decode: proPhotoDecode,
+	Encode: proPhotoEncode,
+	Gamma:  1.8,
+}
+
+// SRGBDecode is the sRGB transfer function, converting to linear light.
+func SRGBDecode(v float64) float64 {
+	if v <= 0.0404482362771082 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// SRGBEncode is the inverse of SRGBDecode.
+func SRGBEncode(v float64) float64 {
+	if v <= 0.00313066844250063 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1.0/2.4) - 0.055
+}
+
+// Negative samples can happen with out-of-gamut colors, so make the gamma
+// curves symmetric about 0.
+func gammaDecode(v float64, gamma float64) float64 {
+	if v < 0.0 {
+		return -math.Pow(-v, gamma)
+	}
+	return math.Pow(v, gamma)
+}
+
+func gammaEncode(v float64, gamma float64) float64 {
+	return gammaDecode(v, 1.0/gamma)
+}
+
+func rec709Decode(v float64) float64 {
+	if v < 0.081 {
+		return v / 4.5
+	}
+	return math.Pow((v+0.099)/1.099, 1.0/0.45)
+}
+
+func rec709Encode(v float64) float64 {
+	if v < 0.018 {
+		return v * 4.5
+	}
+	return 1.099*math.Pow(v, 0.45) - 0.099
+}
+
+func proPhotoDecode(v float64) float64 {
+	if v < 16.0/512.0 {
+		return v / 16.0
+	}
+	return math.Pow(v, 1.8)
+}
+
+func proPhotoEncode(v float64) float64 {
+	if v < 1.0/512.0 {
+		return v * 16.0
+	}
+	return math.Pow(v, 1.0/1.8)
+}
+
+// A 3×3 matrix, by rows.
+type matrix [3][3]float64
+
+func (m *matrix) mul(n *matrix) matrix {
+	var r matrix
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				r[i][j] += m[i][k] * n[k][j]
+			}
+		}
+	}
+	return r
+}
+
+func (m *matrix) apply(v [3]float64) [3]float64 {
+	var r [3]float64
+	for i := 0; i < 3; i++ {
+		r[i] = m[i][0]*v[0] + m[i][1]*v[1] + m[i][2]*v[2]
+	}
+	return r
+}
+
+func (m *matrix) inverse() matrix {
+	var r matrix
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			// The cofactor of element (j,i)
+			a, b := (j+1)%3, (j+2)%3
+			c, d := (i+1)%3, (i+2)%3
+			r[i][j] = (m[a][c]*m[b][d] - m[a][d]*m[b][c]) / det
+		}
+	}
+	return r
+}
+
+// Returns the XYZ tristimulus values of a chromaticity, with Y=1.
+func (c Chromaticity) xyz() [3]float64 {
+	return [3]float64{c.X / c.Y, 1.0, (1.0 - c.X - c.Y) / c.Y}
+}
+
+// Returns the matrix that converts linear RGB samples in s to XYZ.
+func (s *Space) toXYZ() matrix {
+	r, g, b := s.Red.xyz(), s.Green.xyz(), s.Blue.xyz()
+	m := matrix{
+		{r[0], g[0], b[0]},
+		{r[1], g[1], b[1]},
+		{r[2], g[2], b[2]},
+	}
+	// Scale the primaries so that RGB (1,1,1) is the white point.
+	mi := m.inverse()
+	scale := mi.apply(s.White.xyz())
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			m[i][j] *= scale[j]
+		}
+	}
+	return m
+}
+
+// Chromatic adaptation methods, for converting between colorspaces with
+// different white points. Both map the source white point to the target
+// white point.
+const (
+	// The Bradford method, as used by most ICC color management systems.
+	AdaptationBradford = 0
+	// Scaling the XYZ values. This is simple, but not very accurate.
+	AdaptationXYZScaling = 1
+)
+
+// The Bradford cone response matrix
+var bradford = matrix{
+	{0.8951, 0.2664, -0.1614},
+	{-0.7502, 1.7135, 0.0367},
+	{0.0389, -0.0685, 1.0296},
+}
+
+// Returns the matrix that converts XYZ values relative to white point from,
+// to XYZ values relative to white point to, using a cone response matrix.
+func adaptationMatrix(from, to Chromaticity, cone *matrix) matrix {
+	src := cone.apply(from.xyz())
+	dst := cone.apply(to.xyz())
+	scale := matrix{
+		{dst[0] / src[0], 0, 0},
+		{0, dst[1] / src[1], 0},
+		{0, 0, dst[2] / src[2]},
+	}
+	coneInv := cone.inverse()
+	m := coneInv.mul(&scale)
+	return m.mul(cone)
+}
+
+// Adapt returns the Bradford chromatic adaptation matrix that converts XYZ
+// values relative to white point from (e.g. D65), to XYZ values relative
+// to white point to (e.g. D50, for ICC profile connection space data).
+// The matrix is given by rows.
+func Adapt(from, to Chromaticity) [3][3]float64 {
+	return adaptationMatrix(from, to, &bradford)
+}
+
+// Rendering intents, which control how colors that are outside of the
+// target colorspace's gamut are handled. The values are the same as in
+// ICC profiles.
+const (
+	// Out-of-gamut colors are desaturated, keeping their hue and
+	// luminance, until they fit in the gamut. Suitable for photos.
+	IntentPerceptual = 0
+	// Colors are converted exactly, and out-of-gamut colors are clipped.
+	IntentRelativeColorimetric = 1
+	// The source primaries are mapped to the target primaries, so that
+	// saturated colors stay as saturated as possible. Suitable for charts
+	// and other graphics.
+	IntentSaturation = 2
+)
+
+// Conversion is the configuration of a colorspace conversion.
+type Conversion struct {
+	Source, Target *Space
+	// A rendering intent (Intent* constant). The default is
+	// IntentPerceptual.
+	Intent int
+	// If set, the source black point is mapped to the target black point,
+	// and the colors in between are scaled to fit. Otherwise, shadows
+	// that are darker than the target black point are clipped to black,
+	// and if the source black point is lighter than the target's, black
+	// becomes dark gray.
+	BlackPointCompensation bool
+	// The chromatic adaptation method (Adaptation* constant) to use if the
+	// colorspaces have different white points. The default is
+	// AdaptationBradford.
+	Adaptation int
+	// If nonzero, samples above this linear value (which should be between
+	// 0 and 1, e.g. 0.8) are smoothly compressed so that they fit below 1,
+	// instead of being clipped. This avoids posterization of saturated
+	// colors that are out of the target gamut, at the cost of making
+	// colors near the knee a little less accurate. Samples below 0 are
+	// still clipped.
+	SoftClip float64
+}
+
+// Returns the matrix that converts linear RGB samples from c.Source to
+// c.Target, ignoring black points.
+func (c *Conversion) matrix() matrix {
+	if c.Intent == IntentSaturation {
+		return matrix{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+	}
+	src := c.Source.toXYZ()
+	tgt := c.Target.toXYZ()
+	tgtInv := tgt.inverse()
+	if c.Source.White != c.Target.White {
+		var adapt matrix
+		if c.Adaptation == AdaptationXYZScaling {
+			adapt = adaptationMatrix(c.Source.White, c.Target.White, &matrix{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}})
+		} else {
+			adapt = adaptationMatrix(c.Source.White, c.Target.White, &bradford)
+		}
+		src = adapt.mul(&src)
+	}
+	return tgtInv.mul(&src)
+}
+
+// Returns the scale factor and offset that convert the result of c.matrix()
+// to take the black points into account. The offset is added to each
+// sample.
+//
+// A linear sample v in a colorspace whose black point is b means
+// b + (1-b)*v, relative to white. Because black and white are neutral,
+// the black points only affect the gray level of each channel, so this can
+// be done after the matrix.
+func (c *Conversion) blackPointAdjustment() (float64, float64) {
+	bs, bt := c.Source.BlackPoint, c.Target.BlackPoint
+	if c.BlackPointCompensation || bs == bt {
+		// With BPC, the source black is the target black, and the source
+		// white is the target white, which is what the matrix does.
+		return 1.0, 0.0
+	}
+	return (1.0 - bs) / (1.0 - bt), (bs - bt) / (1.0 - bt)
+}
+
+// Returns the input ColorConverter, which must be used with
+// fpresize.CCFFlagWholePixels.
+func (c *Conversion) inputConverter() fpresize.ColorConverter {
+	m := c.matrix()
+	bpScale, bpOffset := c.blackPointAdjustment()
+	tgt := c.Target.toXYZ()
+	lum := tgt[1] // Converts target RGB to luminance
+	decode := c.Source.Decode
+	intent := c.Intent
+	knee := c.SoftClip
+
+	return func(x []float32) {
+		for i := 0; i+2 < len(x); i += 3 {
+			v := [3]float64{decode(float64(x[i])), decode(float64(x[i+1])), decode(float64(x[i+2]))}
+			v = m.apply(v)
+			for k := 0; k < 3; k++ {
+				v[k] = v[k]*bpScale + bpOffset
+				if knee > 0.0 {
+					v[k] = softClip(v[k], knee)
+				}
+			}
+			if intent == IntentPerceptual {
+				v = desaturateIntoGamut(v, lum)
+			}
+			x[i], x[i+1], x[i+2] = float32(v[0]), float32(v[1]), float32(v[2])
+		}
+		if len(x)%3 != 0 {
+			// A grayscale pixel. Gray stays gray (the source white point is
+			// adapted to the target white point), so only its transfer
+			// function and black point need to be converted.
+			for i := len(x) - len(x)%3; i < len(x); i++ {
+				v := decode(float64(x[i]))*bpScale + bpOffset
+				if knee > 0.0 {
+					v = softClip(v, knee)
+				}
+				x[i] = float32(v)
+			}
+		}
+	}
+}
+
+// Compress the part of v that is above knee into the range [knee,1). The
+// curve's slope is 1 at the knee, so there is no visible edge.
+func softClip(v float64, knee float64) float64 {
+	if v <= knee || knee >= 1.0 {
+		return v
+	}
+	return knee + (1.0-knee)*math.Tanh((v-knee)/(1.0-knee))
+}
+
+// Move v toward the gray with the same luminance, just far enough that it
+// is in the range [0,1]. lum is the row of the RGB-to-XYZ matrix that
+// computes luminance.
+func desaturateIntoGamut(v [3]float64, lum [3]float64) [3]float64 {
+	y := lum[0]*v[0] + lum[1]*v[1] + lum[2]*v[2]
+	if y <= 0.0 {
+		return [3]float64{0, 0, 0}
+	}
+	if y >= 1.0 {
+		return [3]float64{1, 1, 1}
+	}
+	// Find the largest t (0 to 1) such that y+t*(v-y) is in range.
+	t := 1.0
+	for k := 0; k < 3; k++ {
+		if v[k] > 1.0 {
+			t = math.Min(t, (1.0-y)/(v[k]-y))
+		} else if v[k] < 0.0 {
+			t = math.Min(t, y/(y-v[k]))
+		}
+	}
+	for k := 0; k < 3; k++ {
+		v[k] = y + t*(v[k]-y)
+	}
+	return v
+}
+
+// Returns the output ColorConverter.
+func (c *Conversion) outputConverter() fpresize.ColorConverter {
+	encode := c.Target.Encode
+	return func(x []float32) {
+		for i := range x {
+			x[i] = float32(encode(float64(x[i])))
+		}
+	}
+}
+
+// Apply sets fp's color converters to perform the conversion. The image is
+// resized in linear light, using the target colorspace's primaries. This
+// must be called before the first resize. It also sets fp's output
+// colorspace description (see fpresize's OutputColorspace).
+func (c *Conversion) Apply(fp *fpresize.FPObject) {
+	fp.SetInputColorConverter(c.inputConverter())
+	fp.SetInputColorConverterFlags(fpresize.CCFFlagWholePixels)
+	fp.SetOutputColorConverter(c.outputConverter())
+	fp.SetOutputColorConverterFlags(0)
+	fp.SetOutputColorspace(c.Target.Info())
+}
+
+// Info returns a description of the colorspace, for fpresize's
+// SetOutputColorspace.
+func (s *Space) Info() *fpresize.ColorspaceInfo {
+	return &fpresize.ColorspaceInfo{
+		Name:  s.Name,
+		Gamma: s.Gamma,
+		Primaries: [4][2]float64{{s.Red.X, s.Red.Y}, {s.Green.X, s.Green.Y},
+			{s.Blue.X, s.Blue.Y}, {s.White.X, s.White.Y}},
+		CICPPrimaries: s.CICPPrimaries,
+		CICPTransfer:  s.CICPTransfer,
+	}
+}
@@ -0,0 +1,182 @@
+// ◄◄◄ colorspace/colorspace_test.go ►►►
+
+// Tests for the colorspace package.
+
+package colorspace
+
+import "testing"
+import "math"
+import "image"
+import "image/color"
+import "github.com/jsummers/fpresize"
+
+// Convert one color by resizing a solid image with fpresize.
+func convertColor(t *testing.T, c *Conversion, clr color.NRGBA) color.NRGBA {
+	src := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for i := 0; i < len(src.Pix); i += 4 {
+		src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3] = clr.R, clr.G, clr.B, clr.A
+	}
+	fp := fpresize.New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 3, 3))
+	c.Apply(fp)
+	dst, err := fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	return dst.NRGBAAt(1, 1)
+}
+
+func closeTo(a, b color.NRGBA, tolerance int) bool {
+	d := func(x, y uint8) bool { return int(x)-int(y) <= tolerance && int(y)-int(x) <= tolerance }
+	return d(a.R, b.R) && d(a.G, b.G) && d(a.B, b.B) && d(a.A, b.A)
+}
+
+func TestMatrix(t *testing.T) {
+	m := SRGB.toXYZ()
+	// The well-known sRGB-to-XYZ matrix
+	if math.Abs(m[0][0]-0.4124) > 0.0002 || math.Abs(m[1][1]-0.7152) > 0.0002 || math.Abs(m[2][2]-0.9505) > 0.0002 {
+		t.Errorf("sRGB to XYZ matrix is wrong: %v", m)
+	}
+	mi := m.inverse()
+	id := m.mul(&mi)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			expected := 0.0
+			if i == j {
+				expected = 1.0
+			}
+			if math.Abs(id[i][j]-expected) > 0.000001 {
+				t.Fatalf("matrix inverse is wrong: %v", id)
+			}
+		}
+	}
+}
+
+func TestConversion(t *testing.T) {
+	c := &Conversion{Source: SRGB, Target: SRGB, Intent: IntentRelativeColorimetric}
+	clr := color.NRGBA{200, 100, 30, 255}
+	if got := convertColor(t, c, clr); !closeTo(got, clr, 1) {
+		t.Errorf("sRGB to sRGB: got %v, expected %v", got, clr)
+	}
+
+	// sRGB red, in Display P3, is about (234, 51, 35).
+	c = &Conversion{Source: SRGB, Target: DisplayP3, Intent: IntentRelativeColorimetric}
+	if got := convertColor(t, c, color.NRGBA{255, 0, 0, 255}); !closeTo(got, color.NRGBA{234, 51, 35, 255}, 2) {
+		t.Errorf("sRGB to P3: got %v", got)
+	}
+
+	// P3 green is outside of the sRGB gamut. With the perceptual intent,
+	// it is desaturated just enough to fit, so the blue channel is not
+	// clipped to 0.
+	c = &Conversion{Source: DisplayP3, Target: SRGB, Intent: IntentPerceptual}
+	if got := convertColor(t, c, color.NRGBA{0, 255, 0, 255}); got.B == 0 || got.G == 255 {
+		t.Errorf("P3 to sRGB, perceptual: got %v", got)
+	}
+	c.Intent = IntentRelativeColorimetric
+	if got := convertColor(t, c, color.NRGBA{0, 255, 0, 255}); got.R != 0 || got.G != 255 || got.B != 0 {
+		t.Errorf("P3 to sRGB, relative colorimetric: got %v", got)
+	}
+
+	// With the saturation intent, primaries stay primaries.
+	c.Intent = IntentSaturation
+	if got := convertColor(t, c, color.NRGBA{0, 255, 0, 255}); got != (color.NRGBA{0, 255, 0, 255}) {
+		t.Errorf("P3 to sRGB, saturation: got %v", got)
+	}
+}
+
+func TestBlackPointCompensation(t *testing.T) {
+	// A colorspace like sRGB, whose black is 5% gray.
+	grayBlack := *SRGB
+	grayBlack.BlackPoint = 0.05
+
+	// Without BPC, dark shadows are crushed to black.
+	c := &Conversion{Source: SRGB, Target: &grayBlack, Intent: IntentRelativeColorimetric}
+	if got := convertColor(t, c, color.NRGBA{40, 40, 40, 255}); got.R != 0 {
+		t.Errorf("without BPC: got %v, expected black", got)
+	}
+	c.BlackPointCompensation = true
+	if got := convertColor(t, c, color.NRGBA{40, 40, 40, 255}); got.R == 0 {
+		t.Errorf("with BPC: got %v, expected dark gray", got)
+	}
+	if got := convertColor(t, c, color.NRGBA{0, 0, 0, 255}); got.R != 0 {
+		t.Errorf("with BPC: black became %v", got)
+	}
+
+	// In the other direction, without BPC, black becomes gray.
+	c = &Conversion{Source: &grayBlack, Target: SRGB, Intent: IntentRelativeColorimetric}
+	if got := convertColor(t, c, color.NRGBA{0, 0, 0, 255}); got.R == 0 {
+		t.Errorf("without BPC: got %v, expected gray", got)
+	}
+	c.BlackPointCompensation = true
+	if got := convertColor(t, c, color.NRGBA{0, 0, 0, 255}); got.R != 0 {
+		t.Errorf("with BPC: got %v, expected black", got)
+	}
+}
+
+func TestAdaptation(t *testing.T) {
+	// The well-known Bradford D65-to-D50 matrix
+	m := Adapt(D65, D50)
+	if math.Abs(m[0][0]-1.0478) > 0.0005 || math.Abs(m[0][1]-0.0229) > 0.0005 || math.Abs(m[2][2]-0.7521) > 0.0005 {
+		t.Errorf("Bradford matrix is wrong: %v", m)
+	}
+
+	// White and neutral colors stay neutral when the white points differ.
+	for _, adaptation := range []int{AdaptationBradford, AdaptationXYZScaling} {
+		c := &Conversion{Source: SRGB, Target: ProPhotoRGB, Intent: IntentRelativeColorimetric,
+			Adaptation: adaptation}
+		if got := convertColor(t, c, color.NRGBA{255, 255, 255, 255}); !closeTo(got, color.NRGBA{255, 255, 255, 255}, 1) {
+			t.Errorf("sRGB white in ProPhoto RGB: got %v (adaptation %d)", got, adaptation)
+		}
+		if got := convertColor(t, c, color.NRGBA{128, 128, 128, 255}); !closeTo(got, color.NRGBA{got.R, got.R, got.R, 255}, 1) {
+			t.Errorf("sRGB gray in ProPhoto RGB: got %v (adaptation %d)", got, adaptation)
+		}
+	}
+
+	// A round trip should not change the color.
+	clr := color.NRGBA{180, 90, 40, 255}
+	c1 := &Conversion{Source: SRGB, Target: ProPhotoRGB, Intent: IntentRelativeColorimetric}
+	c2 := &Conversion{Source: ProPhotoRGB, Target: SRGB, Intent: IntentRelativeColorimetric}
+	if got := convertColor(t, c2, convertColor(t, c1, clr)); !closeTo(got, clr, 2) {
+		t.Errorf("sRGB to ProPhoto RGB and back: got %v, expected %v", got, clr)
+	}
+}
+
+func TestSoftClip(t *testing.T) {
+	if softClip(0.5, 0.8) != 0.5 {
+		t.Errorf("softClip changed a value below the knee")
+	}
+	prev := 0.8
+	for v := 0.85; v < 3.0; v += 0.05 {
+		s := softClip(v, 0.8)
+		if s <= prev || s >= 1.0 {
+			t.Fatalf("softClip(%v) = %v, expected it to increase and stay below 1", v, s)
+		}
+		prev = s
+	}
+
+	// Saturated P3 reds, which are all clipped to the same sRGB red without
+	// soft clipping, should stay distinguishable.
+	c := &Conversion{Source: DisplayP3, Target: SRGB, Intent: IntentRelativeColorimetric}
+	a := convertColor(t, c, color.NRGBA{255, 0, 0, 255})
+	b := convertColor(t, c, color.NRGBA{240, 0, 0, 255})
+	if a.R != 255 || b.R != 255 {
+		t.Errorf("without soft clip: got %v and %v, expected clipped red", a, b)
+	}
+	c.SoftClip = 0.8
+	a = convertColor(t, c, color.NRGBA{255, 0, 0, 255})
+	b = convertColor(t, c, color.NRGBA{240, 0, 0, 255})
+	if a.R <= b.R {
+		t.Errorf("with soft clip: got %v and %v, expected different reds", a, b)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	fp := fpresize.New(image.NewNRGBA(image.Rect(0, 0, 4, 4)))
+	c := &Conversion{Source: SRGB, Target: DisplayP3}
+	c.Apply(fp)
+	info := fp.OutputColorspace()
+	if info == nil || info.Name != "Display P3" || info.CICPPrimaries != 12 || info.CICPTransfer != 13 ||
+		info.Gamma != 2.2 || info.Primaries[1] != [2]float64{0.265, 0.690} || info.Primaries[3] != [2]float64{D65.X, D65.Y} {
+		t.Errorf("Display P3 output colorspace: got %+v", info)
+	}
+}
@@ -31,6 +31,9 @@ Tell fpresize what size, in pixels, to make the new image:
 
     fp.SetTargetBounds(image.Rect(0, 0, 500, 500))
 
+To fill a box of that size without distorting the image, cropping whatever
+doesn't fit, call SetTargetCover instead.
+
 At this point, there are several optional methods you can call to control how
 the image is resized. Notably, you can change the resampling filter with
 SetFilter(), or disable color correction by calling
@@ -48,6 +51,8 @@ impossible. If fpresize knows what sort of resized image you want, it can
 usually take advantage of that to run faster and use less memory.
 
 You can write the resized image to a file by using the Encode method from
-image/jpeg, image/png, or another image package.
+image/jpeg, image/png, or another image package. Or, to write a PNG or JPEG
+file without ever having the whole resized image in memory, use
+EncodeResized instead of a Resize* method.
 */
 package fpresize
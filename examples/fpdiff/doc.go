@@ -0,0 +1,31 @@
+// ◄◄◄ fpdiff/doc.go ►►►
+// Copyright © 2012 Jason Summers
+
+/*
+fpdiff is a sample program that uses the fpresize package. It measures how
+different two images are, to help choose between filters and other
+settings, or to check that a new version of fpresize (or of your program)
+still makes the same images.
+
+Usage:
+    fpdiff [options] <image-file-1> <image-file-2>
+    fpdiff (-w|-h) <n> [options] -a <settings> -b <settings> <source-file>
+
+In the first form, it compares two image files, which must have the same
+dimensions. In the second, it resizes the source image twice, with two sets
+of settings, and compares the results. -w and -h set the target size; if
+only one is given, the other is calculated from the aspect ratio.
+
+A set of settings is a comma-separated list of: "filter=<name>" (such as
+"filter=mitchell"), "blur=<amount>", "nogamma" (disable color correction),
+and "area" (area averaging). For example:
+    fpdiff -w 300 -a filter=lanczos3 -b filter=catrom,blur=0.9 photo.jpg
+An empty set means the defaults.
+
+It reports the PSNR and SSIM of the two images (computed in linear light,
+by the metrics package), and the largest and mean difference between their
+samples. -d writes a difference image (PNG) to a file, in which each sample
+is the absolute difference between the images' samples, multiplied by -amp
+(default 10), so that small differences are visible.
+*/
+package main
@@ -0,0 +1,226 @@
+// ◄◄◄ fpdiff/fpdiff.go ►►►
+// Copyright © 2012 Jason Summers
+
+package main
+
+import "fmt"
+import "os"
+import "flag"
+import "strings"
+import "strconv"
+import "image"
+import "image/color"
+import "image/png"
+import _ "image/jpeg"
+import _ "image/gif"
+import "github.com/jsummers/fpresize"
+import "github.com/jsummers/fpresize/metrics"
+
+type options_type struct {
+	width, height int
+	setsA, setsB  string
+	diffFilename  string
+	amp           float64
+}
+
+func readImageFromFile(fn string) (image.Image, error) {
+	file, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	return img, err
+}
+
+// Apply a set of settings (see doc.go) to fp.
+func applySettings(fp *fpresize.FPObject, settings string) error {
+	for _, s := range strings.Split(settings, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		name, value := s, ""
+		if i := strings.Index(s, "="); i >= 0 {
+			name, value = s[:i], s[i+1:]
+		}
+		switch strings.ToLower(name) {
+		case "filter":
+			err := fp.SetFilterByName(value)
+			if err != nil {
+				return err
+			}
+		case "blur":
+			blur, err := strconv.ParseFloat(value, 64)
+			if err != nil || !(blur > 0.0) {
+				return fmt.Errorf("Invalid blur %+q", value)
+			}
+			fp.SetBlur(blur)
+		case "nogamma":
+			fp.SetInputColorConverter(nil)
+			fp.SetOutputColorConverter(nil)
+		case "area":
+			fp.SetAreaAverage(true)
+		default:
+			return fmt.Errorf("Unrecognized setting %+q", s)
+		}
+	}
+	return nil
+}
+
+// Resize src to r with the given settings.
+func resize(src image.Image, r image.Rectangle, settings string) (image.Image, error) {
+	fp := fpresize.New(src)
+	err := applySettings(fp, settings)
+	if err != nil {
+		return nil, err
+	}
+	fp.SetTargetBounds(r)
+	return fp.ResizeToNRGBA64()
+}
+
+// Returns the two images to compare.
+func getImages(options *options_type, args []string) (image.Image, image.Image, error) {
+	if len(args) == 2 {
+		img1, err := readImageFromFile(args[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		img2, err := readImageFromFile(args[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		return img1, img2, nil
+	}
+
+	src, err := readImageFromFile(args[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	b := src.Bounds()
+	r := fpresize.ComputeFitSize(b.Dx(), b.Dy(), options.width, options.height, true)
+	if r.Empty() {
+		return nil, nil, fmt.Errorf("Invalid source image")
+	}
+	img1, err := resize(src, r, options.setsA)
+	if err != nil {
+		return nil, nil, fmt.Errorf("-a: %v", err)
+	}
+	img2, err := resize(src, r, options.setsB)
+	if err != nil {
+		return nil, nil, fmt.Errorf("-b: %v", err)
+	}
+	return img1, img2, nil
+}
+
+// Returns an image of the absolute differences between the samples of img1
+// and img2 (which have the same size), multiplied by amp. The alpha
+// channel's difference is added to the color samples.
+func makeDiffImage(img1, img2 image.Image, amp float64) *image.NRGBA64 {
+	b1, b2 := img1.Bounds(), img2.Bounds()
+	dst := image.NewNRGBA64(image.Rect(0, 0, b1.Dx(), b1.Dy()))
+	for j := 0; j < b1.Dy(); j++ {
+		for i := 0; i < b1.Dx(); i++ {
+			var s1, s2 [4]uint32
+			s1[0], s1[1], s1[2], s1[3] = img1.At(b1.Min.X+i, b1.Min.Y+j).RGBA()
+			s2[0], s2[1], s2[2], s2[3] = img2.At(b2.Min.X+i, b2.Min.Y+j).RGBA()
+			var d [4]float64
+			for k := 0; k < 4; k++ {
+				d[k] = float64(s1[k]) - float64(s2[k])
+				if d[k] < 0.0 {
+					d[k] = -d[k]
+				}
+			}
+			var c [3]uint16
+			for k := 0; k < 3; k++ {
+				v := (d[k] + d[3]) * amp
+				if v > 65535.0 {
+					v = 65535.0
+				}
+				c[k] = uint16(v + 0.5)
+			}
+			dst.SetNRGBA64(i, j, color.NRGBA64{c[0], c[1], c[2], 0xffff})
+		}
+	}
+	return dst
+}
+
+func writeImageToFile(img image.Image, dstFilename string) error {
+	file, err := os.Create(dstFilename)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(file, img)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func compare(options *options_type, args []string) error {
+	img1, img2, err := getImages(options, args)
+	if err != nil {
+		return err
+	}
+	psnr, err := metrics.PSNR(img1, img2)
+	if err != nil {
+		return err
+	}
+	ssim, err := metrics.SSIM(img1, img2)
+	if err != nil {
+		return err
+	}
+	d, err := metrics.Compare(img1, img2)
+	if err != nil {
+		return err
+	}
+
+	b := img1.Bounds()
+	fmt.Printf("Size:             %dx%d\n", b.Dx(), b.Dy())
+	fmt.Printf("PSNR:             %.2f dB\n", psnr)
+	fmt.Printf("SSIM:             %.6f\n", ssim)
+	fmt.Printf("Max difference:   %.2f/255, at (%d,%d)\n", d.Max*255.0, d.MaxX, d.MaxY)
+	fmt.Printf("Mean difference:  %.4f/255\n", d.Mean*255.0)
+	fmt.Printf("Pixels differing: %d of %d\n", d.NumDiffering, b.Dx()*b.Dy())
+
+	if options.diffFilename != "" {
+		err = writeImageToFile(makeDiffImage(img1, img2, options.amp), options.diffFilename)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	options := new(options_type)
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  fpdiff [options] <image-file-1> <image-file-2>\n")
+		fmt.Fprintf(os.Stderr, "  fpdiff (-w|-h) <n> [options] -a <settings> -b <settings> <source-file>\n")
+		flag.PrintDefaults()
+	}
+
+	flag.IntVar(&options.width, "w", 0, "Target image width, in pixels, when resizing")
+	flag.IntVar(&options.height, "h", 0, "Target image height, in pixels, when resizing")
+	flag.StringVar(&options.setsA, "a", "", "First set of settings, such as filter=lanczos3,blur=1.1")
+	flag.StringVar(&options.setsB, "b", "", "Second set of settings")
+	flag.StringVar(&options.diffFilename, "d", "", "Write a difference image (PNG) to this file")
+	flag.Float64Var(&options.amp, "amp", 10.0, "Amplification of the difference image")
+	flag.Parse()
+
+	resizing := options.width > 0 || options.height > 0
+	if (resizing && flag.NArg() != 1) || (!resizing && flag.NArg() != 2) {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	err := compare(options, flag.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err.Error())
+		os.Exit(1)
+	}
+}
@@ -3,11 +3,80 @@
 
 /*
 fpr is a sample program that uses the fpresize package. It can resize PNG
-and JPEG images.
+and JPEG images, and read GIF images.
+
+If it is built with "go install -tags ximage", it uses the golang.org/x/image
+packages to also read WebP, TIFF, and BMP images, and write TIFF and BMP
+images. The format of a source file is detected from its contents, not its
+name.
 
 Usage:
     fpr -h <height> [options] <source-file> <target-file>
 
+Instead of -w and/or -h, the size may be given as a scale factor, such as
+"-scale 50%" or "-scale 0.5x".
+
+To make several sizes at once, use -sizes with a comma-separated list of
+sizes, each of which is a width, "x" and a height, or both, optionally
+preceded by a name and "=": "-sizes 1600,800,x300,thumb=160x160". The source
+image is only read and converted once. {size} in the target filename is
+replaced by the size's name; if there is no {size}, "_" and the name are
+added before the extension.
+
+If both -w and -h are given, -mode selects how the image is fit to that box:
+"stretch" (the default) ignores the aspect ratio; "fit" makes the image as
+large as will fit in the box; "fill" does the same, but pads the image to
+exactly the size of the box; "cover" fills the box and crops whatever
+doesn't fit. -gravity (center, n, ne, e, ...) positions the image in "fill"
+and "cover" modes.
+
+To resize many files at once, name a directory for the resized files with
+-outdir. The remaining arguments may be files, glob patterns, or directories:
+    fpr -w <width> [options] -outdir <dir> <source-file>...
+The -name option sets the target filename template (default "{name}.{ext}"),
+and -jobs sets how many images are processed at the same time.
+
+With -watch, fpr keeps running, and resizes files as they appear in (or are
+changed in) the source directories, checking every -interval (default 2s).
+Files whose target files are newer than them are skipped.
+
+-grayscale converts the image to grayscale, and writes a grayscale file if
+the image is opaque.
+
+JPEG files can't be transparent. By default, transparent parts of the image
+become black when it is written as a JPEG file. -background (such as
+"-background #ffffff") sets a color to composite the image over instead.
+
+-edge selects how the edges of the image are handled, by choosing what is
+imagined to be outside of it: "none" (nothing), "transparent",
+"replicate" (copies of the edge pixels), "mirror" (a reflection of the
+image), or "tile" (copies of the image). "color:#rrggbb" is like
+"transparent", but the image is then composited over that color. The
+default is "transparent" in "fill" mode, and "none" otherwise. In "fill"
+mode, "replicate", "mirror", and "tile" also fill the padding.
+
+-trim crops off the transparent borders of the image before resizing it,
+leaving the given number of pixels of transparent padding ("-trim 0" leaves
+none).
+
+-progress shows a progress bar, with the name of the current processing
+step and an estimate of the time remaining. In batch mode, it shows how many
+files are done.
+
+-json writes a report for each source file to standard output, as one line
+of JSON: the source and target dimensions, the filter, the time spent in
+each processing stage, and the size of each target file. Other messages are
+written to standard error instead.
+
+EXIF data, ICC color profiles, and XMP data in JPEG and PNG source files are
+copied to JPEG and PNG target files, except for the EXIF tags that give the
+image's dimensions. Use -nometadata to leave them out.
+
+If the EXIF data says that the image is rotated or flipped (as is common for
+photos from cameras), the image is rotated or flipped before it is resized,
+and the orientation in the target file's EXIF data is set to normal. Use
+-noorient to disable this.
+
 For a list of options, run it with no parameters.
 */
 package documentation
@@ -0,0 +1,27 @@
+// ◄◄◄ formats_ximage.go ►►►
+// Copyright © 2012 Jason Summers
+
+//go:build ximage
+// +build ximage
+
+// Support for more file formats, using the golang.org/x/image packages.
+// To enable it, build fpr with "-tags ximage".
+
+package main
+
+import "io"
+import "image"
+import _ "golang.org/x/image/webp"
+import "golang.org/x/image/tiff"
+import "golang.org/x/image/bmp"
+
+func init() {
+	// Importing these packages also registers their decoders, so that
+	// image.Decode can read WebP, TIFF, and BMP files.
+	extraEncoders[ffTIFF] = func(w io.Writer, img image.Image) error {
+		return tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate, Predictor: true})
+	}
+	extraEncoders[ffBMP] = func(w io.Writer, img image.Image) error {
+		return bmp.Encode(w, img)
+	}
+}
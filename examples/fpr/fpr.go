@@ -4,39 +4,54 @@
 package main
 
 import "fmt"
+import "io"
+import "io/ioutil"
+import "bytes"
 import "os"
 import "time"
 import "flag"
 import "path/filepath"
 import "strings"
 import "errors"
+import "strconv"
+import "math"
 import "runtime"
+import "sync"
 import "image"
+import "image/color"
+import "image/draw"
 import "image/png"
 import "image/jpeg"
 import _ "image/gif"
 import "github.com/jsummers/fpresize"
 
-func readImageFromFile(srcFilename string) (image.Image, error) {
+// Read an image file. Also returns the file's metadata, or nil if it has
+// none.
+func readImageFromFile(srcFilename string) (image.Image, *imageMetadata, error) {
 	var err error
 	var srcImg image.Image
+	var meta *imageMetadata
 
-	file, err := os.Open(srcFilename)
+	data, err := ioutil.ReadFile(srcFilename)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer file.Close()
 
-	srcImg, _, err = image.Decode(file)
+	srcImg, _, err = image.Decode(bytes.NewReader(data))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return srcImg, nil
+	meta = readMetadata(data)
+	return srcImg, meta, nil
 }
 
-func writeImageToFile(img image.Image, dstFilename string, outputFileFormat int) error {
+// Write an image file. meta is the metadata to copy to it, if not nil. It is
+// only written to JPEG and PNG files.
+func writeImageToFile(options *options_type, img image.Image, meta *imageMetadata,
+	dstFilename string, outputFileFormat int) error {
 	var err error
+	var buf bytes.Buffer
 
 	file, err := os.Create(dstFilename)
 	if err != nil {
@@ -44,31 +59,78 @@ func writeImageToFile(img image.Image, dstFilename string, outputFileFormat int)
 	}
 	defer file.Close()
 
-	if outputFileFormat == ffJPEG {
-		err = jpeg.Encode(file, img, nil)
-	} else {
-		err = png.Encode(file, img)
+	switch outputFileFormat {
+	case ffJPEG:
+		if meta == nil {
+			err = jpeg.Encode(file, img, &jpeg.Options{Quality: options.jpegQuality})
+			break
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: options.jpegQuality})
+		if err == nil {
+			err = writeJPEGWithMetadata(file, buf.Bytes(), meta)
+		}
+	case ffPNG:
+		enc := &png.Encoder{CompressionLevel: options.pngCompression}
+		if meta == nil {
+			err = enc.Encode(file, img)
+			break
+		}
+		err = enc.Encode(&buf, img)
+		if err == nil {
+			err = writePNGWithMetadata(file, buf.Bytes(), meta)
+		}
+	default:
+		err = extraEncoders[outputFileFormat](file, img)
 	}
 	return err
 }
 
-var startTime time.Time
-var processingStartTime time.Time
-var processingStopTime time.Time
+// Convert the -pngcompression option to a png.CompressionLevel.
+func parsePNGCompression(s string) (png.CompressionLevel, error) {
+	switch s {
+	case "default":
+		return png.DefaultCompression, nil
+	case "none":
+		return png.NoCompression, nil
+	case "fast":
+		return png.BestSpeed, nil
+	case "best":
+		return png.BestCompression, nil
+	}
+	return png.DefaultCompression, fmt.Errorf("Unrecognized PNG compression level %+q", s)
+}
+
+// Returns where to write messages. With -json, standard output is reserved
+// for the report.
+func msgOutput(options *options_type) io.Writer {
+	if options.jsonReport {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
 var lastMsgTime time.Time
+var msgMutex sync.Mutex
 
 func progressMsgf(options *options_type, format string, a ...interface{}) {
 	if !options.verbose && !options.debug {
 		return
 	}
+	// In batch mode, messages can come from more than one goroutine.
+	msgMutex.Lock()
+	defer msgMutex.Unlock()
+	if options.bar != nil {
+		options.bar.clear()
+	}
 	msg := fmt.Sprintf(format, a...)
 	now := time.Now()
+	out := msgOutput(options)
 	if options.debug {
 		if !lastMsgTime.IsZero() {
-			fmt.Printf("%v\n", now.Sub(lastMsgTime))
+			fmt.Fprintf(out, "%v\n", now.Sub(lastMsgTime))
 		}
 	}
-	fmt.Printf("%s\n", msg)
+	fmt.Fprintf(out, "%s\n", msg)
 	lastMsgTime = now
 }
 
@@ -76,17 +138,31 @@ const (
 	ffUnknown = iota
 	ffPNG     = iota
 	ffJPEG    = iota
+	ffTIFF    = iota
+	ffBMP     = iota
 )
 
+// Encoders for formats that the standard library can't write. These are
+// only available if fpr is built with "-tags ximage" (see formats_ximage.go).
+var extraEncoders = make(map[int]func(w io.Writer, img image.Image) error)
+
 func getFileFormatByFilename(fn string) int {
 	ext := strings.ToLower(filepath.Ext(fn))
+	format := ffUnknown
 	switch ext {
 	case ".png":
-		return ffPNG
+		format = ffPNG
 	case ".jpg", ".jpeg":
-		return ffJPEG
+		format = ffJPEG
+	case ".tif", ".tiff":
+		format = ffTIFF
+	case ".bmp":
+		format = ffBMP
 	}
-	return ffUnknown
+	if format != ffPNG && format != ffJPEG && extraEncoders[format] == nil {
+		return ffUnknown
+	}
+	return format
 }
 
 // An example of a custom filter.
@@ -147,79 +223,401 @@ func makeBoxFilter() *fpresize.Filter {
 	return f
 }
 
-func resizeMain(options *options_type) error {
+// These filters aren't part of fpresize, so add them to its registry, for
+// SetFilterByName.
+func init() {
+	fpresize.RegisterFilter("box", makeBoxFilter)
+	fpresize.RegisterFilter("nearest", makeNearestNeighborFilter)
+}
+
+// Parse a -scale option, such as "50%", "0.5x", or "0.5".
+func parseScale(s string) (float64, error) {
+	var factor float64
 	var err error
+
+	if strings.HasSuffix(s, "%") {
+		factor, err = strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		factor /= 100.0
+	} else {
+		factor, err = strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(s), "x"), 64)
+	}
+	if err != nil || factor <= 0.0 || math.IsInf(factor, 0) {
+		return 0.0, fmt.Errorf("Invalid scale %+q", s)
+	}
+	return factor, nil
+}
+
+// Convert a -background option ("#rrggbb", "rrggbb", or "#rgb") to RGB
+// samples from 0 to 1.
+func parseColor(s string) ([]float32, error) {
+	h := strings.TrimPrefix(s, "#")
+	if len(h) == 3 {
+		h = string([]byte{h[0], h[0], h[1], h[1], h[2], h[2]})
+	}
+	if len(h) != 6 {
+		return nil, fmt.Errorf("Invalid color %+q", s)
+	}
+	n, err := strconv.ParseUint(h, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid color %+q", s)
+	}
+	return []float32{float32(n>>16) / 255.0, float32((n>>8)&0xff) / 255.0, float32(n&0xff) / 255.0}, nil
+}
+
+// Convert an -edge option to a VirtualPixels setting (-1 for the default),
+// or, for "color:#rrggbb", a color to fill the edges with.
+func parseEdge(s string) (int, []float32, error) {
+	s = strings.ToLower(s)
+	if strings.HasPrefix(s, "color:") {
+		clr, err := parseColor(strings.TrimPrefix(s, "color:"))
+		return fpresize.VirtualPixelsTransparent, clr, err
+	}
+	switch s {
+	case "default":
+		return -1, nil, nil
+	case "none":
+		return fpresize.VirtualPixelsNone, nil, nil
+	case "transparent":
+		return fpresize.VirtualPixelsTransparent, nil, nil
+	case "replicate":
+		return fpresize.VirtualPixelsReplicate, nil, nil
+	case "mirror":
+		return fpresize.VirtualPixelsMirror, nil, nil
+	case "tile":
+		return fpresize.VirtualPixelsTile, nil, nil
+	}
+	return 0, nil, fmt.Errorf("Unrecognized edge mode %+q", s)
+}
+
+// Resize the image, and composite it over the background color bgColor, for
+// -edge color:.
+// The compositing is done in linear light, before the image is converted to
+// its final colorspace.
+func resizeOverBackground(options *options_type, fp *fpresize.FPObject, bgColor []float32) (image.Image, error) {
+	bg := make([]float32, 3)
+	copy(bg, bgColor)
+	if !options.noGamma {
+		fpresize.SRGBToLinear(bg)
+	}
+	if options.grayscale {
+		gray := 0.2126*bg[0] + 0.7152*bg[1] + 0.0722*bg[2]
+		bg[0], bg[1], bg[2] = gray, gray, gray
+	}
+
+	im, err := fp.ResizeToLinear()
+	if err != nil {
+		return nil, err
+	}
+
+	if fp.HasTransparency() {
+		// The colors have associated alpha, so this is all that's needed.
+		for j := 0; j < im.Rect.Dy(); j++ {
+			row := im.Pix[j*im.Stride : j*im.Stride+4*im.Rect.Dx()]
+			for i := 0; i < len(row); i += 4 {
+				a := row[i+3]
+				if a < 0.0 {
+					a = 0.0
+				} else if a > 1.0 {
+					a = 1.0
+				}
+				for k := 0; k < 3; k++ {
+					row[i+k] += bg[k] * (1.0 - a)
+				}
+				row[i+3] = 1.0
+			}
+		}
+	}
+
+	rgba, err := fp.FinalizeToRGBA(im)
+	if err != nil {
+		return nil, err
+	}
+	if options.grayscale {
+		gray := image.NewGray(rgba.Bounds())
+		draw.Draw(gray, gray.Bounds(), rgba, rgba.Bounds().Min, draw.Src)
+		return gray, nil
+	}
+	return rgba, nil
+}
+
+// Where the resized image goes.
+type targetGeometry struct {
+	canvasW, canvasH int
+	// The rectangle on the canvas that the source image is mapped to.
+	// In "fill" mode it may be smaller than the canvas, and in "cover"
+	// mode it may be larger.
+	x1, y1, x2, y2 float64
+}
+
+// Convert a -gravity option to the relative position of the image on the
+// canvas, from (0,0) for top-left to (1,1) for bottom-right.
+func parseGravity(s string) (gx, gy float64, err error) {
+	gx, gy = 0.5, 0.5
+	switch strings.ToLower(s) {
+	case "center", "c":
+	case "n", "north":
+		gy = 0.0
+	case "s", "south":
+		gy = 1.0
+	case "e", "east":
+		gx = 1.0
+	case "w", "west":
+		gx = 0.0
+	case "ne", "northeast":
+		gx, gy = 1.0, 0.0
+	case "nw", "northwest":
+		gx, gy = 0.0, 0.0
+	case "se", "southeast":
+		gx, gy = 1.0, 1.0
+	case "sw", "southwest":
+		gx, gy = 0.0, 1.0
+	default:
+		err = fmt.Errorf("Unrecognized gravity %+q", s)
+	}
+	return
+}
+
+// Decide where the resized image goes, based on the options and the size of
+// the source image.
+func computeTargetGeometry(options *options_type, srcW, srcH int) targetGeometry {
+	var g targetGeometry
+
+	if options.width < 1 || options.height < 1 || options.mode == "stretch" {
+		g.canvasW, g.canvasH = computeTargetSize(options, srcW, srcH)
+		g.x2, g.y2 = float64(g.canvasW), float64(g.canvasH)
+		return g
+	}
+
+	// The box has both dimensions, and we need to preserve the aspect ratio.
+	if options.mode == "fit" {
+		// The canvas is just big enough for the image.
+		r := fpresize.ComputeFitSize(srcW, srcH, options.width, options.height, true)
+		g.canvasW, g.canvasH = r.Dx(), r.Dy()
+		g.x2, g.y2 = float64(g.canvasW), float64(g.canvasH)
+		return g
+	}
+
+	scaleX := float64(options.width) / float64(srcW)
+	scaleY := float64(options.height) / float64(srcH)
+	var scale float64
+	if options.mode == "cover" {
+		scale = math.Max(scaleX, scaleY)
+	} else {
+		scale = math.Min(scaleX, scaleY)
+	}
+	imgW := float64(srcW) * scale
+	imgH := float64(srcH) * scale
+
+	// "fill" and "cover" modes: The canvas is the requested size, and the
+	// image is positioned on it according to the gravity.
+	g.canvasW, g.canvasH = options.width, options.height
+	g.x1 = (float64(g.canvasW) - imgW) * options.gravityX
+	g.y1 = (float64(g.canvasH) - imgH) * options.gravityY
+	g.x2 = g.x1 + imgW
+	g.y2 = g.y1 + imgH
+	return g
+}
+
+// Decide the size of the resized image, based on the options and the size
+// of the source image, ignoring the -mode option.
+func computeTargetSize(options *options_type, srcW, srcH int) (dstW, dstH int) {
+	if options.scale > 0.0 {
+		dstW = int(0.5 + float64(srcW)*options.scale)
+		dstH = int(0.5 + float64(srcH)*options.scale)
+	} else if options.height > 0 && options.width > 0 {
+		// Use the exact dimensions given
+		dstW = options.width
+		dstH = options.height
+	} else {
+		// Fit to the width or height
+		r := fpresize.ComputeFitSize(srcW, srcH, options.width, options.height, true)
+		dstW, dstH = r.Dx(), r.Dy()
+	}
+	if dstW < 1 {
+		dstW = 1
+	}
+	if dstH < 1 {
+		dstH = 1
+	}
+	return
+}
+
+// One of the sizes given by the -sizes option.
+type sizeSpec struct {
+	name   string // For use in the target filename
+	width  int
+	height int
+}
+
+// Parse a -sizes option, such as "1600,800,x300,thumb=160x160". Each size is
+// a width, a height (preceded by "x"), or both, optionally preceded by a
+// name and "=". The name defaults to the size as written.
+func parseSizes(s string) ([]sizeSpec, error) {
+	var sizes []sizeSpec
+
+	for _, item := range strings.Split(s, ",") {
+		var sz sizeSpec
+		var err error
+
+		dims := item
+		if k := strings.Index(item, "="); k >= 0 {
+			sz.name = item[:k]
+			dims = item[k+1:]
+		} else {
+			sz.name = item
+		}
+
+		wStr, hStr := dims, ""
+		if k := strings.Index(dims, "x"); k >= 0 {
+			wStr, hStr = dims[:k], dims[k+1:]
+		}
+		if wStr != "" {
+			sz.width, err = strconv.Atoi(wStr)
+		}
+		if err == nil && hStr != "" {
+			sz.height, err = strconv.Atoi(hStr)
+		}
+		if err != nil || sz.name == "" || sz.width < 0 || sz.height < 0 || (sz.width == 0 && sz.height == 0) {
+			return nil, fmt.Errorf("Invalid size %+q", item)
+		}
+		sizes = append(sizes, sz)
+	}
+	return sizes, nil
+}
+
+// Make the target filename for one size. {size} in the template is
+// replaced by the size's name. If there is more than one size, and no
+// {size}, the name is added to the end of the filename.
+func sizeFilename(template string, sizeName string, multiple bool) string {
+	if strings.Contains(template, "{size}") {
+		return strings.Replace(template, "{size}", sizeName, -1)
+	}
+	if !multiple {
+		return template
+	}
+	ext := filepath.Ext(template)
+	return strings.TrimSuffix(template, ext) + "_" + sizeName + ext
+}
+
+// Resize one file. dstTemplate is the target filename, which may contain
+// {size} if there is more than one target size. msgPrefix is put at the
+// start of each progress message.
+func resizeMain(options *options_type, srcFilename, dstTemplate string, msgPrefix string) (err error) {
 	var srcBounds image.Rectangle
-	var resizedImage image.Image
 	var srcImg image.Image
-	var srcW, srcH, dstW, dstH int
-	var outputFileFormat int
-	var otherFlags uint32
+	var meta *imageMetadata
+	var processingTime time.Duration
+	var rep *fileReport
+	var orep *outputReport // The report for the current target file
 
 	startTime := time.Now()
 
-	// Allow more than one thread to be used by this process, if more than one CPU exists.
-	runtime.GOMAXPROCS(runtime.NumCPU())
+	if options.jsonReport {
+		rep = newFileReport(options, srcFilename)
+		defer func() {
+			rep.write(err)
+		}()
+	}
 
-	outputFileFormat = getFileFormatByFilename(options.dstFilename)
-	if outputFileFormat == ffUnknown {
-		return errors.New("Can't determine output file format. Please name the output file to end in .png or .jpg")
+	msgf := func(format string, a ...interface{}) {
+		progressMsgf(options, msgPrefix+format, a...)
 	}
 
-	progressMsgf(options, "Reading source file")
-	srcImg, err = readImageFromFile(options.srcFilename)
+	sizes := options.sizes
+	if len(sizes) == 0 {
+		// Just use the -w, -h, and -scale options.
+		sizes = []sizeSpec{{}}
+	}
+	dstFilenames := make([]string, len(sizes))
+	for k := range sizes {
+		dstFilenames[k] = sizeFilename(dstTemplate, sizes[k].name, len(sizes) > 1)
+		if getFileFormatByFilename(dstFilenames[k]) == ffUnknown {
+			return errors.New("Can't determine output file format. Please name the output file to end in .png or .jpg" +
+				" (or .tif or .bmp, if fpr was built with -tags ximage)")
+		}
+	}
+
+	msgf("Reading source file")
+	srcImg, meta, err = readImageFromFile(srcFilename)
 	if err != nil {
 		return err
 	}
 
+	if meta != nil && !options.noOrient {
+		orientation := exifOrientation(meta.exif)
+		if orientation != 1 {
+			msgf("Applying EXIF orientation %d", orientation)
+			srcImg = applyOrientation(srcImg, orientation)
+			// The target image must not be rotated again.
+			setExifOrientation(meta.exif, 1)
+		}
+	}
+	if options.noMetadata {
+		meta = nil
+	}
+
+	if options.trim >= 0 {
+		trimmed := fpresize.TrimTransparentBorders(srcImg, options.trim)
+		if trimmed.Bounds() != srcImg.Bounds() {
+			msgf("Trimming transparent borders, %dx%d -> %dx%d", srcImg.Bounds().Dx(), srcImg.Bounds().Dy(),
+				trimmed.Bounds().Dx(), trimmed.Bounds().Dy())
+			srcImg = trimmed
+		}
+	}
+
 	// Also track the total time it takes to do the resize (i.e. don't count
 	// the time it takes to read and write the files).
-	processingStartTime = time.Now()
+	processingStartTime := time.Now()
 
 	fp := fpresize.New(srcImg)
 
-	fp.SetProgressCallback(func(format string, a ...interface{}) {
-		progressMsgf(options, format, a...)
-	})
+	fp.SetProgressCallback(msgf)
+
+	var barFn func(p fpresize.Progress)
+	if options.bar != nil && options.outDir == "" {
+		// In batch mode, the bar shows how many files are done instead.
+		barFn = options.bar.resizeProgressFunc()
+		defer options.bar.clear()
+	}
+	if barFn != nil || rep != nil {
+		fp.SetProgressFunc(func(p fpresize.Progress) {
+			if orep != nil {
+				orep.recordProgress(p)
+			}
+			if barFn != nil {
+				barFn(p)
+			}
+		})
+	}
 
 	if options.numThreads > 0 {
 		fp.SetMaxWorkerThreads(options.numThreads)
 	}
 
+	if options.grayscale {
+		fp.SetForceGrayscale(true)
+	}
+
 	if options.noGamma {
 		// To do colorspace-unaware resizing, call the following methods:
 		fp.SetInputColorConverter(nil)
 		fp.SetOutputColorConverter(nil)
 	}
 
-	switch options.filterName {
-	case "auto":
-	case "lanczos2":
-		fp.SetFilter(fpresize.MakeLanczosFilter(2))
-	case "lanczos3", "lanczos":
-		fp.SetFilter(fpresize.MakeLanczosFilter(3))
-	case "mix":
-		fp.SetFilter(fpresize.MakePixelMixingFilter())
-	case "mitchell":
-		fp.SetFilter(fpresize.MakeCubicFilter(1.0/3.0, 1.0/3.0))
-	case "catrom":
-		fp.SetFilter(fpresize.MakeCubicFilter(0.0, 0.5))
-	case "hermite":
-		fp.SetFilter(fpresize.MakeCubicFilter(0.0, 0.0))
-	case "bspline":
-		fp.SetFilter(fpresize.MakeCubicFilter(1.0, 0.0))
-	case "gaussian":
-		fp.SetFilter(fpresize.MakeGaussianFilter())
-	case "triangle":
-		fp.SetFilter(fpresize.MakeTriangleFilter())
-	case "box":
-		fp.SetFilter(makeBoxFilter())
-	case "boxavg":
-		fp.SetFilter(fpresize.MakeBoxAvgFilter())
-	case "nearest":
-		fp.SetFilter(makeNearestNeighborFilter())
-	default:
-		return fmt.Errorf("Unrecognized filter %+q", options.filterName)
+	// JPEG files can't be transparent. This has to be set before the source
+	// image is converted, so it is set once for all the sizes, which have the
+	// same target format.
+	if getFileFormatByFilename(dstFilenames[0]) == ffJPEG && options.background != nil {
+		bg := options.background
+		fp.SetBackgroundColor(color.NRGBA{uint8(bg[0]*255.0 + 0.5), uint8(bg[1]*255.0 + 0.5),
+			uint8(bg[2]*255.0 + 0.5), 255})
+	}
+
+	if options.filterName != "auto" {
+		err = fp.SetFilterByName(options.filterName)
+		if err != nil {
+			return err
+		}
 	}
 
 	// The filter to use can be different for the vertical and horizontal
@@ -238,32 +636,96 @@ func resizeMain(options *options_type) error {
 		fp.SetBlur(options.blur)
 	}
 
-	// Decide the size of the resized image.
+	processingTime += time.Now().Sub(processingStartTime)
+
 	srcBounds = srcImg.Bounds()
+	if rep != nil {
+		rep.SourceWidth = srcBounds.Dx()
+		rep.SourceHeight = srcBounds.Dy()
+	}
+
+	// The same FPObject is used for every size, so that the source image only
+	// has to be converted once.
+	for k := range sizes {
+		sizeOptions := *options
+		if sizes[k].name != "" {
+			sizeOptions.width = sizes[k].width
+			sizeOptions.height = sizes[k].height
+			sizeOptions.scale = 0.0
+		}
+		if len(sizes) > 1 {
+			msgf("Making size %s", sizes[k].name)
+		}
+
+		if rep != nil {
+			orep = rep.addOutput(dstFilenames[k])
+		}
+		var d time.Duration
+		d, err = resizeToFile(&sizeOptions, fp, srcBounds, meta, dstFilenames[k], orep, msgf)
+		if err != nil {
+			return err
+		}
+		processingTime += d
+	}
+
+	msgf("Done")
+	if options.debug {
+		msgf("Processing time: %v", processingTime)
+		msgf("Total time: %v", time.Now().Sub(startTime))
+	}
+
+	return nil
+}
+
+// Resize the image to one target size, and write it to a file. Returns the
+// time spent resizing. If orep is not nil, the results are recorded in it.
+func resizeToFile(options *options_type, fp *fpresize.FPObject, srcBounds image.Rectangle,
+	meta *imageMetadata, dstFilename string, orep *outputReport, msgf func(format string, a ...interface{})) (time.Duration, error) {
+	var err error
+	var resizedImage image.Image
+	var srcW, srcH, dstW, dstH int
+	var otherFlags uint32
+
+	processingStartTime := time.Now()
+	outputFileFormat := getFileFormatByFilename(dstFilename)
+
+	// Decide the size of the resized image.
 	srcW = srcBounds.Max.X - srcBounds.Min.X
 	srcH = srcBounds.Max.Y - srcBounds.Min.Y
-	if options.height > 0 && options.width > 0 {
-		// Use the exact dimensions given
-		dstW = options.width
-		dstH = options.height
-	} else if options.height > 0 {
-		// Fit to height
-		dstH = options.height
-		dstW = int(0.5 + (float64(srcW)/float64(srcH))*float64(dstH))
-	} else {
-		// Fit to width
-		dstW = options.width
-		dstH = int(0.5 + (float64(srcH)/float64(srcW))*float64(dstW))
+	geom := computeTargetGeometry(options, srcW, srcH)
+	dstW, dstH = geom.canvasW, geom.canvasH
+	switch options.mode {
+	case "fill":
+		// The parts of the canvas not covered by the image will be
+		// transparent.
+		fp.SetTargetBoundsAdvanced(image.Rect(0, 0, dstW, dstH), geom.x1, geom.y1, geom.x2, geom.y2)
+	case "cover":
+		// The parts of the image that don't fit on the canvas are cropped.
+		fp.SetTargetBoundsAdvanced(image.Rect(0, 0, dstW, dstH), geom.x1, geom.y1, geom.x2, geom.y2)
+		fp.SetVirtualPixels(fpresize.VirtualPixelsNone)
+	default:
+		fp.SetTargetBounds(image.Rect(0, 0, dstW, dstH))
+	}
+	if options.edge >= 0 {
+		fp.SetVirtualPixels(options.edge)
 	}
-	fp.SetTargetBounds(image.Rect(0, 0, dstW, dstH))
 
 	if options.depth > 8 {
 		otherFlags |= fpresize.ResizeFlag16Bit
 	}
 
 	// Do the resize.
-	if outputFileFormat == ffPNG {
+	if options.edgeColor != nil {
+		resizedImage, err = resizeOverBackground(options, fp, options.edgeColor)
+	} else if outputFileFormat == ffPNG || outputFileFormat == ffTIFF {
 		resizedImage, err = fp.ResizeToImage(otherFlags | fpresize.ResizeFlagGrayOK | fpresize.ResizeFlagUnassocAlpha)
+	} else if outputFileFormat == ffBMP {
+		// BMP doesn't support 16 bits per sample.
+		resizedImage, err = fp.ResizeToImage(fpresize.ResizeFlagGrayOK | fpresize.ResizeFlagUnassocAlpha)
+	} else if outputFileFormat == ffJPEG && options.grayscale {
+		// Newer versions of the jpeg package write an image.Gray as a
+		// grayscale JPEG file.
+		resizedImage, err = fp.ResizeToImage(fpresize.ResizeFlagGrayOK)
 	} else if outputFileFormat == ffJPEG {
 		// As of Go 1.0.3, the jpeg package does not support writing grayscale
 		// images. Passing an image.Gray to it will only slow it down.
@@ -275,38 +737,199 @@ func resizeMain(options *options_type) error {
 		resizedImage, err = fp.ResizeToRGBA()
 	}
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	processingStopTime = time.Now()
+	processingTime := time.Now().Sub(processingStartTime)
 
-	progressMsgf(options, "Writing target file")
-	err = writeImageToFile(resizedImage, options.dstFilename, outputFileFormat)
+	msgf("Writing target file")
+	err = writeImageToFile(options, resizedImage, meta, dstFilename, outputFileFormat)
+	if err != nil {
+		return 0, err
+	}
+
+	if orep != nil {
+		orep.Width = dstW
+		orep.Height = dstH
+		orep.ResizeSeconds = processingTime.Seconds()
+		if fi, err := os.Stat(dstFilename); err == nil {
+			orep.FileSize = fi.Size()
+		}
+	}
+	return processingTime, nil
+}
+
+// Returns true if fpr can read the file. This looks at the file's contents,
+// not its name.
+func isReadableFile(fn string) bool {
+	file, err := os.Open(fn)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	_, _, err = image.DecodeConfig(file)
+	return err == nil
+}
+
+// Expand the source file arguments into a list of files. An argument may be
+// a filename, a glob pattern (for shells that don't expand them), or a
+// directory (meaning all the image files in it).
+func expandSourceArgs(args []string) ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+
+	add := func(fn string) {
+		if !seen[fn] {
+			seen[fn] = true
+			files = append(files, fn)
+		}
+	}
+
+	for _, arg := range args {
+		if fi, err := os.Stat(arg); err == nil && fi.IsDir() {
+			matches, err := filepath.Glob(filepath.Join(arg, "*"))
+			if err != nil {
+				return nil, err
+			}
+			for _, fn := range matches {
+				if isReadableFile(fn) {
+					add(fn)
+				}
+			}
+		} else if strings.ContainsAny(arg, "*?[") {
+			matches, err := filepath.Glob(arg)
+			if err != nil {
+				return nil, err
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("No files match %+q", arg)
+			}
+			for _, fn := range matches {
+				add(fn)
+			}
+		} else {
+			add(arg)
+		}
+	}
+	return files, nil
+}
+
+// Make a target filename from a template, by replacing {name} with the
+// source file's base name and {ext} with its extension (without the dot).
+func expandNameTemplate(template, srcFilename string) string {
+	ext := filepath.Ext(srcFilename)
+	name := strings.TrimSuffix(filepath.Base(srcFilename), ext)
+	r := strings.NewReplacer("{name}", name, "{ext}", strings.TrimPrefix(ext, "."))
+	return r.Replace(template)
+}
+
+// The name of the target file for srcFilename, in batch mode.
+func batchTargetFilename(options *options_type, srcFilename string) string {
+	return filepath.Join(options.outDir, expandNameTemplate(options.nameTemplate, srcFilename))
+}
+
+// Resize all the source files, writing the results to options.outDir.
+func resizeBatch(options *options_type, args []string) error {
+	srcFiles, err := expandSourceArgs(args)
 	if err != nil {
 		return err
 	}
+	if len(srcFiles) == 0 {
+		return errors.New("No source files")
+	}
 
-	progressMsgf(options, "Done")
-	if options.debug {
-		fmt.Printf("Processing time: %v\n", processingStopTime.Sub(processingStartTime))
-		fmt.Printf("Total time: %v\n", time.Now().Sub(startTime))
+	err = os.MkdirAll(options.outDir, 0777)
+	if err != nil {
+		return err
 	}
 
+	numFailed := resizeFiles(options, srcFiles)
+	if numFailed > 0 {
+		return fmt.Errorf("%d of %d files failed", numFailed, len(srcFiles))
+	}
 	return nil
 }
 
+// Resize the files in srcFiles, options.jobs at a time. Errors are reported
+// as they happen. Returns the number of files that failed.
+func resizeFiles(options *options_type, srcFiles []string) int {
+	var wg sync.WaitGroup
+	var numFailed, numDone int
+	var failMutex sync.Mutex
+
+	startTime := time.Now()
+	if options.bar != nil {
+		options.bar.showBatch(0, len(srcFiles), startTime)
+		defer options.bar.done()
+	}
+
+	jobs := options.jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	// Limits the number of images being processed at once.
+	inFlight := make(chan bool, jobs)
+
+	for _, srcFilename := range srcFiles {
+		dstFilename := batchTargetFilename(options, srcFilename)
+		inFlight <- true
+		wg.Add(1)
+		go func(srcFilename, dstFilename string) {
+			defer wg.Done()
+			err := resizeMain(options, srcFilename, dstFilename, srcFilename+": ")
+			failMutex.Lock()
+			if err != nil {
+				numFailed++
+				if options.bar != nil {
+					options.bar.clear()
+				}
+				fmt.Fprintf(msgOutput(options), "Error: %s: %v\n", srcFilename, err.Error())
+			}
+			numDone++
+			if options.bar != nil {
+				options.bar.showBatch(numDone, len(srcFiles), startTime)
+			}
+			failMutex.Unlock()
+			<-inFlight
+		}(srcFilename, dstFilename)
+	}
+	wg.Wait()
+	return numFailed
+}
+
 type options_type struct {
-	width       int
-	height      int
-	depth       int
-	srcFilename string
-	dstFilename string
-	filterName  string
-	blur        float64
-	noGamma     bool
-	numThreads  int
-	verbose     bool
-	debug       bool
+	width          int
+	height         int
+	scale          float64
+	sizes          []sizeSpec
+	mode           string
+	gravityX       float64
+	gravityY       float64
+	depth          int
+	filterName     string
+	blur           float64
+	noGamma        bool
+	grayscale      bool
+	background     []float32 // RGB, from 0 to 1. nil if not set.
+	edge           int       // A VirtualPixels* constant, or -1 for the default
+	edgeColor      []float32 // RGB, from 0 to 1, for -edge color:. nil if not set.
+	noMetadata     bool
+	noOrient       bool
+	trim           int // Padding to leave when trimming, or -1 to not trim
+	numThreads     int
+	outDir         string
+	nameTemplate   string
+	jobs           int
+	watch          bool
+	watchInterval  time.Duration
+	jpegQuality    int
+	pngCompression png.CompressionLevel
+	progress       bool
+	bar            *progressBar // The progress bar, if -progress is used
+	jsonReport     bool
+	verbose        bool
+	debug          bool
 }
 
 func main() {
@@ -315,7 +938,9 @@ func main() {
 	// Replace the standard flag.Usage function
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  fpr (-w|-h) <n> [options] <source-file> <target-file>\n")
+		fmt.Fprintf(os.Stderr, "  fpr (-w|-h|-scale) <n> [options] <source-file> <target-file>\n")
+		fmt.Fprintf(os.Stderr, "  fpr (-w|-h|-scale) <n> [options] -outdir <dir> <source-file|glob|dir>...\n")
+		fmt.Fprintf(os.Stderr, "  fpr (-w|-h|-scale) <n> [options] -outdir <dir> -watch <dir|glob>...\n")
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "  Available filters: lanczos, lanczos2, catrom, mitchell, hermite, bspline,\n")
 		fmt.Fprintf(os.Stderr, "    gaussian, mix, box, boxavg, nearest, triangle\n")
@@ -323,30 +948,127 @@ func main() {
 
 	flag.IntVar(&options.height, "h", 0, "Target image height, in pixels")
 	flag.IntVar(&options.width, "w", 0, "Target image width, in pixels")
+	scale := flag.String("scale", "", "Scale factor, such as 50% or 0.5x (instead of -w/-h)")
+	flag.StringVar(&options.mode, "mode", "stretch", "How to fit the image to a -w×-h box: fit, fill, cover, stretch")
+	sizesOpt := flag.String("sizes", "", "Several target sizes, such as 1600,800,thumb=160x160 (instead of -w/-h)")
+	gravity := flag.String("gravity", "center", "Image position in fill/cover mode: center, n, s, e, w, ne, nw, se, sw")
 	flag.IntVar(&options.depth, "depth", 8, "Preferred bit depth, in bits per sample")
 	flag.StringVar(&options.filterName, "filter", "auto", "Resampling filter to use")
 	flag.Float64Var(&options.blur, "blur", 1.0, "Amount to blur")
 	flag.BoolVar(&options.noGamma, "nogamma", false, "Disable color correction")
+	flag.BoolVar(&options.grayscale, "grayscale", false, "Convert the image to grayscale")
+	background := flag.String("background", "", "Background color for transparent images, in JPEG output: #rrggbb")
+	edge := flag.String("edge", "default", "Edge handling: default, none, transparent, replicate, mirror, tile, color:#rrggbb")
+	flag.BoolVar(&options.noMetadata, "nometadata", false, "Don't copy EXIF, ICC profile, and XMP metadata")
+	flag.BoolVar(&options.noOrient, "noorient", false, "Don't rotate the image according to its EXIF orientation")
+	flag.IntVar(&options.trim, "trim", -1, "Trim transparent borders, leaving this many pixels of padding")
 	flag.IntVar(&options.numThreads, "threads", 0, "Maximum number of worker threads")
+	flag.StringVar(&options.outDir, "outdir", "", "Directory for target files; enables batch mode")
+	flag.StringVar(&options.nameTemplate, "name", "{name}.{ext}", "Target filename template, in batch mode")
+	flag.IntVar(&options.jobs, "jobs", 2, "Number of images to process at once, in batch mode")
+	flag.BoolVar(&options.watch, "watch", false, "Keep watching the source directories for new or changed files, in batch mode")
+	flag.DurationVar(&options.watchInterval, "interval", 2*time.Second, "How often to look for new files, with -watch")
+	flag.IntVar(&options.jpegQuality, "quality", jpeg.DefaultQuality, "JPEG quality (1-100)")
+	pngCompression := flag.String("pngcompression", "default", "PNG compression level: default, none, fast, best")
+	flag.BoolVar(&options.progress, "progress", false, "Show a progress bar")
+	flag.BoolVar(&options.jsonReport, "json", false, "Write a report in JSON format for each source file")
 	flag.BoolVar(&options.verbose, "verbose", false, "Verbose output")
 	flag.BoolVar(&options.debug, "debug", false, "Debugging output")
 	flag.Parse()
 
-	if flag.NArg() != 2 {
+	var err error
+	if *sizesOpt != "" {
+		if options.width > 0 || options.height > 0 || *scale != "" {
+			fmt.Printf("Error: -sizes can't be used with -w, -h, or -scale\n")
+			return
+		}
+		options.sizes, err = parseSizes(*sizesOpt)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err.Error())
+			return
+		}
+	} else if *scale != "" {
+		if options.width > 0 || options.height > 0 {
+			fmt.Printf("Error: -scale can't be used with -w or -h\n")
+			return
+		}
+		options.scale, err = parseScale(*scale)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err.Error())
+			return
+		}
+	} else if options.width < 1 && options.height < 1 {
 		flag.Usage()
 		return
 	}
 
-	if options.width < 1 && options.height < 1 {
-		flag.Usage()
+	switch options.mode {
+	case "fit", "fill", "cover", "stretch":
+	default:
+		fmt.Printf("Error: Unrecognized mode %+q\n", options.mode)
+		return
+	}
+	options.gravityX, options.gravityY, err = parseGravity(*gravity)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err.Error())
 		return
 	}
 
-	options.srcFilename = flag.Arg(0)
-	options.dstFilename = flag.Arg(1)
+	if options.jpegQuality < 1 || options.jpegQuality > 100 {
+		fmt.Printf("Error: JPEG quality must be from 1 to 100\n")
+		return
+	}
+	options.pngCompression, err = parsePNGCompression(*pngCompression)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err.Error())
+		return
+	}
+	if *background != "" {
+		options.background, err = parseColor(*background)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err.Error())
+			return
+		}
+	}
 
-	err := resizeMain(options)
+	options.edge, options.edgeColor, err = parseEdge(*edge)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err.Error())
+		return
+	}
+
+	if options.progress {
+		options.bar = new(progressBar)
+	}
+
+	// Allow more than one thread to be used by this process, if more than one CPU exists.
+	runtime.GOMAXPROCS(runtime.NumCPU())
+
+	if options.watch && options.outDir == "" {
+		fmt.Printf("Error: -watch requires -outdir\n")
+		return
+	}
+
+	if options.watch {
+		if flag.NArg() < 1 {
+			flag.Usage()
+			return
+		}
+		err = watchFolders(options, flag.Args())
+	} else if options.outDir != "" {
+		if flag.NArg() < 1 {
+			flag.Usage()
+			return
+		}
+		err = resizeBatch(options, flag.Args())
+	} else {
+		if flag.NArg() != 2 {
+			flag.Usage()
+			return
+		}
+		err = resizeMain(options, flag.Arg(0), flag.Arg(1), "")
+	}
+	if err != nil {
+		fmt.Fprintf(msgOutput(options), "Error: %v\n", err.Error())
 	}
 }
@@ -0,0 +1,60 @@
+// ◄◄◄ examples/fpr/fpr_test.go ►►►
+
+// Tests for fpr.
+
+package main
+
+import "testing"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "image"
+import "image/png"
+
+func TestBackgroundSizes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fpr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A fully transparent source image.
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 30))
+	srcFilename := filepath.Join(dir, "src.png")
+	f, err := os.Create(srcFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = png.Encode(f, src)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := &options_type{mode: "stretch", depth: 8, filterName: "auto", blur: 1.0, edge: -1, trim: -1,
+		jpegQuality: 90}
+	options.sizes, err = parseSizes("20,10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options.background, err = parseColor("#ff0000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = resizeMain(options, srcFilename, filepath.Join(dir, "dst.jpg"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"dst_20.jpg", "dst_10.jpg"} {
+		im, _, err := readImageFromFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, g, b, _ := im.At(5, 2).RGBA()
+		if r < 0xf000 || g > 0x1000 || b > 0x1000 {
+			t.Errorf("%s: the background is (%d,%d,%d), expected red", name, r>>8, g>>8, b>>8)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+// ◄◄◄ metadata.go ►►►
+// Copyright © 2012 Jason Summers
+
+// Copying metadata (EXIF, ICC profile, and XMP) from the source file to the
+// target file. The image packages in the standard library ignore metadata,
+// so we have to find it and write it ourselves.
+
+package main
+
+import "bytes"
+import "io"
+import "io/ioutil"
+import "encoding/binary"
+import "hash/crc32"
+import "compress/zlib"
+
+type imageMetadata struct {
+	exif []byte // TIFF-format EXIF data, without any "Exif\0\0" prefix
+	icc  []byte // An ICC profile
+	xmp  []byte // An XMP packet
+}
+
+const (
+	jpegExifPrefix = "Exif\x00\x00"
+	jpegXMPPrefix  = "http://ns.adobe.com/xap/1.0/\x00"
+	jpegICCPrefix  = "ICC_PROFILE\x00"
+	pngSignature   = "\x89PNG\r\n\x1a\n"
+	pngXMPKeyword  = "XML:com.adobe.xmp"
+)
+
+// The most data that fits in a JPEG marker segment.
+const jpegMaxSegmentData = 65533
+
+// Find the metadata in a JPEG or PNG file. Returns nil if there isn't any,
+// or if the file is in some other format. Invalid metadata is ignored.
+func readMetadata(data []byte) *imageMetadata {
+	var meta *imageMetadata
+
+	if len(data) >= 2 && data[0] == 0xff && data[1] == 0xd8 {
+		meta = readJPEGMetadata(data)
+	} else if bytes.HasPrefix(data, []byte(pngSignature)) {
+		meta = readPNGMetadata(data)
+	}
+	if meta == nil || (meta.exif == nil && meta.icc == nil && meta.xmp == nil) {
+		return nil
+	}
+	if meta.exif != nil {
+		meta.exif = stripExifDimensions(meta.exif)
+	}
+	return meta
+}
+
+func readJPEGMetadata(data []byte) *imageMetadata {
+	meta := new(imageMetadata)
+	var iccChunks [][]byte
+
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xff {
+			break
+		}
+		marker := data[pos+1]
+		if marker == 0xff {
+			// Fill byte
+			pos++
+			continue
+		}
+		if marker == 0xd9 || marker == 0xda {
+			// EOI or SOS. The metadata always comes before the image data.
+			break
+		}
+		segLen := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if segLen < 2 || pos+2+segLen > len(data) {
+			break
+		}
+		seg := data[pos+4 : pos+2+segLen]
+		pos += 2 + segLen
+
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(seg, []byte(jpegExifPrefix)):
+			if meta.exif == nil {
+				meta.exif = seg[len(jpegExifPrefix):]
+			}
+		case marker == 0xe1 && bytes.HasPrefix(seg, []byte(jpegXMPPrefix)):
+			if meta.xmp == nil {
+				meta.xmp = seg[len(jpegXMPPrefix):]
+			}
+		case marker == 0xe2 && bytes.HasPrefix(seg, []byte(jpegICCPrefix)):
+			// A profile can be split across several segments, each of which
+			// has a sequence number (starting at 1) and the number of
+			// segments.
+			seg = seg[len(jpegICCPrefix):]
+			if len(seg) < 2 || seg[0] < 1 || seg[1] < 1 || seg[0] > seg[1] {
+				continue
+			}
+			if iccChunks == nil {
+				iccChunks = make([][]byte, seg[1])
+			}
+			if len(iccChunks) == int(seg[1]) {
+				iccChunks[seg[0]-1] = seg[2:]
+			}
+		}
+	}
+
+	if iccChunks != nil {
+		var icc []byte
+		for _, chunk := range iccChunks {
+			if chunk == nil {
+				// A segment is missing.
+				icc = nil
+				break
+			}
+			icc = append(icc, chunk...)
+		}
+		meta.icc = icc
+	}
+	return meta
+}
+
+func readPNGMetadata(data []byte) *imageMetadata {
+	meta := new(imageMetadata)
+
+	pos := len(pngSignature)
+	for pos+12 <= len(data) {
+		chunkLen := int(binary.BigEndian.Uint32(data[pos:]))
+		if chunkLen < 0 || pos+12+chunkLen > len(data) {
+			break
+		}
+		chunkType := string(data[pos+4 : pos+8])
+		chunk := data[pos+8 : pos+8+chunkLen]
+		pos += 12 + chunkLen
+
+		switch chunkType {
+		case "IDAT", "IEND":
+			// Metadata after the image data is rare, and not worth looking
+			// for.
+			return meta
+		case "eXIf":
+			meta.exif = chunk
+		case "iCCP":
+			// The profile name, a NUL, the compression method, then the
+			// zlib-compressed profile.
+			k := bytes.IndexByte(chunk, 0)
+			if k < 0 || k+2 > len(chunk) || chunk[k+1] != 0 {
+				continue
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(chunk[k+2:]))
+			if err != nil {
+				continue
+			}
+			icc, err := ioutil.ReadAll(zr)
+			if err == nil {
+				meta.icc = icc
+			}
+		case "iTXt":
+			meta.xmp = readPNGXMP(chunk)
+		}
+	}
+	return meta
+}
+
+// Returns the text of an iTXt chunk, if it contains XMP.
+func readPNGXMP(chunk []byte) []byte {
+	// keyword, NUL, compression flag, compression method, language tag, NUL,
+	// translated keyword, NUL, text
+	k := bytes.IndexByte(chunk, 0)
+	if k < 0 || string(chunk[:k]) != pngXMPKeyword || k+3 > len(chunk) {
+		return nil
+	}
+	compressed := chunk[k+1] != 0
+	rest := chunk[k+3:]
+	for i := 0; i < 2; i++ {
+		k = bytes.IndexByte(rest, 0)
+		if k < 0 {
+			return nil
+		}
+		rest = rest[k+1:]
+	}
+	if !compressed {
+		return rest
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(rest))
+	if err != nil {
+		return nil
+	}
+	text, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil
+	}
+	return text
+}
+
+// Returns the byte order of TIFF-format EXIF data, or nil if it isn't valid.
+func exifByteOrder(exif []byte) binary.ByteOrder {
+	if len(exif) < 8 {
+		return nil
+	}
+	switch string(exif[:4]) {
+	case "II*\x00":
+		return binary.LittleEndian
+	case "MM\x00*":
+		return binary.BigEndian
+	}
+	return nil
+}
+
+// Returns the position in exif of the IFD0 entry for the given tag, or -1 if
+// there isn't one.
+func findIFD0Tag(exif []byte, order binary.ByteOrder, tag uint16) int {
+	pos := int(order.Uint32(exif[4:]))
+	if pos < 8 || pos+2 > len(exif) {
+		return -1
+	}
+	n := int(order.Uint16(exif[pos:]))
+	for i := 0; i < n; i++ {
+		entryPos := pos + 2 + 12*i
+		if entryPos+12 > len(exif) {
+			break
+		}
+		if order.Uint16(exif[entryPos:]) == tag {
+			return entryPos
+		}
+	}
+	return -1
+}
+
+// Returns a copy of the EXIF data, with the tags that give the image's width
+// and height removed, since they would be wrong for the resized image.
+// Returns nil if the data isn't valid.
+func stripExifDimensions(exif []byte) []byte {
+	order := exifByteOrder(exif)
+	if order == nil {
+		return nil
+	}
+	exif = append([]byte(nil), exif...)
+
+	// Remove the tags with the given IDs from the IFD at offset pos. Returns
+	// the value of the ExifIFD tag, if there is one.
+	removeTags := func(pos int, tags ...uint16) int {
+		var exifIFD int
+		if pos < 8 || pos+2 > len(exif) {
+			return 0
+		}
+		n := int(order.Uint16(exif[pos:]))
+		end := pos + 2 + 12*n
+		if end+4 > len(exif) {
+			return 0
+		}
+		entries := exif[pos+2 : end]
+		kept := 0
+		for i := 0; i < n; i++ {
+			entry := entries[12*i : 12*i+12]
+			tag := order.Uint16(entry)
+			if tag == 0x8769 {
+				exifIFD = int(order.Uint32(entry[8:]))
+			}
+			remove := false
+			for _, t := range tags {
+				if tag == t {
+					remove = true
+				}
+			}
+			if !remove {
+				copy(entries[12*kept:], entry)
+				kept++
+			}
+		}
+		if kept < n {
+			// Move the offset of the next IFD to just after the remaining
+			// entries. Nothing else in the file moves.
+			copy(exif[pos+2+12*kept:], exif[end:end+4])
+			order.PutUint16(exif[pos:], uint16(kept))
+		}
+		return exifIFD
+	}
+
+	// In IFD0, ImageWidth and ImageLength. In the Exif IFD, PixelXDimension
+	// and PixelYDimension.
+	exifIFD := removeTags(int(order.Uint32(exif[4:])), 0x0100, 0x0101)
+	if exifIFD != 0 {
+		removeTags(exifIFD, 0xa002, 0xa003)
+	}
+	return exif
+}
+
+// Returns the EXIF orientation (1 to 8), or 1 if there isn't a valid one.
+func exifOrientation(exif []byte) int {
+	order := exifByteOrder(exif)
+	if order == nil {
+		return 1
+	}
+	pos := findIFD0Tag(exif, order, 0x0112)
+	// The tag should be a SHORT (type 3), with a count of 1.
+	if pos < 0 || order.Uint16(exif[pos+2:]) != 3 || order.Uint32(exif[pos+4:]) != 1 {
+		return 1
+	}
+	orientation := int(order.Uint16(exif[pos+8:]))
+	if orientation < 1 || orientation > 8 {
+		return 1
+	}
+	return orientation
+}
+
+// Change the EXIF orientation (in-place), if there is one.
+func setExifOrientation(exif []byte, orientation int) {
+	order := exifByteOrder(exif)
+	if order == nil {
+		return
+	}
+	pos := findIFD0Tag(exif, order, 0x0112)
+	if pos < 0 || order.Uint16(exif[pos+2:]) != 3 {
+		return
+	}
+	order.PutUint16(exif[pos+8:], uint16(orientation))
+}
+
+// Write a JPEG file, adding the metadata to the JPEG data made by the jpeg
+// package.
+func writeJPEGWithMetadata(w io.Writer, jpegData []byte, meta *imageMetadata) error {
+	var buf bytes.Buffer
+
+	writeSegment := func(marker byte, prefix string, data []byte) {
+		var hdr [4]byte
+		hdr[0] = 0xff
+		hdr[1] = marker
+		binary.BigEndian.PutUint16(hdr[2:], uint16(2+len(prefix)+len(data)))
+		buf.Write(hdr[:])
+		buf.WriteString(prefix)
+		buf.Write(data)
+	}
+
+	if len(jpegData) < 2 {
+		_, err := w.Write(jpegData)
+		return err
+	}
+	// The segments go right after the SOI marker.
+	buf.Write(jpegData[:2])
+
+	// EXIF and XMP data that doesn't fit in one segment can't be written.
+	if meta.exif != nil && len(jpegExifPrefix)+len(meta.exif) <= jpegMaxSegmentData {
+		writeSegment(0xe1, jpegExifPrefix, meta.exif)
+	}
+	if meta.xmp != nil && len(jpegXMPPrefix)+len(meta.xmp) <= jpegMaxSegmentData {
+		writeSegment(0xe1, jpegXMPPrefix, meta.xmp)
+	}
+	if meta.icc != nil {
+		chunkSize := jpegMaxSegmentData - len(jpegICCPrefix) - 2
+		numChunks := (len(meta.icc) + chunkSize - 1) / chunkSize
+		if numChunks <= 255 {
+			for i := 0; i < numChunks; i++ {
+				chunk := meta.icc[i*chunkSize:]
+				if len(chunk) > chunkSize {
+					chunk = chunk[:chunkSize]
+				}
+				writeSegment(0xe2, jpegICCPrefix+string([]byte{byte(i + 1), byte(numChunks)}), chunk)
+			}
+		}
+	}
+
+	buf.Write(jpegData[2:])
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Write a PNG file, adding the metadata to the PNG data made by the png
+// package.
+func writePNGWithMetadata(w io.Writer, pngData []byte, meta *imageMetadata) error {
+	var buf bytes.Buffer
+
+	writeChunk := func(chunkType string, data []byte) {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(len(data)))
+		buf.Write(b[:])
+		crc := crc32.NewIEEE()
+		crc.Write([]byte(chunkType))
+		crc.Write(data)
+		buf.WriteString(chunkType)
+		buf.Write(data)
+		binary.BigEndian.PutUint32(b[:], crc.Sum32())
+		buf.Write(b[:])
+	}
+
+	// The signature, and the IHDR chunk, which always has 13 bytes of data.
+	ihdrEnd := len(pngSignature) + 12 + 13
+	if len(pngData) < ihdrEnd {
+		_, err := w.Write(pngData)
+		return err
+	}
+	buf.Write(pngData[:ihdrEnd])
+
+	// These chunks must come before the PLTE and IDAT chunks.
+	if meta.icc != nil {
+		var z bytes.Buffer
+		z.WriteString("ICC profile\x00\x00")
+		zw := zlib.NewWriter(&z)
+		zw.Write(meta.icc)
+		zw.Close()
+		writeChunk("iCCP", z.Bytes())
+	}
+	if meta.exif != nil {
+		writeChunk("eXIf", meta.exif)
+	}
+	if meta.xmp != nil {
+		// Keyword, no compression, no language tag or translated keyword.
+		data := append([]byte(pngXMPKeyword+"\x00\x00\x00\x00\x00"), meta.xmp...)
+		writeChunk("iTXt", data)
+	}
+
+	buf.Write(pngData[ihdrEnd:])
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,104 @@
+// ◄◄◄ orient.go ►►►
+// Copyright © 2012 Jason Summers
+
+// Rotating and flipping an image according to its EXIF orientation.
+
+package main
+
+import "image"
+import "image/draw"
+
+// Returns the size of the image after it is transformed for the given EXIF
+// orientation.
+func orientedSize(w, h int, orientation int) (int, int) {
+	if orientation >= 5 {
+		// The image is rotated by 90 degrees, or transposed.
+		return h, w
+	}
+	return w, h
+}
+
+// Given a pixel position in the transformed image, returns the position of
+// the corresponding pixel in the original (w×h) image.
+func orientedSourcePixel(dx, dy int, w, h int, orientation int) (int, int) {
+	switch orientation {
+	case 2: // Mirrored horizontally
+		return w - 1 - dx, dy
+	case 3: // Rotated 180 degrees
+		return w - 1 - dx, h - 1 - dy
+	case 4: // Mirrored vertically
+		return dx, h - 1 - dy
+	case 5: // Transposed
+		return dy, dx
+	case 6: // Needs to be rotated 90 degrees clockwise
+		return dy, h - 1 - dx
+	case 7: // Transversed
+		return w - 1 - dy, h - 1 - dx
+	case 8: // Needs to be rotated 90 degrees counterclockwise
+		return w - 1 - dy, dx
+	}
+	return dx, dy
+}
+
+// Copy pixels from src to dst, transforming them for the orientation. The
+// images have bpp bytes per pixel, and their origins are (0,0).
+func orientPix(dstPix []uint8, dstStride int, srcPix []uint8, srcStride int, bpp int,
+	w, h int, orientation int) {
+	dstW, dstH := orientedSize(w, h, orientation)
+	for dy := 0; dy < dstH; dy++ {
+		for dx := 0; dx < dstW; dx++ {
+			sx, sy := orientedSourcePixel(dx, dy, w, h, orientation)
+			copy(dstPix[dy*dstStride+dx*bpp:dy*dstStride+dx*bpp+bpp],
+				srcPix[sy*srcStride+sx*bpp:sy*srcStride+sx*bpp+bpp])
+		}
+	}
+}
+
+// Returns a copy of src, rotated and/or flipped so that it is displayed
+// correctly, given its EXIF orientation. The returned image's origin is
+// (0,0).
+func applyOrientation(src image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dstW, dstH := orientedSize(w, h, orientation)
+	dstRect := image.Rect(0, 0, dstW, dstH)
+
+	switch s := src.(type) {
+	case *image.Gray:
+		dst := image.NewGray(dstRect)
+		orientPix(dst.Pix, dst.Stride, s.Pix[s.PixOffset(b.Min.X, b.Min.Y):], s.Stride, 1, w, h, orientation)
+		return dst
+	case *image.Gray16:
+		dst := image.NewGray16(dstRect)
+		orientPix(dst.Pix, dst.Stride, s.Pix[s.PixOffset(b.Min.X, b.Min.Y):], s.Stride, 2, w, h, orientation)
+		return dst
+	case *image.NRGBA:
+		dst := image.NewNRGBA(dstRect)
+		orientPix(dst.Pix, dst.Stride, s.Pix[s.PixOffset(b.Min.X, b.Min.Y):], s.Stride, 4, w, h, orientation)
+		return dst
+	case *image.NRGBA64:
+		dst := image.NewNRGBA64(dstRect)
+		orientPix(dst.Pix, dst.Stride, s.Pix[s.PixOffset(b.Min.X, b.Min.Y):], s.Stride, 8, w, h, orientation)
+		return dst
+	case *image.RGBA64:
+		dst := image.NewRGBA64(dstRect)
+		orientPix(dst.Pix, dst.Stride, s.Pix[s.PixOffset(b.Min.X, b.Min.Y):], s.Stride, 8, w, h, orientation)
+		return dst
+	}
+
+	// Anything else (usually an image.YCbCr, from a JPEG file) is converted
+	// to RGBA first.
+	rgba, ok := src.(*image.RGBA)
+	if !ok {
+		rgba = image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+		b = rgba.Bounds()
+	}
+	dst := image.NewRGBA(dstRect)
+	orientPix(dst.Pix, dst.Stride, rgba.Pix[rgba.PixOffset(b.Min.X, b.Min.Y):], rgba.Stride, 4, w, h, orientation)
+	return dst
+}
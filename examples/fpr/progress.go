@@ -0,0 +1,100 @@
+// ◄◄◄ progress.go ►►►
+// Copyright © 2012 Jason Summers
+
+// A progress bar for the terminal, for the -progress option.
+
+package main
+
+import "fmt"
+import "os"
+import "strings"
+import "sync"
+import "time"
+import "github.com/jsummers/fpresize"
+
+// The width of the progress bar line, in characters.
+const progressLineWidth = 79
+
+type progressBar struct {
+	mutex     sync.Mutex
+	stepStart time.Time // When the current step started
+	lastDraw  time.Time
+	visible   bool
+}
+
+// Format a duration as minutes and seconds.
+func formatETA(d time.Duration) string {
+	secs := int(d.Seconds() + 0.5)
+	return fmt.Sprintf("%d:%02d", secs/60, secs%60)
+}
+
+// Draw the bar. frac is the fraction done, from 0 to 1. elapsed is how long
+// the work has taken so far, used to estimate the time remaining.
+func (pb *progressBar) draw(label string, frac float64, elapsed time.Duration, force bool) {
+	const barWidth = 20
+
+	pb.mutex.Lock()
+	defer pb.mutex.Unlock()
+
+	now := time.Now()
+	if !force && now.Sub(pb.lastDraw) < 100*time.Millisecond {
+		return
+	}
+	pb.lastDraw = now
+
+	if frac < 0.0 {
+		frac = 0.0
+	} else if frac > 1.0 {
+		frac = 1.0
+	}
+	n := int(frac * barWidth)
+	line := fmt.Sprintf("[%s%s] %3d%% %s", strings.Repeat("#", n), strings.Repeat(".", barWidth-n),
+		int(frac*100.0), label)
+	if frac > 0.0 && frac < 1.0 {
+		eta := time.Duration(float64(elapsed) * (1.0 - frac) / frac)
+		line += "  ETA " + formatETA(eta)
+	}
+	if len(line) > progressLineWidth {
+		line = line[:progressLineWidth]
+	}
+	fmt.Fprintf(os.Stderr, "\r%-*s", progressLineWidth, line)
+	pb.visible = true
+}
+
+// Erase the bar, so that a message can be printed.
+func (pb *progressBar) clear() {
+	pb.mutex.Lock()
+	defer pb.mutex.Unlock()
+	if pb.visible {
+		fmt.Fprintf(os.Stderr, "\r%*s\r", progressLineWidth, "")
+		pb.visible = false
+	}
+}
+
+// Leave the bar as it is, and move to the next line.
+func (pb *progressBar) done() {
+	pb.mutex.Lock()
+	defer pb.mutex.Unlock()
+	if pb.visible {
+		fmt.Fprintf(os.Stderr, "\n")
+		pb.visible = false
+	}
+}
+
+// Returns a function to pass to FPObject.SetProgressFunc, that shows the
+// progress of each step of a resize.
+func (pb *progressBar) resizeProgressFunc() func(p fpresize.Progress) {
+	return func(p fpresize.Progress) {
+		if p.Done == 0 {
+			pb.stepStart = time.Now()
+		}
+		label := fpresize.StageName(p.Stage) + ": " + p.Step
+		pb.draw(label, p.Fraction(), time.Now().Sub(pb.stepStart), p.Done == 0 || p.Done == p.Total)
+	}
+}
+
+// Show the progress of a batch run.
+func (pb *progressBar) showBatch(filesDone, numFiles int, start time.Time) {
+	label := fmt.Sprintf("%d of %d files", filesDone, numFiles)
+	pb.draw(label, float64(filesDone)/float64(numFiles), time.Now().Sub(start), true)
+}
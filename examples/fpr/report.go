@@ -0,0 +1,89 @@
+// ◄◄◄ report.go ►►►
+// Copyright © 2012 Jason Summers
+
+// The machine-readable report written by the -json option.
+
+package main
+
+import "fmt"
+import "os"
+import "encoding/json"
+import "time"
+import "github.com/jsummers/fpresize"
+
+// The report for one source file. One of these is written to standard
+// output for each source file, as a single line of JSON.
+type fileReport struct {
+	Source       string          `json:"source"`
+	SourceWidth  int             `json:"source_width"`
+	SourceHeight int             `json:"source_height"`
+	Filter       string          `json:"filter"`
+	Outputs      []*outputReport `json:"outputs"`
+	TotalSeconds float64         `json:"total_seconds"`
+	Error        string          `json:"error,omitempty"`
+
+	startTime time.Time
+}
+
+// The report for one target file.
+type outputReport struct {
+	File   string `json:"file"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// The size of the target file, in bytes.
+	FileSize int64 `json:"file_size"`
+	// The time spent resizing, not counting reading and writing files.
+	ResizeSeconds float64 `json:"resize_seconds"`
+	// The time spent in each processing stage, by stage name. The source
+	// image is only converted once, so "convert source" is only reported
+	// for the first target file.
+	StageSeconds map[string]float64 `json:"stage_seconds"`
+
+	stepStart time.Time
+}
+
+func newFileReport(options *options_type, srcFilename string) *fileReport {
+	rep := new(fileReport)
+	rep.Source = srcFilename
+	rep.Filter = options.filterName
+	rep.Outputs = []*outputReport{}
+	rep.startTime = time.Now()
+	return rep
+}
+
+// Start the report for a new target file.
+func (rep *fileReport) addOutput(dstFilename string) *outputReport {
+	orep := new(outputReport)
+	orep.File = dstFilename
+	orep.StageSeconds = make(map[string]float64)
+	rep.Outputs = append(rep.Outputs, orep)
+	return orep
+}
+
+// Record the timing of the resize steps. Called by the FPObject's progress
+// function.
+func (orep *outputReport) recordProgress(p fpresize.Progress) {
+	if p.Done == 0 {
+		orep.stepStart = time.Now()
+	}
+	if p.Done == p.Total {
+		orep.StageSeconds[fpresize.StageName(p.Stage)] += time.Now().Sub(orep.stepStart).Seconds()
+	}
+}
+
+// Finish the report, and write it to standard output.
+func (rep *fileReport) write(err error) {
+	if err != nil {
+		rep.Error = err.Error()
+	}
+	rep.TotalSeconds = time.Now().Sub(rep.startTime).Seconds()
+
+	data, jerr := json.Marshal(rep)
+	if jerr != nil {
+		return
+	}
+	// In batch mode, reports can come from more than one goroutine.
+	msgMutex.Lock()
+	defer msgMutex.Unlock()
+	fmt.Fprintf(os.Stdout, "%s\n", data)
+}
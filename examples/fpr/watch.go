@@ -0,0 +1,123 @@
+// ◄◄◄ watch.go ►►►
+// Copyright © 2012 Jason Summers
+
+// Watch mode: keep resizing files as they are added to the source
+// directories, or changed.
+
+package main
+
+import "fmt"
+import "os"
+import "time"
+import "path/filepath"
+import "strings"
+
+// What we know about a source file.
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+	// The file has been checked, and resized if necessary, since it last
+	// changed.
+	done bool
+}
+
+// List the regular files named by the -watch arguments, which are processed
+// in the same way as in batch mode.
+func listWatchedFiles(args []string) map[string]os.FileInfo {
+	files := make(map[string]os.FileInfo)
+
+	for _, arg := range args {
+		var matches []string
+		if fi, err := os.Stat(arg); err == nil && fi.IsDir() {
+			matches, _ = filepath.Glob(filepath.Join(arg, "*"))
+		} else if strings.ContainsAny(arg, "*?[") {
+			matches, _ = filepath.Glob(arg)
+		} else {
+			matches = []string{arg}
+		}
+		for _, fn := range matches {
+			fi, err := os.Stat(fn)
+			if err == nil && fi.Mode().IsRegular() {
+				files[fn] = fi
+			}
+		}
+	}
+	return files
+}
+
+// Reports whether the target file for srcFilename already exists, and is
+// newer than the source file.
+func targetIsCurrent(options *options_type, srcFilename string, srcInfo os.FileInfo) bool {
+	dstFilename := batchTargetFilename(options, srcFilename)
+	sizes := options.sizes
+	if len(sizes) == 0 {
+		sizes = []sizeSpec{{}}
+	}
+	for k := range sizes {
+		fi, err := os.Stat(sizeFilename(dstFilename, sizes[k].name, len(sizes) > 1))
+		if err != nil || fi.ModTime().Before(srcInfo.ModTime()) {
+			return false
+		}
+	}
+	return true
+}
+
+// Poll the source directories every options.watchInterval, and resize each
+// file that is new or has changed. Files that have already been resized (the
+// target file is newer than the source file) are skipped. Runs until the
+// program is killed.
+func watchFolders(options *options_type, args []string) error {
+	err := os.MkdirAll(options.outDir, 0777)
+	if err != nil {
+		return err
+	}
+	outDir, err := filepath.Abs(options.outDir)
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]*watchedFile)
+
+	fmt.Fprintf(msgOutput(options), "Watching for new files. Press Ctrl-C to stop.\n")
+	for {
+		var todo []string
+
+		files := listWatchedFiles(args)
+		for fn, fi := range files {
+			if dir, err := filepath.Abs(filepath.Dir(fn)); err == nil && dir == outDir {
+				// Don't resize our own output files.
+				continue
+			}
+
+			wf := known[fn]
+			if wf == nil || wf.size != fi.Size() || !wf.modTime.Equal(fi.ModTime()) {
+				// New or changed. Wait until it stops changing, in case it
+				// is still being written.
+				known[fn] = &watchedFile{size: fi.Size(), modTime: fi.ModTime()}
+				continue
+			}
+			if wf.done {
+				continue
+			}
+			wf.done = true
+			if isReadableFile(fn) && !targetIsCurrent(options, fn, fi) {
+				todo = append(todo, fn)
+			}
+		}
+
+		// Forget files that have been deleted, so that they'll be processed
+		// if they come back.
+		for fn := range known {
+			if files[fn] == nil {
+				delete(known, fn)
+			}
+		}
+
+		if len(todo) > 0 {
+			numFailed := resizeFiles(options, todo)
+			fmt.Fprintf(msgOutput(options), "Resized %d of %d files\n", len(todo)-numFailed, len(todo))
+		}
+
+		time.Sleep(options.watchInterval)
+	}
+}
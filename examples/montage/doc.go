@@ -0,0 +1,27 @@
+// ◄◄◄ montage/doc.go ►►►
+// Copyright © 2012 Jason Summers
+
+/*
+montage is a sample program that uses the fpresize package. It resizes a set
+of images to the same cell size, and puts them together in a grid (a
+"contact sheet"), with each image's filename under it.
+
+Usage:
+    montage [options] -o <target-file> <source-file|glob|dir>...
+
+A directory means all the image files in it. The target file may be PNG or
+JPEG.
+
+-cell sets the size of each cell (default 160x160), and -cols the number of
+columns (by default, about the square root of the number of images). -mode
+selects how each image is fit to its cell: "fit" (the default) makes the
+image as large as will fit, centered, with the background showing around it;
+"cover" fills the cell, and crops whatever doesn't fit.
+
+-bg sets the background color (#rrggbb), -gap the space between cells, in
+pixels, and -nolabels turns off the filenames. The images are composited
+over the background in linear light, by fpresize.
+
+-jobs sets how many images are resized at the same time.
+*/
+package main
@@ -0,0 +1,124 @@
+// ◄◄◄ montage/font.go ►►►
+// Copyright © 2012 Jason Summers
+
+package main
+
+// A tiny bitmap font for the labels, so that montage doesn't need any
+// packages outside the standard library.
+
+import "image"
+import "image/color"
+import "strings"
+
+const (
+	glyphW = 3
+	glyphH = 5
+)
+
+// Each glyph is 5 rows of 3 pixels. Lowercase letters are drawn as
+// uppercase, and other characters that aren't here are drawn as '?'.
+var glyphs = map[rune][glyphH]string{
+	'A':  {".#.", "#.#", "###", "#.#", "#.#"},
+	'B':  {"##.", "#.#", "##.", "#.#", "##."},
+	'C':  {".##", "#..", "#..", "#..", ".##"},
+	'D':  {"##.", "#.#", "#.#", "#.#", "##."},
+	'E':  {"###", "#..", "##.", "#..", "###"},
+	'F':  {"###", "#..", "##.", "#..", "#.."},
+	'G':  {".##", "#..", "#.#", "#.#", ".##"},
+	'H':  {"#.#", "#.#", "###", "#.#", "#.#"},
+	'I':  {"###", ".#.", ".#.", ".#.", "###"},
+	'J':  {"..#", "..#", "..#", "#.#", ".#."},
+	'K':  {"#.#", "#.#", "##.", "#.#", "#.#"},
+	'L':  {"#..", "#..", "#..", "#..", "###"},
+	'M':  {"#.#", "###", "###", "#.#", "#.#"},
+	'N':  {"##.", "#.#", "#.#", "#.#", "#.#"},
+	'O':  {".#.", "#.#", "#.#", "#.#", ".#."},
+	'P':  {"##.", "#.#", "##.", "#..", "#.."},
+	'Q':  {".#.", "#.#", "#.#", "##.", ".##"},
+	'R':  {"##.", "#.#", "##.", "#.#", "#.#"},
+	'S':  {".##", "#..", ".#.", "..#", "##."},
+	'T':  {"###", ".#.", ".#.", ".#.", ".#."},
+	'U':  {"#.#", "#.#", "#.#", "#.#", "###"},
+	'V':  {"#.#", "#.#", "#.#", "#.#", ".#."},
+	'W':  {"#.#", "#.#", "###", "###", "#.#"},
+	'X':  {"#.#", "#.#", ".#.", "#.#", "#.#"},
+	'Y':  {"#.#", "#.#", ".#.", ".#.", ".#."},
+	'Z':  {"###", "..#", ".#.", "#..", "###"},
+	'0':  {"###", "#.#", "#.#", "#.#", "###"},
+	'1':  {".#.", "##.", ".#.", ".#.", "###"},
+	'2':  {"##.", "..#", ".#.", "#..", "###"},
+	'3':  {"##.", "..#", ".#.", "..#", "##."},
+	'4':  {"#.#", "#.#", "###", "..#", "..#"},
+	'5':  {"###", "#..", "##.", "..#", "##."},
+	'6':  {".##", "#..", "###", "#.#", "###"},
+	'7':  {"###", "..#", ".#.", ".#.", ".#."},
+	'8':  {"###", "#.#", "###", "#.#", "###"},
+	'9':  {"###", "#.#", "###", "..#", "##."},
+	' ':  {"...", "...", "...", "...", "..."},
+	'.':  {"...", "...", "...", "...", ".#."},
+	',':  {"...", "...", "...", ".#.", "#.."},
+	'-':  {"...", "...", "###", "...", "..."},
+	'_':  {"...", "...", "...", "...", "###"},
+	'+':  {"...", ".#.", "###", ".#.", "..."},
+	'=':  {"...", "###", "...", "###", "..."},
+	'(':  {"..#", ".#.", ".#.", ".#.", "..#"},
+	')':  {"#..", ".#.", ".#.", ".#.", "#.."},
+	'[':  {"##.", "#..", "#..", "#..", "##."},
+	']':  {".##", "..#", "..#", "..#", ".##"},
+	'#':  {"#.#", "###", "#.#", "###", "#.#"},
+	'&':  {".#.", "#.#", ".#.", "#.#", ".##"},
+	'!':  {".#.", ".#.", ".#.", "...", ".#."},
+	'\'': {".#.", ".#.", "...", "...", "..."},
+	'?':  {"##.", "..#", ".#.", "...", ".#."},
+}
+
+// The width of s, in pixels, drawn at the given scale. There is one (scaled)
+// pixel of space between characters.
+func textWidth(s string, scale int) int {
+	n := len([]rune(s))
+	if n == 0 {
+		return 0
+	}
+	return (n*(glyphW+1) - 1) * scale
+}
+
+// Shortens s, if necessary, so that it is at most maxW pixels wide at the
+// given scale. The end of a shortened string is replaced by "..".
+func fitText(s string, scale, maxW int) string {
+	r := []rune(s)
+	if textWidth(s, scale) <= maxW {
+		return s
+	}
+	for len(r) > 0 && textWidth(string(r)+"..", scale) > maxW {
+		r = r[:len(r)-1]
+	}
+	if len(r) == 0 {
+		return ""
+	}
+	return string(r) + ".."
+}
+
+// Draws s on dst, with its top left corner at pt, with each font pixel
+// drawn as a scale×scale square.
+func drawText(dst *image.RGBA, pt image.Point, s string, scale int, clr color.RGBA) {
+	x := pt.X
+	for _, ch := range strings.ToUpper(s) {
+		g, ok := glyphs[ch]
+		if !ok {
+			g = glyphs['?']
+		}
+		for j := 0; j < glyphH; j++ {
+			for i := 0; i < glyphW; i++ {
+				if g[j][i] != '#' {
+					continue
+				}
+				for dy := 0; dy < scale; dy++ {
+					for dx := 0; dx < scale; dx++ {
+						dst.SetRGBA(x+i*scale+dx, pt.Y+j*scale+dy, clr)
+					}
+				}
+			}
+		}
+		x += (glyphW + 1) * scale
+	}
+}
@@ -0,0 +1,360 @@
+// ◄◄◄ montage/montage.go ►►►
+// Copyright © 2012 Jason Summers
+
+package main
+
+import "fmt"
+import "os"
+import "flag"
+import "path/filepath"
+import "strings"
+import "strconv"
+import "math"
+import "sort"
+import "sync"
+import "image"
+import "image/color"
+import "image/draw"
+import "image/png"
+import "image/jpeg"
+import _ "image/gif"
+import "github.com/jsummers/fpresize"
+
+type options_type struct {
+	cellW, cellH int
+	cols         int
+	mode         string
+	gap          int
+	bgColor      []float32
+	labels       bool
+	labelScale   int
+	jobs         int
+	dstFilename  string
+}
+
+// Convert a -bg option ("#rrggbb", "rrggbb", or "#rgb") to RGB samples from
+// 0 to 1.
+func parseColor(s string) ([]float32, error) {
+	h := strings.TrimPrefix(s, "#")
+	if len(h) == 3 {
+		h = string([]byte{h[0], h[0], h[1], h[1], h[2], h[2]})
+	}
+	if len(h) != 6 {
+		return nil, fmt.Errorf("Invalid color %+q", s)
+	}
+	n, err := strconv.ParseUint(h, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid color %+q", s)
+	}
+	return []float32{float32(n>>16) / 255.0, float32((n>>8)&0xff) / 255.0, float32(n&0xff) / 255.0}, nil
+}
+
+// Convert a -cell option ("160x120", or "160" for a square) to a width and
+// height.
+func parseCellSize(s string) (int, int, error) {
+	parts := strings.SplitN(strings.ToLower(s), "x", 2)
+	if len(parts) == 1 {
+		parts = append(parts, parts[0])
+	}
+	w, err1 := strconv.Atoi(parts[0])
+	h, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || w < 1 || h < 1 {
+		return 0, 0, fmt.Errorf("Invalid cell size %+q", s)
+	}
+	return w, h, nil
+}
+
+// Expand the source file arguments into a list of files. An argument may be
+// a filename, a glob pattern (for shells that don't expand them), or a
+// directory (meaning all the image files in it, sorted by name).
+func expandSourceArgs(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		var matches []string
+		var err error
+		if fi, err2 := os.Stat(arg); err2 == nil && fi.IsDir() {
+			matches, err = filepath.Glob(filepath.Join(arg, "*"))
+			if err != nil {
+				return nil, err
+			}
+			sort.Strings(matches)
+			for _, fn := range matches {
+				if isImageFile(fn) {
+					files = append(files, fn)
+				}
+			}
+		} else if strings.ContainsAny(arg, "*?[") {
+			matches, err = filepath.Glob(arg)
+			if err != nil {
+				return nil, err
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("No files match %+q", arg)
+			}
+			files = append(files, matches...)
+		} else {
+			files = append(files, arg)
+		}
+	}
+	return files, nil
+}
+
+// Returns true if montage can read the file. This looks at the file's
+// contents, not its name.
+func isImageFile(fn string) bool {
+	file, err := os.Open(fn)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	_, _, err = image.DecodeConfig(file)
+	return err == nil
+}
+
+func readImageFromFile(fn string) (image.Image, error) {
+	file, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	return img, err
+}
+
+// Returns the rectangle, relative to the cell, that an image of size srcW×srcH
+// is mapped to. In "cover" mode, it is larger than the cell.
+func cellMapping(options *options_type, srcW, srcH int) (x1, y1, x2, y2 float64) {
+	cw, ch := float64(options.cellW), float64(options.cellH)
+	scale := math.Min(cw/float64(srcW), ch/float64(srcH))
+	if options.mode == "cover" {
+		scale = math.Max(cw/float64(srcW), ch/float64(srcH))
+	}
+	w, h := float64(srcW)*scale, float64(srcH)*scale
+	x1 = (cw - w) / 2.0
+	y1 = (ch - h) / 2.0
+	return x1, y1, x1 + w, y1 + h
+}
+
+// Resize the image in srcFilename to a cell, composited over the background
+// color. The compositing is done in linear light, before the image is
+// converted to sRGB.
+func resizeToCell(options *options_type, srcFilename string) (*image.RGBA, error) {
+	src, err := readImageFromFile(srcFilename)
+	if err != nil {
+		return nil, err
+	}
+	b := src.Bounds()
+
+	fp := fpresize.New(src)
+	x1, y1, x2, y2 := cellMapping(options, b.Dx(), b.Dy())
+	fp.SetTargetBoundsAdvanced(image.Rect(0, 0, options.cellW, options.cellH), x1, y1, x2, y2)
+	if options.mode == "cover" {
+		// The image covers the whole cell, so the edges shouldn't fade out.
+		fp.SetVirtualPixels(fpresize.VirtualPixelsReplicate)
+	} else {
+		fp.SetVirtualPixels(fpresize.VirtualPixelsTransparent)
+	}
+
+	im, err := fp.ResizeToLinear()
+	if err != nil {
+		return nil, err
+	}
+
+	bg := make([]float32, 3)
+	copy(bg, options.bgColor)
+	fpresize.SRGBToLinear(bg)
+	// The colors have associated alpha, so this is all that's needed.
+	for j := 0; j < im.Rect.Dy(); j++ {
+		row := im.Pix[j*im.Stride : j*im.Stride+4*im.Rect.Dx()]
+		for i := 0; i < len(row); i += 4 {
+			a := row[i+3]
+			if a < 0.0 {
+				a = 0.0
+			} else if a > 1.0 {
+				a = 1.0
+			}
+			for k := 0; k < 3; k++ {
+				row[i+k] += bg[k] * (1.0 - a)
+			}
+			row[i+3] = 1.0
+		}
+	}
+	return fp.FinalizeToRGBA(im)
+}
+
+// A resized cell, or the error that happened when making it.
+type cellResult struct {
+	index int
+	img   *image.RGBA
+	err   error
+}
+
+// Resize all the source files, options.jobs at a time, and send each of
+// the results to the returned channel, in no particular order.
+func resizeCells(options *options_type, srcFiles []string) <-chan cellResult {
+	results := make(chan cellResult)
+	indices := make(chan int)
+
+	jobs := options.jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	var wg sync.WaitGroup
+	for n := 0; n < jobs; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				img, err := resizeToCell(options, srcFiles[i])
+				results <- cellResult{index: i, img: img, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		for i := range srcFiles {
+			indices <- i
+		}
+		close(indices)
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// Black or white, whichever is easier to read on the background color.
+func labelColor(bg []float32) color.RGBA {
+	if 0.299*bg[0]+0.587*bg[1]+0.114*bg[2] > 0.5 {
+		return color.RGBA{0, 0, 0, 255}
+	}
+	return color.RGBA{255, 255, 255, 255}
+}
+
+func makeMontage(options *options_type, srcFiles []string) (*image.RGBA, error) {
+	cols := options.cols
+	if cols < 1 {
+		cols = int(math.Ceil(math.Sqrt(float64(len(srcFiles)))))
+	}
+	rows := (len(srcFiles) + cols - 1) / cols
+
+	labelH := 0
+	if options.labels {
+		labelH = glyphH*options.labelScale + options.labelScale*2
+	}
+	pitchX := options.cellW + options.gap
+	pitchY := options.cellH + labelH + options.gap
+	w := cols*pitchX + options.gap
+	h := rows*pitchY + options.gap
+	if int64(w)*int64(h) > 1<<28 {
+		return nil, fmt.Errorf("Montage too large (%d×%d)", w, h)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	bg := color.RGBA{uint8(options.bgColor[0]*255.0 + 0.5), uint8(options.bgColor[1]*255.0 + 0.5),
+		uint8(options.bgColor[2]*255.0 + 0.5), 255}
+	draw.Draw(dst, dst.Bounds(), &image.Uniform{bg}, image.ZP, draw.Src)
+	fg := labelColor(options.bgColor)
+
+	var numFailed int
+	for res := range resizeCells(options, srcFiles) {
+		if res.err != nil {
+			// Leave the cell empty, but still label it.
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", srcFiles[res.index], res.err.Error())
+			numFailed++
+		}
+		x := options.gap + (res.index%cols)*pitchX
+		y := options.gap + (res.index/cols)*pitchY
+		if res.img != nil {
+			draw.Draw(dst, image.Rect(x, y, x+options.cellW, y+options.cellH), res.img, image.ZP, draw.Src)
+		}
+		if options.labels {
+			label := fitText(filepath.Base(srcFiles[res.index]), options.labelScale, options.cellW)
+			lx := x + (options.cellW-textWidth(label, options.labelScale))/2
+			drawText(dst, image.Pt(lx, y+options.cellH+options.labelScale), label, options.labelScale, fg)
+		}
+	}
+	if numFailed == len(srcFiles) {
+		return nil, fmt.Errorf("None of the images could be read")
+	}
+	return dst, nil
+}
+
+func writeImageToFile(img image.Image, dstFilename string) error {
+	file, err := os.Create(dstFilename)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(dstFilename)) {
+	case ".jpg", ".jpeg":
+		err = jpeg.Encode(file, img, &jpeg.Options{Quality: 90})
+	default:
+		err = png.Encode(file, img)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func main() {
+	options := new(options_type)
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  montage [options] -o <target-file> <source-file|glob|dir>...\n")
+		flag.PrintDefaults()
+	}
+
+	cell := flag.String("cell", "160x160", "Size of each cell, in pixels: <width>x<height>")
+	flag.IntVar(&options.cols, "cols", 0, "Number of columns (0 = about the square root of the number of images)")
+	flag.StringVar(&options.mode, "mode", "fit", "How to fit each image to its cell: fit, cover")
+	flag.IntVar(&options.gap, "gap", 8, "Space between cells, in pixels")
+	bg := flag.String("bg", "#ffffff", "Background color: #rrggbb")
+	noLabels := flag.Bool("nolabels", false, "Don't write the filenames under the images")
+	flag.IntVar(&options.labelScale, "labelscale", 2, "Size of the label text")
+	flag.IntVar(&options.jobs, "jobs", 4, "Number of images to resize at once")
+	flag.StringVar(&options.dstFilename, "o", "", "Target file (.png or .jpg)")
+	flag.Parse()
+
+	var err error
+	options.cellW, options.cellH, err = parseCellSize(*cell)
+	if err == nil {
+		options.bgColor, err = parseColor(*bg)
+	}
+	if err == nil && options.mode != "fit" && options.mode != "cover" {
+		err = fmt.Errorf("Unrecognized mode %+q", options.mode)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err.Error())
+		os.Exit(1)
+	}
+	options.labels = !*noLabels
+	if options.labelScale < 1 {
+		options.labelScale = 1
+	}
+
+	if options.dstFilename == "" || flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	srcFiles, err := expandSourceArgs(flag.Args())
+	if err == nil && len(srcFiles) == 0 {
+		err = fmt.Errorf("No source files")
+	}
+	var img *image.RGBA
+	if err == nil {
+		img, err = makeMontage(options, srcFiles)
+	}
+	if err == nil {
+		err = writeImageToFile(img, options.dstFilename)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err.Error())
+		os.Exit(1)
+	}
+}
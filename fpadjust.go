@@ -0,0 +1,66 @@
+// ◄◄◄ fpadjust.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements simple tonal adjustments of the resized image.
+
+import "math"
+
+// SetExposure brightens (for ev > 0) or darkens (for ev < 0) the image by
+// the given number of photographic stops: each stop doubles or halves the
+// amount of light. 0 (the default) makes no change.
+//
+// The adjustment, like that of SetLevels, is made to the resized image in
+// linear light, with full precision, before it is converted to the target
+// colorspace, so it doesn't cause banding as it would if it were done to
+// an 8-bit image afterward. Adjustments are not made by ResizeToLinear
+// (but are made by the Finalize* methods), or in data mode.
+func (fp *FPObject) SetExposure(ev float64) {
+	fp.exposure = ev
+}
+
+// SetLevels stretches the range of brightness from black to white (in
+// linear light, from 0.0 to 1.0) to the full range: samples at or below
+// black become 0, and samples at or above white become 1. It is done after
+// the SetExposure adjustment. The default is SetLevels(0, 1), which makes no
+// change. white must be greater than black.
+func (fp *FPObject) SetLevels(black, white float64) {
+	fp.levelsBlack = black
+	fp.levelsWhite = white
+	fp.levelsSet = (black != 0.0 || white != 1.0)
+}
+
+// Reports whether SetExposure or SetLevels has been used to make an
+// adjustment.
+func (fp *FPObject) hasAdjustments() bool {
+	return (fp.exposure != 0.0 || fp.levelsSet) && !fp.dataMode
+}
+
+// Returns the adjustment as v*scale - offset*alpha, for each color sample
+// v (which has associated alpha).
+func (fp *FPObject) adjustmentFactors() (scale, offset float32) {
+	s := math.Exp2(fp.exposure)
+	o := 0.0
+	if fp.levelsSet {
+		s /= fp.levelsWhite - fp.levelsBlack
+		o = fp.levelsBlack / (fp.levelsWhite - fp.levelsBlack)
+	}
+	return float32(s), float32(o)
+}
+
+// Adjusts the color samples of row j of im, a resized image with
+// associated alpha.
+func (fp *FPObject) adjustRow(im *FPImage, j int) {
+	scale, offset := fp.adjustmentFactors()
+	row := im.Pix[j*im.Stride : j*im.Stride+4*im.Rect.Dx()]
+	for i := 0; i < len(row); i += 4 {
+		a := row[i+3]
+		if !fp.mustProcessTransparency {
+			a = 1.0
+		}
+		for k := 0; k < 3; k++ {
+			row[i+k] = row[i+k]*scale - offset*a
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// ◄◄◄ fpalphaweight.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements alpha-weighted normalization between the resampling
+// passes.
+
+// SetAlphaWeighting enables or disables alpha-weighted normalization. The
+// image is always resampled with associated alpha, which weights each color
+// sample by its alpha. If this is enabled, the intermediate image made by
+// the first resampling pass is also renormalized: each color sample is
+// divided by the pixel's summed alpha, clamped to [0,1], and multiplied by
+// the (clamped) alpha again, before the second pass.
+//
+// With filters that have negative lobes, at the hard edges of an alpha
+// cutout the summed alpha can be very small, or slightly out of range, and
+// the colors are then far out of range. Normally those colors are only
+// clamped at the end, after both passes have spread them, which causes
+// fringes of wrong colors along the edges when downscaling. Clamping them
+// between the passes reduces that. It has no effect on opaque images, or in
+// data mode. Planar mode (see SetPlanar) is not used when it is enabled.
+func (fp *FPObject) SetAlphaWeighting(enable bool) {
+	fp.alphaWeighting = enable
+}
+
+// Reports whether the intermediate image should be renormalized, for a
+// four-channel image being resized by resizeImageN (or in pipelined mode).
+func (fp *FPObject) useAlphaWeighting() bool {
+	return fp.alphaWeighting && !fp.dataMode && fp.srcFPImageN == nil && len(fp.channelInfo) == 4 &&
+		fp.channelInfo[3].mustProcess
+}
+
+// Renormalizes a row of four-channel pixels (see SetAlphaWeighting).
+func (fp *FPObject) renormalizeAlphaRow(row []float32) {
+	for i := 0; i+3 < len(row); i += 4 {
+		a := row[i+3]
+		if a <= 0.0 {
+			row[i], row[i+1], row[i+2], row[i+3] = 0.0, 0.0, 0.0, 0.0
+			continue
+		}
+		clampedA := a
+		if clampedA > 1.0 {
+			clampedA = 1.0
+		}
+		for k := 0; k < 3; k++ {
+			if !fp.channelInfo[k].mustProcess {
+				continue
+			}
+			c := row[i+k] / a
+			if c < 0.0 {
+				c = 0.0
+			} else if c > 1.0 {
+				c = 1.0
+			}
+			row[i+k] = c * clampedA
+		}
+		row[i+3] = clampedA
+	}
+}
+
+// Renormalizes the intermediate image im, in place.
+func (fp *FPObject) renormalizeAlpha(im *FPImageN) {
+	w, h := im.Rect.Dx(), im.Rect.Dy()
+	for j := 0; j < h; j++ {
+		fp.renormalizeAlphaRow(im.Pix[j*im.Stride : j*im.Stride+w*4])
+	}
+}
@@ -0,0 +1,115 @@
+// ◄◄◄ fpanalyze.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements inspection of the source image, before resizing.
+
+import "errors"
+import "image"
+
+// SourceInfo describes the pixels of a source image. It is returned by
+// AnalyzeSource.
+type SourceInfo struct {
+	// Set if any pixel is not fully opaque.
+	HasTransparency bool
+	// Set if every pixel is gray (its red, green, and blue samples are
+	// equal).
+	IsGrayscale bool
+	// 8 if every sample can be represented exactly with 8 bits; otherwise
+	// 16.
+	BitDepth int
+}
+
+// Examine one color (with 16-bit samples) and update info.
+func (info *SourceInfo) addColor(r, g, b, a uint32) {
+	if a != 0xffff {
+		info.HasTransparency = true
+	}
+	if r != g || r != b {
+		info.IsGrayscale = false
+	}
+	if r%257 != 0 || g%257 != 0 || b%257 != 0 || a%257 != 0 {
+		info.BitDepth = 16
+	}
+}
+
+// AnalyzeSource examines every pixel of the source image, and reports
+// whether it has transparency, whether it is grayscale, and its effective
+// bit depth, so that the caller can choose the target image format and
+// other settings before resizing. For example, if the image is grayscale,
+// the caller might ask for grayscale output, or call
+// SetForceGrayscale(true) to speed up the resize.
+//
+// Unlike HasTransparency and HasColor, which may be pessimistic, this looks
+// at the actual pixel values, so it may be slow for large images. It also
+// calls Analyze.
+//
+// The source image must have been set by SetSourceImage, and this must be
+// called before the first resize (after which fpresize no longer keeps
+// the original source image). The result is remembered, so it may be
+// called again later.
+func (fp *FPObject) AnalyzeSource() (*SourceInfo, error) {
+	if fp.srcInfo != nil {
+		return fp.srcInfo, nil
+	}
+	if fp.srcImage == nil {
+		return nil, errors.New("AnalyzeSource requires a source image set by SetSourceImage, before the first resize")
+	}
+
+	info := &SourceInfo{IsGrayscale: true, BitDepth: 8}
+
+	switch src := fp.srcImage.(type) {
+	case *image.Gray:
+		// Nothing to do; the defaults are correct.
+	case *image.Paletted:
+		// Only look at the palette colors that are used.
+		var used [256]bool
+		b := src.Rect
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for _, idx := range src.Pix[src.PixOffset(b.Min.X, y):src.PixOffset(b.Max.X, y)] {
+				used[idx] = true
+			}
+		}
+		for idx, c := range src.Palette {
+			if idx < 256 && used[idx] {
+				info.addColor(c.RGBA())
+			}
+		}
+	case *image.NRGBA64:
+		// Look at the samples directly, since converting to associated alpha
+		// could hide their bit depth.
+		b := src.Rect
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := src.NRGBA64At(x, y)
+				info.addColor(uint32(c.R), uint32(c.G), uint32(c.B), uint32(c.A))
+			}
+		}
+	case *image.NRGBA, *image.RGBA, *image.YCbCr, *image.NYCbCrA, *image.CMYK:
+		// These have 8-bit samples, but converting them to 16-bit associated
+		// alpha can make them look like 16-bit samples.
+		fp.analyzeAt(info)
+		info.BitDepth = 8
+	default:
+		fp.analyzeAt(info)
+	}
+
+	err := fp.Analyze()
+	if err != nil {
+		return nil, err
+	}
+
+	fp.srcInfo = info
+	return info, nil
+}
+
+// Examine every pixel of fp.srcImage, using its At method.
+func (fp *FPObject) analyzeAt(info *SourceInfo) {
+	b := fp.srcBounds
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			info.addColor(fp.srcImage.At(x, y).RGBA())
+		}
+	}
+}
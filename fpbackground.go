@@ -0,0 +1,86 @@
+// ◄◄◄ fpbackground.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements flattening transparent source images onto a
+// background color.
+
+import "image/color"
+
+// SetBackgroundColor makes fpresize composite the source image over the
+// background color c, as it is read, so that the resized image is opaque.
+// This is for target formats that don't support transparency, such as
+// JPEG. Unlike compositing the source image with the image/draw package,
+// it is done in linear light (after the input color conversion), so the
+// partly transparent pixels are blended correctly.
+//
+// c is in the source colorspace (the one the input color converter
+// expects), and its alpha is ignored. If the image is converted to
+// grayscale (see SetForceGrayscale), so is c. nil means not to use a
+// background color, which is the default. This has no effect in data mode,
+// or on images set by SetSourceImageN.
+//
+// Only the source image is flattened. Transparent virtual pixels (see
+// SetVirtualPixels) still make the edges of the resized image transparent.
+//
+// This must be called before calling the first Resize method.
+func (fp *FPObject) SetBackgroundColor(c color.Color) {
+	fp.srcSettingChanged()
+	fp.background = c
+}
+
+// Reports whether the source image is composited over a background color.
+func (fp *FPObject) usesBackground() bool {
+	return fp.background != nil && !fp.dataMode
+}
+
+// Returns the background color, converted to linear light (or whatever the
+// input color converter converts to).
+func (fp *FPObject) linearBackground() []float32 {
+	r, g, b, a := fp.background.RGBA()
+	bg := []float32{float32(r), float32(g), float32(b)}
+	for k := range bg {
+		if a > 0 {
+			// Unassociate the alpha, then ignore it.
+			bg[k] /= float32(a)
+		}
+	}
+	if fp.inputCCF != nil {
+		fp.inputCCF(bg)
+	}
+	return bg
+}
+
+// If there is a background color, make wc.cvtRowFn composite each row over
+// it, after converting the row.
+func (fp *FPObject) addBackground(wc *convertSrcWorkContext) {
+	if !fp.usesBackground() {
+		return
+	}
+	bg := fp.linearBackground()
+	if !fp.srcHasColor {
+		// Only the red channel is used.
+		bg[0] = 0.2126*bg[0] + 0.7152*bg[1] + 0.0722*bg[2]
+	}
+	cvtRowFn := wc.cvtRowFn
+	wc.cvtRowFn = func(fp *FPObject, wc *convertSrcWorkContext, j int) {
+		cvtRowFn(fp, wc, j)
+		pos := (j - wc.dstFirstRow) * wc.dst.Stride
+		row := wc.dst.Pix[pos : pos+4*fp.srcW]
+		// The colors have associated alpha, so this is all that's needed.
+		for i := 0; i < len(row); i += 4 {
+			a := row[i+3]
+			if a >= 1.0 {
+				continue
+			}
+			if a < 0.0 {
+				a = 0.0
+			}
+			for k := 0; k < 3; k++ {
+				row[i+k] += bg[k] * (1.0 - a)
+			}
+			row[i+3] = 1.0
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// ◄◄◄ fpbgra.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+import "image"
+import "image/color"
+
+// BGRA is an image whose pixels are stored as premultiplied-alpha B, G, R, A
+// bytes. This is the layout used by Windows DIBs, Cairo's ARGB32 format (on
+// little-endian machines), and many GUI toolkits.
+//
+// It implements the image.Image interface.
+type BGRA struct {
+	// A slice containing all samples. 4 consecutive bytes (B G R A), with
+	// associated alpha, make a pixel.
+	Pix    []uint8
+	Stride int
+	Rect   image.Rectangle
+	// If set, the rows are stored bottom-up: the first row in Pix is the
+	// bottom row of the image (Rect.Max.Y-1).
+	BottomUp bool
+}
+
+// NewBGRA returns a new BGRA image with the given bounds.
+func NewBGRA(r image.Rectangle, bottomUp bool) *BGRA {
+	w, h := r.Dx(), r.Dy()
+	return &BGRA{Pix: make([]uint8, 4*w*h), Stride: 4 * w, Rect: r, BottomUp: bottomUp}
+}
+
+func (im *BGRA) ColorModel() color.Model {
+	return color.RGBAModel
+}
+
+func (im *BGRA) Bounds() image.Rectangle {
+	return im.Rect
+}
+
+// PixOffset returns the index in Pix of the first sample of the pixel
+// at (x, y).
+func (im *BGRA) PixOffset(x, y int) int {
+	if im.BottomUp {
+		return (im.Rect.Max.Y-1-y)*im.Stride + (x-im.Rect.Min.X)*4
+	}
+	return (y-im.Rect.Min.Y)*im.Stride + (x-im.Rect.Min.X)*4
+}
+
+func (im *BGRA) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(im.Rect)) {
+		return color.RGBA{}
+	}
+	i := im.PixOffset(x, y)
+	return color.RGBA{im.Pix[i+2], im.Pix[i+1], im.Pix[i], im.Pix[i+3]}
+}
+
+// ResizeToBGRA resizes the image, and returns a pointer to an image that
+// uses the BGRA format. If bottomUp is set, the rows of the returned image
+// are stored bottom-up.
+func (fp *FPObject) ResizeToBGRA(bottomUp bool) (*BGRA, error) {
+	prepare := func(r image.Rectangle) *convertDstWorkContext {
+		return fp.prepareDst_BGRA(r, bottomUp)
+	}
+	dst, err := fp.resizeToFormat(prepare)
+	if err != nil {
+		return nil, err
+	}
+	return dst.(*BGRA), nil
+}
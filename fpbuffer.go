@@ -0,0 +1,145 @@
+// ◄◄◄ fpbuffer.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements resizing into a caller-supplied buffer.
+
+import "errors"
+import "fmt"
+import "image"
+import "image/draw"
+
+// Pixel formats for ResizeToBuffer. Each is laid out in the same way as the
+// Pix field of the corresponding image type.
+const (
+	PixelFormatRGBA         = 1 // image.RGBA
+	PixelFormatNRGBA        = 2 // image.NRGBA
+	PixelFormatRGBA64       = 3 // image.RGBA64
+	PixelFormatNRGBA64      = 4 // image.NRGBA64
+	PixelFormatGray         = 5 // image.Gray
+	PixelFormatGray16       = 6 // image.Gray16
+	PixelFormatCMYK         = 7 // image.CMYK
+	PixelFormatBGRA         = 8 // BGRA, stored top-down
+	PixelFormatBGRABottomUp = 9 // BGRA, stored bottom-up
+)
+
+// Returns the number of bytes per pixel, and the dstPrepareFunc, for a
+// PixelFormat* constant.
+func (fp *FPObject) bufferFormat(format int) (int, dstPrepareFunc) {
+	switch format {
+	case PixelFormatRGBA:
+		return 4, fp.prepareDst_RGBA
+	case PixelFormatNRGBA:
+		return 4, fp.prepareDst_NRGBA
+	case PixelFormatRGBA64:
+		return 8, fp.prepareDst_RGBA64
+	case PixelFormatNRGBA64:
+		return 8, fp.prepareDst_NRGBA64
+	case PixelFormatGray:
+		return 1, fp.prepareDst_Gray
+	case PixelFormatGray16:
+		return 2, fp.prepareDst_Gray16
+	case PixelFormatCMYK:
+		return 4, fp.prepareDst_CMYK
+	case PixelFormatBGRA, PixelFormatBGRABottomUp:
+		bottomUp := format == PixelFormatBGRABottomUp
+		return 4, func(r image.Rectangle) *convertDstWorkContext {
+			return fp.prepareDst_BGRA(r, bottomUp)
+		}
+	}
+	return 0, nil
+}
+
+// ResizeToBuffer resizes the image, and writes the pixels directly to buf,
+// which might be backed by shared memory or a memory-mapped file. format is
+// a PixelFormat* constant, and stride is the distance in bytes from the
+// start of one row to the start of the next. Bytes in buf that are not part
+// of a pixel (such as row padding) are left unchanged.
+//
+// With PixelFormatGray and PixelFormatGray16, the luminance is used, as
+// with ResizeToGray.
+//
+// fpresize does not keep a reference to buf after ResizeToBuffer returns.
+func (fp *FPObject) ResizeToBuffer(buf []uint8, stride int, format int) error {
+	if fp.dstCanvasW < 1 || fp.dstCanvasH < 1 {
+		return errors.New("Target bounds not set")
+	}
+
+	bpp, prepare := fp.bufferFormat(format)
+	if prepare == nil {
+		return errors.New("Invalid pixel format")
+	}
+	if stride < fp.dstCanvasW*bpp {
+		return fmt.Errorf("Stride too small: %d bytes, need %d", stride, fp.dstCanvasW*bpp)
+	}
+	if len(buf) < stride*(fp.dstCanvasH-1)+fp.dstCanvasW*bpp {
+		return fmt.Errorf("Buffer too small: %d bytes, need %d", len(buf),
+			stride*(fp.dstCanvasH-1)+fp.dstCanvasW*bpp)
+	}
+
+	return fp.resizeToBufferWith(buf, stride, func() (image.Image, error) {
+		if format == PixelFormatGray || format == PixelFormatGray16 {
+			return fp.resizeToGrayFormat(prepare)
+		}
+		return fp.resizeToFormat(prepare)
+	})
+}
+
+// Call resize, with the target image's samples written to buf instead of to
+// a new slice (see newDstPix).
+func (fp *FPObject) resizeToBufferWith(buf []uint8, stride int, resize func() (image.Image, error)) error {
+	fp.dstBuffer = buf
+	fp.dstBufferStride = stride
+	defer func() {
+		fp.dstBuffer = nil
+		fp.dstBufferStride = 0
+	}()
+
+	_, err := resize()
+	return err
+}
+
+// ResizeInto resizes the image, and writes it into dst, which is an image
+// that the caller has allocated, instead of returning a new image. This can
+// avoid allocating memory for each image, for example when resizing the
+// frames of a video, or when a server keeps a pool of target images. dst
+// must be an *image.RGBA, *image.NRGBA, *image.RGBA64, *image.NRGBA64,
+// *image.Gray, *image.Gray16, or *image.CMYK, and its bounds must contain
+// the target bounds. Only the pixels within the target bounds are written.
+//
+// The target image is converted to dst's type. For *image.Gray and
+// *image.Gray16, the luminance is used, as with ResizeToGray.
+func (fp *FPObject) ResizeInto(dst draw.Image) error {
+	var pix []uint8
+	var stride, offs, format int
+
+	if fp.dstCanvasW < 1 || fp.dstCanvasH < 1 {
+		return errors.New("Target bounds not set")
+	}
+	b := fp.dstBounds
+	if !b.In(dst.Bounds()) {
+		return fmt.Errorf("Target image bounds %v do not contain the target bounds %v", dst.Bounds(), b)
+	}
+
+	switch d := dst.(type) {
+	case *image.RGBA:
+		pix, stride, offs, format = d.Pix, d.Stride, d.PixOffset(b.Min.X, b.Min.Y), PixelFormatRGBA
+	case *image.NRGBA:
+		pix, stride, offs, format = d.Pix, d.Stride, d.PixOffset(b.Min.X, b.Min.Y), PixelFormatNRGBA
+	case *image.RGBA64:
+		pix, stride, offs, format = d.Pix, d.Stride, d.PixOffset(b.Min.X, b.Min.Y), PixelFormatRGBA64
+	case *image.NRGBA64:
+		pix, stride, offs, format = d.Pix, d.Stride, d.PixOffset(b.Min.X, b.Min.Y), PixelFormatNRGBA64
+	case *image.Gray:
+		pix, stride, offs, format = d.Pix, d.Stride, d.PixOffset(b.Min.X, b.Min.Y), PixelFormatGray
+	case *image.Gray16:
+		pix, stride, offs, format = d.Pix, d.Stride, d.PixOffset(b.Min.X, b.Min.Y), PixelFormatGray16
+	case *image.CMYK:
+		pix, stride, offs, format = d.Pix, d.Stride, d.PixOffset(b.Min.X, b.Min.Y), PixelFormatCMYK
+	default:
+		return fmt.Errorf("Unsupported target image type %T", dst)
+	}
+
+	return fp.ResizeToBuffer(pix[offs:], stride, format)
+}
@@ -0,0 +1,119 @@
+// ◄◄◄ fpchannels.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements reordering the channels of the target image.
+
+import "errors"
+
+// Channels, for use with SetChannelOrder.
+const (
+	ChannelRed = iota
+	ChannelGreen
+	ChannelBlue
+	ChannelAlpha
+	// Not a channel: every sample is the maximum value. As the alpha
+	// channel, this makes the image opaque, without compositing it over a
+	// background, so that fully transparent pixels become black.
+	ChannelOne
+)
+
+// SetChannelOrder selects the channel of the resized image (a Channel*
+// constant) that goes in each channel of the target image. The default is
+// SetChannelOrder(ChannelRed, ChannelGreen, ChannelBlue, ChannelAlpha). For
+// example, (ChannelBlue, ChannelGreen, ChannelRed, ChannelAlpha) swaps the
+// red and blue channels; and (ChannelGreen, ChannelGreen, ChannelGreen,
+// ChannelOne) extracts the green channel, which will be returned in an
+// image.Gray by ResizeToImage with ResizeFlagGrayOK or ResizeFlagGray.
+//
+// The channels are rearranged by the converter to the target format, as
+// each row is converted, so this doesn't need an extra pass over the image.
+// A sample moved from a color channel to the alpha channel, or the reverse,
+// has the same value in the target image that it would have had in its
+// original channel. SetChannelOrder is not used by ResizeToLinear or
+// ResizeN, or in data mode.
+func (fp *FPObject) SetChannelOrder(r, g, b, a int) {
+	fp.channelOrder = [4]int{r, g, b, a}
+	fp.channelOrderSet = fp.channelOrder != [4]int{ChannelRed, ChannelGreen, ChannelBlue, ChannelAlpha}
+}
+
+func (fp *FPObject) validateChannelOrder() error {
+	for _, c := range fp.channelOrder {
+		if c < ChannelRed || c > ChannelOne {
+			return errors.New("Invalid channel order")
+		}
+	}
+	return nil
+}
+
+// Reports whether SetChannelOrder applies to the conversion to the target
+// image.
+func (fp *FPObject) useChannelOrder() bool {
+	return fp.channelOrderSet && !fp.dataMode
+}
+
+// Reports whether the target image will be grayscale, because its color
+// channels all come from the same channel.
+func (fp *FPObject) channelOrderIsGray() bool {
+	o := fp.channelOrder
+	return fp.useChannelOrder() && o[0] == o[1] && o[1] == o[2]
+}
+
+// Adjust fp.mustProcess*, so that the channels needed by SetChannelOrder
+// are resized.
+func (fp *FPObject) addChannelOrderInfo() {
+	if !fp.useChannelOrder() {
+		return
+	}
+	for k, c := range fp.channelOrder {
+		if k < 3 && c == ChannelAlpha {
+			// The alpha channel can make a grayscale image colored.
+			fp.mustProcessColor = true
+		}
+		if k == 3 && c < ChannelAlpha {
+			// A color channel can make an opaque image transparent.
+			fp.mustProcessTransparency = true
+		}
+	}
+}
+
+// Rearranges the channels of a target row.
+type channelMapper struct {
+	order [4]int
+	ccf   *outputCCFTable
+}
+
+func (fp *FPObject) newChannelMapper() *channelMapper {
+	cm := &channelMapper{order: fp.channelOrder}
+	for k, c := range cm.order {
+		if (k < 3) != (c < 3) && c != ChannelOne {
+			// Samples are moved between the alpha and color channels, so
+			// the output color converter is needed.
+			cm.ccf = fp.newOutputCCFTable()
+			break
+		}
+	}
+	return cm
+}
+
+// Rearranges the channels of row, which has been post-processed, so that it
+// is in linear light, with unassociated alpha.
+func (cm *channelMapper) mapRow(row []float32) {
+	var in [5]float32
+	in[ChannelOne] = 1.0
+	for i := 0; i < len(row); i += 4 {
+		copy(in[:4], row[i:i+4])
+		for k, c := range cm.order {
+			v := in[c]
+			if k < 3 && c == ChannelAlpha {
+				// This will be converted to the target colorspace, so
+				// convert it from there.
+				v = cm.ccf.inverse(v)
+			} else if k == 3 && c < ChannelAlpha {
+				v = cm.ccf.forward(v)
+			}
+			row[i+k] = v
+		}
+	}
+}
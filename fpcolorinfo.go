@@ -0,0 +1,97 @@
+// ◄◄◄ fpcolorinfo.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements describing the colorspace of the resized image.
+
+import "reflect"
+
+// ColorspaceInfo describes the colorspace of an image, so that it can be
+// recorded in the image file: for example, in a PNG file's sRGB, gAMA,
+// cHRM, or cICP chunk, or as an ICC profile.
+type ColorspaceInfo struct {
+	// A descriptive name, such as "sRGB".
+	Name string
+
+	// The approximate gamma of the transfer function, as the exponent that
+	// converts a sample to linear light: 2.2 for sRGB, 1.0 for linear
+	// light. A PNG gAMA chunk stores its reciprocal. 0 if unknown.
+	Gamma float64
+
+	// The CIE 1931 xy chromaticities of the red, green, and blue primaries,
+	// and of the white point. All zero if unknown.
+	Primaries [4][2]float64
+
+	// The ITU-T H.273 color primaries and transfer characteristics code
+	// points, as used by cICP chunks and nclx color boxes (e.g. 1 and 13
+	// for sRGB). 0 if there are none.
+	CICPPrimaries uint8
+	CICPTransfer  uint8
+
+	// The ICC profile that describes the colorspace, if there is one.
+	ICCProfile []byte
+}
+
+// ColorspaceSRGB describes the sRGB colorspace, which is the default for
+// both the source and target images.
+var ColorspaceSRGB = &ColorspaceInfo{
+	Name:          "sRGB",
+	Gamma:         2.2,
+	Primaries:     [4][2]float64{{0.64, 0.33}, {0.30, 0.60}, {0.15, 0.06}, {0.3127, 0.3290}},
+	CICPPrimaries: 1,
+	CICPTransfer:  13,
+}
+
+// Linear returns a copy of c, describing the same primaries in linear
+// light, as in the images made by ResizeToLinear. Its ICC profile is
+// removed, since it no longer applies.
+func (c *ColorspaceInfo) Linear() *ColorspaceInfo {
+	lin := *c
+	lin.Name = c.Name + " (linear)"
+	lin.Gamma = 1.0
+	if c.CICPTransfer != 0 {
+		lin.CICPTransfer = 8
+	}
+	lin.ICCProfile = nil
+	return &lin
+}
+
+// SetOutputColorspace tells fpresize the colorspace that the output color
+// converter converts to, so that it can be reported by OutputColorspace.
+// It may be called before or after SetOutputColorConverter, and it is kept
+// if the converter is changed. nil means to forget it, so that
+// OutputColorspace reports what is known from the color converters.
+func (fp *FPObject) SetOutputColorspace(c *ColorspaceInfo) {
+	fp.outputColorspace = c
+}
+
+// OutputColorspace returns the colorspace of the images made by the
+// Resize* methods (except ResizeToLinear, whose images are in the linear
+// version of it; see ColorspaceInfo.Linear), or nil if it is unknown.
+//
+// It is the colorspace set by SetOutputColorspace, if any. Otherwise, if
+// the default color converters are used, it is sRGB. If neither converter
+// is used, nothing is known about the colorspace; it is the same as the
+// source image's. Nothing is known in data mode, either.
+func (fp *FPObject) OutputColorspace() *ColorspaceInfo {
+	if fp.outputColorspace != nil {
+		return fp.outputColorspace
+	}
+	if fp.dataMode {
+		return nil
+	}
+	if isDefaultCCF(fp.inputCCFSet, fp.inputCCF, SRGBToLinear) &&
+		isDefaultCCF(fp.outputCCFSet, fp.outputCCF, LinearTosRGB) {
+		return ColorspaceSRGB
+	}
+	return nil
+}
+
+// Reports whether a color converter is the default one, dflt.
+func isDefaultCCF(set bool, ccf ColorConverter, dflt ColorConverter) bool {
+	if !set {
+		return true
+	}
+	return ccf != nil && reflect.ValueOf(ccf).Pointer() == reflect.ValueOf(dflt).Pointer()
+}
@@ -0,0 +1,33 @@
+// ◄◄◄ fpcontext.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements cancellation of resizes by a context.
+
+import "context"
+
+// SetContext sets a context that can cancel resizing, for example when a
+// web server's request is canceled, or its deadline passes. If the context
+// is canceled while an image is being resized, the Resize* method (or
+// ResizeN, Analyze, a Finalize* method, etc.) stops promptly, waits for its
+// worker goroutines to exit, and returns the context's error (such as
+// context.Canceled or context.DeadlineExceeded), and no image. The context
+// is checked between the rows (or columns) that are given to the workers,
+// so the delay is about the time it takes to process one of them.
+//
+// If the source image was being converted, the converted image is not
+// saved, so the FPObject can still be used for another resize. nil (the
+// default) means resizing can't be canceled.
+func (fp *FPObject) SetContext(ctx context.Context) {
+	fp.ctx = ctx
+}
+
+// Returns the context's error, if the context set by SetContext has been
+// canceled, or nil.
+func (fp *FPObject) ctxErr() error {
+	if fp.ctx == nil {
+		return nil
+	}
+	return fp.ctx.Err()
+}
@@ -13,31 +13,53 @@ import "image"
 import "image/color"
 import "errors"
 
-func (fp *FPObject) makeInputLUT_Xto32(tableSize int) []float32 {
+// Reports whether makeInputLUT_Xto32 will make (or use) a lookup table of
+// the given size.
+func (fp *FPObject) useInputLUT(tableSize int) bool {
 	if fp.inputCCF == nil {
-		return nil
+		return false
+	}
+	if (fp.inputCCFFlags & CCFFlagWholePixels) != 0 {
+		return false
+	}
+	if fp.inputLUT != nil {
+		return true
 	}
 	if (fp.inputCCFFlags & CCFFlagNoCache) != 0 {
-		return nil
+		return false
 	}
-	if (fp.inputCCFFlags & CCFFlagWholePixels) != 0 {
+	// Don't bother with a lookup table if the image is very small.
+	// It's hard to estimate what the threshold should be, but accuracy is not
+	// very important here.
+	return fp.lutPaysOff(fp.inputCCF, fp.inputCCFFlags, &fp.inputCCFCost, lutKindInput32, tableSize,
+		fp.srcW*fp.srcH, fp.workersFor(StageConvertSource))
+}
+
+func (fp *FPObject) makeInputLUT_Xto32(tableSize int) []float32 {
+	if !fp.useInputLUT(tableSize) {
 		return nil
 	}
-	if fp.srcW*fp.srcH < (tableSize/4)*fp.numWorkers {
-		// Don't bother with a lookup table if the image is very small.
-		// It's hard to estimate what the threshold should be, but accuracy is not
-		// very important here.
-		return nil
+
+	build := func() interface{} {
+		fp.progressMsgf("Creating input color correction lookup table")
+
+		tbl := make([]float32, tableSize)
+		for i := 0; i < tableSize; i++ {
+			tbl[i] = float32(i) / float32(tableSize-1)
+		}
+		fp.inputCCF(tbl)
+		return tbl
 	}
 
-	fp.progressMsgf("Creating input color correction lookup table")
+	if fp.inputLUT != nil {
+		return fp.inputLUT.getTable(lutKindInput32, tableSize, build).([]float32)
+	}
 
-	tbl := make([]float32, tableSize)
-	for i := 0; i < tableSize; i++ {
-		tbl[i] = float32(i) / float32(tableSize-1)
+	key, shareable := makeLUTCacheKey(fp.inputCCF, fp.inputCCFFlags, lutKindInput32, tableSize)
+	if shareable {
+		return getSharedLUT(key, build).([]float32)
 	}
-	fp.inputCCF(tbl)
-	return tbl
+	return build().([]float32)
 }
 
 // Data that is constant for all workers.
@@ -51,6 +73,17 @@ type convertSrcWorkContext struct {
 	src_AsYCbCr     *image.YCbCr
 	src_AsGray      *image.Gray
 	cvtRowFn        func(fp *FPObject, cctx *convertSrcWorkContext, j int)
+	// The source row that corresponds to row 0 of dst.
+	dstFirstRow int
+	// If set, the rows are read from this, and converted in-place.
+	rowReader RowReader
+}
+
+// Returns the slice of samples in wc.dst that represents pixel i of source
+// row j.
+func (wc *convertSrcWorkContext) dstPixel(j, i int) []float32 {
+	pos := (j-wc.dstFirstRow)*wc.dst.Stride + 4*i
+	return wc.dst.Pix[pos : pos+4]
 }
 
 type convertSrcWorkItem struct {
@@ -74,7 +107,7 @@ func convertSrcRow_Any(fp *FPObject, wc *convertSrcWorkContext, j int) {
 
 		// Identify the slice of samples representing this pixel in the
 		// converted image.
-		dstSam := wc.dst.Pix[j*wc.dst.Stride+4*i : j*wc.dst.Stride+4*i+4]
+		dstSam := wc.dstPixel(j, i)
 
 		// Choose from among several methods of converting the pixel to our
 		// desired format.
@@ -132,7 +165,7 @@ func convertSrcRow_Gray(fp *FPObject, wc *convertSrcWorkContext, j int) {
 
 		// Identify the slice of samples representing this pixel in the
 		// converted image.
-		dstSam := wc.dst.Pix[j*wc.dst.Stride+i*4 : j*wc.dst.Stride+i*4+4]
+		dstSam := wc.dstPixel(j, i)
 
 		// Do color correction, if necessary.
 		if fp.inputCCF != nil && wc.inputLUT_8to32 != nil {
@@ -173,7 +206,7 @@ func convertSrcRow_NRGBA(fp *FPObject, wc *convertSrcWorkContext, j int) {
 
 		// Identify the slice of samples representing this pixel in the
 		// converted image.
-		dstSam := wc.dst.Pix[j*wc.dst.Stride+4*i : j*wc.dst.Stride+4*i+4]
+		dstSam := wc.dstPixel(j, i)
 
 		// Do color correction, if necessary
 		if fp.inputCCF != nil && wc.inputLUT_8to32 != nil {
@@ -223,7 +256,7 @@ func convertSrcRow_RGBA(fp *FPObject, wc *convertSrcWorkContext, j int) {
 
 		// Identify the slice of samples representing this pixel in the
 		// converted image.
-		dstSam := wc.dst.Pix[j*wc.dst.Stride+4*i : j*wc.dst.Stride+4*i+4]
+		dstSam := wc.dstPixel(j, i)
 
 		// If we are going to use a lookup table, do that now.
 		if srcSam8[3] == 255 && fp.inputCCF != nil && wc.inputLUT_8to32 != nil {
@@ -292,7 +325,7 @@ func convertSrcRow_YCbCr(fp *FPObject, wc *convertSrcWorkContext, j int) {
 
 		// Identify the slice of samples representing this pixel in the
 		// converted image.
-		dstSam := wc.dst.Pix[j*wc.dst.Stride+4*i : j*wc.dst.Stride+4*i+4]
+		dstSam := wc.dstPixel(j, i)
 
 		if fp.inputCCF != nil && wc.inputLUT_8to32 != nil {
 			// Convert to linear color, using a lookup table.
@@ -314,6 +347,83 @@ func convertSrcRow_YCbCr(fp *FPObject, wc *convertSrcWorkContext, j int) {
 	}
 }
 
+// Convert row j from fp.srcImage to wc.dst, for data mode.
+// Samples are read as unassociated alpha, and no other processing is done.
+func convertSrcRow_Data(fp *FPObject, wc *convertSrcWorkContext, j int) {
+	var srcSam16 [4]uint32
+	var k int
+
+	for i := 0; i < fp.srcW; i++ {
+		x := fp.srcBounds.Min.X + i
+		y := fp.srcBounds.Min.Y + j
+
+		switch src := wc.srcImage.(type) {
+		case *image.NRGBA:
+			p := src.Pix[src.PixOffset(x, y):]
+			for k = 0; k < 4; k++ {
+				srcSam16[k] = uint32(p[k]) * 257
+			}
+		case *image.NRGBA64:
+			p := src.Pix[src.PixOffset(x, y):]
+			for k = 0; k < 4; k++ {
+				srcSam16[k] = uint32(p[2*k])<<8 | uint32(p[2*k+1])
+			}
+		default:
+			// Other image types store associated alpha (or no alpha), so
+			// there's little reason to try to be more precise than this.
+			c := color.NRGBA64Model.Convert(src.At(x, y)).(color.NRGBA64)
+			srcSam16[0], srcSam16[1], srcSam16[2], srcSam16[3] =
+				uint32(c.R), uint32(c.G), uint32(c.B), uint32(c.A)
+		}
+
+		if srcSam16[3] < 65535 {
+			fp.srcHasTransparency = true
+		}
+
+		dstSam := wc.dstPixel(j, i)
+		for k = 0; k < 4; k++ {
+			dstSam[k] = float32(srcSam16[k]) / 65535.0
+		}
+	}
+}
+
+// Convert row j of wc.dst, in-place, from the format returned by a
+// RowReader.
+func convertSrcRow_Float(fp *FPObject, wc *convertSrcWorkContext, j int) {
+	var k int
+
+	for i := 0; i < fp.srcW; i++ {
+		dstSam := wc.dstPixel(j, i)
+
+		if dstSam[3] < 1.0 {
+			fp.srcHasTransparency = true
+		}
+		if fp.dataMode {
+			continue
+		}
+
+		if dstSam[3] <= 0.0 {
+			for k = 0; k < 4; k++ {
+				dstSam[k] = 0.0
+			}
+			continue
+		} else if dstSam[3] > 1.0 {
+			dstSam[3] = 1.0
+		}
+
+		if fp.inputCCF != nil {
+			fp.inputCCF(dstSam[0:3])
+		}
+
+		// Convert to associated alpha.
+		if dstSam[3] < 1.0 {
+			for k = 0; k < 3; k++ {
+				dstSam[k] *= dstSam[3]
+			}
+		}
+	}
+}
+
 func (fp *FPObject) convertSrcWorker(wc *convertSrcWorkContext, workQueue chan convertSrcWorkItem) {
 	for {
 		wi := <-workQueue
@@ -325,20 +435,22 @@ func (fp *FPObject) convertSrcWorker(wc *convertSrcWorkContext, workQueue chan c
 	}
 }
 
-// Copies(&converts) from fp.srcImg to the given image.
-func (fp *FPObject) convertSrc(src image.Image, dst *FPImage) error {
-	var i int
-	var j int
-	var nSamples int
-	var wi convertSrcWorkItem
+// Prepare to convert rows of the source image, by choosing a conversion
+// function and making lookup tables. This also sets fp.srcHasColor.
+func (fp *FPObject) prepareConvertSrc() *convertSrcWorkContext {
+	wc := new(convertSrcWorkContext)
 
-	if int64(fp.srcW)*int64(fp.srcH) > maxImagePixels {
-		return errors.New("Source image too large to process")
+	if fp.srcRowReader != nil {
+		wc.rowReader = fp.srcRowReader
+		wc.cvtRowFn = convertSrcRow_Float
+		fp.srcHasColor = true
+		fp.addGrayConversion(wc)
+		fp.addSourceRowHook(wc)
+		fp.addBackground(wc)
+		return wc
 	}
 
-	wc := new(convertSrcWorkContext)
-	wc.dst = dst
-	wc.srcImage = src
+	wc.srcImage = fp.srcImage
 
 	// Look at the underlying type of fp.srcImage, and prepare a conversion
 	// strategy.
@@ -370,6 +482,58 @@ func (fp *FPObject) convertSrc(src image.Image, dst *FPImage) error {
 		wc.inputLUT_16to32 = fp.makeInputLUT_Xto32(65536)
 	}
 
+	if fp.dataMode {
+		wc.cvtRowFn = convertSrcRow_Data
+	}
+	fp.addGrayConversion(wc)
+	fp.addSourceRowHook(wc)
+	fp.addBackground(wc)
+	return wc
+}
+
+// If the image is to be converted to grayscale, make wc.cvtRowFn do that
+// after converting each row.
+func (fp *FPObject) addGrayConversion(wc *convertSrcWorkContext) {
+	if !fp.forceGray || fp.dataMode || !fp.srcHasColor {
+		return
+	}
+	cvtColorRowFn := wc.cvtRowFn
+	wc.cvtRowFn = func(fp *FPObject, wc *convertSrcWorkContext, j int) {
+		cvtColorRowFn(fp, wc, j)
+		convertSrcRowToGray(fp, wc, j)
+	}
+	fp.srcHasColor = false
+}
+
+// Convert row j of wc.dst (which has already been converted from the source
+// image) to grayscale. Only the first (red) channel is set, because the
+// other color channels are ignored when the image is known to be grayscale.
+func convertSrcRowToGray(fp *FPObject, wc *convertSrcWorkContext, j int) {
+	for i := 0; i < fp.srcW; i++ {
+		sam := wc.dstPixel(j, i)
+		sam[0] = 0.2126*sam[0] + 0.7152*sam[1] + 0.0722*sam[2]
+	}
+}
+
+// Copies(&converts) from fp.srcImage or fp.srcRowReader to the given image.
+func (fp *FPObject) convertSrc(dst *FPImage) error {
+	var i int
+	var j int
+	var nSamples int
+	var wi convertSrcWorkItem
+	var err error
+
+	if int64(fp.srcW)*int64(fp.srcH) > maxImagePixels {
+		return errors.New("Source image too large to process")
+	}
+
+	if fp.srcImage == nil && fp.srcRowReader == nil {
+		return errors.New("No source image")
+	}
+
+	wc := fp.prepareConvertSrc()
+	wc.dst = dst
+
 	fp.progressMsgf("Converting to FPImage format")
 
 	// Allocate the pixel array
@@ -379,26 +543,43 @@ func (fp *FPObject) convertSrc(src image.Image, dst *FPImage) error {
 	dst.Rect.Max.Y = fp.srcH
 	dst.Stride = fp.srcW * 4
 	nSamples = dst.Stride * fp.srcH
-	dst.Pix = make([]float32, nSamples)
+	dst.Pix = fp.allocSamples(nSamples)
 
 	workQueue := make(chan convertSrcWorkItem)
+	nw := fp.workersFor(StageConvertSource)
+	pt := fp.startProgress(StageConvertSource, "Converting source image", fp.srcH)
 
-	for i = 0; i < fp.numWorkers; i++ {
+	for i = 0; i < nw; i++ {
 		go fp.convertSrcWorker(wc, workQueue)
 	}
 
 	// Each row is a "work item". Send each row to a worker.
 	for j = 0; j < fp.srcH; j++ {
+		if err = fp.ctxErr(); err != nil {
+			break
+		}
+		if wc.rowReader != nil {
+			// Rows have to be read one at a time, in order, so read them
+			// here instead of in the workers.
+			err = wc.rowReader.ReadRow(fp.srcBounds.Min.Y+j, dst.Pix[j*dst.Stride:(j+1)*dst.Stride])
+			if err != nil {
+				break
+			}
+		}
 		wi.j = j
 		workQueue <- wi
+		pt.add(1)
 	}
 
 	// Send out a "stop work" order. When all workers have received it, we know
 	// that all the work is done.
 	wi.stopNow = true
-	for i = 0; i < fp.numWorkers; i++ {
+	for i = 0; i < nw; i++ {
 		workQueue <- wi
 	}
+	if err == nil {
+		pt.finish()
+	}
 
-	return nil
+	return err
 }
@@ -9,25 +9,83 @@
 package fpresize
 
 import "image"
+import "image/color"
+import "math"
+
+// Reports whether the makeOutputLUT_* functions will make (or use) a lookup
+// table of the given kind (a lutKind* constant) and size.
+func (fp *FPObject) useOutputLUT(kind int, tableSize int) bool {
+	if fp.outputCCF == nil {
+		return false
+	}
+	if (fp.outputCCFFlags & CCFFlagWholePixels) != 0 {
+		return false
+	}
+	if fp.outputLUT != nil {
+		return true
+	}
+	if (fp.outputCCFFlags & CCFFlagNoCache) != 0 {
+		return false
+	}
+	return fp.lutPaysOff(fp.outputCCF, fp.outputCCFFlags, &fp.outputCCFCost, kind, tableSize,
+		fp.dstCanvasW*fp.dstCanvasH, fp.workersFor(StageConvertTarget))
+}
+
+// SetLinearRounding controls how samples are rounded to 8 bits, when
+// converting to the target colorspace. Normally, a sample is converted to
+// the target colorspace, and then rounded there, so occasionally the sample
+// is one shade too light. If linear rounding is enabled, it is set to the
+// 8-bit value that is nearest to it in linear light, which is
+// colorimetrically correct.
+//
+// This affects the 8-bit formats that have no alpha channel, or that use
+// unassociated alpha (such as NRGBA, Gray, and CMYK). A lookup table is
+// always used for them, which may make small images a little slower. It has
+// no effect if the output color converter uses CCFFlagWholePixels.
+// Conversion to a palette (see ResizeFlagPalettedOK) always finds the
+// nearest colors in linear light.
+func (fp *FPObject) SetLinearRounding(enable bool) {
+	fp.linearRounding = enable
+}
+
+// Reports whether linear rounding is enabled, and can be done.
+func (fp *FPObject) useLinearRounding() bool {
+	return fp.linearRounding && fp.outputCCF != nil && (fp.outputCCFFlags&CCFFlagWholePixels) == 0
+}
 
 // Make a lookup table that takes an int from 0 to tablesize-1,
 // and returns a uint8 representing a sample from 0 to 255.
 func (fp *FPObject) makeOutputLUT_Xto8(tableSize int) []uint8 {
-	var i int
-
-	if fp.inputCCF == nil {
+	linear := fp.useLinearRounding()
+	if !linear && !fp.useOutputLUT(lutKindOutput8, tableSize) {
 		return nil
 	}
-	if (fp.outputCCFFlags & CCFFlagNoCache) != 0 {
-		return nil
+
+	build := func() interface{} {
+		return fp.buildOutputLUT_Xto8(tableSize, linear)
 	}
-	if (fp.outputCCFFlags & CCFFlagWholePixels) != 0 {
-		return nil
+
+	kind := lutKindOutput8
+	if linear {
+		kind = lutKindOutput8Linear
 	}
-	if fp.dstCanvasW*fp.dstCanvasH < (tableSize/4)*fp.numWorkers {
-		return nil
+
+	if fp.outputLUT != nil {
+		return fp.outputLUT.getTable(kind, tableSize, build).([]uint8)
 	}
 
+	key, shareable := makeLUTCacheKey(fp.outputCCF, fp.outputCCFFlags, kind, tableSize)
+	if shareable {
+		return getSharedLUT(key, build).([]uint8)
+	}
+	return fp.buildOutputLUT_Xto8(tableSize, linear)
+}
+
+// If linear is set, each entry is the 8-bit value that is nearest in linear
+// light (see SetLinearRounding).
+func (fp *FPObject) buildOutputLUT_Xto8(tableSize int, linear bool) []uint8 {
+	var i int
+
 	fp.progressMsgf("Creating output color correction lookup table")
 
 	var tempTable = make([]float32, tableSize)
@@ -39,7 +97,7 @@ func (fp *FPObject) makeOutputLUT_Xto8(tableSize int) []uint8 {
 
 	tbl := make([]uint8, tableSize)
 	for i = 0; i < tableSize; i++ {
-		// This is not perfect.
+		// This is not perfect, unless linear is set.
 		// Of the 256 available target-colorspace values, what we really want
 		// is the one that is nearest in a *linear* colorspace.
 		// But here we are converting to the target colorspace, then choosing
@@ -51,35 +109,138 @@ func (fp *FPObject) makeOutputLUT_Xto8(tableSize int) []uint8 {
 		// not just those that use this code specifically.)
 		tbl[i] = uint8(tempTable[i]*255.0 + 0.5)
 	}
+
+	if linear {
+		// Move each entry to the nearest value in linear light. thresholds[c]
+		// is the linear value halfway between values c and c+1.
+		lin := fp.linearValuesOf8BitSamples()
+		var thresholds [255]float32
+		for c := range thresholds {
+			thresholds[c] = (lin[c] + lin[c+1]) / 2.0
+		}
+		for i = 0; i < tableSize; i++ {
+			v := float32(i) / float32(tableSize-1)
+			c := int(tbl[i])
+			for c < 255 && v > thresholds[c] {
+				c++
+			}
+			for c > 0 && v < thresholds[c-1] {
+				c--
+			}
+			tbl[i] = uint8(c)
+		}
+	}
 	return tbl
 }
 
+// Returns the linear value of each 8-bit target colorspace value, by
+// inverting the output color converter (which is assumed to be increasing).
+// It is done by bisection, converting all 256 values at once.
+func (fp *FPObject) linearValuesOf8BitSamples() []float32 {
+	lo := make([]float32, 256)
+	hi := make([]float32, 256)
+	mid := make([]float32, 256)
+	for c := range hi {
+		hi[c] = 1.0
+	}
+	for iter := 0; iter < 24; iter++ {
+		for c := range mid {
+			mid[c] = (lo[c] + hi[c]) / 2.0
+		}
+		conv := append([]float32(nil), mid...)
+		fp.outputCCF(conv)
+		for c := range mid {
+			if conv[c] < float32(c)/255.0 {
+				lo[c] = mid[c]
+			} else {
+				hi[c] = mid[c]
+			}
+		}
+	}
+	for c := range mid {
+		mid[c] = (lo[c] + hi[c]) / 2.0
+	}
+	mid[0], mid[255] = 0.0, 1.0
+	return mid
+}
+
 // Make a lookup table that takes an int from 0 to tablesize-1,
 // and returns a float32 representing a sample from 0.0 to 1.0.
 func (fp *FPObject) makeOutputLUT_Xto32(tableSize int) []float32 {
-	var i int
-
-	if fp.inputCCF == nil {
+	if !fp.useOutputLUT(lutKindOutput32, tableSize) {
 		return nil
 	}
-	if (fp.outputCCFFlags & CCFFlagNoCache) != 0 {
-		return nil
+
+	build := func() interface{} {
+		fp.progressMsgf("Creating output color correction lookup table")
+
+		tbl := make([]float32, tableSize)
+		for i := 0; i < tableSize; i++ {
+			tbl[i] = float32(i) / float32(tableSize-1)
+		}
+		fp.outputCCF(tbl)
+		return tbl
 	}
-	if (fp.outputCCFFlags & CCFFlagWholePixels) != 0 {
-		return nil
+
+	if fp.outputLUT != nil {
+		return fp.outputLUT.getTable(lutKindOutput32, tableSize, build).([]float32)
+	}
+
+	key, shareable := makeLUTCacheKey(fp.outputCCF, fp.outputCCFFlags, lutKindOutput32, tableSize)
+	if shareable {
+		return getSharedLUT(key, build).([]float32)
 	}
-	if fp.dstCanvasW*fp.dstCanvasH < (tableSize/4)*fp.numWorkers {
+	return build().([]float32)
+}
+
+// Make a lookup table for converting samples to 16-bit target images. A
+// table that could be used without interpolation would need close to a
+// million entries, to be accurate to 16 bits where the output color
+// converter is steepest (near 0). Instead, entry i is the converted value
+// of (i/(tableSize-1))², and values are interpolated between entries (see
+// lookupOutputLUT16). With the square root, the converted values are close
+// to linear functions of the index, even for converters (such as gamma
+// curves) whose slope is infinite at 0, so a small table is accurate enough.
+func (fp *FPObject) makeOutputLUT16(tableSize int) []float32 {
+	if !fp.useOutputLUT(lutKindOutput16, tableSize) {
 		return nil
 	}
 
-	fp.progressMsgf("Creating output color correction lookup table")
+	build := func() interface{} {
+		fp.progressMsgf("Creating 16-bit output color correction lookup table")
 
-	tbl := make([]float32, tableSize)
-	for i = 0; i < tableSize; i++ {
-		tbl[i] = float32(i) / float32(tableSize-1)
+		tbl := make([]float32, tableSize)
+		for i := 0; i < tableSize; i++ {
+			u := float64(i) / float64(tableSize-1)
+			tbl[i] = float32(u * u)
+		}
+		fp.outputCCF(tbl)
+		return tbl
 	}
-	fp.outputCCF(tbl)
-	return tbl
+
+	if fp.outputLUT != nil {
+		return fp.outputLUT.getTable(lutKindOutput16, tableSize, build).([]float32)
+	}
+
+	key, shareable := makeLUTCacheKey(fp.outputCCF, fp.outputCCFFlags, lutKindOutput16, tableSize)
+	if shareable {
+		return getSharedLUT(key, build).([]float32)
+	}
+	return build().([]float32)
+}
+
+// Converts v (from 0 to 1) to the target colorspace, using a table made by
+// makeOutputLUT16.
+func lookupOutputLUT16(tbl []float32, v float32) float32 {
+	if v <= 0.0 {
+		return tbl[0]
+	}
+	x := float32(math.Sqrt(float64(v))) * float32(len(tbl)-1)
+	i := int(x)
+	if i >= len(tbl)-1 {
+		return tbl[len(tbl)-1]
+	}
+	return tbl[i] + (x-float32(i))*(tbl[i+1]-tbl[i])
 }
 
 // Take a row fresh from resizeWidth/resizeHeight
@@ -88,13 +249,18 @@ func (fp *FPObject) makeOutputLUT_Xto32(tableSize int) []float32 {
 //  * unassociated alpha, linear colorspace, samples always valid,
 //    all samples clamped to [0,1].
 //
-// It is possible that we will convert to unassociated alpha needlessly, only
-// to convert right back to associated alpha. That will happen if color
-// correction is disabled, and the final image format uses associated alpha.
-// We may optimize for that case in a future version.
+// If color correction is disabled, and the final image format uses
+// associated alpha, converting to unassociated alpha would be wasted work.
+// The converters for such formats use postProcessRow_Assoc instead (see
+// keepsAssocAlpha).
 func (fp *FPObject) postProcessRow(im *FPImage, j int) {
 	var k int
 
+	if fp.dataMode {
+		fp.postProcessRow_Data(im, j)
+		return
+	}
+
 	for i := 0; i < (im.Rect.Max.X - im.Rect.Min.X); i++ {
 		rp := j*im.Stride + i*4 // index of the Red sample in im.Pix
 		ap := rp + 3            // index of the alpha sample
@@ -149,27 +315,192 @@ func (fp *FPObject) postProcessRow(im *FPImage, j int) {
 	}
 }
 
+// Post-process row j of wc.src, after making the SetExposure and SetLevels
+// adjustments, and then call the output row hook, if any.
+func (fp *FPObject) postProcessDstRow(wc *convertDstWorkContext, j int) {
+	if fp.hasAdjustments() {
+		fp.adjustRow(wc.src, j)
+	}
+	fp.postProcessRow(wc.src, j)
+	if fp.outputRowHook != nil {
+		fp.callRowHook(fp.outputRowHook, wc.src, j, wc.srcRowY+j)
+	}
+	if wc.channels != nil {
+		wc.channels.mapRow(wc.src.Pix[j*wc.src.Stride : j*wc.src.Stride+4*wc.src.Rect.Dx()])
+	}
+}
+
+// Reports whether the rows of wc.src can stay associated with alpha, and be
+// post-processed by postProcessRow_Assoc, for a target image with
+// associated alpha. That is possible if there is no color conversion, and
+// nothing needs the unassociated samples.
+func (fp *FPObject) keepsAssocAlpha(wc *convertDstWorkContext) bool {
+	return fp.outputCCF == nil && !fp.dataMode && fp.mustProcessTransparency &&
+		fp.outputRowHook == nil && wc.channels == nil
+}
+
+// Like postProcessDstRow, but leave the samples associated with alpha. Each
+// color sample is clamped to [0,alpha] (and rescaled, for alpha > 1), which
+// gives the same result as clamping the unassociated sample to [0,1].
+func (fp *FPObject) postProcessRow_Assoc(im *FPImage, j int) {
+	if fp.hasAdjustments() {
+		fp.adjustRow(im, j)
+	}
+	row := im.Pix[j*im.Stride : j*im.Stride+4*im.Rect.Dx()]
+	for i := 0; i < len(row); i += 4 {
+		if !fp.mustProcessColor {
+			row[i+1] = row[i]
+			row[i+2] = row[i]
+		}
+
+		a := row[i+3]
+		if a <= 0.0 {
+			// A fully transparent pixel
+			row[i], row[i+1], row[i+2], row[i+3] = 0.0, 0.0, 0.0, 0.0
+			continue
+		}
+		for k := 0; k < 3; k++ {
+			if row[i+k] < 0.0 {
+				row[i+k] = 0.0
+			} else if row[i+k] > a {
+				row[i+k] = a
+			}
+			if a > 1.0 {
+				row[i+k] /= a
+			}
+		}
+		if a > 1.0 {
+			row[i+3] = 1.0
+		}
+	}
+}
+
+// The data mode version of postProcessRow(). The alpha channel is not
+// special, except that it may not have been processed.
+func (fp *FPObject) postProcessRow_Data(im *FPImage, j int) {
+	var k int
+	var v [3]float32
+
+	dataMin, dataMax := fp.getDataRange()
+
+	for i := 0; i < (im.Rect.Max.X - im.Rect.Min.X); i++ {
+		sam := im.Pix[j*im.Stride+i*4 : j*im.Stride+i*4+4]
+
+		if !fp.mustProcessColor {
+			sam[1] = sam[0]
+			sam[2] = sam[0]
+		}
+		if !fp.mustProcessTransparency {
+			sam[3] = 1.0
+		}
+
+		if fp.renormalize {
+			// Convert to the data range, and find the vector's length.
+			var lenSq float64
+			for k = 0; k < 3; k++ {
+				v[k] = dataMin + sam[k]*(dataMax-dataMin)
+				lenSq += float64(v[k]) * float64(v[k])
+			}
+			if lenSq > 0.0 {
+				length := float32(math.Sqrt(lenSq))
+				for k = 0; k < 3; k++ {
+					sam[k] = (v[k]/length - dataMin) / (dataMax - dataMin)
+				}
+			}
+		}
+
+		// Clamp to [0,1]
+		for k = 0; k < 4; k++ {
+			if sam[k] < 0.0 {
+				sam[k] = 0.0
+			} else if sam[k] > 1.0 {
+				sam[k] = 1.0
+			}
+		}
+	}
+}
+
 // Miscellaneous contextual data that is used internally by the various
 // conversion functions.
 type convertDstWorkContext struct {
 	src *FPImage
 
+	// The row of the target image that corresponds to row 0 of src.
+	dstRowOffset int
+	// The y coordinate, in the target image's coordinate system, of row 0
+	// of src. This is for the output row hook.
+	srcRowY int
+	// Set if the channels are to be rearranged (see SetChannelOrder).
+	channels *channelMapper
+
 	cvtRowFn func(fp *FPObject, wc *convertDstWorkContext, j int)
 
+	// The target image, as it will be returned to the caller.
+	dstImage image.Image
+	// Set if the target image is src itself (converted in-place).
+	inPlace bool
+
 	dstPix    []uint8
 	dstStride int
-
-	dstRGBA    *image.RGBA
-	dstRGBA64  *image.RGBA64
-	dstNRGBA64 *image.NRGBA64
-	dstGray    *image.Gray
-	dstGray16  *image.Gray16
-	isNRGBA64  bool
+	// Options for writing to dstPix (used by the NRGBA and RGBA converters).
+	// If bottomUp is set, the rows are stored in reverse order, and
+	// dstHeight is the number of rows. If swapRB is set, the red and blue
+	// samples are swapped.
+	bottomUp  bool
+	dstHeight int
+	swapRB    bool
+
+	dstRGBA64   *image.RGBA64
+	dstNRGBA64  *image.NRGBA64
+	dstGray     *image.Gray
+	dstGray16   *image.Gray16
+	dstPaletted *image.Paletted
+	pal         *paletteMatcher
+	dstCMYK     *image.CMYK
+	isNRGBA64   bool
+	// The converter used by ResizeToConverter.
+	rowConverter RowConverter
 
 	outputLUT_Xto8_Size  int
 	outputLUT_Xto8       []uint8
 	outputLUT_Xto32_Size int
 	outputLUT_Xto32      []float32
+	outputLUT16          []float32 // See makeOutputLUT16
+}
+
+// Returns the index in wc.dstPix of the first sample of target row dj.
+func (wc *convertDstWorkContext) dstRowPos(dj int) int {
+	if wc.bottomUp {
+		dj = wc.dstHeight - 1 - dj
+	}
+	return dj * wc.dstStride
+}
+
+// Swap the red and blue samples of the first w pixels of row dj of
+// wc.dstPix, if wc.swapRB is set.
+func (wc *convertDstWorkContext) swapRowRB(dj int, w int) {
+	if !wc.swapRB {
+		return
+	}
+	row := wc.dstPix[wc.dstRowPos(dj) : wc.dstRowPos(dj)+w*4]
+	for i := 0; i < w*4; i += 4 {
+		row[i], row[i+2] = row[i+2], row[i]
+	}
+}
+
+// Allocates the samples for a target image with bounds r, having bpp bytes
+// per pixel. Returns the samples and the stride, which is padded to the row
+// alignment set by SetTargetRowAlignment. During ResizeToBuffer, the
+// caller's buffer is returned instead.
+func (fp *FPObject) newDstPix(r image.Rectangle, bpp int) ([]uint8, int) {
+	if fp.dstBuffer != nil {
+		return fp.dstBuffer, fp.dstBufferStride
+	}
+	stride := r.Dx() * bpp
+	if fp.dstRowAlignment > 1 && stride%fp.dstRowAlignment != 0 {
+		stride += fp.dstRowAlignment - stride%fp.dstRowAlignment
+	}
+	return make([]uint8, stride*r.Dy()), stride
 }
 
 type convertDstWorkItem struct {
@@ -188,31 +519,51 @@ func (fp *FPObject) convertDstWorker(wc *convertDstWorkContext, workQueue chan c
 	}
 }
 
-func (fp *FPObject) convertDstIndirect(wc *convertDstWorkContext) {
+// pt may be nil.
+func (fp *FPObject) convertDstIndirect(wc *convertDstWorkContext, pt *progressTracker) {
 	var i, j int
 	var wi convertDstWorkItem
 
 	workQueue := make(chan convertDstWorkItem)
+	nw := fp.workersFor(StageConvertTarget)
 
-	for i = 0; i < fp.numWorkers; i++ {
+	for i = 0; i < nw; i++ {
 		go fp.convertDstWorker(wc, workQueue)
 	}
 
 	// Each row is a "work item". Send each row to a worker.
 	for j = 0; j < (wc.src.Rect.Max.Y - wc.src.Rect.Min.Y); j++ {
+		if fp.ctxErr() != nil {
+			break
+		}
 		wi.j = j
 		workQueue <- wi
+		pt.add(1)
 	}
 
 	// Send out a "stop work" order.
 	wi.stopNow = true
-	for i = 0; i < fp.numWorkers; i++ {
+	for i = 0; i < nw; i++ {
 		workQueue <- wi
 	}
+	pt.finish()
 }
 
 func convertDstRow_FP(fp *FPObject, wc *convertDstWorkContext, j int) {
-	fp.postProcessRow(wc.src, j)
+	fp.postProcessDstRow(wc, j)
+
+	if fp.dataMode {
+		// Convert to the data range.
+		dataMin, dataMax := fp.getDataRange()
+		if dataMin != 0.0 || dataMax != 1.0 {
+			row := wc.src.Pix[j*wc.src.Stride : j*wc.src.Stride+4*(wc.src.Rect.Max.X-wc.src.Rect.Min.X)]
+			for k := range row {
+				row[k] = dataMin + row[k]*(dataMax-dataMin)
+			}
+		}
+		return
+	}
+
 	if fp.outputCCF == nil {
 		return
 	}
@@ -231,12 +582,36 @@ func convertDstRow_FP(fp *FPObject, wc *convertDstWorkContext, j int) {
 	}
 }
 
+// A dstPrepareFunc allocates a target image with the given bounds, and
+// returns a work context that can be used to convert resized rows to it.
+// The caller sets wc.src (and wc.dstRowOffset) before each conversion.
+type dstPrepareFunc func(r image.Rectangle) *convertDstWorkContext
+
+// Convert all of src to the format selected by prepare, and return the
+// resulting image.
+func (fp *FPObject) convertDst(prepare dstPrepareFunc, src *FPImage) image.Image {
+	fp.dstFPImage = src
+	wc := prepare(src.Bounds())
+	fp.dstFPImage = nil
+	wc.src = src
+	wc.srcRowY = src.Rect.Min.Y
+	if fp.useChannelOrder() {
+		wc.channels = fp.newChannelMapper()
+	}
+	if wc.inPlace {
+		wc.dstImage = src
+	}
+	pt := fp.startProgress(StageConvertTarget, "Converting to target format", src.Rect.Dy())
+	fp.convertDstIndirect(wc, pt)
+	return wc.dstImage
+}
+
 // The target image will still be an FPImage, but we need to do some post-
 // processing: convert to unassociated alpha, and probably convert from linear
 // color to the target colorspace. The conversion is in-place.
-func (fp *FPObject) convertDst_FP(im *FPImage) {
+func (fp *FPObject) prepareDst_FP(r image.Rectangle) *convertDstWorkContext {
 	wc := new(convertDstWorkContext)
-	wc.src = im
+	wc.inPlace = true
 
 	if fp.outputCCF == nil {
 		fp.progressMsgf("Post-processing image")
@@ -245,17 +620,27 @@ func (fp *FPObject) convertDst_FP(im *FPImage) {
 	}
 
 	wc.cvtRowFn = convertDstRow_FP
-	fp.convertDstIndirect(wc)
+	return wc
+}
+
+func (fp *FPObject) convertDst_FP(im *FPImage) {
+	fp.convertDst(fp.prepareDst_FP, im)
 }
 
 func convertDstRow_NRGBA(fp *FPObject, wc *convertDstWorkContext, j int) {
 	var k int
 
-	fp.postProcessRow(wc.src, j)
+	dj := j + wc.dstRowOffset // Row in the target image
+	if fp.dstRowIsEmpty(wc, j) {
+		wc.clearDstRow(dj, (wc.src.Rect.Max.X-wc.src.Rect.Min.X)*4)
+		return
+	}
+	fp.postProcessDstRow(wc, j)
+	rowPos := wc.dstRowPos(dj)
 
 	for i := 0; i < (wc.src.Rect.Max.X - wc.src.Rect.Min.X); i++ {
 		srcSam := wc.src.Pix[j*wc.src.Stride+i*4 : j*wc.src.Stride+i*4+4]
-		dstSam := wc.dstPix[j*wc.dstStride+i*4 : j*wc.dstStride+i*4+4]
+		dstSam := wc.dstPix[rowPos+i*4 : rowPos+i*4+4]
 
 		// Set the alpha sample
 		if !fp.mustProcessTransparency {
@@ -283,25 +668,21 @@ func convertDstRow_NRGBA(fp *FPObject, wc *convertDstWorkContext, j int) {
 			dstSam[k] = uint8(srcSam[k]*255.0 + 0.5)
 		}
 	}
+
+	wc.swapRowRB(dj, wc.src.Rect.Max.X-wc.src.Rect.Min.X)
 }
 
 // src is floating point, linear colorspace, unassociated alpha
 // dst is uint8, target colorspace, unassociated alpha
 // It's okay to modify src's pixels; it's about to be thrown away.
-func (fp *FPObject) convertDst_NRGBA_internal(src *FPImage, dstPix []uint8, dstStride int,
-	formatName string) {
+func (fp *FPObject) prepareDst_NRGBA_internal(dstPix []uint8, dstStride int,
+	formatName string) *convertDstWorkContext {
 	wc := new(convertDstWorkContext)
-	wc.src = src
 	wc.dstPix = dstPix
 	wc.dstStride = dstStride
 
-	// This table size is optimized for sRGB. The sRGB curve's slope for
-	// the darkest colors (the ones we're most concerned about) is 12.92,
-	// so our table needs to have around 256*12.92 or more entries to ensure
-	// that it includes every possible color value. A size of 9885 ≈
-	// 255*12.92*3+1 improves precision, and makes the dark colors almost always
-	// round correctly.
-	wc.outputLUT_Xto8_Size = 9885
+	// See defaultOutputLUTSize.
+	wc.outputLUT_Xto8_Size = fp.outputLUTSize8()
 	wc.outputLUT_Xto8 = fp.makeOutputLUT_Xto8(wc.outputLUT_Xto8_Size)
 
 	if fp.outputCCF == nil {
@@ -311,23 +692,49 @@ func (fp *FPObject) convertDst_NRGBA_internal(src *FPImage, dstPix []uint8, dstS
 	}
 
 	wc.cvtRowFn = convertDstRow_NRGBA
-	fp.convertDstIndirect(wc)
+	return wc
 }
 
-func (fp *FPObject) convertDst_NRGBA(src *FPImage) (dst *image.NRGBA) {
-	dst = image.NewNRGBA(src.Bounds())
-	fp.convertDst_NRGBA_internal(src, dst.Pix, dst.Stride, "NRGBA")
-	return
+func (fp *FPObject) prepareDst_NRGBA(r image.Rectangle) *convertDstWorkContext {
+	dst := &image.NRGBA{Rect: r}
+	dst.Pix, dst.Stride = fp.newDstPix(r, 4)
+	wc := fp.prepareDst_NRGBA_internal(dst.Pix, dst.Stride, "NRGBA")
+	wc.dstImage = dst
+	return wc
+}
+
+func (fp *FPObject) convertDst_NRGBA(src *FPImage) *image.NRGBA {
+	return fp.convertDst(fp.prepareDst_NRGBA, src).(*image.NRGBA)
 }
 
 func convertDstRow_RGBA(fp *FPObject, wc *convertDstWorkContext, j int) {
 	var k int
 
-	fp.postProcessRow(wc.src, j)
+	dj := j + wc.dstRowOffset // Row in the target image
+	if fp.dstRowIsEmpty(wc, j) {
+		wc.clearDstRow(dj, (wc.src.Rect.Max.X-wc.src.Rect.Min.X)*4)
+		return
+	}
+	rowPos := wc.dstRowPos(dj)
+
+	if fp.keepsAssocAlpha(wc) {
+		// The samples are already in the target format, apart from their
+		// scale.
+		fp.postProcessRow_Assoc(wc.src, j)
+		row := wc.src.Pix[j*wc.src.Stride : j*wc.src.Stride+4*(wc.src.Rect.Max.X-wc.src.Rect.Min.X)]
+		dstRow := wc.dstPix[rowPos : rowPos+len(row)]
+		for k := range row {
+			dstRow[k] = uint8(row[k]*255.0 + 0.5)
+		}
+		wc.swapRowRB(dj, wc.src.Rect.Max.X-wc.src.Rect.Min.X)
+		return
+	}
+
+	fp.postProcessDstRow(wc, j)
 
 	for i := 0; i < (wc.src.Rect.Max.X - wc.src.Rect.Min.X); i++ {
 		srcSam := wc.src.Pix[j*wc.src.Stride+i*4 : j*wc.src.Stride+i*4+4]
-		dstSam := wc.dstRGBA.Pix[j*wc.dstRGBA.Stride+i*4 : j*wc.dstRGBA.Stride+i*4+4]
+		dstSam := wc.dstPix[rowPos+i*4 : rowPos+i*4+4]
 
 		// Set the alpha sample
 		if !fp.mustProcessTransparency {
@@ -354,35 +761,65 @@ func convertDstRow_RGBA(fp *FPObject, wc *convertDstWorkContext, j int) {
 			dstSam[k] = uint8((srcSam[k]*srcSam[3])*255.0 + 0.5)
 		}
 	}
+
+	wc.swapRowRB(dj, wc.src.Rect.Max.X-wc.src.Rect.Min.X)
 }
 
-func (fp *FPObject) convertDst_RGBA(src *FPImage) *image.RGBA {
+// dst is uint8, target colorspace, associated alpha
+func (fp *FPObject) prepareDst_RGBA_internal(dstPix []uint8, dstStride int,
+	formatName string) *convertDstWorkContext {
 	if !fp.mustProcessTransparency {
-		// If the image has no transparency, use convertDst_NRGBA_internal,
+		// If the image has no transparency, use the NRGBA converter,
 		// which is usually somewhat faster.
-		dst := image.NewRGBA(src.Bounds())
-		fp.convertDst_NRGBA_internal(src, dst.Pix, dst.Stride, "RGB")
-		return dst
+		return fp.prepareDst_NRGBA_internal(dstPix, dstStride, formatName)
 	}
 
 	wc := new(convertDstWorkContext)
-	wc.src = src
-	wc.dstRGBA = image.NewRGBA(src.Bounds())
+	wc.dstPix = dstPix
+	wc.dstStride = dstStride
 
 	// Because we still need to convert to associated alpha after doing color conversion,
 	// the lookup table should return high-precision numbers -- uint8 is not enough.
-	wc.outputLUT_Xto32_Size = 9885
+	wc.outputLUT_Xto32_Size = fp.outputLUTSize8()
 	wc.outputLUT_Xto32 = fp.makeOutputLUT_Xto32(wc.outputLUT_Xto32_Size)
 
 	if fp.outputCCF == nil {
-		fp.progressMsgf("Converting to RGBA format")
+		fp.progressMsgf("Converting to %s format", formatName)
 	} else {
-		fp.progressMsgf("Converting to target colorspace, and RGBA format")
+		fp.progressMsgf("Converting to target colorspace, and %s format", formatName)
 	}
 
 	wc.cvtRowFn = convertDstRow_RGBA
-	fp.convertDstIndirect(wc)
-	return wc.dstRGBA
+	return wc
+}
+
+func (fp *FPObject) prepareDst_RGBA(r image.Rectangle) *convertDstWorkContext {
+	dst := &image.RGBA{Rect: r}
+	dst.Pix, dst.Stride = fp.newDstPix(r, 4)
+	formatName := "RGBA"
+	if !fp.mustProcessTransparency {
+		formatName = "RGB"
+	}
+	wc := fp.prepareDst_RGBA_internal(dst.Pix, dst.Stride, formatName)
+	wc.dstImage = dst
+	return wc
+}
+
+// The target image is a BGRA, which is like an image.RGBA with the red and
+// blue samples swapped, and optionally stored bottom-up.
+func (fp *FPObject) prepareDst_BGRA(r image.Rectangle, bottomUp bool) *convertDstWorkContext {
+	dst := &BGRA{Rect: r, BottomUp: bottomUp}
+	dst.Pix, dst.Stride = fp.newDstPix(r, 4)
+	wc := fp.prepareDst_RGBA_internal(dst.Pix, dst.Stride, "BGRA")
+	wc.bottomUp = bottomUp
+	wc.dstHeight = r.Dy()
+	wc.swapRB = true
+	wc.dstImage = dst
+	return wc
+}
+
+func (fp *FPObject) convertDst_RGBA(src *FPImage) *image.RGBA {
+	return fp.convertDst(fp.prepareDst_RGBA, src).(*image.RGBA)
 }
 
 func convertDstRow_RGBA64orNRGBA64(fp *FPObject, wc *convertDstWorkContext, j int) {
@@ -390,7 +827,21 @@ func convertDstRow_RGBA64orNRGBA64(fp *FPObject, wc *convertDstWorkContext, j in
 	var dstPixelData []uint8
 	var k int
 
-	fp.postProcessRow(wc.src, j)
+	dj := j + wc.dstRowOffset // Row in the target image
+
+	if !wc.isNRGBA64 && fp.keepsAssocAlpha(wc) {
+		fp.postProcessRow_Assoc(wc.src, j)
+		row := wc.src.Pix[j*wc.src.Stride : j*wc.src.Stride+4*(wc.src.Rect.Max.X-wc.src.Rect.Min.X)]
+		dstRow := wc.dstRGBA64.Pix[dj*wc.dstRGBA64.Stride : dj*wc.dstRGBA64.Stride+2*len(row)]
+		for k = range row {
+			v := uint16(row[k]*65535.0 + 0.5)
+			dstRow[k*2] = uint8(v >> 8)
+			dstRow[k*2+1] = uint8(v & 0xff)
+		}
+		return
+	}
+
+	fp.postProcessDstRow(wc, j)
 
 	for i := 0; i < (wc.src.Rect.Max.X - wc.src.Rect.Min.X); i++ {
 		srcSam := wc.src.Pix[j*wc.src.Stride+i*4 : j*wc.src.Stride+i*4+4]
@@ -404,7 +855,13 @@ func convertDstRow_RGBA64orNRGBA64(fp *FPObject, wc *convertDstWorkContext, j in
 
 		// Do colorspace conversion if needed.
 		if fp.outputCCF != nil && dstSam[3] > 0 {
-			fp.outputCCF(srcSam[0:3])
+			if wc.outputLUT16 != nil {
+				for k = 0; k < 3; k++ {
+					srcSam[k] = lookupOutputLUT16(wc.outputLUT16, srcSam[k])
+				}
+			} else {
+				fp.outputCCF(srcSam[0:3])
+			}
 		}
 
 		if wc.isNRGBA64 {
@@ -413,12 +870,12 @@ func convertDstRow_RGBA64orNRGBA64(fp *FPObject, wc *convertDstWorkContext, j in
 				dstSam[k] = uint16(srcSam[k]*65535.0 + 0.5)
 			}
 			// Locate this pixel in the target image.
-			dstPixelData = wc.dstNRGBA64.Pix[j*wc.dstNRGBA64.Stride+i*8 : j*wc.dstNRGBA64.Stride+i*8+8]
+			dstPixelData = wc.dstNRGBA64.Pix[dj*wc.dstNRGBA64.Stride+i*8 : dj*wc.dstNRGBA64.Stride+i*8+8]
 		} else { // RGBA64 format
 			for k = 0; k < 3; k++ {
 				dstSam[k] = uint16((srcSam[k]*srcSam[3])*65535.0 + 0.5)
 			}
-			dstPixelData = wc.dstRGBA64.Pix[j*wc.dstRGBA64.Stride+i*8 : j*wc.dstRGBA64.Stride+i*8+8]
+			dstPixelData = wc.dstRGBA64.Pix[dj*wc.dstRGBA64.Stride+i*8 : dj*wc.dstRGBA64.Stride+i*8+8]
 		}
 
 		// Convert all samples to final RGBA/NRGBA format (big endian uint16)
@@ -429,11 +886,13 @@ func convertDstRow_RGBA64orNRGBA64(fp *FPObject, wc *convertDstWorkContext, j in
 	}
 }
 
-func (fp *FPObject) convertDst_NRGBA64(src *FPImage) *image.NRGBA64 {
+func (fp *FPObject) prepareDst_NRGBA64(r image.Rectangle) *convertDstWorkContext {
 	wc := new(convertDstWorkContext)
-	wc.src = src
 	wc.isNRGBA64 = true
-	wc.dstNRGBA64 = image.NewNRGBA64(src.Bounds())
+	wc.dstNRGBA64 = &image.NRGBA64{Rect: r}
+	wc.dstNRGBA64.Pix, wc.dstNRGBA64.Stride = fp.newDstPix(r, 8)
+	wc.dstImage = wc.dstNRGBA64
+	wc.outputLUT16 = fp.makeOutputLUT16(fp.outputLUTSize16())
 
 	if fp.outputCCF == nil {
 		fp.progressMsgf("Converting to NRGBA64 format")
@@ -442,15 +901,20 @@ func (fp *FPObject) convertDst_NRGBA64(src *FPImage) *image.NRGBA64 {
 	}
 
 	wc.cvtRowFn = convertDstRow_RGBA64orNRGBA64
-	fp.convertDstIndirect(wc)
-	return wc.dstNRGBA64
+	return wc
 }
 
-func (fp *FPObject) convertDst_RGBA64(src *FPImage) *image.RGBA64 {
+func (fp *FPObject) convertDst_NRGBA64(src *FPImage) *image.NRGBA64 {
+	return fp.convertDst(fp.prepareDst_NRGBA64, src).(*image.NRGBA64)
+}
+
+func (fp *FPObject) prepareDst_RGBA64(r image.Rectangle) *convertDstWorkContext {
 	wc := new(convertDstWorkContext)
-	wc.src = src
 	wc.isNRGBA64 = false
-	wc.dstRGBA64 = image.NewRGBA64(src.Bounds())
+	wc.dstRGBA64 = &image.RGBA64{Rect: r}
+	wc.dstRGBA64.Pix, wc.dstRGBA64.Stride = fp.newDstPix(r, 8)
+	wc.dstImage = wc.dstRGBA64
+	wc.outputLUT16 = fp.makeOutputLUT16(fp.outputLUTSize16())
 
 	if fp.outputCCF == nil {
 		fp.progressMsgf("Converting to RGBA64 format")
@@ -459,12 +923,20 @@ func (fp *FPObject) convertDst_RGBA64(src *FPImage) *image.RGBA64 {
 	}
 
 	wc.cvtRowFn = convertDstRow_RGBA64orNRGBA64
-	fp.convertDstIndirect(wc)
-	return wc.dstRGBA64
+	return wc
+}
+
+func (fp *FPObject) convertDst_RGBA64(src *FPImage) *image.RGBA64 {
+	return fp.convertDst(fp.prepareDst_RGBA64, src).(*image.RGBA64)
 }
 
 func convertDstRow_Gray(fp *FPObject, wc *convertDstWorkContext, j int) {
 	var tmpPix [3]float32
+	dj := j + wc.dstRowOffset // Row in the target image
+
+	if fp.outputRowHook != nil || fp.hasAdjustments() || wc.channels != nil {
+		fp.postProcessDstRow(wc, j)
+	}
 
 	for i := 0; i < (wc.src.Rect.Max.X - wc.src.Rect.Min.X); i++ {
 		srcVal := wc.src.Pix[j*wc.src.Stride+i*4]
@@ -476,7 +948,7 @@ func convertDstRow_Gray(fp *FPObject, wc *convertDstWorkContext, j int) {
 			srcVal = 1.0
 		}
 
-		dstSamPos := j*wc.dstGray.Stride + i // Index into wc.dstGray.Pix
+		dstSamPos := dj*wc.dstGray.Stride + i // Index into wc.dstGray.Pix
 
 		// Do colorspace conversion if needed.
 		if fp.outputCCF != nil {
@@ -501,12 +973,13 @@ func convertDstRow_Gray(fp *FPObject, wc *convertDstWorkContext, j int) {
 	}
 }
 
-func (fp *FPObject) convertDst_Gray(src *FPImage) *image.Gray {
+func (fp *FPObject) prepareDst_Gray(r image.Rectangle) *convertDstWorkContext {
 	wc := new(convertDstWorkContext)
-	wc.src = src
-	wc.dstGray = image.NewGray(src.Bounds())
+	wc.dstGray = &image.Gray{Rect: r}
+	wc.dstGray.Pix, wc.dstGray.Stride = fp.newDstPix(r, 1)
+	wc.dstImage = wc.dstGray
 
-	wc.outputLUT_Xto8_Size = 9885
+	wc.outputLUT_Xto8_Size = fp.outputLUTSize8()
 	wc.outputLUT_Xto8 = fp.makeOutputLUT_Xto8(wc.outputLUT_Xto8_Size)
 
 	if fp.outputCCF == nil {
@@ -516,20 +989,26 @@ func (fp *FPObject) convertDst_Gray(src *FPImage) *image.Gray {
 	}
 
 	wc.cvtRowFn = convertDstRow_Gray
-	fp.convertDstIndirect(wc)
-	return wc.dstGray
+	return wc
+}
+
+func (fp *FPObject) convertDst_Gray(src *FPImage) *image.Gray {
+	return fp.convertDst(fp.prepareDst_Gray, src).(*image.Gray)
 }
 
 func convertDstRow_Gray16(fp *FPObject, wc *convertDstWorkContext, j int) {
 	var tmpPix [3]float32
 
-	fp.postProcessRow(wc.src, j)
+	fp.postProcessDstRow(wc, j)
+	dj := j + wc.dstRowOffset // Row in the target image
 
 	for i := 0; i < (wc.src.Rect.Max.X - wc.src.Rect.Min.X); i++ {
 		srcVal := wc.src.Pix[j*wc.src.Stride+i*4]
 
 		// Do colorspace conversion if needed.
-		if fp.outputCCF != nil {
+		if wc.outputLUT16 != nil {
+			srcVal = lookupOutputLUT16(wc.outputLUT16, srcVal)
+		} else if fp.outputCCF != nil {
 			tmpPix[0] = srcVal
 			if (fp.outputCCFFlags & CCFFlagWholePixels) != 0 {
 				tmpPix[1] = srcVal
@@ -542,15 +1021,17 @@ func convertDstRow_Gray16(fp *FPObject, wc *convertDstWorkContext, j int) {
 		}
 
 		dstVal16 := uint16(srcVal*65535.0 + 0.5)
-		wc.dstGray16.Pix[j*wc.dstGray16.Stride+i*2] = uint8(dstVal16 >> 8)
-		wc.dstGray16.Pix[j*wc.dstGray16.Stride+i*2+1] = uint8(dstVal16 & 0xff)
+		wc.dstGray16.Pix[dj*wc.dstGray16.Stride+i*2] = uint8(dstVal16 >> 8)
+		wc.dstGray16.Pix[dj*wc.dstGray16.Stride+i*2+1] = uint8(dstVal16 & 0xff)
 	}
 }
 
-func (fp *FPObject) convertDst_Gray16(src *FPImage) *image.Gray16 {
+func (fp *FPObject) prepareDst_Gray16(r image.Rectangle) *convertDstWorkContext {
 	wc := new(convertDstWorkContext)
-	wc.src = src
-	wc.dstGray16 = image.NewGray16(src.Bounds())
+	wc.dstGray16 = &image.Gray16{Rect: r}
+	wc.dstGray16.Pix, wc.dstGray16.Stride = fp.newDstPix(r, 2)
+	wc.dstImage = wc.dstGray16
+	wc.outputLUT16 = fp.makeOutputLUT16(fp.outputLUTSize16())
 
 	if fp.outputCCF == nil {
 		fp.progressMsgf("Converting to Gray16 format")
@@ -559,6 +1040,92 @@ func (fp *FPObject) convertDst_Gray16(src *FPImage) *image.Gray16 {
 	}
 
 	wc.cvtRowFn = convertDstRow_Gray16
-	fp.convertDstIndirect(wc)
-	return wc.dstGray16
+	return wc
+}
+
+func (fp *FPObject) convertDst_Gray16(src *FPImage) *image.Gray16 {
+	return fp.convertDst(fp.prepareDst_Gray16, src).(*image.Gray16)
+}
+
+// Convert a row to the palette, using wc.pal. The palette colors are
+// matched in linear light, so no color conversion is needed.
+func convertDstRow_Paletted(fp *FPObject, wc *convertDstWorkContext, j int) {
+	fp.postProcessDstRow(wc, j)
+	dj := j + wc.dstRowOffset // Row in the target image
+	w := wc.src.Rect.Max.X - wc.src.Rect.Min.X
+
+	wc.pal.convertRow(wc.src.Pix[j*wc.src.Stride:j*wc.src.Stride+w*4],
+		wc.dstPaletted.Pix[dj*wc.dstPaletted.Stride:dj*wc.dstPaletted.Stride+w],
+		wc.dstPaletted.Rect.Min.X, wc.dstPaletted.Rect.Min.Y+dj)
+}
+
+func (fp *FPObject) prepareDst_Paletted(r image.Rectangle, p color.Palette) *convertDstWorkContext {
+	wc := new(convertDstWorkContext)
+	wc.dstPaletted = &image.Paletted{Rect: r, Palette: p}
+	wc.dstPaletted.Pix, wc.dstPaletted.Stride = fp.newDstPix(r, 1)
+	wc.dstImage = wc.dstPaletted
+	wc.pal = fp.newPaletteMatcher(p)
+	fp.progressMsgf("Converting to Paletted format")
+	wc.cvtRowFn = convertDstRow_Paletted
+	return wc
+}
+
+// CMYK has no alpha channel, so transparent pixels are composited over white
+// (the color of the paper). The conversion to CMYK is the same naive one used
+// by color.RGBToCMYK, done after conversion to the target RGB colorspace.
+func convertDstRow_CMYK(fp *FPObject, wc *convertDstWorkContext, j int) {
+	var k int
+	var rgb [3]uint8
+
+	fp.postProcessDstRow(wc, j)
+	dj := j + wc.dstRowOffset // Row in the target image
+
+	for i := 0; i < (wc.src.Rect.Max.X - wc.src.Rect.Min.X); i++ {
+		srcSam := wc.src.Pix[j*wc.src.Stride+i*4 : j*wc.src.Stride+i*4+4]
+
+		if fp.mustProcessTransparency && srcSam[3] < 1.0 {
+			for k = 0; k < 3; k++ {
+				srcSam[k] = srcSam[k]*srcSam[3] + (1.0 - srcSam[3])
+			}
+		}
+
+		if fp.outputCCF != nil && wc.outputLUT_Xto8 != nil {
+			for k = 0; k < 3; k++ {
+				rgb[k] = wc.outputLUT_Xto8[int(srcSam[k]*float32(wc.outputLUT_Xto8_Size-1)+0.5)]
+			}
+		} else {
+			if fp.outputCCF != nil {
+				fp.outputCCF(srcSam[0:3])
+			}
+			for k = 0; k < 3; k++ {
+				rgb[k] = uint8(srcSam[k]*255.0 + 0.5)
+			}
+		}
+
+		c, m, y, kk := color.RGBToCMYK(rgb[0], rgb[1], rgb[2])
+		dstSam := wc.dstCMYK.Pix[dj*wc.dstCMYK.Stride+i*4 : dj*wc.dstCMYK.Stride+i*4+4]
+		dstSam[0] = c
+		dstSam[1] = m
+		dstSam[2] = y
+		dstSam[3] = kk
+	}
+}
+
+func (fp *FPObject) prepareDst_CMYK(r image.Rectangle) *convertDstWorkContext {
+	wc := new(convertDstWorkContext)
+	wc.dstCMYK = &image.CMYK{Rect: r}
+	wc.dstCMYK.Pix, wc.dstCMYK.Stride = fp.newDstPix(r, 4)
+	wc.dstImage = wc.dstCMYK
+
+	wc.outputLUT_Xto8_Size = fp.outputLUTSize8()
+	wc.outputLUT_Xto8 = fp.makeOutputLUT_Xto8(wc.outputLUT_Xto8_Size)
+
+	if fp.outputCCF == nil {
+		fp.progressMsgf("Converting to CMYK format")
+	} else {
+		fp.progressMsgf("Converting to target colorspace, and CMYK format")
+	}
+
+	wc.cvtRowFn = convertDstRow_CMYK
+	return wc
 }
@@ -0,0 +1,72 @@
+// ◄◄◄ fpconverter.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements custom target formats.
+
+import "image"
+
+// A RowConverter converts the rows of the resized image to a custom format,
+// such as RGB565, or a device's frame buffer. It is used by
+// ResizeToConverter.
+type RowConverter interface {
+	// Start is called once, before any rows are converted, with the bounds
+	// of the target image. It is called after the source image has been
+	// analyzed, so it can use HasColor and HasTransparency to choose a
+	// format. If it returns an error, no rows are converted, and
+	// ResizeToConverter returns the error.
+	Start(r image.Rectangle) error
+
+	// ConvertRow converts one row of the resized image. y is the row's y
+	// coordinate, in the target image's coordinate system. samples contains
+	// four samples for each pixel in the row -- red, green, blue, alpha --
+	// the same as in the image returned by Resize: they are in the target
+	// colorspace, from 0.0 to 1.0 (or in the data range, in data mode), and
+	// the alpha sample is not associated. For a grayscale image, the three
+	// color samples are the same.
+	//
+	// ConvertRow is called from multiple goroutines at once, for different
+	// rows, and the rows are not converted in any particular order. samples
+	// may be modified, but must not be used after ConvertRow returns.
+	ConvertRow(y int, samples []float32)
+}
+
+// ResizeToConverter resizes the image, and passes its rows to rc, which
+// converts them to a custom format. The rows are converted in parallel, as
+// they are by the other Resize* methods, and in pipelined mode each band
+// is converted as soon as it has been made.
+//
+// The SetExposure and SetLevels adjustments, the output row hook, and the
+// channel order (see SetChannelOrder) are applied before rc sees the rows.
+func (fp *FPObject) ResizeToConverter(rc RowConverter) error {
+	var startErr error
+	prepare := func(r image.Rectangle) *convertDstWorkContext {
+		wc := new(convertDstWorkContext)
+		startErr = rc.Start(r)
+		if startErr != nil {
+			wc.cvtRowFn = func(fp *FPObject, wc *convertDstWorkContext, j int) {}
+			return wc
+		}
+		if fp.outputCCF == nil {
+			fp.progressMsgf("Converting to custom format")
+		} else {
+			fp.progressMsgf("Converting to target colorspace, and custom format")
+		}
+		wc.rowConverter = rc
+		wc.cvtRowFn = convertDstRow_Converter
+		return wc
+	}
+
+	_, err := fp.resizeToFormat(prepare)
+	if err != nil {
+		return err
+	}
+	return startErr
+}
+
+func convertDstRow_Converter(fp *FPObject, wc *convertDstWorkContext, j int) {
+	convertDstRow_FP(fp, wc, j)
+	row := wc.src.Pix[j*wc.src.Stride : j*wc.src.Stride+4*wc.src.Rect.Dx()]
+	wc.rowConverter.ConvertRow(wc.srcRowY+j, row)
+}
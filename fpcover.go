@@ -0,0 +1,315 @@
+// ◄◄◄ fpcover.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements resizing an image to cover a target size, cropping
+// whatever doesn't fit.
+
+import "errors"
+import "fmt"
+import "image"
+import "image/color"
+import "math"
+import "strings"
+
+// Gravity settings, for use with SetGravity.
+const (
+	// Keep the center of the image. This is the default.
+	GravityCenter = iota
+	GravityNorth
+	GravityNorthEast
+	GravityEast
+	GravitySouthEast
+	GravitySouth
+	GravitySouthWest
+	GravityWest
+	GravityNorthWest
+	// Keep the part of the image that is most likely to be interesting:
+	// the regions found by the RegionProvider, if one is set, or else the
+	// areas with the most detail and the most saturated colors.
+	GravityAuto
+)
+
+// The relative position of each gravity anchor in the image, in the order
+// of the Gravity* constants. GravityAuto uses the center, when it can't
+// decide.
+var gravityAnchors = [...][2]float64{
+	{0.5, 0.5}, {0.5, 0.0}, {1.0, 0.0}, {1.0, 0.5}, {1.0, 1.0},
+	{0.5, 1.0}, {0.0, 1.0}, {0.0, 0.5}, {0.0, 0.0}, {0.5, 0.5},
+}
+
+var gravityNames = map[string]int{
+	"center": GravityCenter, "c": GravityCenter,
+	"north": GravityNorth, "n": GravityNorth,
+	"northeast": GravityNorthEast, "ne": GravityNorthEast,
+	"east": GravityEast, "e": GravityEast,
+	"southeast": GravitySouthEast, "se": GravitySouthEast,
+	"south": GravitySouth, "s": GravitySouth,
+	"southwest": GravitySouthWest, "sw": GravitySouthWest,
+	"west": GravityWest, "w": GravityWest,
+	"northwest": GravityNorthWest, "nw": GravityNorthWest,
+	"auto": GravityAuto, "attention": GravityAuto,
+}
+
+// GravityByName returns the Gravity* constant with the given name: "center",
+// a compass direction ("north" or "n", "southeast" or "se", etc.), or
+// "auto" (or "attention"). Names are not case-sensitive.
+func GravityByName(name string) (int, error) {
+	g, ok := gravityNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("Unrecognized gravity %+q", name)
+	}
+	return g, nil
+}
+
+// A Region is a part of the source image that should be kept, if possible,
+// when the image is cropped (see SetTargetCover). Rect is in the source
+// image's coordinate system. Weight is its importance, relative to the
+// other regions; regions with a weight of 0 or less are ignored.
+type Region struct {
+	Rect   image.Rectangle
+	Weight float64
+}
+
+// A RegionProvider finds the regions of interest of an image, for example
+// by face detection or a saliency model.
+type RegionProvider interface {
+	Regions(src image.Image) ([]Region, error)
+}
+
+// RegionProviderFunc adapts an ordinary function to the RegionProvider
+// interface.
+type RegionProviderFunc func(src image.Image) ([]Region, error)
+
+func (f RegionProviderFunc) Regions(src image.Image) ([]Region, error) {
+	return f(src)
+}
+
+// SetRegionProvider sets the RegionProvider that SetTargetCover uses to
+// choose which part of the image to keep. nil (the default) means none. It
+// must be called before SetTargetCover.
+func (fp *FPObject) SetRegionProvider(p RegionProvider) {
+	fp.regionProvider = p
+}
+
+// SetFocalPoint sets the point that SetTargetCover keeps in view, in
+// coordinates relative to the source image: (0,0) is its upper-left corner,
+// and (1,1) its lower-right corner. The crop window is placed so that the
+// point is at the same relative position in the target image as in the
+// source image; for example, a point 1/3 of the way across the source image
+// is 1/3 of the way across the target image. It must be called before
+// SetTargetCover, and it takes precedence over any RegionProvider.
+func (fp *FPObject) SetFocalPoint(x, y float64) {
+	fp.focalX = math.Max(0.0, math.Min(x, 1.0))
+	fp.focalY = math.Max(0.0, math.Min(y, 1.0))
+	fp.focalSet = true
+}
+
+// SetGravity sets the part of the image that SetTargetCover keeps (a
+// Gravity* constant). With one of the compass directions, the crop window
+// is placed against that edge or corner of the image. It must be called
+// before SetTargetCover. It replaces any focal point set by SetFocalPoint.
+//
+// If a RegionProvider is set, its regions take precedence, and the gravity
+// is only used to choose among equally good positions.
+func (fp *FPObject) SetGravity(g int) {
+	fp.gravity = g
+	fp.focalSet = false
+}
+
+// The attention detector divides the source image into at most this many
+// cells in each dimension.
+const attentionCells = 32
+
+// The attention detector looks at at most this many pixels in each
+// dimension.
+const attentionSamples = 256
+
+// The built-in region finder, for GravityAuto. It returns a region for each
+// cell of a grid covering the image, weighted by the amount of detail (the
+// luminance gradient) and color saturation in it. Transparent areas count
+// for nothing.
+func attentionRegions(src image.Image) []Region {
+	b := src.Bounds()
+	stepX := (b.Dx() + attentionSamples - 1) / attentionSamples
+	stepY := (b.Dy() + attentionSamples - 1) / attentionSamples
+	nx := (b.Dx() + stepX - 1) / stepX
+	ny := (b.Dy() + stepY - 1) / stepY
+
+	// The luminance, and the saturation times alpha, of each sampled pixel
+	lum := make([]float64, nx*ny)
+	sat := make([]float64, nx*ny)
+	for j := 0; j < ny; j++ {
+		for i := 0; i < nx; i++ {
+			c := color.NRGBA64Model.Convert(src.At(b.Min.X+i*stepX, b.Min.Y+j*stepY)).(color.NRGBA64)
+			r, g, bl := float64(c.R)/65535.0, float64(c.G)/65535.0, float64(c.B)/65535.0
+			a := float64(c.A) / 65535.0
+			lum[j*nx+i] = (0.299*r + 0.587*g + 0.114*bl) * a
+			sat[j*nx+i] = (math.Max(r, math.Max(g, bl)) - math.Min(r, math.Min(g, bl))) * a
+		}
+	}
+
+	cellsX, cellsY := attentionCells, attentionCells
+	if cellsX > nx {
+		cellsX = nx
+	}
+	if cellsY > ny {
+		cellsY = ny
+	}
+	energy := make([]float64, cellsX*cellsY)
+	for j := 0; j < ny; j++ {
+		for i := 0; i < nx; i++ {
+			e := sat[j*nx+i]
+			if i+1 < nx {
+				e += math.Abs(lum[j*nx+i+1] - lum[j*nx+i])
+			}
+			if j+1 < ny {
+				e += math.Abs(lum[(j+1)*nx+i] - lum[j*nx+i])
+			}
+			energy[(j*cellsY/ny)*cellsX+i*cellsX/nx] += e
+		}
+	}
+
+	var regions []Region
+	for cy := 0; cy < cellsY; cy++ {
+		for cx := 0; cx < cellsX; cx++ {
+			if energy[cy*cellsX+cx] <= 0.0 {
+				continue
+			}
+			// The pixels of the samples in this cell
+			x0 := (cx*nx + cellsX - 1) / cellsX * stepX
+			x1 := ((cx+1)*nx + cellsX - 1) / cellsX * stepX
+			y0 := (cy*ny + cellsY - 1) / cellsY * stepY
+			y1 := ((cy+1)*ny + cellsY - 1) / cellsY * stepY
+			regions = append(regions, Region{Rect: image.Rect(x0, y0, x1, y1).Add(b.Min),
+				Weight: energy[cy*cellsX+cx]})
+		}
+	}
+	return regions
+}
+
+// A region, projected onto the dimension that is being cropped.
+type regionSpan struct {
+	min, max float64
+	weight   float64
+}
+
+// How much of the regions a crop window starting at t, of length winLen,
+// contains. Each region counts for its weight times the fraction of it that
+// is in the window.
+func cropScore(spans []regionSpan, t, winLen float64) float64 {
+	var score float64
+	for _, s := range spans {
+		overlap := math.Min(s.max, t+winLen) - math.Max(s.min, t)
+		if overlap > 0.0 {
+			score += s.weight * overlap / (s.max - s.min)
+		}
+	}
+	return score
+}
+
+// Chooses where a crop window of length winLen starts, in a dimension of
+// length srcLen, so as to contain as much of the regions as possible. Of the
+// best positions, the one nearest to dflt is used.
+func chooseCropOffset(spans []regionSpan, srcLen, winLen, dflt float64) float64 {
+	maxT := srcLen - winLen
+	if len(spans) == 0 || maxT <= 0.0 {
+		return math.Max(0.0, math.Min(dflt, maxT))
+	}
+
+	// The score is piecewise linear in t, so the best positions include one
+	// where an edge of the window meets an edge of a region, or the window
+	// is at an edge of the image.
+	candidates := []float64{0.0, maxT, dflt}
+	for _, s := range spans {
+		candidates = append(candidates, s.min, s.max, s.min-winLen, s.max-winLen)
+	}
+	best, bestScore := 0.0, -1.0
+	for _, t := range candidates {
+		t = math.Max(0.0, math.Min(t, maxT))
+		score := cropScore(spans, t, winLen)
+		const epsilon = 1.0e-9
+		if score > bestScore+epsilon ||
+			(score > bestScore-epsilon && math.Abs(t-dflt) < math.Abs(best-dflt)) {
+			best, bestScore = t, score
+		}
+	}
+	return best
+}
+
+// SetTargetCover sets the target bounds to a w×h image (with an origin of
+// (0,0)), and maps the source image onto it so as to fill it, preserving
+// the aspect ratio. The part of the source image that doesn't fit is
+// cropped off. The source image must be set first.
+//
+// The crop window is placed according to the focal point, if one has been
+// set by SetFocalPoint. Otherwise, if a RegionProvider has been set (or the
+// gravity is GravityAuto), it is placed so as to contain as much as
+// possible of the regions of interest. Otherwise, it is placed according to
+// the gravity (see SetGravity), which by default keeps the center of the
+// image. The regions are only used if the source is an image.Image.
+//
+// The VirtualPixels setting should usually be something other than
+// VirtualPixelsTransparent (the default for this kind of mapping), so that
+// the edges of the target image don't fade out.
+func (fp *FPObject) SetTargetCover(w, h int) error {
+	if w < 1 || h < 1 {
+		return errors.New("Invalid target size")
+	}
+	if fp.srcW < 1 || fp.srcH < 1 {
+		return errors.New("Source image not set")
+	}
+	if fp.gravity < 0 || fp.gravity >= len(gravityAnchors) {
+		return errors.New("Invalid gravity setting")
+	}
+
+	var regions []Region
+	if fp.srcImage != nil && !fp.focalSet {
+		if fp.regionProvider != nil {
+			var err error
+			regions, err = fp.regionProvider.Regions(fp.srcImage)
+			if err != nil {
+				return err
+			}
+		} else if fp.gravity == GravityAuto {
+			regions = attentionRegions(fp.srcImage)
+		}
+	}
+
+	srcW, srcH := float64(fp.srcW), float64(fp.srcH)
+	// The scale factor, and the size of the crop window, in source pixels.
+	scale := math.Max(float64(w)/srcW, float64(h)/srcH)
+	winW, winH := float64(w)/scale, float64(h)/scale
+
+	// Only one dimension is cropped (except for rounding error).
+	cropX := srcW-winW > srcH-winH
+	var spans []regionSpan
+	for _, r := range regions {
+		rect := r.Rect.Intersect(fp.srcBounds).Sub(fp.srcBounds.Min)
+		if rect.Empty() || !(r.Weight > 0.0) {
+			continue
+		}
+		if cropX {
+			spans = append(spans, regionSpan{float64(rect.Min.X), float64(rect.Max.X), r.Weight})
+		} else {
+			spans = append(spans, regionSpan{float64(rect.Min.Y), float64(rect.Max.Y), r.Weight})
+		}
+	}
+
+	fx, fy := gravityAnchors[fp.gravity][0], gravityAnchors[fp.gravity][1]
+	if fp.focalSet {
+		fx, fy = fp.focalX, fp.focalY
+	}
+	// The position of the crop window, relative to the source image.
+	var winX, winY float64
+	if cropX {
+		winX = chooseCropOffset(spans, srcW, winW, fx*(srcW-winW))
+	} else {
+		winY = chooseCropOffset(spans, srcH, winH, fy*(srcH-winH))
+	}
+
+	x1, y1 := -winX*scale, -winY*scale
+	fp.SetTargetBoundsAdvanced(image.Rect(0, 0, w, h), x1, y1, x1+srcW*scale, y1+srcH*scale)
+	return nil
+}
@@ -0,0 +1,98 @@
+// ◄◄◄ fpdisk.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements disk-backed intermediate images.
+
+import "os"
+
+// Images smaller than this many bytes are never disk-backed.
+var diskBackedMinBytes = 16 * 1024 * 1024
+
+// SetDiskBacked makes fpresize store its large internal images (the
+// converted source image, and the intermediate images made while
+// resizing) in temporary memory-mapped files in dir, instead of in
+// ordinary memory. If dir is "", the default temporary directory is used.
+// This lets very large images (such as 300-megapixel scans) be resized on
+// a computer that doesn't have enough memory for them, at the cost of
+// speed. The operating system pages the images in and out as needed.
+//
+// The files are deleted as soon as they are created, so they do not
+// outlast the process, but their disk space (and address space) is not
+// freed until they are unmapped. The intermediate images are unmapped as
+// soon as they are no longer needed. The others are not unmapped by the
+// garbage collector, so Close must be called when the FPObject is no longer
+// needed. FPImage images returned by Resize and ResizeToLinear may also be
+// disk-backed, and must not be used after Close; ReleaseImage frees one of
+// them sooner.
+//
+// If memory-mapped files are not supported on this platform, or a file
+// can't be created, ordinary memory is used. Pipelined mode (see
+// SetPipelined), which keeps only a few bands of the image in memory, is
+// usually a better way to save memory, when it can be used.
+func (fp *FPObject) SetDiskBacked(enable bool, dir string) {
+	fp.diskBacked = enable
+	fp.diskBackedDir = dir
+	if enable && fp.mappedFiles == nil {
+		// (Created here, so that copies of fp share it.)
+		fp.mappedFiles = make(map[*float32][]byte)
+	}
+}
+
+// Returns a slice of n new samples, which are all 0. It may be disk-backed.
+func (fp *FPObject) allocSamples(n int) []float32 {
+	if !fp.diskBacked || n*4 < diskBackedMinBytes {
+		return make([]float32, n)
+	}
+
+	dir := fp.diskBackedDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	data, sam, err := mapTempFile(dir, n)
+	if err != nil {
+		fp.progressMsgf("Can't use a temp file (%s); using memory", err.Error())
+		return make([]float32, n)
+	}
+	fp.mappedFiles[&sam[0]] = data
+	return sam
+}
+
+// Frees samples returned by allocSamples, if they are disk-backed. They must
+// not be used afterward.
+func (fp *FPObject) releaseSamples(sam []float32) {
+	if len(sam) == 0 {
+		return
+	}
+	data, ok := fp.mappedFiles[&sam[0]]
+	if !ok {
+		return
+	}
+	delete(fp.mappedFiles, &sam[0])
+	unmapTempFile(data)
+}
+
+// ReleaseImage frees the temporary file used by im, an image returned by
+// Resize or ResizeToLinear, if it is disk-backed (see SetDiskBacked). im
+// must not be used afterward. It does nothing if im is not disk-backed.
+func (fp *FPObject) ReleaseImage(im *FPImage) {
+	fp.releaseSamples(im.Pix)
+}
+
+// Close frees the temporary files used by SetDiskBacked, including the one
+// that holds the converted source image, so the image can't be resized
+// again afterward. It does nothing if there are none.
+func (fp *FPObject) Close() error {
+	var err error
+	if fp.srcFPImage != nil && len(fp.srcFPImage.Pix) > 0 && fp.mappedFiles[&fp.srcFPImage.Pix[0]] != nil {
+		fp.srcFPImage = nil
+	}
+	for k, data := range fp.mappedFiles {
+		if e := unmapTempFile(data); e != nil && err == nil {
+			err = e
+		}
+		delete(fp.mappedFiles, k)
+	}
+	return err
+}
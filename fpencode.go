@@ -0,0 +1,190 @@
+// ◄◄◄ fpencode.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements resizing directly to a PNG or JPEG encoder.
+
+import "errors"
+import "image"
+import "image/color"
+import "image/jpeg"
+import "image/png"
+import "io"
+import "strings"
+
+// EncodeOptions controls how EncodeResized writes the image.
+type EncodeOptions struct {
+	// JPEG quality, from 1 to 100. 0 means the encoder's default.
+	Quality int
+
+	// If true, write a PNG image with 16 bits per sample.
+	Want16Bit bool
+}
+
+// A band of the target image, sent from the resize goroutine to the encoder.
+type encodeBand struct {
+	band   image.Image
+	y0     int // The row of the target image that is row 0 of band
+	opaque bool
+}
+
+// An image.Image whose pixels are supplied by the resize goroutine, one band
+// at a time, as the encoder asks for them. Bands must be read in order.
+type bandStream struct {
+	bounds  image.Rectangle
+	bands   chan encodeBand // Closed when there are no more bands
+	release chan bool       // Tells the resize goroutine it can reuse the band
+
+	cur    *encodeBand // The current band, or nil
+	y0, y1 int         // The rows of cur, in the target image's coordinates
+}
+
+// Called (as fp.dstBandFn) by the resize goroutine. Waits until the encoder
+// is done with the band.
+func (s *bandStream) put(fp *FPObject, band image.Image, y0 int) {
+	s.bands <- encodeBand{band: band, y0: fp.dstBounds.Min.Y + y0, opaque: !fp.mustProcessTransparency}
+	<-s.release
+}
+
+// Makes the band containing row y the current band. Returns false if there
+// is no such band, or it has already been discarded.
+func (s *bandStream) seek(y int) bool {
+	for s.cur == nil || y >= s.y1 {
+		s.next()
+		if s.cur == nil {
+			return false
+		}
+	}
+	return y >= s.y0
+}
+
+// Discards the current band, and waits for the next one.
+func (s *bandStream) next() {
+	if s.cur != nil {
+		s.release <- true
+		s.cur = nil
+	}
+	b, ok := <-s.bands
+	if !ok {
+		return
+	}
+	s.cur = &b
+	s.y0 = b.y0
+	s.y1 = s.y0 + b.band.Bounds().Dy()
+}
+
+// Discards the remaining bands, so that the resize goroutine can finish.
+func (s *bandStream) drain() {
+	for {
+		s.next()
+		if s.cur == nil {
+			return
+		}
+	}
+}
+
+func (s *bandStream) Bounds() image.Rectangle {
+	return s.bounds
+}
+
+func (s *bandStream) ColorModel() color.Model {
+	if !s.seek(s.bounds.Min.Y) {
+		return color.NRGBAModel
+	}
+	return s.cur.band.ColorModel()
+}
+
+// Opaque lets the PNG encoder know whether it needs an alpha channel,
+// without reading the whole image.
+func (s *bandStream) Opaque() bool {
+	if !s.seek(s.bounds.Min.Y) {
+		return true
+	}
+	return s.cur.opaque
+}
+
+func (s *bandStream) At(x, y int) color.Color {
+	if !s.seek(y) {
+		return color.Transparent
+	}
+	return s.cur.band.At(x, y-s.y0+s.cur.band.Bounds().Min.Y)
+}
+
+// EncodeResized resizes the image, and writes it to w in the given format
+// ("png" or "jpeg"). opts may be nil.
+//
+// The image is resized in pipelined mode (see SetPipelined), and each band
+// of target rows is given to the encoder as soon as it is ready, so the
+// whole target image never exists in memory at once. This makes it
+// possible to write images that are too large to hold in memory, when used
+// with a RowReader source.
+//
+// PNG images are written as grayscale if the image is known to be grayscale
+// and opaque (see SetForceGrayscale). JPEG images have no transparency, so
+// any transparency is composited over black.
+//
+// If the resize fails before the first band is ready, nothing is written.
+// If it fails partway through (for example, because the context set by
+// SetContext is canceled), the error is returned, but the encoder will
+// already have written part of the image to w, with the missing rows
+// transparent (or black). So on error, w may contain a partial image, which
+// should be discarded.
+func (fp *FPObject) EncodeResized(w io.Writer, format string, opts *EncodeOptions) error {
+	var flags uint32
+	var encode func(w io.Writer, m image.Image) error
+
+	if opts == nil {
+		opts = &EncodeOptions{}
+	}
+	switch strings.ToLower(format) {
+	case "png":
+		flags = ResizeFlagGrayOK | ResizeFlagUnassocAlpha
+		if opts.Want16Bit {
+			flags |= ResizeFlag16Bit
+		}
+		encode = png.Encode
+	case "jpeg", "jpg":
+		flags = ResizeFlagGrayOK | ResizeFlagUnassocAlpha | ResizeFlagDropAlpha
+		var jopts *jpeg.Options
+		if opts.Quality > 0 {
+			jopts = &jpeg.Options{Quality: opts.Quality}
+		}
+		encode = func(w io.Writer, m image.Image) error {
+			return jpeg.Encode(w, m, jopts)
+		}
+	default:
+		return errors.New("Unsupported target format")
+	}
+
+	s := new(bandStream)
+	s.bands = make(chan encodeBand)
+	s.release = make(chan bool)
+	fp.dstBandFn = func(band image.Image, y0 int) {
+		s.put(fp, band, y0)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := fp.resizeWithFlags(flags, fp.resizePipelined)
+		close(s.bands)
+		errc <- err
+	}()
+
+	// Wait for the first band, so that nothing is written if the image
+	// can't be resized.
+	var err error
+	s.next()
+	if s.cur != nil {
+		s.bounds = fp.dstBounds
+		err = encode(w, s)
+	}
+	s.drain()
+
+	resizeErr := <-errc
+	fp.dstBandFn = nil
+	if resizeErr != nil {
+		return resizeErr
+	}
+	return err
+}
@@ -0,0 +1,226 @@
+// ◄◄◄ fpfile/fpfile.go ►►►
+// Copyright © 2012 Jason Summers
+
+// Package fpfile provides convenience functions that read an image file,
+// resize it with fpresize, and write the result to a new file.
+//
+// It takes care of decoding the source image, choosing the right Resize*
+// method for the target file format, and encoding the result. PNG, JPEG, and
+// GIF files can be read. PNG and JPEG files can be written.
+package fpfile
+
+import "io"
+import "os"
+import "errors"
+import "path/filepath"
+import "strings"
+import "image"
+import "image/png"
+import "image/jpeg"
+import _ "image/gif"
+import "github.com/jsummers/fpresize"
+
+// Options controls how an image is resized and written.
+type Options struct {
+	// The size of the target image, in pixels. If one of them is 0, it will
+	// be calculated from the other, so as to preserve the aspect ratio. At
+	// least one of them must be set.
+	Width  int
+	Height int
+
+	// The target file format: "png" or "jpeg". If empty, ResizeFile uses the
+	// target filename's extension, and ResizeReader uses the source image's
+	// format (or PNG, if that format can't be written).
+	Format string
+
+	// JPEG quality, from 1 to 100. 0 means the encoder's default.
+	Quality int
+
+	// If true, write a 16-bits-per-sample image if the format supports it.
+	Want16Bit bool
+
+	// The resampling filter to use. nil means fpresize's default.
+	Filter *fpresize.Filter
+
+	// If not nil, Configure is called with the FPObject after the options
+	// above have been applied, and before the image is resized, so that any
+	// other settings can be changed.
+	Configure func(fp *fpresize.FPObject)
+}
+
+// Returns the canonical name of a file format, or "" if it is not one that
+// we can write.
+func normalizeFormat(format string) string {
+	switch strings.ToLower(format) {
+	case "png":
+		return "png"
+	case "jpeg", "jpg":
+		return "jpeg"
+	}
+	return ""
+}
+
+// FormatByFilename returns the file format ("png" or "jpeg") suggested by
+// the filename's extension, or "" if it is not recognized.
+func FormatByFilename(fn string) string {
+	ext := strings.TrimPrefix(filepath.Ext(fn), ".")
+	return normalizeFormat(ext)
+}
+
+// TargetSize calculates the size of the resized image, given the size of
+// the source image and the requested width and height, either (but not
+// both) of which may be 0.
+func TargetSize(srcW, srcH, width, height int) (int, int, error) {
+	if width < 0 || height < 0 || (width == 0 && height == 0) {
+		return 0, 0, errors.New("fpfile: invalid target size")
+	}
+	if srcW < 1 || srcH < 1 {
+		return 0, 0, errors.New("fpfile: empty source image")
+	}
+
+	if width == 0 {
+		// Fit to height
+		width = int(0.5 + (float64(srcW)/float64(srcH))*float64(height))
+	} else if height == 0 {
+		// Fit to width
+		height = int(0.5 + (float64(srcH)/float64(srcW))*float64(width))
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return width, height, nil
+}
+
+// ResizeImage resizes src according to opts, returning an image that is
+// suitable for writing in the given format ("png" or "jpeg"). A nil opts is
+// the same as an empty Options, which fails because no size is given.
+func ResizeImage(src image.Image, format string, opts *Options) (image.Image, error) {
+	var flags uint32
+
+	if opts == nil {
+		opts = &Options{}
+	}
+	format = normalizeFormat(format)
+	if format == "" {
+		return nil, errors.New("fpfile: unsupported target format")
+	}
+
+	srcBounds := src.Bounds()
+	dstW, dstH, err := TargetSize(srcBounds.Dx(), srcBounds.Dy(), opts.Width, opts.Height)
+	if err != nil {
+		return nil, err
+	}
+
+	fp := fpresize.New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, dstW, dstH))
+	if opts.Filter != nil {
+		fp.SetFilter(opts.Filter)
+	}
+	if opts.Configure != nil {
+		opts.Configure(fp)
+	}
+
+	if format == "jpeg" {
+		// JPEG has no transparency, and the jpeg package works best with
+		// RGBA images.
+		return fp.ResizeToRGBA()
+	}
+
+	flags = fpresize.ResizeFlagGrayOK | fpresize.ResizeFlagUnassocAlpha
+	if opts.Want16Bit {
+		flags |= fpresize.ResizeFlag16Bit
+	}
+	return fp.ResizeToImage(flags)
+}
+
+// Encode writes img to w in the given format ("png" or "jpeg").
+func Encode(w io.Writer, img image.Image, format string, opts *Options) error {
+	switch normalizeFormat(format) {
+	case "png":
+		return png.Encode(w, img)
+	case "jpeg":
+		var jopts *jpeg.Options
+		if opts != nil && opts.Quality > 0 {
+			jopts = &jpeg.Options{Quality: opts.Quality}
+		}
+		return jpeg.Encode(w, img, jopts)
+	}
+	return errors.New("fpfile: unsupported target format")
+}
+
+// ResizeReader reads an image from r, resizes it, and writes it to w. opts
+// is as for ResizeImage.
+func ResizeReader(r io.Reader, w io.Writer, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	src, srcFormat, err := image.Decode(r)
+	if err != nil {
+		return err
+	}
+
+	format := normalizeFormat(opts.Format)
+	if format == "" && opts.Format != "" {
+		return errors.New("fpfile: unsupported target format")
+	}
+	if format == "" {
+		format = normalizeFormat(srcFormat)
+		if format == "" {
+			format = "png"
+		}
+	}
+
+	dst, err := ResizeImage(src, format, opts)
+	if err != nil {
+		return err
+	}
+	return Encode(w, dst, format, opts)
+}
+
+// ResizeFile reads the image file srcPath, resizes it, and writes it to
+// dstPath. opts is as for ResizeImage.
+func ResizeFile(srcPath, dstPath string, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	format := normalizeFormat(opts.Format)
+	if format == "" {
+		if opts.Format != "" {
+			return errors.New("fpfile: unsupported target format")
+		}
+		format = FormatByFilename(dstPath)
+		if format == "" {
+			return errors.New("fpfile: can't determine target format; name the file to end in .png or .jpg")
+		}
+	}
+
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	src, _, err := image.Decode(srcFile)
+	if err != nil {
+		return err
+	}
+
+	dst, err := ResizeImage(src, format, opts)
+	if err != nil {
+		return err
+	}
+
+	dstFile, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	err = Encode(dstFile, dst, format, opts)
+	if err != nil {
+		dstFile.Close()
+		return err
+	}
+	return dstFile.Close()
+}
@@ -0,0 +1,91 @@
+// ◄◄◄ fpfile/fpfile_test.go ►►►
+
+// Tests for the fpfile package.
+
+package fpfile
+
+import "testing"
+import "bytes"
+import "image"
+import "image/color"
+import "image/png"
+import "image/jpeg"
+
+func TestTargetSize(t *testing.T) {
+	w, h, err := TargetSize(400, 300, 200, 0)
+	if err != nil || w != 200 || h != 150 {
+		t.Errorf("TargetSize(width): %d, %d, %v", w, h, err)
+	}
+	w, h, err = TargetSize(400, 300, 0, 30)
+	if err != nil || w != 40 || h != 30 {
+		t.Errorf("TargetSize(height): %d, %d, %v", w, h, err)
+	}
+	_, _, err = TargetSize(400, 300, 0, 0)
+	if err == nil {
+		t.Errorf("TargetSize: no error for missing size")
+	}
+}
+
+func TestResizeReader(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	for j := 0; j < 20; j++ {
+		for i := 0; i < 40; i++ {
+			src.SetNRGBA(i, j, color.NRGBA{uint8(i * 6), uint8(j * 12), 100, uint8(255 - i)})
+		}
+	}
+	var in bytes.Buffer
+	err := png.Encode(&in, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// PNG in, PNG out (the default), with transparency kept.
+	var out bytes.Buffer
+	err = ResizeReader(bytes.NewReader(in.Bytes()), &out, &Options{Width: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := png.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst.Bounds() != image.Rect(0, 0, 10, 5) {
+		t.Errorf("ResizeReader: wrong size %v", dst.Bounds())
+	}
+	if _, ok := dst.(*image.NRGBA); !ok {
+		t.Errorf("ResizeReader: PNG output has type %T", dst)
+	}
+
+	// PNG in, JPEG out.
+	out.Reset()
+	err = ResizeReader(bytes.NewReader(in.Bytes()), &out, &Options{Height: 8, Format: "jpeg", Quality: 90})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err = jpeg.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst.Bounds() != image.Rect(0, 0, 16, 8) {
+		t.Errorf("ResizeReader: wrong JPEG size %v", dst.Bounds())
+	}
+
+	err = ResizeReader(bytes.NewReader(in.Bytes()), &out, &Options{Width: 10, Format: "bmp"})
+	if err == nil {
+		t.Errorf("ResizeReader: no error for unsupported format")
+	}
+
+	// A nil opts is an error (no size is given), not a panic.
+	_, err = ResizeImage(src, "png", nil)
+	if err == nil {
+		t.Errorf("ResizeImage: no error for nil options")
+	}
+	err = ResizeReader(bytes.NewReader(in.Bytes()), &out, nil)
+	if err == nil {
+		t.Errorf("ResizeReader: no error for nil options")
+	}
+	err = ResizeFile("nonexistent.png", "nonexistent-out.png", nil)
+	if err == nil {
+		t.Errorf("ResizeFile: no error for nil options")
+	}
+}
@@ -5,7 +5,11 @@
 
 package fpresize
 
+import "fmt"
 import "math"
+import "sort"
+import "strings"
+import "sync"
 
 // Filter represents a resampling filter.
 //
@@ -20,6 +24,12 @@ type Filter struct {
 	// about the line x=0, and will not be called with negative x.
 	F func(x float64, scaleFactor float64) float64
 
+	// FVec, if not nil, is a faster way to call F many times. It sets each
+	// out[i] to F(xs[i], scaleFactor). It is optional, but it may be worth
+	// providing for filters that are expensive to evaluate, since a large
+	// image may need millions of filter values.
+	FVec func(xs []float64, scaleFactor float64, out []float64)
+
 	// Radius returns the largest distance from 0 at which the filter's value
 	// is nonzero (not taking blurring into account). The filter must still
 	// return the correct value (0) for arguments larger than the radius.
@@ -28,14 +38,61 @@ type Filter struct {
 	// Flags may affect how fpresize uses the filter. This field can be (and
 	// usually is) nil.
 	Flags func(scaleFactor float64) uint32
+
+	// Name is an optional name for the filter. It is only used to describe
+	// the filter, e.g. by Plan. FilterByName sets it, if the filter doesn't.
+	Name string
+
+	// MinScaleFactor and MaxScaleFactor, if not 0, are the range of scale
+	// factors (see FPObject.ScaleFactor) that the filter is intended for.
+	// Like FilterFlagDownscaleOnly and FilterFlagUpscaleOnly, they don't
+	// prevent the filter from being used, but see SetStrictFilterScale.
+	MinScaleFactor float64
+	MaxScaleFactor float64
 }
 
 const (
 	// If FPFlagAsymmetric is set, the filter is not assumed to be symmetric,
 	// and it must handle negative arguments.
 	FilterFlagAsymmetric = 0x00000001
+
+	// FilterFlagDownscaleOnly declares that the filter is only intended for
+	// reducing the size of an image (a scale factor of 1 or less).
+	FilterFlagDownscaleOnly = 0x00000002
+
+	// FilterFlagUpscaleOnly declares that the filter is only intended for
+	// enlarging an image (a scale factor of 1 or more).
+	FilterFlagUpscaleOnly = 0x00000004
 )
 
+// Returns a description of why f is not intended for the given scale
+// factor, or "" if it is.
+func (f *Filter) scaleFactorProblem(scaleFactor float64) string {
+	var flags uint32
+	if f.Flags != nil {
+		flags = f.Flags(scaleFactor)
+	}
+	name := f.Name
+	if name == "" {
+		name = "custom"
+	}
+	switch {
+	case flags&FilterFlagDownscaleOnly != 0 && scaleFactor > 1.0:
+		return fmt.Sprintf("the %s filter is only intended for downscaling (scale factor %.6g)", name,
+			scaleFactor)
+	case flags&FilterFlagUpscaleOnly != 0 && scaleFactor < 1.0:
+		return fmt.Sprintf("the %s filter is only intended for upscaling (scale factor %.6g)", name,
+			scaleFactor)
+	case f.MinScaleFactor > 0.0 && scaleFactor < f.MinScaleFactor:
+		return fmt.Sprintf("the %s filter is not intended for scale factors below %.6g (scale factor %.6g)",
+			name, f.MinScaleFactor, scaleFactor)
+	case f.MaxScaleFactor > 0.0 && scaleFactor > f.MaxScaleFactor:
+		return fmt.Sprintf("the %s filter is not intended for scale factors above %.6g (scale factor %.6g)",
+			name, f.MaxScaleFactor, scaleFactor)
+	}
+	return ""
+}
+
 // Returns a triangle filter.
 func MakeTriangleFilter() *Filter {
 	f := new(Filter)
@@ -175,3 +232,179 @@ func Sinc(x float64) float64 {
 	}
 	return math.Sin(math.Pi*x) / (math.Pi * x)
 }
+
+// Jinc is the 2-dimensional counterpart of Sinc, 2·J₁(πx)/(πx), where J₁
+// is the Bessel function of the first kind, of order 1. Jinc(0) is 1, and
+// its first zero is at about 1.2197. It is the basis of the "EWA" filters
+// used in some other software.
+func Jinc(x float64) float64 {
+	if x <= 0.000000005 && x >= -0.000000005 {
+		return 1.0
+	}
+	return 2.0 * math.J1(math.Pi*x) / (math.Pi * x)
+}
+
+// BesselI0 is the modified Bessel function of the first kind, of order 0,
+// which is needed for the Kaiser window.
+func BesselI0(x float64) float64 {
+	// Sum the power series, until the terms no longer matter.
+	sum, term := 1.0, 1.0
+	q := x * x / 4.0
+	for k := 1.0; term > sum*1.0e-16; k++ {
+		term *= q / (k * k)
+		sum += term
+	}
+	return sum
+}
+
+// The window functions below are defined on the interval from -1 to 1, and
+// are 0 outside of it. To make a filter with a given radius, scale the
+// argument; for example, a Lanczos-3 filter is Sinc(x)·Sinc(x/3), or
+// Sinc(x)·LanczosWindow(x/3). See also MakeWindowedSincFilter.
+
+// LanczosWindow is the central lobe of the Sinc function, stretched to the
+// window's width.
+func LanczosWindow(x float64) float64 {
+	if x <= -1.0 || x >= 1.0 {
+		return 0.0
+	}
+	return Sinc(x)
+}
+
+// HannWindow is the Hann (raised cosine) window.
+func HannWindow(x float64) float64 {
+	if x <= -1.0 || x >= 1.0 {
+		return 0.0
+	}
+	return 0.5 + 0.5*math.Cos(math.Pi*x)
+}
+
+// HammingWindow is the Hamming window. Unlike most windows, it does not
+// reach 0 at its ends, so a filter made with it is not continuous there.
+func HammingWindow(x float64) float64 {
+	if x < -1.0 || x > 1.0 {
+		return 0.0
+	}
+	return 0.54 + 0.46*math.Cos(math.Pi*x)
+}
+
+// BlackmanWindow is the Blackman window.
+func BlackmanWindow(x float64) float64 {
+	if x <= -1.0 || x >= 1.0 {
+		return 0.0
+	}
+	return 0.42 + 0.5*math.Cos(math.Pi*x) + 0.08*math.Cos(2.0*math.Pi*x)
+}
+
+// KaiserWindow is the Kaiser window, with shape parameter beta. Larger
+// values of beta make the window narrower. Values from about 4 to 9 are
+// typical for image resampling.
+func KaiserWindow(x float64, beta float64) float64 {
+	if x < -1.0 || x > 1.0 {
+		return 0.0
+	}
+	return BesselI0(beta*math.Sqrt(1.0-x*x)) / BesselI0(beta)
+}
+
+// MakeWindowedSincFilter returns a filter that is the Sinc function
+// multiplied by the given window function (such as HannWindow), stretched
+// to the given radius. MakeWindowedSincFilter(3, LanczosWindow) is the same
+// as MakeLanczosFilter(3).
+func MakeWindowedSincFilter(radius float64, window func(x float64) float64) *Filter {
+	f := new(Filter)
+	f.F = func(x float64, scaleFactor float64) float64 {
+		if x < radius {
+			return Sinc(x) * window(x/radius)
+		}
+		return 0.0
+	}
+	f.Radius = func(scaleFactor float64) float64 {
+		return radius
+	}
+	return f
+}
+
+var (
+	defaultFilterMutex sync.RWMutex
+	defaultFilter      *Filter
+)
+
+// SetDefaultFilter sets the filter that is used by every FPObject whose
+// filter has not been set by SetFilter (or whose FilterGetter returns nil).
+// nil restores the built-in default, Lanczos-2.
+//
+// This affects all FPObjects in the program, so it is intended to be called
+// once, when the program starts.
+func SetDefaultFilter(fpf *Filter) {
+	defaultFilterMutex.Lock()
+	defer defaultFilterMutex.Unlock()
+	defaultFilter = fpf
+}
+
+// DefaultFilter returns the filter that is used if no filter is set. See
+// SetDefaultFilter.
+func DefaultFilter() *Filter {
+	defaultFilterMutex.RLock()
+	fpf := defaultFilter
+	defaultFilterMutex.RUnlock()
+	if fpf == nil {
+		fpf = MakeLanczosFilter(2)
+		fpf.Name = "lanczos2"
+	}
+	return fpf
+}
+
+// The filter registry maps filter names to functions that make filters.
+var (
+	filterRegistryMutex sync.RWMutex
+	filterRegistry      = map[string]func() *Filter{
+		"lanczos2": func() *Filter { return MakeLanczosFilter(2) },
+		"lanczos3": func() *Filter { return MakeLanczosFilter(3) },
+		"lanczos":  func() *Filter { return MakeLanczosFilter(3) },
+		"mix":      MakePixelMixingFilter,
+		"mitchell": func() *Filter { return MakeCubicFilter(1.0/3.0, 1.0/3.0) },
+		"catrom":   func() *Filter { return MakeCubicFilter(0.0, 0.5) },
+		"hermite":  func() *Filter { return MakeCubicFilter(0.0, 0.0) },
+		"bspline":  func() *Filter { return MakeCubicFilter(1.0, 0.0) },
+		"gaussian": MakeGaussianFilter,
+		"triangle": MakeTriangleFilter,
+		"boxavg":   MakeBoxAvgFilter,
+	}
+)
+
+// RegisterFilter adds a filter to the registry used by FilterByName and
+// SetFilterByName, or replaces the one with the same name. Names are not
+// case-sensitive. makeFilter is called each time the filter is looked up.
+func RegisterFilter(name string, makeFilter func() *Filter) {
+	filterRegistryMutex.Lock()
+	defer filterRegistryMutex.Unlock()
+	filterRegistry[strings.ToLower(name)] = makeFilter
+}
+
+// FilterByName returns the registered filter with the given name, such as
+// "lanczos3" or "mitchell". It returns an error if there is no such filter.
+func FilterByName(name string) (*Filter, error) {
+	filterRegistryMutex.RLock()
+	makeFilter, ok := filterRegistry[strings.ToLower(name)]
+	filterRegistryMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unrecognized filter %+q", name)
+	}
+	f := makeFilter()
+	if f.Name == "" {
+		f.Name = strings.ToLower(name)
+	}
+	return f, nil
+}
+
+// FilterNames returns the names of the registered filters, in sorted order.
+func FilterNames() []string {
+	filterRegistryMutex.RLock()
+	defer filterRegistryMutex.RUnlock()
+	names := make([]string, 0, len(filterRegistry))
+	for name := range filterRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
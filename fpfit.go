@@ -0,0 +1,63 @@
+// ◄◄◄ fpfit.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements calculating the size of a resized image.
+
+import "image"
+
+// ComputeFitSize returns the bounds (with an origin of (0,0)) of the largest
+// image with the same aspect ratio as a srcW×srcH image that fits in a
+// maxW×maxH box. A maxW or maxH of 0 means there is no limit in that
+// dimension. If allowEnlarge is false, and the source image already fits,
+// its own size is returned.
+//
+// The limiting dimension is exactly the size of the box, and the other one
+// is rounded to the nearest pixel (but is at least 1, and never more than
+// the box). An empty rectangle is returned if srcW or srcH is less than 1.
+func ComputeFitSize(srcW, srcH, maxW, maxH int, allowEnlarge bool) image.Rectangle {
+	if srcW < 1 || srcH < 1 {
+		return image.Rectangle{}
+	}
+	if maxW < 1 && maxH < 1 {
+		return image.Rect(0, 0, srcW, srcH)
+	}
+
+	// Is the width the limiting dimension? This is calculated exactly, so
+	// that it doesn't depend on floating point rounding.
+	widthLimited := maxH < 1 || (maxW >= 1 && int64(srcW)*int64(maxH) >= int64(srcH)*int64(maxW))
+
+	// Calculate the other dimension as n*num/den, rounded.
+	round := func(n, num, den int) int {
+		return int((2*int64(n)*int64(num) + int64(den)) / (2 * int64(den)))
+	}
+
+	var w, h int
+	if widthLimited {
+		if !allowEnlarge && maxW >= srcW {
+			return image.Rect(0, 0, srcW, srcH)
+		}
+		w = maxW
+		h = round(srcH, maxW, srcW)
+		if maxH >= 1 && h > maxH {
+			h = maxH
+		}
+	} else {
+		if !allowEnlarge && maxH >= srcH {
+			return image.Rect(0, 0, srcW, srcH)
+		}
+		h = maxH
+		w = round(srcW, maxH, srcH)
+		if maxW >= 1 && w > maxW {
+			w = maxW
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return image.Rect(0, 0, w, h)
+}
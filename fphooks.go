@@ -0,0 +1,92 @@
+// ◄◄◄ fphooks.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements hooks for processing the image's rows in linear
+// light.
+
+// A RowHook processes one row of an image. y is the row's y coordinate, in
+// the image's coordinate system. samples contains four samples for each
+// pixel in the row -- red, green, blue, alpha -- and may be modified in
+// place. A RowHook is called from multiple goroutines at once, for
+// different rows, and the rows are not processed in any particular order.
+type RowHook func(y int, samples []float32)
+
+// SetOutputRowHook sets a function to be called on each row of the resized
+// image, before it is converted to the target colorspace. This can be used
+// to apply effects (such as a vignette, or a tone curve) in linear light,
+// without an extra pass over the image.
+//
+// The samples are in linear light (unless the output color converter is
+// nil), from 0.0 to 1.0, and the alpha sample is not associated. In data
+// mode, they are the normalized data values. Any samples that the hook
+// sets outside the range 0.0 to 1.0 are clamped.
+//
+// If fpresize has decided that the target image doesn't need color or
+// transparency (because the source image has none), the hook can't add
+// them: only the red sample is used for a grayscale image, and the alpha
+// sample is ignored for an opaque image. The hook isn't used by
+// ResizeToLinear and ResizeN, but is used by the Finalize* methods.
+func (fp *FPObject) SetOutputRowHook(fn RowHook) {
+	fp.outputRowHook = fn
+}
+
+// SetSourceRowHook sets a function to be called on each row of the source
+// image, after it is converted to linear light (by the input color
+// converter), and before it is resized. This can be used for exposure
+// correction, channel mixing, or masking, as part of the same parallel pass
+// that converts the source image. As with the input color converter, it
+// must be set before the first resize (or Analyze), since the converted
+// source image is saved.
+//
+// The samples have associated alpha, as in an FPImage: to make a pixel
+// partly transparent, multiply all four of its samples by the same amount.
+// In data mode, they are the normalized data values. The alpha sample is
+// clamped to the range 0.0 to 1.0. If the source image is grayscale (or is
+// converted to grayscale by SetForceGrayscale), only the red sample is
+// used.
+func (fp *FPObject) SetSourceRowHook(fn RowHook) {
+	fp.srcSettingChanged()
+	fp.sourceRowHook = fn
+}
+
+// If there is a source row hook, make wc.cvtRowFn call it after converting
+// each row.
+func (fp *FPObject) addSourceRowHook(wc *convertSrcWorkContext) {
+	hook := fp.sourceRowHook
+	if hook == nil {
+		return
+	}
+	cvtRowFn := wc.cvtRowFn
+	wc.cvtRowFn = func(fp *FPObject, wc *convertSrcWorkContext, j int) {
+		cvtRowFn(fp, wc, j)
+		pos := (j - wc.dstFirstRow) * wc.dst.Stride
+		row := wc.dst.Pix[pos : pos+4*fp.srcW]
+		hook(fp.srcBounds.Min.Y+j, row)
+		for i := 3; i < len(row); i += 4 {
+			if row[i] < 1.0 {
+				if row[i] < 0.0 {
+					row[i] = 0.0
+				}
+				fp.srcHasTransparency = true
+			} else if row[i] > 1.0 {
+				row[i] = 1.0
+			}
+		}
+	}
+}
+
+// Calls hook on row j of im, which has the given y coordinate, and then
+// clamps the samples to [0,1].
+func (fp *FPObject) callRowHook(hook RowHook, im *FPImage, j int, y int) {
+	row := im.Pix[j*im.Stride : j*im.Stride+4*im.Rect.Dx()]
+	hook(y, row)
+	for k, v := range row {
+		if v < 0.0 {
+			row[k] = 0.0
+		} else if v > 1.0 {
+			row[k] = 1.0
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// ◄◄◄ fpicon/fpicon.go ►►►
+// Copyright © 2012 Jason Summers
+
+// Package fpicon makes the set of sizes needed for an icon (such as a
+// favicon or an application icon) from one source image, and writes them
+// to an ICO file.
+package fpicon
+
+import "io"
+import "bytes"
+import "errors"
+import "sort"
+import "encoding/binary"
+import "image"
+import "image/png"
+import "github.com/jsummers/fpresize"
+
+// StandardSizes is the usual set of icon sizes, in pixels.
+var StandardSizes = []int{16, 32, 48, 64, 128, 256}
+
+// A resized image, in fpresize's linear format.
+type linearIcon struct {
+	size int
+	im   *fpresize.FPImage
+}
+
+// Make resizes src to a square icon of each of the given sizes (nil means
+// StandardSizes), returning them in the same order. A source image that is
+// not square is made to fit, centered, with transparent padding.
+//
+// Instead of resizing the source image for each size, which may be slow
+// for a large source image, each icon is made from the smallest larger
+// icon that is at least twice its size (or the source image, if there is
+// none). The icons are kept in fpresize's high-precision linear format
+// until they are all done, so this doesn't lose much quality.
+//
+// If configure is not nil, it is called with the FPObject used to resize
+// the source image, so that other settings (such as the filter) can be
+// changed. It is also called with each FPObject used to resize an icon to a
+// smaller one, so it should only change the settings that make sense for
+// both. Those FPObjects resize images with SetSourceImageN, and their
+// virtual pixels and target bounds are set after configure is called.
+func Make(src image.Image, sizes []int, configure func(fp *fpresize.FPObject)) ([]*image.NRGBA, error) {
+	if sizes == nil {
+		sizes = StandardSizes
+	}
+	for _, size := range sizes {
+		if size < 1 {
+			return nil, errors.New("fpicon: invalid icon size")
+		}
+	}
+	b := src.Bounds()
+	if b.Empty() {
+		return nil, errors.New("fpicon: empty source image")
+	}
+
+	// Largest first
+	order := make([]int, len(sizes))
+	copy(order, sizes)
+	sort.Sort(sort.Reverse(sort.IntSlice(order)))
+
+	// fp resizes the source image, and is also used to convert the linear
+	// icons to NRGBA.
+	fp := fpresize.New(src)
+	fp.SetVirtualPixels(fpresize.VirtualPixelsTransparent)
+	if configure != nil {
+		configure(fp)
+	}
+
+	var made []linearIcon
+	for n, size := range order {
+		if n > 0 && size == order[n-1] {
+			continue
+		}
+
+		var parent *linearIcon
+		for i := len(made) - 1; i >= 0; i-- {
+			if made[i].size >= 2*size {
+				parent = &made[i]
+				break
+			}
+		}
+
+		var im *fpresize.FPImage
+		var err error
+		if parent == nil {
+			im, err = resizeSource(fp, b, size)
+		} else {
+			im, err = resizeLinear(parent.im, size, configure)
+		}
+		if err != nil {
+			return nil, err
+		}
+		made = append(made, linearIcon{size: size, im: im})
+	}
+
+	icons := make([]*image.NRGBA, len(sizes))
+	for _, li := range made {
+		// FinalizeToNRGBA may modify the image, but it is no longer needed.
+		icon, err := fp.FinalizeToNRGBA(li.im)
+		if err != nil {
+			return nil, err
+		}
+		for i, size := range sizes {
+			if size == li.size {
+				icons[i] = icon
+			}
+		}
+	}
+	return icons, nil
+}
+
+// Resize the source image (with bounds b) to fit in a size×size square.
+func resizeSource(fp *fpresize.FPObject, b image.Rectangle, size int) (*fpresize.FPImage, error) {
+	w, h := float64(size), float64(size)
+	if b.Dx() > b.Dy() {
+		h = w * float64(b.Dy()) / float64(b.Dx())
+	} else {
+		w = h * float64(b.Dx()) / float64(b.Dy())
+	}
+	x1 := (float64(size) - w) / 2.0
+	y1 := (float64(size) - h) / 2.0
+	fp.SetTargetBoundsAdvanced(image.Rect(0, 0, size, size), x1, y1, x1+w, y1+h)
+	return fp.ResizeToLinear()
+}
+
+// Resize a square linear image to size×size. Its samples are already linear
+// and associated with alpha, so they are resized as-is.
+func resizeLinear(src *fpresize.FPImage, size int,
+	configure func(fp *fpresize.FPObject)) (*fpresize.FPImage, error) {
+	fp := new(fpresize.FPObject)
+	fp.SetSourceImageN(&fpresize.FPImageN{Pix: src.Pix, Stride: src.Stride, Rect: src.Rect, NumChannels: 4})
+	if configure != nil {
+		configure(fp)
+	}
+	fp.SetTargetBounds(image.Rect(0, 0, size, size))
+	fp.SetVirtualPixels(fpresize.VirtualPixelsNone)
+	dst, err := fp.ResizeN()
+	if err != nil {
+		return nil, err
+	}
+	return &fpresize.FPImage{Pix: dst.Pix, Stride: dst.Stride, Rect: dst.Rect}, nil
+}
+
+// EncodeICO writes icons to w as an ICO file. Each icon is stored as a PNG
+// image, which is supported by all current ICO readers. Icons can be at
+// most 256 pixels wide and high.
+func EncodeICO(w io.Writer, icons []image.Image) error {
+	if len(icons) == 0 || len(icons) > 65535 {
+		return errors.New("fpicon: invalid number of icons")
+	}
+
+	data := make([][]byte, len(icons))
+	for i, icon := range icons {
+		b := icon.Bounds()
+		if b.Dx() < 1 || b.Dy() < 1 || b.Dx() > 256 || b.Dy() > 256 {
+			return errors.New("fpicon: invalid icon size")
+		}
+		var buf bytes.Buffer
+		err := png.Encode(&buf, icon)
+		if err != nil {
+			return err
+		}
+		data[i] = buf.Bytes()
+	}
+
+	// The header, and one directory entry per icon
+	hdr := make([]byte, 6+16*len(icons))
+	binary.LittleEndian.PutUint16(hdr[2:], 1) // Type: icon
+	binary.LittleEndian.PutUint16(hdr[4:], uint16(len(icons)))
+	offset := len(hdr)
+	for i, icon := range icons {
+		e := hdr[6+16*i : 6+16*(i+1)]
+		b := icon.Bounds()
+		// A width or height of 256 is stored as 0.
+		e[0] = uint8(b.Dx())
+		e[1] = uint8(b.Dy())
+		binary.LittleEndian.PutUint16(e[4:], 1)  // Color planes
+		binary.LittleEndian.PutUint16(e[6:], 32) // Bits per pixel
+		binary.LittleEndian.PutUint32(e[8:], uint32(len(data[i])))
+		binary.LittleEndian.PutUint32(e[12:], uint32(offset))
+		offset += len(data[i])
+	}
+
+	_, err := w.Write(hdr)
+	if err != nil {
+		return err
+	}
+	for _, d := range data {
+		_, err = w.Write(d)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
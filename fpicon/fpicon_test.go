@@ -0,0 +1,114 @@
+// ◄◄◄ fpicon/fpicon_test.go ►►►
+
+// Tests for the fpicon package.
+
+package fpicon
+
+import "testing"
+import "bytes"
+import "encoding/binary"
+import "image"
+import "image/color"
+import "image/png"
+import "sync"
+import "github.com/jsummers/fpresize"
+
+func TestMake(t *testing.T) {
+	// A wide image: the top half is red, and the bottom half is blue.
+	src := image.NewNRGBA(image.Rect(0, 0, 600, 300))
+	for j := 0; j < 300; j++ {
+		for i := 0; i < 600; i++ {
+			c := color.NRGBA{255, 0, 0, 255}
+			if j >= 150 {
+				c = color.NRGBA{0, 0, 255, 255}
+			}
+			src.SetNRGBA(i, j, c)
+		}
+	}
+
+	sizes := []int{16, 256, 48, 32}
+	icons, err := Make(src, sizes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, icon := range icons {
+		size := sizes[i]
+		if icon.Rect != image.Rect(0, 0, size, size) {
+			t.Fatalf("Make: icon %d has bounds %v", i, icon.Rect)
+		}
+		// The image is padded at the top and bottom.
+		if c := icon.NRGBAAt(size/2, 0); c.A != 0 {
+			t.Errorf("Make: %d: top edge is %v, expected transparent", size, c)
+		}
+		if c := icon.NRGBAAt(size/2, size*3/8); c.R < 250 || c.B > 5 || c.A < 250 {
+			t.Errorf("Make: %d: top half is %v, expected red", size, c)
+		}
+		if c := icon.NRGBAAt(size/2, size*5/8); c.B < 250 || c.R > 5 || c.A < 250 {
+			t.Errorf("Make: %d: bottom half is %v, expected blue", size, c)
+		}
+	}
+
+	if _, err := Make(src, []int{0}, nil); err == nil {
+		t.Errorf("Make: no error for invalid size")
+	}
+}
+
+func TestMakeConfigure(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 300, 300))
+
+	// The filter should be used for the icon made from the larger one, as
+	// well as for the one made from the source image.
+	var mu sync.Mutex
+	used := make(map[*fpresize.FPObject]bool)
+	configure := func(fp *fpresize.FPObject) {
+		fp.SetFilterGetter(func(isVertical bool) *fpresize.Filter {
+			mu.Lock()
+			used[fp] = true
+			mu.Unlock()
+			return fpresize.MakeLanczosFilter(3)
+		})
+	}
+	_, err := Make(src, []int{256, 16}, configure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(used) != 2 {
+		t.Errorf("Make: the filter was used by %d FPObjects, expected 2", len(used))
+	}
+}
+
+func TestEncodeICO(t *testing.T) {
+	icons, err := Make(image.NewGray(image.Rect(0, 0, 40, 40)), []int{16, 256}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = EncodeICO(&buf, []image.Image{icons[0], icons[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ico := buf.Bytes()
+	if binary.LittleEndian.Uint16(ico[2:]) != 1 || binary.LittleEndian.Uint16(ico[4:]) != 2 {
+		t.Fatalf("EncodeICO: bad header % x", ico[:6])
+	}
+	for i, size := range []int{16, 0} {
+		e := ico[6+16*i:]
+		if int(e[0]) != size || int(e[1]) != size {
+			t.Errorf("EncodeICO: entry %d has size %d×%d", i, e[0], e[1])
+		}
+		n := binary.LittleEndian.Uint32(e[8:])
+		offset := binary.LittleEndian.Uint32(e[12:])
+		im, err := png.Decode(bytes.NewReader(ico[offset : offset+n]))
+		if err != nil {
+			t.Fatalf("EncodeICO: entry %d: %v", i, err)
+		}
+		if im.Bounds() != icons[i].Rect {
+			t.Errorf("EncodeICO: entry %d has bounds %v", i, im.Bounds())
+		}
+	}
+
+	if err := EncodeICO(&buf, []image.Image{image.NewNRGBA(image.Rect(0, 0, 300, 300))}); err == nil {
+		t.Errorf("EncodeICO: no error for an icon that is too large")
+	}
+}
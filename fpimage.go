@@ -21,6 +21,39 @@ type FPImage struct {
 
 const maxImagePixels = 536870911 // ((2^31)-1)/4
 
+// FPImageN is a high-precision image with an arbitrary number of channels.
+// It is like FPImage, except that it does not implement the image.Image
+// interface, and fpresize does not assign any meaning to its channels.
+type FPImageN struct {
+	// A slice containing all samples. NumChannels consecutive floating point
+	// samples make a pixel.
+	Pix         []float32
+	Stride      int
+	Rect        image.Rectangle
+	NumChannels int
+}
+
+// NewFPImageN returns a new FPImageN with the given bounds and number of
+// channels. All samples are initialized to 0.
+func NewFPImageN(r image.Rectangle, numChannels int) *FPImageN {
+	im := new(FPImageN)
+	im.Rect = r
+	im.NumChannels = numChannels
+	im.Stride = r.Dx() * numChannels
+	im.Pix = make([]float32, im.Stride*r.Dy())
+	return im
+}
+
+// An FPImage is an FPImageN with 4 channels. These functions convert between
+// them, sharing the underlying samples.
+func (fpi *FPImage) asFPImageN() *FPImageN {
+	return &FPImageN{Pix: fpi.Pix, Stride: fpi.Stride, Rect: fpi.Rect, NumChannels: 4}
+}
+
+func (fpi *FPImageN) asFPImage() *FPImage {
+	return &FPImage{Pix: fpi.Pix, Stride: fpi.Stride, Rect: fpi.Rect}
+}
+
 // FPColor is a custom color type, used by the FPImage type.
 // It implements the color.Color interface.
 type FPColor struct {
@@ -0,0 +1,194 @@
+// ◄◄◄ fplabels.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements resizing label maps, such as segmentation masks, in
+// which each sample is the ID of a class, not an intensity.
+
+import "errors"
+import "image"
+
+// The source labels, and the weights for each target row and column.
+type labelWorkContext struct {
+	labels     []uint16 // The source labels, srcW per row
+	srcW       int
+	rowWeights [][]fpWeight
+	colWeights [][]fpWeight
+	dst        []uint16 // The target labels, dstCanvasW per row
+	dstW       int
+}
+
+// Returns the weights from weightList for each of the n target rows or
+// columns, without the ones that are not positive, or that refer to
+// (transparent) virtual pixels.
+func labelWeights(weightList []fpWeight, n int) [][]fpWeight {
+	lw := make([][]fpWeight, n)
+	for _, wt := range weightList {
+		if wt.srcSamIdx >= 0 && wt.weight > 0.0 {
+			lw[wt.dstSamIdx] = append(lw[wt.dstSamIdx], wt)
+		}
+	}
+	return lw
+}
+
+// A label and its total weight.
+type labelVote struct {
+	label  uint16
+	weight float32
+}
+
+// Read target row numbers from workQueue, and compute those rows. A
+// negative number means stop.
+func labelWorker(wc *labelWorkContext, workQueue chan int) {
+	var votes []labelVote
+	for {
+		row := <-workQueue
+		if row < 0 {
+			return
+		}
+
+		for col := 0; col < wc.dstW; col++ {
+			// There are usually only a few different labels near a pixel,
+			// so a short list is faster than a map.
+			votes = votes[:0]
+			for _, wy := range wc.rowWeights[row] {
+				srcRow := wc.labels[wy.srcSamIdx*wc.srcW:]
+				for _, wx := range wc.colWeights[col] {
+					label := srcRow[wx.srcSamIdx]
+					w := wx.weight * wy.weight
+					found := false
+					for v := range votes {
+						if votes[v].label == label {
+							votes[v].weight += w
+							found = true
+							break
+						}
+					}
+					if !found {
+						votes = append(votes, labelVote{label, w})
+					}
+				}
+			}
+
+			// The label with the most weight wins. Ties go to the smallest
+			// label, so that the result doesn't depend on the order of the
+			// weights.
+			var best labelVote
+			for v, vote := range votes {
+				if v == 0 || vote.weight > best.weight || (vote.weight == best.weight && vote.label < best.label) {
+					best = vote
+				}
+			}
+			wc.dst[row*wc.dstW+col] = best.label
+		}
+	}
+}
+
+// ResizeLabels resizes a label map, such as a segmentation mask, whose
+// samples are the IDs of classes. Interpolating them would produce
+// meaningless classes, so instead each target pixel is set to the label
+// that has the most weight (the sum of the filter's positive weights) among
+// the source pixels in the filter's footprint.
+//
+// The source image must have been set by SetSourceImage, and must be an
+// *image.Gray, *image.Gray16, or *image.Paletted (whose labels are the
+// palette indices). The resized image has the same type, and a Paletted
+// image keeps its palette. Color conversion, and the other settings that
+// only affect intensities, are not used. The target pixels that have no
+// source pixels in their footprint (due to VirtualPixelsTransparent) are set
+// to label 0.
+func (fp *FPObject) ResizeLabels() (image.Image, error) {
+	if fp.srcImage == nil {
+		return nil, errors.New("ResizeLabels requires a source image set by SetSourceImage")
+	}
+	err := fp.validateSettings()
+	if err != nil {
+		return nil, err
+	}
+	fp.setNumWorkers()
+	fp.startWeightLog()
+	fp.warnFilterScale()
+
+	wc := new(labelWorkContext)
+	wc.srcW, wc.dstW = fp.srcW, fp.dstCanvasW
+	wc.labels = make([]uint16, fp.srcW*fp.srcH)
+	b := fp.srcBounds
+	switch src := fp.srcImage.(type) {
+	case *image.Gray:
+		for j := 0; j < fp.srcH; j++ {
+			for i := 0; i < fp.srcW; i++ {
+				wc.labels[j*fp.srcW+i] = uint16(src.Pix[src.PixOffset(b.Min.X+i, b.Min.Y+j)])
+			}
+		}
+	case *image.Gray16:
+		for j := 0; j < fp.srcH; j++ {
+			for i := 0; i < fp.srcW; i++ {
+				wc.labels[j*fp.srcW+i] = src.Gray16At(b.Min.X+i, b.Min.Y+j).Y
+			}
+		}
+	case *image.Paletted:
+		for j := 0; j < fp.srcH; j++ {
+			for i := 0; i < fp.srcW; i++ {
+				wc.labels[j*fp.srcW+i] = uint16(src.Pix[src.PixOffset(b.Min.X+i, b.Min.Y+j)])
+			}
+		}
+	default:
+		return nil, errors.New("ResizeLabels requires a Gray, Gray16, or Paletted source image")
+	}
+
+	wc.rowWeights = labelWeights(fp.createWeightList(true), fp.dstCanvasH)
+	wc.colWeights = labelWeights(fp.createWeightList(false), fp.dstCanvasW)
+	wc.dst = make([]uint16, fp.dstCanvasW*fp.dstCanvasH)
+
+	workQueue := make(chan int)
+	nw := fp.workersFor(StageResample)
+	pt := fp.startProgress(StageResample, "Resizing labels", fp.dstCanvasH)
+
+	for i := 0; i < nw; i++ {
+		go labelWorker(wc, workQueue)
+	}
+	for row := 0; row < fp.dstCanvasH; row++ {
+		if fp.ctxErr() != nil {
+			break
+		}
+		workQueue <- row
+		pt.add(1)
+	}
+	for i := 0; i < nw; i++ {
+		workQueue <- -1
+	}
+	pt.finish()
+	if err = fp.ctxErr(); err != nil {
+		return nil, err
+	}
+
+	r := fp.dstBounds
+	switch fp.srcImage.(type) {
+	case *image.Gray:
+		dst := image.NewGray(r)
+		for j := 0; j < r.Dy(); j++ {
+			for i := 0; i < r.Dx(); i++ {
+				dst.Pix[j*dst.Stride+i] = uint8(wc.dst[j*wc.dstW+i])
+			}
+		}
+		return dst, nil
+	case *image.Gray16:
+		dst := image.NewGray16(r)
+		for j := 0; j < r.Dy(); j++ {
+			for i := 0; i < r.Dx(); i++ {
+				v := wc.dst[j*wc.dstW+i]
+				dst.Pix[j*dst.Stride+i*2] = uint8(v >> 8)
+				dst.Pix[j*dst.Stride+i*2+1] = uint8(v)
+			}
+		}
+		return dst, nil
+	}
+	dst := image.NewPaletted(r, fp.srcImage.(*image.Paletted).Palette)
+	for j := 0; j < r.Dy(); j++ {
+		for i := 0; i < r.Dx(); i++ {
+			dst.Pix[j*dst.Stride+i] = uint8(wc.dst[j*wc.dstW+i])
+		}
+	}
+	return dst, nil
+}
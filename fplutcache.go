@@ -0,0 +1,154 @@
+// ◄◄◄ fplutcache.go ►►►
+// Copyright © 2012 Jason Summers
+
+// Color conversion lookup tables that can be shared by multiple FPObjects:
+// a package-level cache, and the ColorLUT type.
+
+package fpresize
+
+import "reflect"
+import "runtime"
+import "strings"
+import "sync"
+
+const (
+	lutKindInput32 = iota
+	lutKindOutput8
+	lutKindOutput32
+	lutKindOutput16
+	lutKindOutput8Linear
+)
+
+type lutCacheKey struct {
+	fn   uintptr // Code address of the ColorConverter
+	kind int     // A lutKind* constant
+	size int     // Number of entries in the table
+}
+
+type lutCacheEntry struct {
+	once sync.Once
+	tbl  interface{} // []float32 or []uint8, depending on the kind
+}
+
+var lutCache struct {
+	sync.Mutex
+	disabled bool
+	entries  map[lutCacheKey]*lutCacheEntry
+}
+
+// SetSharedLUTCache enables or disables the package-level cache of color
+// conversion lookup tables. It is enabled by default.
+//
+// Lookup tables made from the same ColorConverter are identical, so FPObjects
+// can share them. For programs that resize many images, this can save a
+// significant amount of time. Disabling the cache also frees the tables
+// that were cached.
+//
+// Only ColorConverters that are ordinary (named, non-method) functions can
+// be cached, because closures have no useful identity. The function's results
+// must depend only on its input. If that's not the case, use
+// CCFFlagNoSharedCache.
+func SetSharedLUTCache(enable bool) {
+	lutCache.Lock()
+	defer lutCache.Unlock()
+	lutCache.disabled = !enable
+	if !enable {
+		lutCache.entries = nil
+	}
+}
+
+// Returns the cache key for a lookup table, and whether such a table may be
+// cached.
+func makeLUTCacheKey(ccf ColorConverter, ccfFlags uint32, kind int, size int) (lutCacheKey, bool) {
+	var key lutCacheKey
+
+	if ccf == nil || (ccfFlags&CCFFlagNoSharedCache) != 0 {
+		return key, false
+	}
+
+	key.fn = reflect.ValueOf(ccf).Pointer()
+	key.kind = kind
+	key.size = size
+
+	// Closures and method values created from the same code share a code
+	// address, but may behave differently, so don't cache them.
+	f := runtime.FuncForPC(key.fn)
+	if f == nil {
+		return key, false
+	}
+	name := f.Name()
+	if strings.Contains(name, ".func") || strings.HasSuffix(name, "-fm") {
+		return key, false
+	}
+	return key, true
+}
+
+// Returns the cached table for the given key, creating it with the build
+// function if necessary.
+func getSharedLUT(key lutCacheKey, build func() interface{}) interface{} {
+	lutCache.Lock()
+	if lutCache.disabled {
+		lutCache.Unlock()
+		return build()
+	}
+	if lutCache.entries == nil {
+		lutCache.entries = make(map[lutCacheKey]*lutCacheEntry)
+	}
+	e := lutCache.entries[key]
+	if e == nil {
+		e = new(lutCacheEntry)
+		lutCache.entries[key] = e
+	}
+	lutCache.Unlock()
+
+	e.once.Do(func() { e.tbl = build() })
+	return e.tbl
+}
+
+// Reports whether the cache has (or is making) the table for key.
+func hasSharedLUT(key lutCacheKey) bool {
+	lutCache.Lock()
+	defer lutCache.Unlock()
+	return !lutCache.disabled && lutCache.entries[key] != nil
+}
+
+// A ColorLUT is a set of lookup tables made from a ColorConverter, which
+// can be used by any number of FPObjects, including at the same time.
+// See SetInputColorLUT and SetOutputColorLUT.
+//
+// Using a ColorLUT is a way to make sure that lookup tables are created
+// only once, and are used even for small images, for which fpresize would
+// not normally think it worthwhile to create them.
+//
+// The ColorConverter must convert each sample independently of the others
+// (i.e. CCFFlagWholePixels must not be needed). The tables are created
+// when they are first needed.
+type ColorLUT struct {
+	ccf     ColorConverter
+	mu      sync.Mutex
+	entries map[lutCacheKey]*lutCacheEntry
+}
+
+// NewColorLUT returns a new ColorLUT for the given ColorConverter.
+func NewColorLUT(ccf ColorConverter) *ColorLUT {
+	lut := new(ColorLUT)
+	lut.ccf = ccf
+	lut.entries = make(map[lutCacheKey]*lutCacheEntry)
+	return lut
+}
+
+// Returns the table of the given kind and size, creating it if necessary.
+func (lut *ColorLUT) getTable(kind int, size int, build func() interface{}) interface{} {
+	key := lutCacheKey{kind: kind, size: size}
+
+	lut.mu.Lock()
+	e := lut.entries[key]
+	if e == nil {
+		e = new(lutCacheEntry)
+		lut.entries[key] = e
+	}
+	lut.mu.Unlock()
+
+	e.once.Do(func() { e.tbl = build() })
+	return e.tbl
+}
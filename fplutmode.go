@@ -0,0 +1,193 @@
+// ◄◄◄ fplutmode.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements the settings that control when color conversion
+// lookup tables are used, and how large they are.
+
+import "time"
+
+// Values for SetLUTMode.
+const (
+	// Use a lookup table if the image is large enough, compared to the
+	// table (see SetLUTThreshold). This is the default.
+	LUTModeDefault = 0
+	// Always use a lookup table, if the color converter allows it.
+	LUTModeAlways = 1
+	// Never use a lookup table, unless one is supplied by a ColorLUT.
+	LUTModeNever = 2
+	// Measure how long the color converter takes, the first time a table
+	// might be used, and use a table only if that is estimated to be faster.
+	LUTModeAuto = 3
+)
+
+// The default number of entries in the output lookup tables for 8-bit
+// target images. This size is optimized for sRGB. The sRGB curve's slope
+// for the darkest colors (the ones we're most concerned about) is 12.92, so
+// our table needs to have around 256*12.92 or more entries to ensure that
+// it includes every possible color value. A size of 9885 ≈ 255*12.92*3+1
+// improves precision, and makes the dark colors almost always round
+// correctly.
+const defaultOutputLUTSize = 9885
+
+// The default number of entries in the output lookup tables for 16-bit
+// target images (see makeOutputLUT16).
+const defaultOutputLUT16Size = 4097
+
+// The smallest lookup table that may be selected by SetOutputLUTSizes.
+const minOutputLUTSize = 256
+
+// The default for SetLUTThreshold.
+const defaultLUTThreshold = 0.25
+
+// SetLUTMode controls whether color conversion is done with lookup tables,
+// which are made by calling the color converter once for each entry. mode
+// is a LUTMode* constant.
+//
+// With LUTModeDefault, a table is only made if the image is large enough
+// that it will probably pay off. That works well for the standard color
+// converters, but an expensive custom converter is worth a table even for
+// small images, and a cheap one may not be worth it even for large images.
+// LUTModeAuto measures how long the converter takes (once per FPObject and
+// color converter), and decides based on that. A table that is already in
+// the shared cache (see SetSharedLUTCache) costs nothing to make.
+//
+// Tables are never used if the converter has CCFFlagWholePixels or
+// CCFFlagNoCache, and they are always used if they are supplied by a
+// ColorLUT. Linear rounding (see SetLinearRounding) always uses a table for
+// 8-bit target images.
+func (fp *FPObject) SetLUTMode(mode int) {
+	fp.lutMode = mode
+}
+
+// SetLUTThreshold sets the threshold used by LUTModeDefault: a lookup table
+// is used if the image has at least pixelsPerEntry pixels for each entry
+// in the table, for each worker goroutine. 0 means the default, 0.25.
+func (fp *FPObject) SetLUTThreshold(pixelsPerEntry float64) {
+	fp.lutThreshold = pixelsPerEntry
+}
+
+// SetOutputLUTSizes sets the number of entries in the output lookup tables.
+// size8 is for 8-bit target images (the default is 9885, which is enough
+// for sRGB's steep curve near black), and size16 is for 16-bit target
+// images (the default is 4097). Larger tables are more accurate, but take
+// longer to make. 0 means the default, and sizes less than 256 are
+// increased to 256.
+func (fp *FPObject) SetOutputLUTSizes(size8, size16 int) {
+	fp.outputLUTSize, fp.outputLUT16Size = size8, size16
+}
+
+// Returns the size of the output lookup tables for 8-bit target images.
+func (fp *FPObject) outputLUTSize8() int {
+	return lutSizeOrDefault(fp.outputLUTSize, defaultOutputLUTSize)
+}
+
+// Returns the size of the output lookup tables for 16-bit target images.
+func (fp *FPObject) outputLUTSize16() int {
+	return lutSizeOrDefault(fp.outputLUT16Size, defaultOutputLUT16Size)
+}
+
+// Returns size, or def if size is 0.
+func lutSizeOrDefault(size int, def int) int {
+	if size == 0 {
+		return def
+	}
+	if size < minOutputLUTSize {
+		return minOutputLUTSize
+	}
+	return size
+}
+
+// The measured cost of a color converter, in seconds.
+type ccfCost struct {
+	perPixel  float64 // To convert one pixel (three samples) directly
+	perEntry  float64 // To make one entry of a lookup table
+	perLookup float64 // To convert one pixel with a lookup table
+}
+
+// The number of pixels used to measure a color converter.
+const ccfCostPixels = 256
+
+// Measures how long ccf takes, in the ways it is used by the converters.
+// Each measurement is made a few times, and the fastest is used, to reduce
+// the effect of other activity on the computer.
+func measureCCFCost(ccf ColorConverter) *ccfCost {
+	samples := make([]float32, 3*ccfCostPixels)
+	tbl := make([]float32, len(samples))
+	for i := range tbl {
+		tbl[i] = float32(i) / float32(len(tbl)-1)
+	}
+
+	fastest := func(fn func()) float64 {
+		var best time.Duration
+		for r := 0; r < 3; r++ {
+			copy(samples, tbl)
+			start := time.Now()
+			fn()
+			d := time.Since(start)
+			if r == 0 || d < best {
+				best = d
+			}
+		}
+		return best.Seconds()
+	}
+
+	c := new(ccfCost)
+	c.perPixel = fastest(func() {
+		for i := 0; i < ccfCostPixels; i++ {
+			ccf(samples[i*3 : i*3+3])
+		}
+	}) / ccfCostPixels
+	c.perEntry = fastest(func() {
+		ccf(samples)
+	}) / float64(len(samples))
+	c.perLookup = fastest(func() {
+		for i := range samples {
+			samples[i] = tbl[int(samples[i]*float32(len(tbl)-1)+0.5)]
+		}
+	}) / ccfCostPixels
+	return c
+}
+
+// Reports whether a lookup table with tableSize entries should be used, to
+// convert numPixels pixels with ccf using nw workers, according to the LUT
+// mode. kind is a lutKind* constant. *cost holds the measured cost of ccf,
+// if it has been measured.
+func (fp *FPObject) lutPaysOff(ccf ColorConverter, ccfFlags uint32, cost **ccfCost, kind int,
+	tableSize int, numPixels int, nw int) bool {
+	switch fp.lutMode {
+	case LUTModeAlways:
+		return true
+	case LUTModeNever:
+		return false
+	case LUTModeAuto:
+		return fp.lutIsFaster(ccf, ccfFlags, cost, kind, tableSize, numPixels, nw)
+	}
+	threshold := fp.lutThreshold
+	if threshold <= 0.0 {
+		threshold = defaultLUTThreshold
+	}
+	return float64(numPixels) >= threshold*float64(tableSize)*float64(nw)
+}
+
+// The LUTModeAuto part of lutPaysOff: reports whether using the table is
+// estimated to be faster than converting the pixels directly, measuring the
+// cost of ccf if necessary.
+func (fp *FPObject) lutIsFaster(ccf ColorConverter, ccfFlags uint32, cost **ccfCost, kind int,
+	tableSize int, numPixels int, nw int) bool {
+	if *cost == nil {
+		*cost = measureCCFCost(ccf)
+		fp.progressMsgf("Color converter cost: %.1f ns per pixel, %.1f ns per table entry",
+			(*cost).perPixel*1.0e9, (*cost).perEntry*1.0e9)
+	}
+	c := *cost
+	direct := float64(numPixels) * c.perPixel / float64(nw)
+	withLUT := float64(numPixels) * c.perLookup / float64(nw)
+	key, shareable := makeLUTCacheKey(ccf, ccfFlags, kind, tableSize)
+	if !shareable || !hasSharedLUT(key) {
+		// The table is made by one goroutine.
+		withLUT += float64(tableSize) * c.perEntry
+	}
+	return withLUT < direct
+}
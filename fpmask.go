@@ -0,0 +1,124 @@
+// ◄◄◄ fpmask.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements resampling with a mask that gives the importance of
+// each source pixel.
+//
+// It is done by normalized convolution: each sample is multiplied by its
+// pixel's mask value, and the mask is resampled along with the image, as an
+// extra channel. Each resampled sample is then divided by the resampled mask
+// value, which is the sum of the weights that were actually used for it.
+
+import "errors"
+import "image"
+import "image/color"
+
+// If the sum of the mask-weighted filter weights for a target pixel is less
+// than this, the pixel has too little valid data, and it is set to 0.
+const maskMinWeight = 1.0 / 1024.0
+
+// SetSourceMask sets a mask that gives the weight of each source pixel, for
+// example to exclude defective sensor pixels, or regions that have been
+// masked out. Its gray value is the weight: black pixels (0) are ignored,
+// and white pixels have full weight. It must be the same size as the source
+// image; its pixels correspond to the source image's pixels, whatever its
+// origin. nil (the default) means no mask.
+//
+// The filter weights are multiplied by the mask, and renormalized for each
+// target pixel, so the invalid pixels don't contaminate the result. The
+// samples of target pixels that have (almost) no valid source pixels are set
+// to 0; such pixels are transparent, if the image has transparency.
+// Filters with negative lobes (such as Lanczos) can give a target pixel
+// almost no weight when a source pixel near its center is masked out, so a
+// filter without them, such as MakeGaussianFilter, is often a better choice.
+// The mask can't be used in pipelined mode, so it can't be used with
+// EncodeResized. It is cleared by Reset.
+func (fp *FPObject) SetSourceMask(mask image.Image) {
+	fp.srcMask = mask
+}
+
+// Checks that the mask can be used.
+func (fp *FPObject) validateSourceMask() error {
+	if fp.srcMask == nil {
+		return nil
+	}
+	b := fp.srcMask.Bounds()
+	if fp.srcW > 0 && fp.srcH > 0 && (b.Dx() != fp.srcW || b.Dy() != fp.srcH) {
+		return errors.New("The source mask is not the same size as the source image")
+	}
+	return nil
+}
+
+// Returns a copy of src with an extra channel containing the mask, and
+// every other sample multiplied by the mask.
+func (fp *FPObject) applySourceMask(src *FPImageN) *FPImageN {
+	nch := src.NumChannels
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dst := &FPImageN{Rect: src.Rect, NumChannels: nch + 1, Stride: w * (nch + 1)}
+	dst.Pix = fp.allocSamples(dst.Stride * h)
+
+	mb := fp.srcMask.Bounds()
+	gray, isGray := fp.srcMask.(*image.Gray)
+	for j := 0; j < h; j++ {
+		srcRow := src.Pix[j*src.Stride:]
+		dstRow := dst.Pix[j*dst.Stride:]
+		for i := 0; i < w; i++ {
+			var m float32
+			if isGray {
+				m = float32(gray.Pix[gray.PixOffset(mb.Min.X+i, mb.Min.Y+j)]) / 255.0
+			} else {
+				c := color.Gray16Model.Convert(fp.srcMask.At(mb.Min.X+i, mb.Min.Y+j)).(color.Gray16)
+				m = float32(c.Y) / 65535.0
+			}
+			for k := 0; k < nch; k++ {
+				dstRow[i*(nch+1)+k] = srcRow[i*nch+k] * m
+			}
+			dstRow[i*(nch+1)+nch] = m
+		}
+	}
+	return dst
+}
+
+// Divides the samples of a resampled image made by applySourceMask by its
+// mask channel, and returns them without that channel.
+func (fp *FPObject) removeSourceMask(src *FPImageN) *FPImageN {
+	nch := src.NumChannels - 1
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dst := &FPImageN{Rect: src.Rect, NumChannels: nch, Stride: w * nch}
+	dst.Pix = fp.allocSamples(dst.Stride * h)
+
+	for j := 0; j < h; j++ {
+		srcRow := src.Pix[j*src.Stride:]
+		dstRow := dst.Pix[j*dst.Stride:]
+		for i := 0; i < w; i++ {
+			m := srcRow[i*(nch+1)+nch]
+			if m < maskMinWeight {
+				continue
+			}
+			for k := 0; k < nch; k++ {
+				dstRow[i*nch+k] = srcRow[i*(nch+1)+k] / m
+			}
+		}
+	}
+	return dst
+}
+
+// Resizes src with the source mask, using a copy of fp.
+func (fp *FPObject) resizeImageNMasked(src *FPImageN) *FPImageN {
+	fp.progressMsgf("Applying the source mask")
+	masked := fp.applySourceMask(src)
+
+	sub := *fp
+	sub.srcMask = nil
+	sub.channelInfo = make([]channelInfoType, len(fp.channelInfo)+1)
+	copy(sub.channelInfo, fp.channelInfo)
+	sub.channelInfo[len(fp.channelInfo)].mustProcess = true
+
+	dstMasked := sub.resizeImageN(masked)
+	fp.releaseSamples(masked.Pix)
+	dst := fp.removeSourceMask(dstMasked)
+	fp.releaseSamples(dstMasked.Pix)
+	return dst
+}
@@ -0,0 +1,17 @@
+// ◄◄◄ fpmmap_other.go ►►►
+// Copyright © 2012 Jason Summers
+
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package fpresize
+
+import "errors"
+
+func mapTempFile(dir string, n int) ([]byte, []float32, error) {
+	return nil, nil, errors.New("Memory-mapped files are not supported on this platform")
+}
+
+func unmapTempFile(data []byte) error {
+	return nil
+}
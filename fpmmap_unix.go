@@ -0,0 +1,37 @@
+// ◄◄◄ fpmmap_unix.go ►►►
+// Copyright © 2012 Jason Summers
+
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package fpresize
+
+import "os"
+import "syscall"
+import "unsafe"
+
+// Create a temporary file in dir, big enough for n samples, and map it into
+// memory. Returns the mapped bytes, and the same memory as samples.
+func mapTempFile(dir string, n int) ([]byte, []float32, error) {
+	file, err := os.CreateTemp(dir, "fpresize")
+	if err != nil {
+		return nil, nil, err
+	}
+	// The file stays around until it is unmapped.
+	defer file.Close()
+	defer os.Remove(file.Name())
+
+	err = file.Truncate(int64(n) * 4)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, n*4, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, unsafe.Slice((*float32)(unsafe.Pointer(&data[0])), n), nil
+}
+
+func unmapTempFile(data []byte) error {
+	return syscall.Munmap(data)
+}
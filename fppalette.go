@@ -0,0 +1,226 @@
+// ◄◄◄ fppalette.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements conversion to a paletted image.
+
+import "image"
+import "image/color"
+import "sort"
+
+// SetPaletteDither enables or disables dithering, when the image is
+// converted to a palette (see SetTargetPalette and ResizeFlagPalettedOK).
+//
+// The dithering is ordered (it uses a fixed 4×4 pattern, which can be
+// shifted by SetPaletteDitherOffset), so it is the same every time, and
+// doesn't make small changes to the image spread across large areas, as
+// error diffusion would. Each pixel is set to one of a group of up to 16
+// palette colors whose average, in linear light, is as close as possible to
+// the pixel's color (Knoll's pattern dithering).
+func (fp *FPObject) SetPaletteDither(enable bool) {
+	fp.paletteDither = enable
+}
+
+// SetPaletteDitherOffset shifts the dither pattern used by SetPaletteDither
+// by (dx,dy) pixels. The pattern is the same for every resize with the same
+// offset, so the output is reproducible, but the frames of an animation can
+// be given different offsets, so that the pattern doesn't stay in place.
+// Only the offsets modulo 4 matter. The default is (0,0).
+func (fp *FPObject) SetPaletteDitherOffset(dx, dy int) {
+	fp.paletteDitherOffset = image.Pt(dx, dy)
+}
+
+// The order in which the colors of a 4×4 dither pattern are used.
+var ditherPattern4 = [4][4]int{
+	{0, 8, 2, 10},
+	{12, 4, 14, 6},
+	{3, 11, 1, 9},
+	{15, 7, 13, 5},
+}
+
+// Finds the nearest palette colors, in linear light.
+type paletteMatcher struct {
+	// The palette colors, in linear light, with associated alpha (except in
+	// data mode).
+	lin [][4]float32
+	lum []float32 // The luminance of each color, for sorting
+	// Set if the pixels to be matched have associated alpha.
+	assocAlpha bool
+	dither     bool
+	ditherOffs image.Point // Set by SetPaletteDitherOffset
+}
+
+// Converts the palette's colors to linear light, by inverting the output
+// color converter.
+func (fp *FPObject) newPaletteMatcher(p color.Palette) *paletteMatcher {
+	pm := new(paletteMatcher)
+	pm.assocAlpha = !fp.dataMode
+	pm.dither = fp.paletteDither
+	pm.ditherOffs = fp.paletteDitherOffset
+
+	ccf := fp.newOutputCCFTable()
+	toLinear := ccf.inverse
+
+	pm.lin = make([][4]float32, len(p))
+	pm.lum = make([]float32, len(p))
+	for n, c := range p {
+		c64 := color.NRGBA64Model.Convert(c).(color.NRGBA64)
+		a := float32(c64.A) / 65535.0
+		lc := &pm.lin[n]
+		lc[0] = toLinear(float32(c64.R) / 65535.0)
+		lc[1] = toLinear(float32(c64.G) / 65535.0)
+		lc[2] = toLinear(float32(c64.B) / 65535.0)
+		lc[3] = a
+		pm.lum[n] = 0.2126*lc[0] + 0.7152*lc[1] + 0.0722*lc[2]
+		if pm.assocAlpha {
+			for k := 0; k < 3; k++ {
+				lc[k] *= a
+			}
+		}
+	}
+	return pm
+}
+
+// A table of the output color converter's values, for converting single
+// samples, and for inverting it.
+type outputCCFTable struct {
+	fwd []float32 // nil if there is no output color converter
+}
+
+func (fp *FPObject) newOutputCCFTable() *outputCCFTable {
+	t := new(outputCCFTable)
+	if fp.outputCCF == nil {
+		return t
+	}
+	// The table is filled with gray pixels, so that it works with
+	// converters that use CCFFlagWholePixels.
+	const tableSize = 4096
+	tbl := make([]float32, tableSize*3)
+	for i := 0; i < tableSize; i++ {
+		v := float32(i) / float32(tableSize-1)
+		tbl[i*3], tbl[i*3+1], tbl[i*3+2] = v, v, v
+	}
+	fp.outputCCF(tbl)
+	t.fwd = make([]float32, tableSize)
+	for i := range t.fwd {
+		t.fwd[i] = tbl[i*3]
+	}
+	return t
+}
+
+// Converts v, from 0 to 1, to the target colorspace.
+func (t *outputCCFTable) forward(v float32) float32 {
+	if t.fwd == nil {
+		return v
+	}
+	x := v * float32(len(t.fwd)-1)
+	i := int(x)
+	if i < 0 {
+		return t.fwd[0]
+	}
+	if i >= len(t.fwd)-1 {
+		return t.fwd[len(t.fwd)-1]
+	}
+	// Interpolate between entries i and i+1.
+	f := x - float32(i)
+	return t.fwd[i] + f*(t.fwd[i+1]-t.fwd[i])
+}
+
+// Converts v, from 0 to 1, from the target colorspace to linear light.
+func (t *outputCCFTable) inverse(v float32) float32 {
+	fwd := t.fwd
+	if fwd == nil {
+		return v
+	}
+	// The table is assumed to be increasing.
+	i := sort.Search(len(fwd), func(i int) bool { return fwd[i] >= v })
+	if i == 0 {
+		return 0.0
+	}
+	if i == len(fwd) {
+		return 1.0
+	}
+	// Interpolate between entries i-1 and i.
+	f := float32(0.0)
+	if fwd[i] > fwd[i-1] {
+		f = (v - fwd[i-1]) / (fwd[i] - fwd[i-1])
+	}
+	return (float32(i-1) + f) / float32(len(fwd)-1)
+}
+
+// Returns the index of the palette color nearest to c.
+func (pm *paletteMatcher) nearest(c *[4]float32) int {
+	best := 0
+	bestDist := float32(-1.0)
+	for n := range pm.lin {
+		var dist float32
+		for k := 0; k < 4; k++ {
+			d := c[k] - pm.lin[n][k]
+			dist += d * d
+		}
+		if bestDist < 0.0 || dist < bestDist {
+			best, bestDist = n, dist
+		}
+	}
+	return best
+}
+
+// Returns the colors of the dither pattern for c, sorted by luminance.
+func (pm *paletteMatcher) pattern(c *[4]float32) []uint8 {
+	var candidates [16]uint8
+	var errSum [4]float32
+	for n := range candidates {
+		var attempt [4]float32
+		for k := 0; k < 4; k++ {
+			attempt[k] = c[k] + errSum[k]
+		}
+		idx := pm.nearest(&attempt)
+		candidates[n] = uint8(idx)
+		for k := 0; k < 4; k++ {
+			errSum[k] += c[k] - pm.lin[idx][k]
+		}
+	}
+	sort.SliceStable(candidates[:], func(a, b int) bool {
+		return pm.lum[candidates[a]] < pm.lum[candidates[b]]
+	})
+	return candidates[:]
+}
+
+// Converts a row of wc.src (which has been post-processed) to palette
+// indices. x and y are the target image coordinates of the first pixel in
+// the row, which select the position in the dither pattern.
+func (pm *paletteMatcher) convertRow(src []float32, dst []uint8, x, y int) {
+	// Finding the nearest palette colors is slow, so remember the colors
+	// we've seen in this row. The key is the color, to 16 bits per sample.
+	cache := make(map[uint64][]uint8)
+
+	for i := range dst {
+		var c [4]float32
+		var key uint64
+		for k := 0; k < 4; k++ {
+			c[k] = src[i*4+k]
+			if pm.assocAlpha && k < 3 {
+				c[k] *= src[i*4+3]
+			}
+			key = key<<16 | uint64(c[k]*65535.0+0.5)
+		}
+
+		p, ok := cache[key]
+		if !ok {
+			if pm.dither {
+				p = pm.pattern(&c)
+			} else {
+				p = []uint8{uint8(pm.nearest(&c))}
+			}
+			cache[key] = p
+		}
+
+		if pm.dither {
+			px, py := x+i+pm.ditherOffs.X, y+pm.ditherOffs.Y
+			dst[i] = p[ditherPattern4[(py%4+4)%4][(px%4+4)%4]]
+		} else {
+			dst[i] = p[0]
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// ◄◄◄ fpphysical.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements setting the target size in physical units.
+
+import "errors"
+import "image"
+import "math"
+
+const mmPerInch = 25.4
+
+// SetSourceDPI sets the resolution of the source image, in pixels per inch,
+// for use by SetTargetPhysicalSize. 0 (the default) means unknown.
+func (fp *FPObject) SetSourceDPI(dpi float64) {
+	fp.srcDPI = dpi
+}
+
+// SetTargetPhysicalSize sets the target bounds (with an origin of (0,0)) to
+// the number of pixels needed to print the image at the given size, in
+// millimeters, at the given resolution, in pixels per inch.
+//
+// If one of widthMM and heightMM is 0, it is calculated from the other, so
+// as to preserve the source image's aspect ratio. If both are 0, the image
+// keeps its physical size, which must be known from SetSourceDPI, so the
+// image is just resampled to the new resolution. The source image must be
+// set first.
+func (fp *FPObject) SetTargetPhysicalSize(widthMM, heightMM, dpi float64) error {
+	if !(dpi > 0.0) || widthMM < 0.0 || heightMM < 0.0 {
+		return errors.New("Invalid physical size")
+	}
+	if widthMM == 0.0 || heightMM == 0.0 {
+		if fp.srcW < 1 || fp.srcH < 1 {
+			return errors.New("Source image not set")
+		}
+		srcW, srcH := float64(fp.srcW), float64(fp.srcH)
+		switch {
+		case widthMM != 0.0:
+			heightMM = widthMM * srcH / srcW
+		case heightMM != 0.0:
+			widthMM = heightMM * srcW / srcH
+		case fp.srcDPI > 0.0:
+			widthMM = srcW / fp.srcDPI * mmPerInch
+			heightMM = srcH / fp.srcDPI * mmPerInch
+		default:
+			return errors.New("Source DPI not set")
+		}
+	}
+
+	w := int(math.Floor(widthMM/mmPerInch*dpi + 0.5))
+	h := int(math.Floor(heightMM/mmPerInch*dpi + 0.5))
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	fp.SetTargetBounds(image.Rect(0, 0, w, h))
+	return nil
+}
@@ -0,0 +1,439 @@
+// ◄◄◄ fppipeline.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements pipelined mode, in which the image is converted,
+// resized, and converted to the target format one band of rows at a time.
+
+import "image"
+import "errors"
+
+// The number of target rows in each band, in pipelined mode. EncodeResized
+// needs it to be a multiple of 16, so that the JPEG encoder's blocks of
+// rows don't cross bands.
+const pipelineBandHeight = 32
+
+// SetPipelined enables or disables pipelined mode.
+//
+// Normally, the entire source image is converted to floating point format,
+// then the entire image is resized, then the entire resized image is
+// converted to the target format. In pipelined mode, the image is processed
+// in horizontal bands instead: source rows are converted when they are
+// needed, and each band of target rows is converted to the target format
+// while the next band is being resized. Only a few rows of the source image
+// exist in floating point format at any one time, which greatly reduces the
+// amount of memory needed for large images.
+//
+// In pipelined mode, the converted source image is not saved, so resizing
+// the same FPObject more than once requires converting the source image
+// again each time. Also, the width is always changed before the height,
+// which can make enlarging an image slower.
+//
+// Pipelined mode affects Resize, ResizeToImage, and the ResizeTo[N]RGBA[64]
+// methods.
+func (fp *FPObject) SetPipelined(enable bool) {
+	fp.pipelined = enable
+}
+
+// Data used by the pipelined resize process.
+type pipelineContext struct {
+	// For converting source rows. nil if the source rows are read from
+	// fp.srcFPImage instead.
+	srcWC *convertSrcWorkContext
+
+	hWeights []fpWeight // Weights for changing the width
+	// The weights for changing the height, grouped by target row.
+	rowWeights [][]fpWeight
+	// minSrcRow[y] is the lowest numbered intermediate row needed by target
+	// row y, or by any row after it.
+	minSrcRow []int
+	chans     []int // The channels that must be processed
+	// Set if the intermediate rows are renormalized (see SetAlphaWeighting).
+	alphaWeighting bool
+
+	// The intermediate (width-resized) rows that are currently in memory.
+	// win[0] is row winFirst.
+	win      [][]float32
+	winFirst int
+	nextRow  int         // The next intermediate row to make.
+	freeRows [][]float32 // Discarded rows, that can be reused.
+	scratch  [][]float32 // One source row buffer per worker.
+
+	// Buffers for rows read from a RowReader, that are not currently in use.
+	rawRows chan []float32
+}
+
+type pipelineRowWorkItem struct {
+	j       int       // The source row
+	raw     []float32 // The row, if it was read from a RowReader
+	dst     []float32 // The intermediate row to write to
+	stopNow bool
+}
+
+type pipelineBandWorkItem struct {
+	y       int       // The target row
+	dst     []float32 // Samples for the target row
+	stopNow bool
+}
+
+// Reports whether the image (an image.Image or RowReader) might have
+// transparency, without converting it.
+func imageMayHaveTransparency(src interface{}) bool {
+	if o, ok := src.(interface {
+		Opaque() bool
+	}); ok {
+		return !o.Opaque()
+	}
+	return true
+}
+
+// Read source rows from workQueue, convert them, and change their width.
+// scratch is a buffer big enough to hold one converted source row.
+func (fp *FPObject) pipelineRowWorker(pc *pipelineContext, scratch []float32,
+	workQueue chan pipelineRowWorkItem) {
+	var cwc convertSrcWorkContext
+	var rowImg FPImage
+	var srcRow []float32
+
+	if pc.srcWC != nil {
+		// Make a private copy of the work context, so that each worker can
+		// convert rows to its own buffer.
+		cwc = *pc.srcWC
+		rowImg.Pix = scratch
+		rowImg.Stride = len(scratch)
+		cwc.dst = &rowImg
+	}
+
+	for {
+		wi := <-workQueue
+		if wi.stopNow {
+			return
+		}
+
+		if wi.raw != nil {
+			// The row converter converts RowReader rows in-place.
+			copy(scratch, wi.raw)
+			pc.rawRows <- wi.raw
+		} else if pc.srcWC != nil {
+			// The row converter expects fully-transparent pixels to already be 0.
+			for k := range scratch {
+				scratch[k] = 0.0
+			}
+		}
+
+		if pc.srcWC != nil {
+			cwc.dstFirstRow = wi.j
+			cwc.cvtRowFn(fp, &cwc, wi.j)
+			srcRow = scratch
+		} else {
+			srcRow = fp.srcFPImage.Pix[wi.j*fp.srcFPImage.Stride:]
+		}
+
+		for k := range wi.dst {
+			wi.dst[k] = 0.0
+		}
+		for _, k := range pc.chans {
+			resampleLine(pc.hWeights, srcRow[k:], wi.dst[k:], 4, 4)
+		}
+		if pc.alphaWeighting {
+			fp.renormalizeAlphaRow(wi.dst)
+		}
+	}
+}
+
+// Read target rows from workQueue, and calculate them from the intermediate
+// rows in pc.win.
+func (fp *FPObject) pipelineBandWorker(pc *pipelineContext, workQueue chan pipelineBandWorkItem) {
+	for {
+		wi := <-workQueue
+		if wi.stopNow {
+			return
+		}
+
+		for k := range wi.dst {
+			wi.dst[k] = 0.0
+		}
+		for _, w := range pc.rowWeights[wi.y] {
+			src := pc.win[w.srcSamIdx-pc.winFirst]
+			for i := 0; i < len(wi.dst); i += 4 {
+				for _, k := range pc.chans {
+					wi.dst[i+k] += src[i+k] * w.weight
+				}
+			}
+		}
+	}
+}
+
+// Make sure that all the intermediate rows needed by target rows y0 through
+// y1-1 are in pc.win, and discard the ones that will never be needed again.
+func (fp *FPObject) pipelineMakeRows(pc *pipelineContext, y0, y1 int) error {
+	var wi pipelineRowWorkItem
+	var i int
+	var err error
+
+	// Discard rows that are no longer needed.
+	for len(pc.win) > 0 && pc.winFirst < pc.minSrcRow[y0] {
+		pc.freeRows = append(pc.freeRows, pc.win[0])
+		pc.win = pc.win[1:]
+		pc.winFirst++
+	}
+
+	// Figure out which rows we need to make.
+	first := pc.nextRow
+	if first < pc.minSrcRow[y0] {
+		first = pc.minSrcRow[y0]
+	}
+	last := -1
+	for y := y0; y < y1; y++ {
+		for _, w := range pc.rowWeights[y] {
+			if w.srcSamIdx > last {
+				last = w.srcSamIdx
+			}
+		}
+	}
+	if last < first {
+		return nil
+	}
+	if len(pc.win) == 0 {
+		pc.winFirst = first
+	}
+
+	workQueue := make(chan pipelineRowWorkItem)
+	nw := fp.workersFor(StageConvertSource)
+
+	for i = 0; i < nw; i++ {
+		if i >= len(pc.scratch) {
+			pc.scratch = append(pc.scratch, make([]float32, fp.srcW*4))
+		}
+		go fp.pipelineRowWorker(pc, pc.scratch[i], workQueue)
+	}
+
+	rowReader := fp.srcRowReader
+	if pc.srcWC == nil {
+		rowReader = nil
+	}
+	if rowReader != nil && pc.rawRows == nil {
+		// Each worker can be using one buffer, and we can be filling one more.
+		pc.rawRows = make(chan []float32, nw+1)
+		for i = 0; i < nw+1; i++ {
+			pc.rawRows <- make([]float32, fp.srcW*4)
+		}
+	}
+
+	for j := first; j <= last; j++ {
+		var row []float32
+		if len(pc.freeRows) > 0 {
+			row = pc.freeRows[len(pc.freeRows)-1]
+			pc.freeRows = pc.freeRows[:len(pc.freeRows)-1]
+		} else {
+			row = make([]float32, fp.dstCanvasW*4)
+		}
+		if rowReader != nil {
+			// Rows have to be read one at a time, in order, so read them
+			// here instead of in the workers.
+			wi.raw = <-pc.rawRows
+			err = rowReader.ReadRow(fp.srcBounds.Min.Y+j, wi.raw)
+			if err != nil {
+				pc.rawRows <- wi.raw
+				break
+			}
+		}
+		pc.win = append(pc.win, row)
+
+		wi.j = j
+		wi.dst = row
+		workQueue <- wi
+	}
+
+	wi.stopNow = true
+	for i = 0; i < nw; i++ {
+		workQueue <- wi
+	}
+	pc.nextRow = last + 1
+	return err
+}
+
+// Calculate the rows of band, which begins at target row y0.
+func (fp *FPObject) pipelineMakeBand(pc *pipelineContext, band *FPImage, y0 int) {
+	var wi pipelineBandWorkItem
+	var i int
+
+	workQueue := make(chan pipelineBandWorkItem)
+	nw := fp.workersFor(StageResample)
+
+	for i = 0; i < nw; i++ {
+		go fp.pipelineBandWorker(pc, workQueue)
+	}
+
+	for j := 0; j < band.Rect.Dy(); j++ {
+		wi.y = y0 + j
+		wi.dst = band.Pix[j*band.Stride : j*band.Stride+4*band.Rect.Dx()]
+		workQueue <- wi
+	}
+
+	wi.stopNow = true
+	for i = 0; i < nw; i++ {
+		workQueue <- wi
+	}
+}
+
+func (fp *FPObject) resizePipelined(prepare dstPrepareFunc) (image.Image, error) {
+	var bandPix [2][]float32
+	var dstFP *FPImage
+	var emitDone chan bool
+
+	err := fp.resizeSetup()
+	if err != nil {
+		return nil, err
+	}
+	// This is checked here, rather than by validateSettings, because
+	// EncodeResized resizes in pipelined mode without calling SetPipelined.
+	if fp.srcMask != nil {
+		return nil, errors.New("A source mask can't be used in pipelined mode")
+	}
+
+	pc := new(pipelineContext)
+
+	if fp.srcFPImage == nil {
+		// We have to decide which channels to process before converting
+		// the image, so we can't look at every pixel to see whether it is
+		// transparent. A source row hook might make it transparent.
+		if fp.sourceRowHook != nil {
+			fp.srcHasTransparency = true
+		} else if fp.srcImage != nil {
+			fp.srcHasTransparency = imageMayHaveTransparency(fp.srcImage)
+		} else if fp.srcRowReader != nil {
+			fp.srcHasTransparency = imageMayHaveTransparency(fp.srcRowReader)
+		} else {
+			return nil, errors.New("No source image")
+		}
+		pc.srcWC = fp.prepareConvertSrc()
+	}
+
+	fp.setChannelInfo()
+	fp.applyTargetHints()
+	for k := range fp.channelInfo {
+		if fp.channelInfo[k].mustProcess {
+			pc.chans = append(pc.chans, k)
+		}
+	}
+	pc.alphaWeighting = fp.useAlphaWeighting()
+
+	pc.hWeights = fp.createWeightList(false)
+	pc.rowWeights = make([][]fpWeight, fp.dstCanvasH)
+	for _, w := range fp.createWeightList(true) {
+		if w.srcSamIdx >= 0 {
+			pc.rowWeights[w.dstSamIdx] = append(pc.rowWeights[w.dstSamIdx], w)
+		}
+	}
+	pc.minSrcRow = make([]int, fp.dstCanvasH)
+	minRow := fp.srcH
+	for y := fp.dstCanvasH - 1; y >= 0; y-- {
+		for _, w := range pc.rowWeights[y] {
+			if w.srcSamIdx < minRow {
+				minRow = w.srcSamIdx
+			}
+		}
+		pc.minSrcRow[y] = minRow
+	}
+
+	fp.progressMsgf("Resizing in bands, %dx%d -> %dx%d", fp.srcW, fp.srcH,
+		fp.dstCanvasW, fp.dstCanvasH)
+
+	dstRect := fp.dstBounds
+	if fp.dstBandFn != nil {
+		dstRect.Max.Y = dstRect.Min.Y + pipelineBandHeight
+		if dstRect.Max.Y > fp.dstBounds.Max.Y {
+			dstRect.Max.Y = fp.dstBounds.Max.Y
+		}
+	}
+	wc := prepare(dstRect)
+	if fp.useChannelOrder() {
+		wc.channels = fp.newChannelMapper()
+	}
+	stride := fp.dstCanvasW * 4
+	if wc.inPlace {
+		// The bands will be parts of the target image.
+		dstFP = new(FPImage)
+		dstFP.Rect = fp.dstBounds
+		dstFP.Stride = stride
+		dstFP.Pix = make([]float32, stride*fp.dstCanvasH)
+		wc.dstImage = dstFP
+	} else {
+		// Use two band buffers, so that one can be converted to the target
+		// format while the other is being resized.
+		for k := range bandPix {
+			bandPix[k] = make([]float32, stride*pipelineBandHeight)
+		}
+	}
+
+	pt := fp.startProgress(StageResample, "Resizing in bands", fp.dstCanvasH)
+
+	for y0 := 0; y0 < fp.dstCanvasH; y0 += pipelineBandHeight {
+		y1 := y0 + pipelineBandHeight
+		if y1 > fp.dstCanvasH {
+			y1 = fp.dstCanvasH
+		}
+
+		err = fp.ctxErr()
+		if err != nil {
+			break
+		}
+		err = fp.pipelineMakeRows(pc, y0, y1)
+		if err != nil {
+			break
+		}
+
+		band := new(FPImage)
+		band.Rect = image.Rect(0, 0, fp.dstCanvasW, y1-y0)
+		band.Stride = stride
+		if dstFP != nil {
+			band.Pix = dstFP.Pix[y0*stride : y1*stride]
+		} else {
+			band.Pix = bandPix[(y0/pipelineBandHeight)%2][:(y1-y0)*stride]
+		}
+		fp.pipelineMakeBand(pc, band, y0)
+		pt.add(y1 - y0)
+
+		// Wait for the previous band to be converted, then start converting
+		// this one.
+		if emitDone != nil {
+			<-emitDone
+		}
+		emitDone = make(chan bool)
+		wc.src = band
+		wc.srcRowY = fp.dstBounds.Min.Y + y0
+		if fp.dstBandFn == nil {
+			wc.dstRowOffset = y0
+		}
+		go func(done chan bool, y0 int) {
+			// This runs at the same time as the next band is being made,
+			// so it doesn't report its progress.
+			fp.convertDstIndirect(wc, nil)
+			if fp.dstBandFn != nil {
+				fp.dstBandFn(wc.dstImage, y0)
+			}
+			done <- true
+		}(emitDone, y0)
+	}
+
+	if emitDone != nil {
+		<-emitDone
+	}
+	if err == nil {
+		// The last band might not have been converted completely.
+		err = fp.ctxErr()
+	}
+	if err == nil {
+		pt.finish()
+	}
+
+	// A RowReader can only be read once.
+	fp.srcRowReader = nil
+
+	if err != nil {
+		return nil, err
+	}
+	return wc.dstImage, nil
+}
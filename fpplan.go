@@ -0,0 +1,266 @@
+// ◄◄◄ fpplan.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements Plan, which describes how an image will be resized.
+
+import "errors"
+import "fmt"
+import "image"
+import "strings"
+
+// PlanDimension describes how one dimension of the image will be resized.
+type PlanDimension struct {
+	// SourceSize is the size of the source image, in pixels. If the image
+	// will be pre-reduced, it is the pre-reduced size, and PreReducedFrom
+	// is the original size. Otherwise, PreReducedFrom is 0.
+	SourceSize     int
+	PreReducedFrom int
+	TargetSize     int     // The width or height of the target canvas
+	ScaleFactor    float64 // See FPObject.ScaleFactor
+
+	// AreaAverage is set if SetAreaAverage is in effect, in which case
+	// Filter, Radius, and Blur are not used.
+	AreaAverage bool
+	Filter      string  // The filter's Name, which may be empty
+	Radius      float64 // The filter's radius, not counting blur or reduction
+	Blur        float64 // 1.0 means no blur
+
+	// FilterWarning, if not empty, says why the filter is not intended for
+	// this scale factor (see SetStrictFilterScale).
+	FilterWarning string
+
+	// Weights is the number of weights in the weight list. Imported is set
+	// if the weight list was loaded by ImportWeights.
+	Weights  int
+	Imported bool
+
+	// AvgTaps and MaxTaps are the average and largest number of source
+	// samples (taps) that each target sample is computed from, in this
+	// dimension's pass. The time the pass takes is roughly proportional to
+	// AvgTaps, so they can be used to compare the cost of filters.
+	AvgTaps float64
+	MaxTaps int
+}
+
+// Plan describes what a resize will do, as returned by FPObject.Plan.
+type Plan struct {
+	Horizontal PlanDimension
+	Vertical   PlanDimension
+
+	// WidthFirst is set if the width will be changed before the height.
+	WidthFirst bool
+	Planar     bool // See SetPlanar
+	Pipelined  bool // See SetPipelined
+
+	// Channels has one element for each channel of the image while it is
+	// being resized (red, green, blue, alpha, for an image.Image source),
+	// which is set if that channel will be processed.
+	Channels []bool
+
+	// InputLUT is set if a lookup table will be used for the input color
+	// conversion. OutputLUT is set if one will be used for the output
+	// color conversion, when converting to a format with 8 bits per sample.
+	InputLUT  bool
+	OutputLUT bool
+
+	// Workers is the number of worker goroutines for each stage, indexed
+	// by the Stage* constants.
+	Workers []int
+}
+
+// String returns a readable description of the plan, on several lines.
+func (p *Plan) String() string {
+	var b strings.Builder
+
+	yesNo := func(v bool) string {
+		if v {
+			return "yes"
+		}
+		return "no"
+	}
+	dim := func(name string, d *PlanDimension) {
+		fmt.Fprintf(&b, "%s: ", name)
+		if d.PreReducedFrom != 0 {
+			fmt.Fprintf(&b, "pre-reduce %d -> %d, then ", d.PreReducedFrom, d.SourceSize)
+		}
+		fmt.Fprintf(&b, "%d -> %d (scale factor %.6g), ", d.SourceSize, d.TargetSize, d.ScaleFactor)
+		switch {
+		case d.Imported:
+			b.WriteString("imported weights")
+		case d.AreaAverage:
+			b.WriteString("area average")
+		default:
+			filter := d.Filter
+			if filter == "" {
+				filter = "custom filter"
+			}
+			fmt.Fprintf(&b, "%s, radius %.6g, blur %.6g", filter, d.Radius, d.Blur)
+		}
+		fmt.Fprintf(&b, ", %d weights (%.2f taps per sample, max %d)\n", d.Weights, d.AvgTaps, d.MaxTaps)
+		if d.FilterWarning != "" {
+			fmt.Fprintf(&b, "  Warning: %s\n", d.FilterWarning)
+		}
+	}
+
+	dim("Width", &p.Horizontal)
+	dim("Height", &p.Vertical)
+	if p.WidthFirst {
+		b.WriteString("Pass order: width first\n")
+	} else {
+		b.WriteString("Pass order: height first\n")
+	}
+	fmt.Fprintf(&b, "Planar: %s, pipelined: %s\n", yesNo(p.Planar), yesNo(p.Pipelined))
+
+	b.WriteString("Channels processed:")
+	for k, v := range p.Channels {
+		if v {
+			fmt.Fprintf(&b, " %d", k)
+		}
+	}
+	b.WriteString("\n")
+
+	fmt.Fprintf(&b, "Lookup tables: input %s, output %s\n", yesNo(p.InputLUT), yesNo(p.OutputLUT))
+	stageNames := []string{"convert source", "resample", "convert target"}
+	b.WriteString("Workers:")
+	for stage, n := range p.Workers {
+		if stage > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, " %s %d", stageNames[stage], n)
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// Plan returns a description of what resizing the image would do with the
+// current settings: the order of the passes, the filter used in each
+// dimension, which channels will be processed, whether lookup tables will
+// be used, and how many worker goroutines each stage will use. It doesn't
+// resize or convert the image.
+//
+// Until the source image has been converted (e.g. by Analyze), it is not
+// known whether it is grayscale or opaque, so the plan may process more
+// channels than the resize actually will.
+func (fp *FPObject) Plan() (*Plan, error) {
+	err := fp.validateSettings()
+	if err != nil {
+		return nil, err
+	}
+	if fp.srcW < 1 || fp.srcH < 1 {
+		return nil, errors.New("Source image not set")
+	}
+	fp.setNumWorkers()
+	if fp.srcFPImageN == nil {
+		fp.setDefaultColorConverters()
+	}
+
+	p := new(Plan)
+	p.Planar = fp.planar
+	p.Pipelined = fp.pipelined && fp.srcFPImageN == nil
+	p.Channels = fp.planChannels()
+
+	p.Workers = make([]int, numWorkStages)
+	for stage := range p.Workers {
+		p.Workers[stage] = fp.workersFor(stage)
+	}
+
+	// Resizing is done with a copy of fp whose source size has been changed,
+	// if the image is pre-reduced.
+	sub := *fp
+	sub.srcW, sub.srcH = fp.resampledSrcSize()
+	sub.planDimension(&p.Horizontal, false)
+	sub.planDimension(&p.Vertical, true)
+	if sub.srcW != fp.srcW {
+		p.Horizontal.PreReducedFrom = fp.srcW
+	}
+	if sub.srcH != fp.srcH {
+		p.Vertical.PreReducedFrom = fp.srcH
+	}
+	p.WidthFirst = p.Pipelined || sub.dstCanvasW <= sub.srcW
+
+	if fp.srcFPImageN == nil {
+		if fp.srcFPImage == nil && fp.srcRowReader == nil {
+			switch fp.srcImage.(type) {
+			case *image.NRGBA, *image.RGBA, *image.YCbCr, *image.Gray:
+				p.InputLUT = fp.useInputLUT(256)
+			default:
+				p.InputLUT = fp.useInputLUT(65536)
+			}
+		}
+		p.OutputLUT = fp.useOutputLUT(lutKindOutput8, fp.outputLUTSize8()) || fp.useLinearRounding()
+	}
+	return p, nil
+}
+
+// Fill in d, for the given dimension.
+func (fp *FPObject) planDimension(d *PlanDimension, isVertical bool) {
+	d.SourceSize, d.TargetSize = fp.srcW, fp.dstCanvasW
+	if isVertical {
+		d.SourceSize, d.TargetSize = fp.srcH, fp.dstCanvasH
+	}
+	d.ScaleFactor = fp.ScaleFactor(isVertical)
+	d.AreaAverage = fp.areaAverage
+
+	filter := fp.filterFor(isVertical)
+	d.Filter = filter.Name
+	d.Radius = filter.Radius(d.ScaleFactor)
+	d.Blur = 1.0
+	if fp.blurGetter != nil {
+		d.Blur = fp.blurGetter(isVertical)
+	}
+
+	d.Imported = fp.importedWeightList(isVertical) != nil
+	d.FilterWarning = fp.filterScaleProblem(isVertical)
+	wl := fp.createWeightList(isVertical)
+	d.Weights = len(wl)
+	d.AvgTaps, d.MaxTaps = tapsPerSample(wl, d.TargetSize)
+}
+
+// Returns the average and largest number of weights for each of the n
+// target samples in weightList.
+func tapsPerSample(weightList []fpWeight, n int) (float64, int) {
+	if n < 1 {
+		return 0.0, 0
+	}
+	counts := make([]int, n)
+	var maxTaps int
+	for i := range weightList {
+		c := &counts[weightList[i].dstSamIdx]
+		*c++
+		if *c > maxTaps {
+			maxTaps = *c
+		}
+	}
+	return float64(len(weightList)) / float64(n), maxTaps
+}
+
+// Returns the channels that will be processed. If the source image hasn't
+// been converted, this has to be estimated from its type.
+func (fp *FPObject) planChannels() []bool {
+	if fp.srcFPImageN != nil {
+		ch := make([]bool, fp.srcFPImageN.NumChannels)
+		for k := range ch {
+			ch[k] = true
+		}
+		return ch
+	}
+
+	hasColor, hasTransparency := fp.srcHasColor, fp.srcHasTransparency
+	if fp.srcFPImage == nil {
+		var src interface{} = fp.srcImage
+		if fp.srcRowReader != nil {
+			src = fp.srcRowReader
+		}
+		hasTransparency = imageMayHaveTransparency(src)
+		switch src.(type) {
+		case *image.Gray, *image.Gray16:
+			hasColor = false
+		default:
+			hasColor = !fp.forceGray || fp.dataMode
+		}
+	}
+	alpha := (hasTransparency && !fp.usesBackground()) || fp.getVirtualPixels() == VirtualPixelsTransparent
+	return []bool{true, hasColor, hasColor, alpha}
+}
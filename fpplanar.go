@@ -0,0 +1,146 @@
+// ◄◄◄ fpplanar.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements resizing with a planar internal layout.
+
+import "image"
+
+// SetPlanar enables planar mode, in which the image is split into separate
+// planes (one per channel) while it is being resized, instead of keeping
+// the channels of each pixel together. In each resampling pass, the
+// samples that are combined are then next to each other in memory (the
+// vertical pass combines whole rows at a time), which suits the CPU's
+// cache and makes the inner loops simple enough to vectorize. The cost is
+// the time and memory needed to split and rejoin the planes.
+//
+// The result is the same, apart from floating point rounding.
+func (fp *FPObject) SetPlanar(enable bool) {
+	fp.planar = enable
+}
+
+// Resize src one plane at a time. dst is created with the same layout as
+// src. Channels that don't need to be processed are left as zero.
+func (fp *FPObject) resizePlanes(src *FPImageN) *FPImageN {
+	nch := src.NumChannels
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dst := NewFPImageN(image.Rect(0, 0, fp.dstCanvasW, fp.dstCanvasH), nch)
+
+	sub := *fp
+	sub.planar = false
+	sub.channelInfo = []channelInfoType{{mustProcess: true}}
+
+	plane := NewFPImageN(image.Rect(0, 0, w, h), 1)
+	for k := 0; k < nch; k++ {
+		if !fp.channelInfo[k].mustProcess {
+			continue
+		}
+		for j := 0; j < h; j++ {
+			srcRow := src.Pix[j*src.Stride:]
+			planeRow := plane.Pix[j*plane.Stride : j*plane.Stride+w]
+			for i := range planeRow {
+				planeRow[i] = srcRow[i*nch+k]
+			}
+		}
+
+		dstPlane := sub.resizePlaneN(plane)
+
+		for j := 0; j < fp.dstCanvasH; j++ {
+			dstRow := dst.Pix[j*dst.Stride:]
+			planeRow := dstPlane.Pix[j*dstPlane.Stride : j*dstPlane.Stride+fp.dstCanvasW]
+			for i, v := range planeRow {
+				dstRow[i*nch+k] = v
+			}
+		}
+		fp.releaseSamples(dstPlane.Pix)
+	}
+	return dst
+}
+
+// Resize a one-channel image. The horizontal pass is done in the usual
+// way, which has unit stride for a one-channel image. The vertical pass is
+// done by rows.
+func (fp *FPObject) resizePlaneN(src *FPImageN) *FPImageN {
+	hWeights := fp.createWeightList(false)
+	vWeights := fp.createWeightList(true)
+	if fp.dstCanvasW > fp.srcW {
+		intermed := fp.resizeHeightByRows(src, vWeights)
+		dst := fp.resizeWidth(intermed, hWeights, nil)
+		fp.releaseSamples(intermed.Pix)
+		return dst
+	}
+	intermed := fp.resizeWidth(src, hWeights, nil)
+	dst := fp.resizeHeightByRows(intermed, vWeights)
+	fp.releaseSamples(intermed.Pix)
+	return dst
+}
+
+// Data that is constant for all row workers.
+type rowResampleWorkContext struct {
+	src, dst *FPImageN
+	rowLen   int
+	// The weights for each target row.
+	rowWeights [][]fpWeight
+}
+
+// Read target row numbers from workQueue, and compute those rows. A
+// negative number means stop.
+func rowResampleWorker(wc *rowResampleWorkContext, workQueue chan int) {
+	for {
+		row := <-workQueue
+		if row < 0 {
+			return
+		}
+
+		dstRow := wc.dst.Pix[row*wc.dst.Stride : row*wc.dst.Stride+wc.rowLen]
+		for _, wt := range wc.rowWeights[row] {
+			srcRow := wc.src.Pix[wt.srcSamIdx*wc.src.Stride : wt.srcSamIdx*wc.src.Stride+wc.rowLen]
+			for i := range dstRow {
+				dstRow[i] += srcRow[i] * wt.weight
+			}
+		}
+	}
+}
+
+// Create dst, an image with a different height than src, using weightList
+// (from createWeightList(true)). Each target row is computed as a weighted
+// sum of whole source rows, so all channels and columns are processed.
+func (fp *FPObject) resizeHeightByRows(src *FPImageN, weightList []fpWeight) *FPImageN {
+	fp.progressMsgf("Changing height (by rows), %d -> %d", fp.srcH, fp.dstCanvasH)
+
+	wc := new(rowResampleWorkContext)
+	wc.src = src
+	wc.dst = &FPImageN{Rect: image.Rect(0, 0, src.Rect.Dx(), fp.dstCanvasH), NumChannels: src.NumChannels}
+	wc.dst.Stride = src.Rect.Dx() * src.NumChannels
+	wc.dst.Pix = fp.allocSamples(wc.dst.Stride * fp.dstCanvasH)
+	wc.rowLen = src.Rect.Dx() * src.NumChannels
+
+	wc.rowWeights = make([][]fpWeight, fp.dstCanvasH)
+	for _, wt := range weightList {
+		if wt.srcSamIdx >= 0 {
+			// Not a (transparent) virtual pixel
+			wc.rowWeights[wt.dstSamIdx] = append(wc.rowWeights[wt.dstSamIdx], wt)
+		}
+	}
+
+	workQueue := make(chan int)
+	nw := fp.workersFor(StageResample)
+	pt := fp.startProgress(StageResample, "Changing height", fp.dstCanvasH)
+
+	for i := 0; i < nw; i++ {
+		go rowResampleWorker(wc, workQueue)
+	}
+	for row := 0; row < fp.dstCanvasH; row++ {
+		if fp.ctxErr() != nil {
+			break
+		}
+		workQueue <- row
+		pt.add(1)
+	}
+	for i := 0; i < nw; i++ {
+		workQueue <- -1
+	}
+	pt.finish()
+	return wc.dst
+}
@@ -0,0 +1,99 @@
+// ◄◄◄ fpprogress.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements structured progress reporting.
+
+// Progress describes how far along a resize is. It is passed to the function
+// set by SetProgressFunc.
+type Progress struct {
+	Stage int    // The current processing stage (StageConvertSource, etc.)
+	Step  string // A description of the current step, e.g. "Changing width"
+	Done  int    // The number of units of work in this step that are done
+	Total int    // The total number of units of work in this step
+}
+
+// Fraction returns the fraction of the current step that is done, from 0
+// to 1.
+func (p Progress) Fraction() float64 {
+	if p.Total <= 0 {
+		return 1.0
+	}
+	return float64(p.Done) / float64(p.Total)
+}
+
+// StageName returns a short name for a processing stage (a Stage* constant).
+func StageName(stage int) string {
+	switch stage {
+	case StageConvertSource:
+		return "convert source"
+	case StageResample:
+		return "resample"
+	case StageConvertTarget:
+		return "convert target"
+	}
+	return "unknown"
+}
+
+// SetProgressFunc sets a function that is called periodically while an image
+// is being resized, to report how far along it is. A resize consists of
+// several steps, each of which is part of one of the processing stages. Each
+// step begins with a call in which p.Done is 0, and ends with a call in
+// which p.Done equals p.Total. Within a step, the function is called about
+// 100 times at most.
+//
+// The function is called by the goroutine that called the Resize* method,
+// one call at a time, so it should return quickly. nil disables progress
+// reporting.
+func (fp *FPObject) SetProgressFunc(fn func(p Progress)) {
+	fp.progressFunc = fn
+}
+
+// Tracks the progress of one step, and reports it to fp.progressFunc.
+// A nil *progressTracker does nothing.
+type progressTracker struct {
+	fn   func(p Progress)
+	p    Progress
+	next int // Report again when p.Done reaches this.
+	inc  int
+}
+
+// Start a progress step. Returns nil if progress isn't being reported.
+func (fp *FPObject) startProgress(stage int, step string, total int) *progressTracker {
+	if fp.progressFunc == nil {
+		return nil
+	}
+	pt := &progressTracker{fn: fp.progressFunc}
+	pt.p.Stage = stage
+	pt.p.Step = step
+	pt.p.Total = total
+	pt.inc = total / 100
+	if pt.inc < 1 {
+		pt.inc = 1
+	}
+	pt.next = pt.inc
+	pt.fn(pt.p)
+	return pt
+}
+
+// Record that n more units of work are done.
+func (pt *progressTracker) add(n int) {
+	if pt == nil {
+		return
+	}
+	pt.p.Done += n
+	if pt.p.Done >= pt.next && pt.p.Done < pt.p.Total {
+		pt.fn(pt.p)
+		pt.next = pt.p.Done + pt.inc
+	}
+}
+
+// Record that the step is finished.
+func (pt *progressTracker) finish() {
+	if pt == nil {
+		return
+	}
+	pt.p.Done = pt.p.Total
+	pt.fn(pt.p)
+}
@@ -0,0 +1,188 @@
+// ◄◄◄ fpquantize.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements generating a palette for the resized image.
+
+import "image/color"
+import "sort"
+
+// The most pixels that are examined when generating a palette. Larger
+// images are sampled.
+const quantizeMaxSamples = 1 << 20
+
+// SetPaletteSize makes ResizeToImage, with ResizeFlagPalettedOK, generate a
+// palette of up to n colors (2 to 256) for the resized image, instead of
+// using the source image's palette. 0 (the default) disables it. A palette
+// set by SetTargetPalette takes precedence.
+//
+// The palette is made by the median cut method, from the resized image
+// before it is converted to the target colorspace, so that the colors are
+// compared in linear light, with full precision. A palette can't be
+// generated in pipelined mode, since the whole image is not available.
+func (fp *FPObject) SetPaletteSize(n int) {
+	if n > 256 {
+		n = 256
+	}
+	fp.paletteSize = n
+}
+
+// A box of colors, for the median cut method.
+type quantizeBox struct {
+	samples [][4]float32
+	sse     float64 // Sum of the squared distances from the mean
+	mean    [4]float64
+}
+
+func newQuantizeBox(samples [][4]float32) *quantizeBox {
+	b := &quantizeBox{samples: samples}
+	for _, s := range samples {
+		for k := 0; k < 4; k++ {
+			b.mean[k] += float64(s[k])
+		}
+	}
+	for k := 0; k < 4; k++ {
+		b.mean[k] /= float64(len(samples))
+	}
+	for _, s := range samples {
+		for k := 0; k < 4; k++ {
+			d := float64(s[k]) - b.mean[k]
+			b.sse += d * d
+		}
+	}
+	return b
+}
+
+// Splits the box at the median of the channel with the largest variance.
+// Returns nil, nil if it can't be split.
+func (b *quantizeBox) split() (*quantizeBox, *quantizeBox) {
+	var variance [4]float64
+	for _, s := range b.samples {
+		for k := 0; k < 4; k++ {
+			d := float64(s[k]) - b.mean[k]
+			variance[k] += d * d
+		}
+	}
+	axis := 0
+	for k := 1; k < 4; k++ {
+		if variance[k] > variance[axis] {
+			axis = k
+		}
+	}
+
+	sort.Slice(b.samples, func(i, j int) bool { return b.samples[i][axis] < b.samples[j][axis] })
+	m := len(b.samples) / 2
+	// Don't put equal values in both boxes.
+	for m > 0 && b.samples[m-1][axis] == b.samples[m][axis] {
+		m--
+	}
+	if m == 0 {
+		m = len(b.samples) / 2
+		for m < len(b.samples) && b.samples[m-1][axis] == b.samples[m][axis] {
+			m++
+		}
+		if m == len(b.samples) {
+			return nil, nil
+		}
+	}
+	return newQuantizeBox(b.samples[:m]), newQuantizeBox(b.samples[m:])
+}
+
+// Returns the pixels of im (a resized image, in linear light, with
+// associated alpha) to use for making a palette.
+func (fp *FPObject) quantizeSamples(im *FPImage) [][4]float32 {
+	w, h := im.Rect.Dx(), im.Rect.Dy()
+	step := 1
+	for (w/step)*(h/step) > quantizeMaxSamples {
+		step++
+	}
+
+	// The SetExposure and SetLevels adjustments haven't been made yet.
+	scale, offset := float32(1.0), float32(0.0)
+	if fp.hasAdjustments() {
+		scale, offset = fp.adjustmentFactors()
+	}
+
+	samples := make([][4]float32, 0, (w/step+1)*(h/step+1))
+	for j := 0; j < h; j += step {
+		row := im.Pix[j*im.Stride:]
+		for i := 0; i < w; i += step {
+			var s [4]float32
+			copy(s[:], row[i*4:i*4+4])
+			if !fp.mustProcessColor {
+				s[1], s[2] = s[0], s[0]
+			}
+			if !fp.mustProcessTransparency {
+				s[3] = 1.0
+			}
+			for k := 0; k < 3; k++ {
+				s[k] = s[k]*scale - offset*s[3]
+			}
+			for k := 0; k < 4; k++ {
+				if s[k] < 0.0 {
+					s[k] = 0.0
+				} else if s[k] > 1.0 {
+					s[k] = 1.0
+				}
+			}
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
+
+// Generates a palette of up to n colors for im, in the target colorspace.
+func (fp *FPObject) makePalette(im *FPImage, n int) color.Palette {
+	fp.progressMsgf("Generating a palette")
+	samples := fp.quantizeSamples(im)
+	if len(samples) == 0 {
+		return nil
+	}
+
+	boxes := []*quantizeBox{newQuantizeBox(samples)}
+	for len(boxes) < n {
+		// Split the box with the largest error.
+		best := -1
+		for i, b := range boxes {
+			if b.sse > 0.0 && (best < 0 || b.sse > boxes[best].sse) {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+		b1, b2 := boxes[best].split()
+		if b1 == nil {
+			boxes[best].sse = 0.0
+			continue
+		}
+		boxes[best] = b1
+		boxes = append(boxes, b2)
+	}
+
+	// Convert the average colors to the target colorspace.
+	p := make(color.Palette, len(boxes))
+	rgb := make([]float32, 3)
+	for i, b := range boxes {
+		a := float32(b.mean[3])
+		for k := 0; k < 3; k++ {
+			rgb[k] = float32(b.mean[k])
+			if !fp.dataMode && a > 0.0 {
+				rgb[k] /= a
+			}
+			if rgb[k] > 1.0 {
+				rgb[k] = 1.0
+			}
+		}
+		if fp.outputCCF != nil {
+			fp.outputCCF(rgb)
+		}
+		p[i] = color.NRGBA{uint8(rgb[0]*255.0 + 0.5), uint8(rgb[1]*255.0 + 0.5),
+			uint8(rgb[2]*255.0 + 0.5), uint8(a*255.0 + 0.5)}
+		if !fp.dataMode && a <= 0.0 {
+			p[i] = color.NRGBA{}
+		}
+	}
+	return p
+}
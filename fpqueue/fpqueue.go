@@ -0,0 +1,295 @@
+// ◄◄◄ fpqueue/fpqueue.go ►►►
+// Copyright © 2012 Jason Summers
+
+// Package fpqueue is a job queue for resizing images with fpresize, with
+// priorities and deadlines, and limits on the number of jobs that run at
+// the same time and on the memory they use.
+//
+// It is meant for image servers, which can give interactive requests (such
+// as a thumbnail that someone is waiting for) a higher priority than
+// background work (such as regenerating every thumbnail after a change of
+// settings), so that the background work doesn't delay them.
+//
+// Jobs are started in order of priority (highest first), then deadline
+// (earliest first; jobs without a deadline go last), then submission. A job
+// whose deadline passes before it starts is not run. A job that is running
+// is not interrupted.
+package fpqueue
+
+import "container/heap"
+import "errors"
+import "image"
+import "runtime"
+import "sync"
+import "time"
+import "github.com/jsummers/fpresize"
+
+// Errors returned by Ticket.Wait and Queue.Submit.
+var (
+	ErrClosed           = errors.New("fpqueue: the queue is closed")
+	ErrCanceled         = errors.New("fpqueue: the job was canceled")
+	ErrDeadlineExceeded = errors.New("fpqueue: the job's deadline passed before it started")
+)
+
+// A Job describes one image to resize.
+type Job struct {
+	// The source image, and the size of the target image.
+	Source image.Image
+	Width  int
+	Height int
+
+	// Resize makes the target image, from an FPObject that has been given the
+	// source image and the target bounds, so it can change other settings,
+	// and choose the Resize* method. nil means ResizeToNRGBA.
+	Resize func(fp *fpresize.FPObject) (image.Image, error)
+
+	// Jobs with a higher Priority are started first. The default is 0.
+	Priority int
+
+	// If not zero, the job is not run if it hasn't started by Deadline.
+	Deadline time.Time
+
+	// The memory the job needs, in bytes. 0 means to use EstimateMemory.
+	Memory int64
+}
+
+// Options controls a Queue. A nil *Options means the defaults.
+type Options struct {
+	// The most jobs that run at the same time. 0 means the number of CPUs.
+	MaxConcurrent int
+
+	// The most memory (as estimated by Job.Memory) that the running jobs
+	// can use together. A job that needs more than this is only started when
+	// no others are running. 0 means no limit.
+	MaxMemory int64
+
+	// If not 0, the number of worker goroutines that each job's FPObject may
+	// use (see FPObject.SetMaxWorkerThreads). Lower values help when many
+	// jobs run at once.
+	WorkersPerJob int
+}
+
+// EstimateMemory returns the approximate number of bytes fpresize uses to
+// resize a srcW×srcH image to dstW×dstH, not counting the source image:
+// the converted source image, the intermediate image, and the resized
+// image, each with four 32-bit floating point samples per pixel.
+func EstimateMemory(srcW, srcH, dstW, dstH int) int64 {
+	src := int64(srcW) * int64(srcH)
+	dst := int64(dstW) * int64(dstH)
+	// The intermediate image has the target width and source height, or
+	// the reverse, whichever is smaller.
+	intermed := int64(dstW) * int64(srcH)
+	if alt := int64(srcW) * int64(dstH); alt < intermed {
+		intermed = alt
+	}
+	return 16 * (src + intermed + dst)
+}
+
+// A Ticket is the pending result of a submitted job.
+type Ticket struct {
+	q     *Queue
+	job   Job
+	mem   int64
+	seq   uint64
+	index int // The index in q.pending, or -1 if not pending
+
+	done   chan struct{}
+	result image.Image
+	err    error
+}
+
+// Done returns a channel that is closed when the job has finished, or won't
+// be run.
+func (t *Ticket) Done() <-chan struct{} {
+	return t.done
+}
+
+// Wait waits for the job to finish, and returns the resized image.
+func (t *Ticket) Wait() (image.Image, error) {
+	<-t.done
+	return t.result, t.err
+}
+
+// Cancel removes the job from the queue, if it hasn't started, so that Wait
+// returns ErrCanceled. Reports whether it was removed.
+func (t *Ticket) Cancel() bool {
+	q := t.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&q.pending, t.index)
+	q.finish(t, nil, ErrCanceled)
+	return true
+}
+
+// The pending jobs, as a heap ordered by pendingQueue.Less.
+type pendingQueue []*Ticket
+
+func (pq pendingQueue) Len() int {
+	return len(pq)
+}
+
+func (pq pendingQueue) Less(i, j int) bool {
+	a, b := &pq[i].job, &pq[j].job
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if !a.Deadline.Equal(b.Deadline) {
+		if a.Deadline.IsZero() || b.Deadline.IsZero() {
+			return b.Deadline.IsZero()
+		}
+		return a.Deadline.Before(b.Deadline)
+	}
+	return pq[i].seq < pq[j].seq
+}
+
+func (pq pendingQueue) Swap(i, j int) {
+	pq[i], pq[j] = pq[j], pq[i]
+	pq[i].index = i
+	pq[j].index = j
+}
+
+func (pq *pendingQueue) Push(x interface{}) {
+	t := x.(*Ticket)
+	t.index = len(*pq)
+	*pq = append(*pq, t)
+}
+
+func (pq *pendingQueue) Pop() interface{} {
+	old := *pq
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*pq = old[:len(old)-1]
+	t.index = -1
+	return t
+}
+
+// A Queue runs resize jobs. It must be created by New.
+type Queue struct {
+	opts Options
+
+	mu       sync.Mutex
+	pending  pendingQueue
+	seq      uint64
+	running  int
+	memInUse int64
+	closed   bool
+	wg       sync.WaitGroup // Counts the jobs that haven't finished
+}
+
+// New returns a new Queue. opts may be nil.
+func New(opts *Options) *Queue {
+	q := new(Queue)
+	if opts != nil {
+		q.opts = *opts
+	}
+	if q.opts.MaxConcurrent < 1 {
+		q.opts.MaxConcurrent = runtime.NumCPU()
+	}
+	return q
+}
+
+// Submit adds a job to the queue. The job is copied, so it can be reused
+// after Submit returns.
+func (q *Queue) Submit(job *Job) (*Ticket, error) {
+	if job.Source == nil {
+		return nil, errors.New("fpqueue: no source image")
+	}
+	if job.Width < 1 || job.Height < 1 {
+		return nil, errors.New("fpqueue: invalid target size")
+	}
+
+	t := &Ticket{q: q, job: *job, index: -1, done: make(chan struct{})}
+	t.mem = job.Memory
+	if t.mem <= 0 {
+		b := job.Source.Bounds()
+		t.mem = EstimateMemory(b.Dx(), b.Dy(), job.Width, job.Height)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, ErrClosed
+	}
+	q.seq++
+	t.seq = q.seq
+	q.wg.Add(1)
+	heap.Push(&q.pending, t)
+	q.dispatch()
+	return t, nil
+}
+
+// Len returns the number of jobs that are waiting, and the number that are
+// running.
+func (q *Queue) Len() (pending, running int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending), q.running
+}
+
+// Close stops the queue from accepting new jobs, and waits for the jobs
+// that were already submitted to finish.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.wg.Wait()
+}
+
+// Start as many pending jobs as the limits allow. q.mu must be locked.
+func (q *Queue) dispatch() {
+	for len(q.pending) > 0 && q.running < q.opts.MaxConcurrent {
+		t := q.pending[0]
+		if !t.job.Deadline.IsZero() && time.Now().After(t.job.Deadline) {
+			heap.Pop(&q.pending)
+			q.finish(t, nil, ErrDeadlineExceeded)
+			continue
+		}
+		// Wait for memory to be freed, rather than starting a lower priority
+		// job that would fit, so that large jobs aren't put off forever.
+		if q.opts.MaxMemory > 0 && q.running > 0 && q.memInUse+t.mem > q.opts.MaxMemory {
+			return
+		}
+		heap.Pop(&q.pending)
+		q.running++
+		q.memInUse += t.mem
+		go q.run(t)
+	}
+}
+
+// Run a job, then start the next ones.
+func (q *Queue) run(t *Ticket) {
+	result, err := q.resize(&t.job)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running--
+	q.memInUse -= t.mem
+	q.finish(t, result, err)
+	q.dispatch()
+}
+
+func (q *Queue) resize(job *Job) (image.Image, error) {
+	fp := fpresize.New(job.Source)
+	fp.SetTargetBounds(image.Rect(0, 0, job.Width, job.Height))
+	if q.opts.WorkersPerJob > 0 {
+		fp.SetMaxWorkerThreads(q.opts.WorkersPerJob)
+	}
+	if job.Resize != nil {
+		return job.Resize(fp)
+	}
+	im, err := fp.ResizeToNRGBA()
+	if err != nil {
+		return nil, err
+	}
+	return im, nil
+}
+
+// Record the result of a job that has finished, or won't be run.
+func (q *Queue) finish(t *Ticket, result image.Image, err error) {
+	t.result, t.err = result, err
+	close(t.done)
+	q.wg.Done()
+}
@@ -0,0 +1,140 @@
+// ◄◄◄ fpqueue/fpqueue_test.go ►►►
+
+// Tests for the fpqueue package.
+
+package fpqueue
+
+import "testing"
+import "image"
+import "sync"
+import "time"
+import "github.com/jsummers/fpresize"
+
+func testSource() image.Image {
+	return image.NewNRGBA(image.Rect(0, 0, 40, 30))
+}
+
+func TestQueue(t *testing.T) {
+	q := New(nil)
+	var tickets []*Ticket
+	for i := 1; i <= 5; i++ {
+		tk, err := q.Submit(&Job{Source: testSource(), Width: i * 3, Height: i * 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tickets = append(tickets, tk)
+	}
+	for i, tk := range tickets {
+		im, err := tk.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if im.Bounds() != image.Rect(0, 0, (i+1)*3, (i+1)*2) {
+			t.Errorf("job %d: got bounds %v", i, im.Bounds())
+		}
+	}
+	q.Close()
+	if _, err := q.Submit(&Job{Source: testSource(), Width: 3, Height: 3}); err != ErrClosed {
+		t.Errorf("Submit after Close: got error %v", err)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	q := New(&Options{MaxConcurrent: 1})
+
+	// A job that runs until it is released, so that the others have to wait.
+	release := make(chan struct{})
+	started := make(chan struct{})
+	blocker, err := q.Submit(&Job{Source: testSource(), Width: 5, Height: 5,
+		Resize: func(fp *fpresize.FPObject) (image.Image, error) {
+			close(started)
+			<-release
+			return fp.ResizeToNRGBA()
+		}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	var mu sync.Mutex
+	var order []string
+	job := func(name string, priority int, deadline time.Time) *Ticket {
+		tk, err := q.Submit(&Job{Source: testSource(), Width: 5, Height: 5, Priority: priority,
+			Deadline: deadline, Resize: func(fp *fpresize.FPObject) (image.Image, error) {
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+				return fp.ResizeToNRGBA()
+			}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tk
+	}
+	later := time.Now().Add(time.Hour)
+	job("background", -1, time.Time{})
+	job("normal", 0, time.Time{})
+	job("urgent", 0, later)
+	job("interactive", 10, time.Time{})
+	canceled := job("canceled", 5, time.Time{})
+	expired := job("expired", 20, time.Now().Add(-time.Second))
+
+	if pending, running := q.Len(); pending != 6 || running != 1 {
+		t.Errorf("got %d pending and %d running jobs", pending, running)
+	}
+	if !canceled.Cancel() {
+		t.Errorf("Cancel failed")
+	}
+	close(release)
+	if _, err := blocker.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	if _, err := canceled.Wait(); err != ErrCanceled {
+		t.Errorf("canceled job: got error %v", err)
+	}
+	if _, err := expired.Wait(); err != ErrDeadlineExceeded {
+		t.Errorf("expired job: got error %v", err)
+	}
+	want := []string{"interactive", "urgent", "normal", "background"}
+	if len(order) != len(want) {
+		t.Fatalf("got order %v, expected %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("got order %v, expected %v", order, want)
+		}
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	mem := EstimateMemory(40, 30, 20, 15)
+	q := New(&Options{MaxConcurrent: 4, MaxMemory: mem + mem/2, WorkersPerJob: 1})
+
+	var mu sync.Mutex
+	var running, maxRunning int
+	for i := 0; i < 8; i++ {
+		_, err := q.Submit(&Job{Source: testSource(), Width: 20, Height: 15,
+			Resize: func(fp *fpresize.FPObject) (image.Image, error) {
+				mu.Lock()
+				running++
+				if running > maxRunning {
+					maxRunning = running
+				}
+				mu.Unlock()
+				time.Sleep(time.Millisecond)
+				mu.Lock()
+				running--
+				mu.Unlock()
+				return fp.ResizeToNRGBA()
+			}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Close()
+	if maxRunning != 1 {
+		t.Errorf("%d jobs ran at once, expected 1", maxRunning)
+	}
+}
@@ -0,0 +1,149 @@
+// ◄◄◄ fpreduce.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements fast pre-reduction of the source image, for very
+// large reductions.
+
+import "image"
+import "math"
+
+// Pre-reduction modes, for use with SetPreReduce.
+const (
+	// Pre-reduce when reducing by a factor of at least 16. This is the
+	// default.
+	PreReduceAuto = iota
+	// Never pre-reduce.
+	PreReduceNever
+	// Pre-reduce whenever it would make a difference.
+	PreReduceAlways
+)
+
+// The reduction factor at which PreReduceAuto starts to pre-reduce.
+const preReduceAutoFactor = 16.0
+
+// Pre-reduction reduces the image to this many times the target size.
+const preReduceMultiple = 4
+
+// SetPreReduce controls pre-reduction (a PreReduce* constant). When an
+// image is reduced by a large factor (e.g. a 100-megapixel photo to a 256
+// pixel thumbnail), most of the time is spent applying the filter, whose
+// cost is proportional to the reduction factor. With pre-reduction, the
+// source image is first reduced to a few times the target size by simple
+// averaging, using an integral image (summed-area table), whose cost doesn't
+// depend on the reduction factor. Then the filter is applied as usual. The
+// difference in quality is small, because the averaging only blurs
+// details that are much smaller than a target pixel.
+//
+// Pre-reduction is done separately for each dimension. It is not used
+// with SetAreaAverage, PixelAlignCorners, or in pipelined mode.
+func (fp *FPObject) SetPreReduce(mode int) {
+	fp.preReduce = mode
+}
+
+// Returns the size to pre-reduce the given dimension of the source image
+// to, or the size of the source image if it shouldn't be pre-reduced.
+func (fp *FPObject) preReduceSize(isVertical bool) int {
+	srcN, dstTrueN := fp.srcW, fp.dstTrueW
+	if isVertical {
+		srcN, dstTrueN = fp.srcH, fp.dstTrueH
+	}
+	if fp.areaAverage || fp.alignCorners(isVertical) {
+		return srcN
+	}
+
+	factor := float64(srcN) / dstTrueN
+	switch fp.preReduce {
+	case PreReduceAuto:
+		if factor < preReduceAutoFactor {
+			return srcN
+		}
+	case PreReduceAlways:
+	default:
+		return srcN
+	}
+
+	n := preReduceMultiple * int(math.Ceil(dstTrueN))
+	if n >= srcN {
+		return srcN
+	}
+	return n
+}
+
+// Returns the size of the source image that is resampled: the pre-reduced
+// size, if the image will be pre-reduced.
+func (fp *FPObject) resampledSrcSize() (int, int) {
+	if fp.pipelined && fp.srcFPImageN == nil {
+		return fp.srcW, fp.srcH
+	}
+	return fp.preReduceSize(false), fp.preReduceSize(true)
+}
+
+// Returns the positions of the boundaries between n equal-sized groups of
+// srcN samples.
+func preReduceBoundaries(srcN, n int) []int {
+	b := make([]int, n+1)
+	for i := range b {
+		b[i] = int(int64(i) * int64(srcN) / int64(n))
+	}
+	return b
+}
+
+// Reduce src to w×h, by averaging the samples in each box of source pixels.
+// The boxes are at integer positions, so their sizes vary by no more than 1
+// source pixel (which is much smaller than a target pixel).
+//
+// Instead of storing the whole integral image, it is computed one row at a
+// time, and only its values at the box boundaries are kept.
+func (fp *FPObject) preReduceImage(src *FPImageN, w, h int) *FPImageN {
+	nch := src.NumChannels
+	srcW, srcH := src.Rect.Dx(), src.Rect.Dy()
+	xb := preReduceBoundaries(srcW, w)
+	yb := preReduceBoundaries(srcH, h)
+
+	dst := NewFPImageN(image.Rect(0, 0, w, h), nch)
+
+	// The integral image at the current row, and at the previous row
+	// boundary, at each column boundary.
+	cur := make([]float64, (w+1)*nch)
+	prev := make([]float64, (w+1)*nch)
+
+	j := 0 // The target row
+	for sy := 0; sy < srcH; sy++ {
+		row := src.Pix[sy*src.Stride:]
+		for k := 0; k < nch; k++ {
+			if !fp.channelInfo[k].mustProcess {
+				continue
+			}
+			var rowSum float64
+			sx := 0
+			for i := 1; i <= w; i++ {
+				for ; sx < xb[i]; sx++ {
+					rowSum += float64(row[sx*nch+k])
+				}
+				cur[i*nch+k] += rowSum
+			}
+		}
+
+		if sy+1 < yb[j+1] {
+			continue
+		}
+
+		// This is the last row of target row j.
+		dstRow := dst.Pix[j*dst.Stride:]
+		for i := 0; i < w; i++ {
+			area := float64((xb[i+1] - xb[i]) * (yb[j+1] - yb[j]))
+			for k := 0; k < nch; k++ {
+				if !fp.channelInfo[k].mustProcess {
+					continue
+				}
+				sum := (cur[(i+1)*nch+k] - cur[i*nch+k]) - (prev[(i+1)*nch+k] - prev[i*nch+k])
+				dstRow[i*nch+k] = float32(sum / area)
+			}
+		}
+		copy(prev, cur)
+		j++
+	}
+	return dst
+}
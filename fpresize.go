@@ -6,9 +6,12 @@ package fpresize
 // This is the main file of the fpresize library.
 // It implements the resize algorithm, and most of the API.
 
+import "context"
 import "image"
+import "image/color"
 import "math"
 import "errors"
+import "fmt"
 import "runtime"
 
 // FPObject is an opaque struct that tracks the state of the resize process.
@@ -31,10 +34,78 @@ type FPObject struct {
 	dstTrueW float64
 	dstTrueH float64
 
+	// The target bounds and offsets, as set by SetTargetBounds[Advanced].
+	// The dstBounds, dstCanvas*, and dstOffset* fields are the same, unless
+	// they have been restricted to the region of interest (see
+	// resolveRegionOfInterest).
+	dstFullBounds  image.Rectangle
+	dstFullOffsetX float64
+	dstFullOffsetY float64
+	// Set by SetTargetRegionOfInterest
+	dstROI    image.Rectangle
+	dstROISet bool
+
 	// Source image in FP format. This is recorded, so that it can be
 	// resized multiple times.
 	srcFPImage *FPImage
 
+	// Set if the source is an FPImageN, instead of an image.Image.
+	srcFPImageN *FPImageN
+
+	// Set if the source is a RowReader, instead of an image.Image.
+	srcRowReader RowReader
+
+	// The source image's palette, if it is an image.Paletted.
+	srcPalette color.Palette
+	// The result of AnalyzeSource, if it has been called.
+	srcInfo *SourceInfo
+	// The palette set by SetTargetPalette.
+	dstPalette color.Palette
+	// Set by SetPaletteDither
+	paletteDither bool
+	// Set by SetPaletteDitherOffset
+	paletteDitherOffset image.Point
+	// Set by SetPaletteSize
+	paletteSize int
+	// The resized image, while a dstPrepareFunc is being called (except in
+	// pipelined mode), so that a palette can be made for it.
+	dstFPImage *FPImage
+	// The row alignment set by SetTargetRowAlignment.
+	dstRowAlignment int
+	// The ResizeFlagGray and ResizeFlagDropAlpha flags, during a call to
+	// ResizeToImage.
+	dstHints uint32
+	// The caller's buffer, during a call to ResizeToBuffer.
+	dstBuffer       []uint8
+	dstBufferStride int
+	// Set during a call to EncodeResized. The target image is only one band
+	// tall, and dstBandFn is called with it after each band is converted.
+	dstBandFn func(band image.Image, y0 int)
+
+	// The source image's resolution, set by SetSourceDPI
+	srcDPI float64
+
+	// Set by SetRegionProvider
+	regionProvider RegionProvider
+	// Set by SetFocalPoint
+	focalX, focalY float64
+	focalSet       bool
+	// A Gravity* constant, set by SetGravity
+	gravity int
+
+	// Set by SetExposure and SetLevels
+	exposure                 float64
+	levelsBlack, levelsWhite float64
+	levelsSet                bool
+
+	// Set by SetChannelOrder
+	channelOrder    [4]int
+	channelOrderSet bool
+
+	// Set by SetSourceRowHook and SetOutputRowHook
+	sourceRowHook RowHook
+	outputRowHook RowHook
+
 	srcHasTransparency      bool // Does the source image have transparency?
 	srcHasColor             bool // Is the source image NOT grayscale (or gray+alpha)?
 	mustProcessTransparency bool // Do we need to process an alpha channel?
@@ -42,6 +113,9 @@ type FPObject struct {
 
 	filterGetter FilterGetter
 	blurGetter   BlurGetter
+	srcMask      image.Image     // Set by SetSourceMask
+	background   color.Color     // Set by SetBackgroundColor
+	ctx          context.Context // Set by SetContext
 
 	inputCCFSet    bool
 	inputCCF       ColorConverter
@@ -49,15 +123,66 @@ type FPObject struct {
 	outputCCFSet   bool
 	outputCCF      ColorConverter
 	outputCCFFlags uint32
-
-	virtualPixels int // A virtPix* constant
+	inputLUT       *ColorLUT
+	outputLUT      *ColorLUT
+	linearRounding bool // Set by SetLinearRounding
+	// Set by SetLUTMode, SetLUTThreshold, and SetOutputLUTSizes
+	lutMode         int
+	lutThreshold    float64
+	outputLUTSize   int
+	outputLUT16Size int
+	// The measured costs of the color converters, for LUTModeAuto
+	inputCCFCost  *ccfCost
+	outputCCFCost *ccfCost
+	// Set by SetOutputColorspace
+	outputColorspace *ColorspaceInfo
+
+	virtualPixels    int  // A VirtualPixels* constant, if virtualPixelsSet
+	virtualPixelsSet bool // Was SetVirtualPixels called?
+	advancedBounds   bool // Were the bounds set by SetTargetBoundsAdvanced?
+	strictBounds     bool // Set by SetStrictTargetBounds
+	strictFilter     bool // Set by SetStrictFilterScale
+	dstBoundsAdjust  bool // Did setTargetCanvasBounds have to enlarge the bounds?
+	pixelAlignment   int  // A PixelAlign* constant
+	areaAverage      bool // Set by SetAreaAverage
+	preReduce        int  // A PreReduce* constant
+	planar           bool // Set by SetPlanar
+	alphaWeighting   bool // Set by SetAlphaWeighting
+
+	// Set by SetDiskBacked. mappedFiles records the memory-mapped temp
+	// files in use, by the address of their first sample.
+	diskBacked    bool
+	diskBackedDir string
+	mappedFiles   map[*float32][]byte
+
+	// Weight lists loaded by ImportWeights
+	importedWeights []*weightTable
+	// The weight lists made since the last Reset, and those kept by Reset
+	weightLog   *weightLog
+	keptWeights []*weightTable
+
+	// Set if a setting that affects how the source image is converted was
+	// changed after the converted image was saved in srcFPImage.
+	lateSrcSetting bool
+
+	dataMode    bool    // Are the samples non-color data?
+	dataMin     float64 // The value represented by a sample of 0.
+	dataMax     float64 // The value represented by a maximum-valued sample.
+	renormalize bool    // Renormalize (R,G,B) vectors, in data mode.
+
+	pipelined bool // Convert, resize, and emit the image in bands.
+	forceGray bool // Convert the source image to grayscale.
 
 	progressCallback func(format string, a ...interface{})
+	progressFunc     func(p Progress)
 
-	numWorkers int // Number of worker goroutines we will use
-	maxWorkers int // Max number requested by caller. 0 = not set.
+	numWorkers   int                // Number of worker goroutines we will use
+	maxWorkers   int                // Max number requested by caller. 0 = not set.
+	exactWorkers int                // Exact number requested by caller. 0 = not set.
+	stageWorkers [numWorkStages]int // Per-stage overrides. 0 = not set.
 
-	channelInfo [4]channelInfoType
+	// One element per channel of the image being resized.
+	channelInfo []channelInfoType
 }
 
 type channelInfoType struct {
@@ -69,6 +194,58 @@ type channelInfoType struct {
 const (
 	VirtualPixelsNone = iota
 	VirtualPixelsTransparent
+	// Pixels outside the image are copies of the nearest edge pixel (this is
+	// sometimes called clamping).
+	VirtualPixelsReplicate
+	// The image is reflected at its edges.
+	VirtualPixelsMirror
+	// The image is repeated in every direction (wrapping), as is needed for
+	// tileable textures.
+	VirtualPixelsTile
+)
+
+// Returns the sample inside an image of n samples to use for sample idx,
+// which may be outside the image, for the given VirtualPixels setting.
+// Samples inside the image are returned unchanged.
+func edgeSample(idx, n int, virtualPixels int) int {
+	if idx >= 0 && idx < n {
+		return idx
+	}
+	switch virtualPixels {
+	case VirtualPixelsReplicate:
+		if idx < 0 {
+			return 0
+		}
+		return n - 1
+	case VirtualPixelsMirror:
+		idx %= 2 * n
+		if idx < 0 {
+			idx += 2 * n
+		}
+		if idx >= n {
+			idx = 2*n - 1 - idx
+		}
+		return idx
+	case VirtualPixelsTile:
+		idx %= n
+		if idx < 0 {
+			idx += n
+		}
+		return idx
+	}
+	return idx
+}
+
+// Pixel alignment conventions, for use with SetPixelAlignment.
+const (
+	// The edges of the source image are mapped to the edges of the target
+	// image (so the centers of the pixels are at "+0.5" positions). This is
+	// the default.
+	PixelAlignCenters = iota
+	// The centers of the corner pixels of the source image are mapped to the
+	// centers of the corner pixels of the target image (like the
+	// "align corners" option of some other libraries).
+	PixelAlignCorners
 )
 
 // A ColorConverter is passed a slice of samples. It converts them all to
@@ -84,6 +261,10 @@ const (
 	// If set via Set*ColorConverterFlags(), the R, G, and B channels may have
 	// different response curves.
 	CCFFlagWholePixels = 0x00000002
+	// If set via Set*ColorConverterFlags(), lookup tables made from the
+	// color converter will not be shared with other FPObjects. See
+	// SetSharedLUTCache.
+	CCFFlagNoSharedCache = 0x00000004
 )
 
 // A FilterGetter is a function that returns a Filter. The isVertical
@@ -101,8 +282,19 @@ type fpWeight struct {
 	weight    float32
 }
 
+// Return a weightlist for the given dimension: one that was imported or kept
+// for the same geometry, or a new one.
+func (fp *FPObject) createWeightList(isVertical bool) []fpWeight {
+	if wl := fp.importedWeightList(isVertical); wl != nil {
+		return wl
+	}
+	wl := fp.computeWeightList(isVertical)
+	fp.logWeights(isVertical, wl)
+	return wl
+}
+
 // Create and return a weightlist for the given dimension, using fp.filter.
-func (fp *FPObject) createWeightList(isVertical bool) (weightList []fpWeight) {
+func (fp *FPObject) computeWeightList(isVertical bool) (weightList []fpWeight) {
 	var filter *Filter
 	var radius float64
 	var filterFlags uint32
@@ -114,6 +306,10 @@ func (fp *FPObject) createWeightList(isVertical bool) (weightList []fpWeight) {
 	var reductionFactor float64
 	var weightsUsed int
 
+	if fp.areaAverage {
+		return fp.createAreaWeightList(isVertical)
+	}
+
 	if isVertical {
 		srcN, dstCanvasN = fp.srcH, fp.dstCanvasH
 		dstTrueN = fp.dstTrueH
@@ -124,9 +320,17 @@ func (fp *FPObject) createWeightList(isVertical bool) (weightList []fpWeight) {
 		dstOffset = fp.dstOffsetX
 	}
 	srcN_flt = float64(srcN)
-	scaleFactor = dstTrueN / srcN_flt
+	scaleFactor = fp.ScaleFactor(isVertical)
+	virtualPixels := fp.getVirtualPixels()
+	alignCorners := fp.alignCorners(isVertical)
 
-	if dstTrueN < srcN_flt {
+	if alignCorners {
+		if scaleFactor < 1.0 {
+			reductionFactor = 1.0 / scaleFactor
+		} else {
+			reductionFactor = 1.0
+		}
+	} else if dstTrueN < srcN_flt {
 		reductionFactor = srcN_flt / dstTrueN
 	} else {
 		reductionFactor = 1.0
@@ -136,14 +340,7 @@ func (fp *FPObject) createWeightList(isVertical bool) (weightList []fpWeight) {
 		reductionFactor *= fp.blurGetter(isVertical)
 	}
 
-	if fp.filterGetter != nil {
-		filter = fp.filterGetter(isVertical)
-	}
-	if filter == nil {
-		// Our default filter
-		filter = MakeLanczosFilter(2)
-	}
-
+	filter = fp.filterFor(isVertical)
 	radius = filter.Radius(scaleFactor)
 
 	if filter.Flags != nil {
@@ -155,40 +352,72 @@ func (fp *FPObject) createWeightList(isVertical bool) (weightList []fpWeight) {
 	weightListCap := int(1.0 + (1.01+2.0*radius*reductionFactor)*float64(dstCanvasN))
 	weightList = make([]fpWeight, weightListCap)
 
+	// The filter arguments, source sample indices, and filter values, for
+	// the current sample
+	var args, vals []float64
+	var srcIdxs []int
+
 	for dstSamIdx := 0; dstSamIdx < dstCanvasN; dstSamIdx++ {
 		var v_norm float64 // Sum of the filter values for the current sample
 		var v_count int    // Number of weights used by the current sample
 
 		// Figure out the range of src samples that are relevent to this dst sample.
-		posInSrc := ((0.5+float64(dstSamIdx)-dstOffset)/dstTrueN)*srcN_flt - 0.5
+		var posInSrc float64
+		if alignCorners {
+			posInSrc = (float64(dstSamIdx) - dstOffset) / scaleFactor
+		} else {
+			posInSrc = ((0.5+float64(dstSamIdx)-dstOffset)/dstTrueN)*srcN_flt - 0.5
+		}
 		firstSrcSamIdx := int(math.Ceil(posInSrc - radius*reductionFactor - 0.0001))
 		lastSrcSamIdx := int(math.Floor(posInSrc + radius*reductionFactor + 0.0001))
 
 		v_norm = 0.0
 		v_count = 0
 
-		// Iterate through the input samples that affect this output sample
+		// Collect the arguments to pass to the filter function, for the input
+		// samples that affect this output sample.
+		args = args[:0]
+		srcIdxs = srcIdxs[:0]
 		for srcSamIdx := firstSrcSamIdx; srcSamIdx <= lastSrcSamIdx; srcSamIdx++ {
-			var isVirtual bool
-
-			if srcSamIdx >= 0 && srcSamIdx < srcN {
-				isVirtual = false
-			} else {
-				if fp.virtualPixels == VirtualPixelsNone {
+			idx := srcSamIdx
+			if srcSamIdx < 0 || srcSamIdx >= srcN {
+				switch virtualPixels {
+				case VirtualPixelsNone:
 					continue
+				case VirtualPixelsTransparent:
+				default:
+					// Use a sample from inside the image.
+					idx = edgeSample(srcSamIdx, srcN, virtualPixels)
 				}
-				isVirtual = true
 			}
-
-			// arg is the value passed to the filter function;
-			// v is the value returned by the filter function.
 			arg := (float64(srcSamIdx) - posInSrc) / reductionFactor
 			// For convenience, (usually) don't supply negative arguments to filters.
 			if (arg < 0.0) && (filterFlags&FilterFlagAsymmetric == 0) {
 				arg = -arg
 			}
+			args = append(args, arg)
+			srcIdxs = append(srcIdxs, idx)
+		}
+
+		// Evaluate the filter, all at once if possible.
+		if cap(vals) < len(args) {
+			vals = make([]float64, len(args), 2*len(args))
+		}
+		vals = vals[:len(args)]
+		if filter.FVec != nil {
+			filter.FVec(args, scaleFactor, vals)
+		} else {
+			for n := range args {
+				vals[n] = filter.F(args[n], scaleFactor)
+			}
+		}
+
+		// Iterate through the input samples that affect this output sample
+		for n, srcSamIdx := range srcIdxs {
+			isVirtual := srcSamIdx < 0 || srcSamIdx >= srcN
 
-			v := filter.F(arg, scaleFactor)
+			// v is the value returned by the filter function.
+			v := vals[n]
 			if v == 0.0 {
 				continue
 			}
@@ -227,6 +456,71 @@ func (fp *FPObject) createWeightList(isVertical bool) (weightList []fpWeight) {
 	return
 }
 
+// Create and return a weightlist for the given dimension, in which each
+// target sample is the exact average of the part of the source image that
+// it covers. Each weight is the length of the overlap between a source
+// sample and the target sample's footprint.
+func (fp *FPObject) createAreaWeightList(isVertical bool) []fpWeight {
+	srcN, dstCanvasN := fp.srcW, fp.dstCanvasW
+	dstTrueN, dstOffset := fp.dstTrueW, fp.dstOffsetX
+	if isVertical {
+		srcN, dstCanvasN = fp.srcH, fp.dstCanvasH
+		dstTrueN, dstOffset = fp.dstTrueH, fp.dstOffsetY
+	}
+	srcPerDst := float64(srcN) / dstTrueN
+	virtualPixels := fp.getVirtualPixels()
+	extendEdges := virtualPixels != VirtualPixelsNone && virtualPixels != VirtualPixelsTransparent
+
+	weightList := make([]fpWeight, 0, int(float64(dstCanvasN)*(srcPerDst+3.0)))
+
+	for dstSamIdx := 0; dstSamIdx < dstCanvasN; dstSamIdx++ {
+		// The footprint of this target sample, in source coordinates.
+		a := (float64(dstSamIdx) - dstOffset) * srcPerDst
+		b := (float64(dstSamIdx+1) - dstOffset) * srcPerDst
+		if (b <= 0.0 || a >= float64(srcN)) && !extendEdges {
+			// Entirely outside the source image
+			continue
+		}
+
+		first := len(weightList)
+		var total float64
+
+		firstSrcSamIdx := int(math.Floor(a))
+		lastSrcSamIdx := int(math.Ceil(b)) - 1
+		if !extendEdges {
+			if firstSrcSamIdx < 0 {
+				firstSrcSamIdx = 0
+			}
+			if lastSrcSamIdx > srcN-1 {
+				lastSrcSamIdx = srcN - 1
+			}
+		}
+		for srcSamIdx := firstSrcSamIdx; srcSamIdx <= lastSrcSamIdx; srcSamIdx++ {
+			overlap := math.Min(b, float64(srcSamIdx+1)) - math.Max(a, float64(srcSamIdx))
+			if overlap <= 0.0 {
+				continue
+			}
+			weightList = append(weightList, fpWeight{srcSamIdx: edgeSample(srcSamIdx, srcN, virtualPixels),
+				dstSamIdx: dstSamIdx, weight: float32(overlap)})
+			total += overlap
+		}
+
+		if virtualPixels == VirtualPixelsTransparent {
+			// The part of the footprint outside the source image is
+			// transparent, so it counts toward the total.
+			total = b - a
+		}
+		if total <= 0.0 {
+			weightList = weightList[:first]
+			continue
+		}
+		for w := first; w < len(weightList); w++ {
+			weightList[w].weight = float32(float64(weightList[w].weight) / total)
+		}
+	}
+	return weightList
+}
+
 // Data that is constant for all workers.
 type resampleWorkContext struct {
 	weightList []fpWeight
@@ -254,20 +548,39 @@ func resampleWorker(wc *resampleWorkContext, workQueue chan resampleWorkItem) {
 			return
 		}
 
-		// Resample one row or column.
-		for i := range wc.weightList {
-			if wc.weightList[i].srcSamIdx >= 0 {
-				// Not a (transparent) virtual pixel
-				wi.dstSam[wc.weightList[i].dstSamIdx*wc.dstStride] += wi.srcSam[wc.weightList[i].srcSamIdx*
-					wc.srcStride] * wc.weightList[i].weight
-			}
+		resampleLine(wc.weightList, wi.srcSam, wi.dstSam, wc.srcStride, wc.dstStride)
+	}
+}
+
+// Resample one row or column.
+func resampleLine(weightList []fpWeight, srcSam, dstSam []float32, srcStride, dstStride int) {
+	for i := range weightList {
+		if weightList[i].srcSamIdx >= 0 {
+			// Not a (transparent) virtual pixel
+			dstSam[weightList[i].dstSamIdx*dstStride] += srcSam[weightList[i].srcSamIdx*
+				srcStride] * weightList[i].weight
+		}
+	}
+}
+
+// Returns a slice that tells which of the n source rows or columns are used
+// by weightList.
+func srcLinesUsed(weightList []fpWeight, n int) []bool {
+	used := make([]bool, n)
+	for i := range weightList {
+		if weightList[i].srcSamIdx >= 0 {
+			used[weightList[i].srcSamIdx] = true
 		}
 	}
+	return used
 }
 
-// Create dst, an image with a different height than src.
+// Create dst, an image with a different height than src, using weightList
+// (from createWeightList(true)).
 // dst's origin will be (0,0).
-func (fp *FPObject) resizeHeight(src *FPImage) (dst *FPImage) {
+// If colsUsed is not nil, only the columns for which it is true are resized;
+// the others are left as zero.
+func (fp *FPObject) resizeHeight(src *FPImageN, weightList []fpWeight, colsUsed []bool) (dst *FPImageN) {
 	var nSamples int
 	var w int // width of both images
 	var wi resampleWorkItem
@@ -276,35 +589,42 @@ func (fp *FPObject) resizeHeight(src *FPImage) (dst *FPImage) {
 	fp.progressMsgf("Changing height, %d -> %d", fp.srcH, fp.dstCanvasH)
 
 	wc := new(resampleWorkContext)
-	dst = new(FPImage)
+	dst = new(FPImageN)
 
 	w = src.Rect.Dx()
+	nch := src.NumChannels
 
 	dst.Rect.Min.X = 0
 	dst.Rect.Min.Y = 0
 	dst.Rect.Max.X = w
 	dst.Rect.Max.Y = fp.dstCanvasH
+	dst.NumChannels = nch
 
-	dst.Stride = w * 4
+	dst.Stride = w * nch
 	nSamples = dst.Stride * fp.dstCanvasH
-	dst.Pix = make([]float32, nSamples)
+	dst.Pix = fp.allocSamples(nSamples)
 
-	wc.weightList = fp.createWeightList(true)
+	wc.weightList = weightList
 
 	wc.srcStride = src.Stride
 	wc.dstStride = dst.Stride
 
 	workQueue := make(chan resampleWorkItem)
+	nw := fp.workersFor(StageResample)
+	pt := fp.startProgress(StageResample, "Changing height", w)
 
 	// Start workers
-	for i = 0; i < fp.numWorkers; i++ {
+	for i = 0; i < nw; i++ {
 		go resampleWorker(wc, workQueue)
 	}
 
 	// Iterate over the columns (of which src and dst have the same number).
 	// Columns of *samples*, that is, not pixels.
-	for col := 0; col < 4*w; col++ {
-		if fp.channelInfo[col%4].mustProcess {
+	for col := 0; col < nch*w; col++ {
+		if col%nch == 0 && fp.ctxErr() != nil {
+			break
+		}
+		if fp.channelInfo[col%nch].mustProcess && (colsUsed == nil || colsUsed[col/nch]) {
 			wi.srcSam = src.Pix[col:]
 			wi.dstSam = dst.Pix[col:]
 			// Assign the work to whatever worker happens to be available to receive it.
@@ -312,18 +632,25 @@ func (fp *FPObject) resizeHeight(src *FPImage) (dst *FPImage) {
 			// pass it again.
 			workQueue <- wi
 		}
+		if col%nch == nch-1 {
+			pt.add(1)
+		}
 	}
 
 	// Tell the workers to stop, and block until they all receive our Stop message.
 	wi.stopNow = true
-	for i = 0; i < fp.numWorkers; i++ {
+	for i = 0; i < nw; i++ {
 		workQueue <- wi
 	}
+	pt.finish()
 	return
 }
 
-// Create dst, an image with a different width than src.
-func (fp *FPObject) resizeWidth(src *FPImage) (dst *FPImage) {
+// Create dst, an image with a different width than src, using weightList
+// (from createWeightList(false)).
+// If rowsUsed is not nil, only the rows for which it is true are resized;
+// the others are left as zero.
+func (fp *FPObject) resizeWidth(src *FPImageN, weightList []fpWeight, rowsUsed []bool) (dst *FPImageN) {
 	var nSamples int
 	var h int // height of both images
 	var wi resampleWorkItem
@@ -332,45 +659,58 @@ func (fp *FPObject) resizeWidth(src *FPImage) (dst *FPImage) {
 	fp.progressMsgf("Changing width, %d -> %d", fp.srcW, fp.dstCanvasW)
 
 	wc := new(resampleWorkContext)
-	dst = new(FPImage)
+	dst = new(FPImageN)
 
 	h = src.Rect.Dy()
+	nch := src.NumChannels
 
 	dst.Rect.Min.X = 0
 	dst.Rect.Min.Y = 0
 	dst.Rect.Max.X = fp.dstCanvasW
 	dst.Rect.Max.Y = h
-	dst.Stride = fp.dstCanvasW * 4
+	dst.NumChannels = nch
+	dst.Stride = fp.dstCanvasW * nch
 	nSamples = dst.Stride * h
-	dst.Pix = make([]float32, nSamples)
+	dst.Pix = fp.allocSamples(nSamples)
 
-	wc.weightList = fp.createWeightList(false)
+	wc.weightList = weightList
 
-	wc.srcStride = 4
-	wc.dstStride = 4
+	wc.srcStride = nch
+	wc.dstStride = nch
 
 	workQueue := make(chan resampleWorkItem)
+	nw := fp.workersFor(StageResample)
+	pt := fp.startProgress(StageResample, "Changing width", h)
 
-	for i = 0; i < fp.numWorkers; i++ {
+	for i = 0; i < nw; i++ {
 		go resampleWorker(wc, workQueue)
 	}
 
 	// Iterate over the rows (of which src and dst have the same number)
 	for row := 0; row < h; row++ {
-		// Iterate over R,G,B,A
-		for k := 0; k < 4; k++ {
+		if fp.ctxErr() != nil {
+			break
+		}
+		if rowsUsed != nil && !rowsUsed[row] {
+			pt.add(1)
+			continue
+		}
+		// Iterate over the channels (R,G,B,A, for an FPImage)
+		for k := 0; k < nch; k++ {
 			if fp.channelInfo[k].mustProcess {
 				wi.srcSam = src.Pix[row*src.Stride+k:]
 				wi.dstSam = dst.Pix[row*dst.Stride+k:]
 				workQueue <- wi
 			}
 		}
+		pt.add(1)
 	}
 
 	wi.stopNow = true
-	for i = 0; i < fp.numWorkers; i++ {
+	for i = 0; i < nw; i++ {
 		workQueue <- wi
 	}
+	pt.finish()
 	return
 }
 
@@ -382,34 +722,189 @@ func New(srcImg image.Image) *FPObject {
 	return fp
 }
 
+// SetSourceImageN tells fpresize to read an image with an arbitrary number
+// of channels. This may be used instead of SetSourceImage, for images
+// that can't be represented well by Go's image.Image interface, such as
+// CMYK or multispectral images.
+//
+// The samples are resized as-is. They are not color-converted, and no
+// channel is treated as alpha. If you want the resizing to be done in a
+// linear colorspace, or with associated alpha, you must convert the image
+// yourself before and after resizing it.
+//
+// Use ResizeN to resize the image. The other Resize* methods will not work.
+func (fp *FPObject) SetSourceImageN(src *FPImageN) {
+	fp.forgetSource()
+	fp.srcFPImageN = src
+	fp.srcImage = nil
+	fp.srcRowReader = nil
+	fp.srcPalette = nil
+	fp.srcBounds = src.Rect
+	fp.srcW = fp.srcBounds.Dx()
+	fp.srcH = fp.srcBounds.Dy()
+}
+
 // SetSourceImage tells fpresize the image to read.
-// Only one source image may be selected per FPObject.
 // Once selected, the caller may not modify the image until after the first
 // successful call to a Resize* method.
 //
+// SetSourceImage may be called again, after resizing, to resize another
+// image with the same settings (filter, color converters, target bounds,
+// and so on), as when making thumbnails of a batch of images. Everything fp
+// has saved or learned about the previous source image is forgotten: the
+// converted image, and whether it has transparency or color. The settings
+// that describe the previous image, such as its source mask and resolution,
+// are kept; Reset forgets those too.
+//
 // It is recommended to call New(), instead of calling SetSourceImage
 // directly.
 func (fp *FPObject) SetSourceImage(srcImg image.Image) {
+	fp.forgetSource()
 	fp.srcImage = srcImg
+	fp.srcFPImageN = nil
+	fp.srcRowReader = nil
+	fp.srcPalette = nil
+	if p, ok := srcImg.(*image.Paletted); ok {
+		fp.srcPalette = p.Palette
+	}
 	fp.srcBounds = srcImg.Bounds()
 	fp.srcW = fp.srcBounds.Dx()
 	fp.srcH = fp.srcBounds.Dy()
 }
 
+// A RowReader supplies a source image one row at a time. It can be used
+// instead of an image.Image, so that the source image does not have to be
+// fully decoded into memory before resizing it.
+//
+// ReadRow reads the row whose y coordinate is y (in the coordinate system
+// of Bounds) into dst, which has 4*Bounds().Dx() elements. Each pixel is
+// four samples -- red, green, blue, alpha -- from 0.0 to 1.0. The alpha
+// sample is not associated, and the color samples are in the source
+// colorspace (the one that the input color converter expects).
+//
+// ReadRow is called sequentially, with y increasing each time. It is never
+// called more than once for the same row, but some rows may be skipped.
+//
+// If a RowReader also has an "Opaque() bool" method, it will be used in
+// pipelined mode to decide whether the image needs an alpha channel.
+type RowReader interface {
+	Bounds() image.Rectangle
+	ReadRow(y int, dst []float32) error
+}
+
+// SetSourceRowReader tells fpresize to read the source image from r.
+//
+// The rows are read during the first Resize* call. Normally they are all
+// read and saved, as usual. But in pipelined mode (see SetPipelined), they
+// are read only as they are needed, and not saved, so the image can only be
+// resized once.
+func (fp *FPObject) SetSourceRowReader(r RowReader) {
+	fp.forgetSource()
+	fp.srcRowReader = r
+	fp.srcImage = nil
+	fp.srcFPImageN = nil
+	fp.srcPalette = nil
+	fp.srcBounds = r.Bounds()
+	fp.srcW = fp.srcBounds.Dx()
+	fp.srcH = fp.srcBounds.Dy()
+}
+
+// Reset prepares fp to resize another image, srcImg, as if it were a new
+// FPObject whose settings had been copied from fp. Everything fp knows
+// about the previous source image is forgotten: the converted image (and
+// any temporary file it uses), whether it has transparency or color, and
+// its resolution. srcImg may be nil, if the source image will be set by
+// another method, such as SetSourceRowReader.
+//
+// The settings are kept, including the target bounds, so they may need to
+// be set again if they depend on the size of the source image.
+//
+// If keepWeights is set, the weight lists that fp has made are kept, and
+// used again if the geometry (the source and target sizes, and the
+// position of the image on the canvas) turns out to be the same, as it
+// often is when FPObjects are pooled to make thumbnails of same-sized
+// images. As with ImportWeights, the filter and other settings that affect
+// the weights are not checked, so they must not be changed. Otherwise, the
+// kept weight lists are forgotten.
+func (fp *FPObject) Reset(srcImg image.Image, keepWeights bool) {
+	if keepWeights {
+		fp.keptWeights = fp.weightsToKeep()
+	} else {
+		fp.keptWeights = nil
+	}
+	fp.weightLog = nil
+
+	fp.forgetSource()
+	fp.srcImage = nil
+	fp.srcFPImageN = nil
+	fp.srcRowReader = nil
+	fp.srcPalette = nil
+	fp.srcBounds = image.Rectangle{}
+	fp.srcW, fp.srcH = 0, 0
+	fp.srcDPI = 0.0
+	fp.srcMask = nil
+
+	if srcImg != nil {
+		fp.SetSourceImage(srcImg)
+	}
+}
+
+// Forget the converted source image, and what was learned about it, before
+// another source image is selected.
+func (fp *FPObject) forgetSource() {
+	if fp.srcFPImage != nil {
+		fp.releaseSamples(fp.srcFPImage.Pix)
+	}
+	fp.srcFPImage = nil
+	fp.srcInfo = nil
+	fp.srcHasTransparency = false
+	fp.srcHasColor = false
+	fp.mustProcessTransparency = false
+	fp.mustProcessColor = false
+	fp.channelInfo = nil
+	fp.lateSrcSetting = false
+	fp.dstFPImage = nil
+}
+
 // SetFilterGetter specifies a function that will return the resampling filter
 // to use. Said function will be called twice per resize: once per dimension.
 func (fp *FPObject) SetFilterGetter(gff FilterGetter) {
 	fp.filterGetter = gff
 }
 
+// Returns the filter to use for the given dimension.
+func (fp *FPObject) filterFor(isVertical bool) *Filter {
+	var filter *Filter
+	if fp.filterGetter != nil {
+		filter = fp.filterGetter(isVertical)
+	}
+	if filter == nil {
+		filter = DefaultFilter()
+	}
+	return filter
+}
+
 // SetFilter sets the resampling filter to use when resizing.
 // This should be something returned by a Make*Filter function, or a custom
 // filter.
-// If not called, a reasonable default will be used (currently Lanczos-2).
+// If not called, the filter set by SetDefaultFilter will be used (by default,
+// Lanczos-2).
 func (fp *FPObject) SetFilter(fpf *Filter) {
 	fp.SetFilterGetter(func(isVertical bool) *Filter { return fpf })
 }
 
+// SetFilterByName sets the resampling filter to use when resizing, by name
+// (see FilterByName). It returns an error if the name is not recognized, in
+// which case the filter setting is not changed.
+func (fp *FPObject) SetFilterByName(name string) error {
+	fpf, err := FilterByName(name)
+	if err != nil {
+		return err
+	}
+	fp.SetFilter(fpf)
+	return nil
+}
+
 // SetBlurGetter specifies a function that will return the blur setting to
 // use. Said function will be called twice per resize: once per dimension.
 func (fp *FPObject) SetBlurGetter(gbf BlurGetter) {
@@ -426,21 +921,42 @@ func (fp *FPObject) SetBlur(blur float64) {
 
 // ScaleFactor returns the current scale factor (target size divided by
 // source size) for the given dimension.
-// This is only valid during or after Resize() -- it's meant to be used by
-// callback functions, so that the filter to use could be selected based on
-// this information.
+// This is valid once the source image and target bounds have been set, so
+// it can be used to select the filter to use, either before resizing or in
+// a callback function.
+//
+// With PixelAlignCorners, this is the ratio of the distances between the
+// centers of the corner pixels.
 func (fp *FPObject) ScaleFactor(isVertical bool) float64 {
+	srcN, dstTrueN := fp.srcW, fp.dstTrueW
+	if isVertical {
+		srcN, dstTrueN = fp.srcH, fp.dstTrueH
+	}
+	if fp.alignCorners(isVertical) {
+		return (dstTrueN - 1.0) / float64(srcN-1)
+	}
+	return dstTrueN / float64(srcN)
+}
+
+// Reports whether pixels are corner-aligned in the given dimension. The
+// PixelAlignCorners setting is ignored if the source image or target
+// rectangle is only one pixel across, since then there is no distance
+// between the corner pixels.
+func (fp *FPObject) alignCorners(isVertical bool) bool {
+	if fp.pixelAlignment != PixelAlignCorners {
+		return false
+	}
 	if isVertical {
-		return fp.dstTrueH / float64(fp.srcH)
+		return fp.srcH > 1 && fp.dstTrueH > 1.0
 	}
-	return fp.dstTrueW / float64(fp.srcW)
+	return fp.srcW > 1 && fp.dstTrueW > 1.0
 }
 
 // HasTransparency returns true if the source image has any pixels that are
 // not fully opaque, or transparency is otherwise needed to process the image.
-// This is only valid during or after Resize() -- it's meant to be used by
-// callback functions, so that the filter to use could be selected based on
-// this information.
+// This is only valid after Analyze has been called, or during or after
+// Resize() -- it can be used by callback functions, so that the filter to use
+// could be selected based on this information.
 func (fp *FPObject) HasTransparency() bool {
 	return fp.mustProcessTransparency
 }
@@ -449,9 +965,9 @@ func (fp *FPObject) HasTransparency() bool {
 // transparency). A return value of true does not necessarily provide any
 // information -- the image could still be grayscale.
 //
-// This is only valid during or after Resize() -- it's meant to be used by
-// callback functions, so that the filter to use could be selected based on
-// this information.
+// This is only valid after Analyze has been called, or during or after
+// Resize() -- it can be used by callback functions, so that the filter to use
+// could be selected based on this information.
 func (fp *FPObject) HasColor() bool {
 	return fp.mustProcessColor
 }
@@ -486,8 +1002,11 @@ func LinearTosRGB(s []float32) {
 // The default value is SRGBToLinear.
 // This may be nil, for no conversion.
 func (fp *FPObject) SetInputColorConverter(ccf ColorConverter) {
+	fp.srcSettingChanged()
 	fp.inputCCF = ccf
 	fp.inputCCFSet = true
+	fp.inputLUT = nil
+	fp.inputCCFCost = nil
 }
 
 // Supply a ColorConverter function to use when converting from the colors in
@@ -500,6 +1019,24 @@ func (fp *FPObject) SetInputColorConverter(ccf ColorConverter) {
 func (fp *FPObject) SetOutputColorConverter(ccf ColorConverter) {
 	fp.outputCCF = ccf
 	fp.outputCCFSet = true
+	fp.outputLUT = nil
+	fp.outputCCFCost = nil
+}
+
+// SetInputColorLUT is like SetInputColorConverter, except that it selects
+// a ColorLUT's color converter, and causes the ColorLUT's lookup tables to
+// be used whenever possible, regardless of the size of the image.
+func (fp *FPObject) SetInputColorLUT(lut *ColorLUT) {
+	fp.SetInputColorConverter(lut.ccf)
+	fp.inputLUT = lut
+}
+
+// SetOutputColorLUT is like SetOutputColorConverter, except that it selects
+// a ColorLUT's color converter, and causes the ColorLUT's lookup tables to
+// be used whenever possible, regardless of the size of the image.
+func (fp *FPObject) SetOutputColorLUT(lut *ColorLUT) {
+	fp.SetOutputColorConverter(lut.ccf)
+	fp.outputLUT = lut
 }
 
 // Set the properties of the input color converter.
@@ -519,6 +1056,7 @@ func (fp *FPObject) SetOutputColorConverterFlags(flags uint32) {
 // method, not before.
 func (fp *FPObject) setTargetCanvasBounds(dstBounds image.Rectangle) {
 	fp.dstBounds = dstBounds
+	fp.dstBoundsAdjust = dstBounds.Dx() < 1 || dstBounds.Dy() < 1
 	if fp.dstBounds.Max.X < fp.dstBounds.Min.X+1 {
 		fp.dstBounds.Max.X = fp.dstBounds.Min.X + 1
 	}
@@ -531,22 +1069,62 @@ func (fp *FPObject) setTargetCanvasBounds(dstBounds image.Rectangle) {
 	fp.dstOffsetY = 0.0
 	fp.dstTrueW = float64(fp.dstCanvasW)
 	fp.dstTrueH = float64(fp.dstCanvasH)
+	fp.dstFullBounds = fp.dstBounds
+	fp.dstFullOffsetX = 0.0
+	fp.dstFullOffsetY = 0.0
+}
+
+// SetTargetRegionOfInterest restricts the resize to the part of the target
+// image that is inside r, so that the resized image returned by the
+// Resize* methods has bounds r (or the part of r that is inside the target
+// bounds). Its pixels are the same as the corresponding pixels of the full
+// resized image, but no time is spent computing the others. This is useful
+// for viewers that only display part of a large zoomed image.
+//
+// It may be called before or after setting the target bounds, and the
+// region of interest is kept if the target bounds are set again. Calling
+// this with an empty rectangle clears it.
+func (fp *FPObject) SetTargetRegionOfInterest(r image.Rectangle) {
+	fp.dstROI = r
+	fp.dstROISet = !r.Empty()
+	fp.resolveRegionOfInterest()
+}
+
+// Restrict the target geometry to the region of interest, if there is one.
+// This is done whenever the target bounds or the region of interest is set,
+// so that they can be set in any order.
+func (fp *FPObject) resolveRegionOfInterest() {
+	r := fp.dstFullBounds
+	if fp.dstROISet {
+		r = fp.dstROI.Intersect(fp.dstFullBounds)
+	}
+	fp.dstBounds = r
+	fp.dstCanvasW = r.Dx()
+	fp.dstCanvasH = r.Dy()
+	// The weights for a target pixel only depend on its position relative
+	// to the source image, so moving the canvas is all we need to do.
+	fp.dstOffsetX = fp.dstFullOffsetX - float64(r.Min.X-fp.dstFullBounds.Min.X)
+	fp.dstOffsetY = fp.dstFullOffsetY - float64(r.Min.Y-fp.dstFullBounds.Min.Y)
 }
 
 // SetTargetBounds sets the size and origin of the resized image.
 // The source image will be mapped onto the given bounds.
-// It also sets the VirtualPixels setting to None.
+// Unless SetVirtualPixels is used, the VirtualPixels setting will be None.
 //
 // If the height or width is less than 1, the bounds will be adjusted
-// so that it is 1.
+// so that it is 1, unless SetStrictTargetBounds(true) has been called.
 func (fp *FPObject) SetTargetBounds(dstBounds image.Rectangle) {
 	fp.setTargetCanvasBounds(dstBounds)
-	fp.virtualPixels = VirtualPixelsNone
+	fp.advancedBounds = false
+	fp.resolveRegionOfInterest()
 }
 
 // SetTargetBoundsAdvanced sets the bounds of the target image, and
 // the mapping of the source image onto it.
-// It also sets the VirtualPixels setting to Transparent.
+// Unless SetVirtualPixels is used, the VirtualPixels setting will be
+// Transparent. Any other setting may be used; for example,
+// VirtualPixelsReplicate fills the rest of the canvas with opaque pixels, by
+// extending the edges of the image.
 //
 // dstBounds is the bounds of the target image.
 //
@@ -561,19 +1139,292 @@ func (fp *FPObject) SetTargetBoundsAdvanced(dstBounds image.Rectangle,
 	fp.setTargetCanvasBounds(dstBounds)
 	fp.dstOffsetX = x1 - float64(fp.dstBounds.Min.X)
 	fp.dstOffsetY = y1 - float64(fp.dstBounds.Min.Y)
+	fp.dstFullOffsetX = fp.dstOffsetX
+	fp.dstFullOffsetY = fp.dstOffsetY
 	fp.dstTrueW = x2 - x1
 	fp.dstTrueH = y2 - y1
-	fp.virtualPixels = VirtualPixelsTransparent
+	fp.advancedBounds = true
+	fp.resolveRegionOfInterest()
 }
 
-// SetVirtualPixels controls how the edges of the image are handled.
-// n is VirtualPixelsNone or VirtualPixelsTransparent.
-// This can only be called after setting the target bounds.
+// SetVirtualPixels controls how the edges of the image are handled, by
+// pretending that there are pixels outside the source image.
+// n is a VirtualPixels* constant. With VirtualPixelsNone, there are no such
+// pixels, so the target pixels near the edges are computed from fewer
+// source pixels. With VirtualPixelsTransparent, they are transparent, so
+// the edges fade out. The other settings extend the image with opaque
+// pixels, which can also be used to fill a canvas that is larger than the
+// image (see SetTargetBoundsAdvanced).
+// It overrides the default, which depends on whether the target bounds were
+// set by SetTargetBounds or SetTargetBoundsAdvanced. It may be called before
+// or after setting the target bounds.
 func (fp *FPObject) SetVirtualPixels(n int) {
 	fp.virtualPixels = n
+	fp.virtualPixelsSet = true
 }
 
-// (This is a debugging method. Please don't use.)
+// Returns the VirtualPixels setting to use.
+func (fp *FPObject) getVirtualPixels() int {
+	if fp.virtualPixelsSet {
+		return fp.virtualPixels
+	}
+	if fp.advancedBounds {
+		return VirtualPixelsTransparent
+	}
+	return VirtualPixelsNone
+}
+
+// Record that a setting that affects the conversion of the source image has
+// changed. It's too late for that, if the image has already been converted.
+func (fp *FPObject) srcSettingChanged() {
+	if fp.srcFPImage != nil {
+		fp.lateSrcSetting = true
+	}
+}
+
+// ErrInvalidTargetBounds is returned (possibly wrapped, with more
+// information) by the Resize* methods if the target bounds are empty, and
+// SetStrictTargetBounds(true) has been called, or if the target image
+// mapping is unusable. Scale factors (see ScaleFactor) must be between
+// 1/1000000 and 1000000.
+var ErrInvalidTargetBounds = errors.New("Invalid target bounds")
+
+// The largest scale factor, and the inverse of the smallest, that fpresize
+// accepts. More extreme scale factors are not useful, and would cause
+// excessive memory use, or floating point precision problems.
+const maxScaleFactor = 1.0e6
+
+// SetStrictTargetBounds controls what happens if the target bounds are set
+// to a rectangle whose width or height is less than 1. Normally, the size is
+// silently adjusted to 1. If strict mode is enabled, resizing fails with
+// ErrInvalidTargetBounds instead, which can reveal bugs in the caller's size
+// calculations.
+func (fp *FPObject) SetStrictTargetBounds(enable bool) {
+	fp.strictBounds = enable
+}
+
+// ErrFilterScale is returned (wrapped, with more information) by the
+// Resize* methods if SetStrictFilterScale(true) has been called, and a
+// filter is used outside of the range of scale factors it is intended for.
+var ErrFilterScale = errors.New("Filter not intended for this scale factor")
+
+// SetStrictFilterScale controls what happens if a filter is used with a
+// scale factor it is not intended for, as declared by its
+// FilterFlagDownscaleOnly or FilterFlagUpscaleOnly flags, or its
+// MinScaleFactor or MaxScaleFactor. Normally, a warning is sent to the
+// progress callback (see SetProgressCallback), and Plan reports it. If
+// strict mode is enabled, resizing fails with ErrFilterScale instead.
+func (fp *FPObject) SetStrictFilterScale(enable bool) {
+	fp.strictFilter = enable
+}
+
+// Returns a description of why the filter for the given dimension is not
+// intended for its scale factor, or "" if it is, or no filter is used.
+func (fp *FPObject) filterScaleProblem(isVertical bool) string {
+	if fp.areaAverage || fp.importedWeightList(isVertical) != nil {
+		return ""
+	}
+	return fp.filterFor(isVertical).scaleFactorProblem(fp.ScaleFactor(isVertical))
+}
+
+// Sends a warning to the progress callback for each dimension whose filter
+// is not intended for its scale factor.
+func (fp *FPObject) warnFilterScale() {
+	if fp.progressCallback == nil {
+		return
+	}
+	for _, isVertical := range []bool{false, true} {
+		if problem := fp.filterScaleProblem(isVertical); problem != "" {
+			fp.progressMsgf("Warning: %s", problem)
+		}
+	}
+}
+
+// ErrEmptySource is returned by the Resize* methods (and Analyze) if the
+// source image's width or height is less than 1.
+var ErrEmptySource = errors.New("Source image is empty")
+
+// Reports whether a source image has been set, but it has no pixels.
+func (fp *FPObject) srcIsEmpty() bool {
+	if fp.srcImage == nil && fp.srcRowReader == nil && fp.srcFPImageN == nil && fp.srcFPImage == nil {
+		return false
+	}
+	return fp.srcW < 1 || fp.srcH < 1
+}
+
+// Check that the settings make sense together. This is done at resize time,
+// so that the settings can be made in any order.
+func (fp *FPObject) validateSettings() error {
+	if fp.srcIsEmpty() {
+		return ErrEmptySource
+	}
+	if fp.dstROISet && fp.dstBounds.Empty() {
+		return errors.New("Target region of interest is outside the target bounds")
+	}
+	if fp.dstCanvasW < 1 || fp.dstCanvasH < 1 {
+		return errors.New("Target bounds not set")
+	}
+	if fp.strictBounds && fp.dstBoundsAdjust {
+		return fmt.Errorf("%w: the width and height must be at least 1", ErrInvalidTargetBounds)
+	}
+	if !(fp.dstTrueW > 0.0) || !(fp.dstTrueH > 0.0) ||
+		math.IsInf(fp.dstTrueW, 0) || math.IsInf(fp.dstTrueH, 0) {
+		return fmt.Errorf("%w: x2 must be greater than x1, and y2 greater than y1", ErrInvalidTargetBounds)
+	}
+	if fp.srcW > 0 && fp.srcH > 0 {
+		for _, isVertical := range []bool{false, true} {
+			sf := fp.ScaleFactor(isVertical)
+			if sf > maxScaleFactor || sf < 1.0/maxScaleFactor {
+				return fmt.Errorf("%w: scale factor %g is out of range", ErrInvalidTargetBounds, sf)
+			}
+			if fp.strictFilter {
+				if problem := fp.filterScaleProblem(isVertical); problem != "" {
+					return fmt.Errorf("%w: %s", ErrFilterScale, problem)
+				}
+			}
+		}
+	}
+	switch fp.getVirtualPixels() {
+	case VirtualPixelsNone, VirtualPixelsTransparent, VirtualPixelsReplicate, VirtualPixelsMirror, VirtualPixelsTile:
+	default:
+		return errors.New("Invalid VirtualPixels setting")
+	}
+	switch fp.pixelAlignment {
+	case PixelAlignCenters, PixelAlignCorners:
+	default:
+		return errors.New("Invalid pixel alignment setting")
+	}
+	switch fp.preReduce {
+	case PreReduceAuto, PreReduceNever, PreReduceAlways:
+	default:
+		return errors.New("Invalid pre-reduce setting")
+	}
+	if fp.areaAverage && fp.pixelAlignment == PixelAlignCorners {
+		return errors.New("Area averaging can't be used with PixelAlignCorners")
+	}
+	if fp.dstRowAlignment < 0 {
+		return errors.New("Invalid target row alignment")
+	}
+	if fp.levelsSet && !(fp.levelsWhite > fp.levelsBlack) {
+		return errors.New("Invalid levels: white must be greater than black")
+	}
+	if err := fp.validateChannelOrder(); err != nil {
+		return err
+	}
+	if err := fp.validateSourceMask(); err != nil {
+		return err
+	}
+	if len(fp.dstPalette) > 256 {
+		return errors.New("Target palette has more than 256 colors")
+	}
+	if fp.lateSrcSetting {
+		return errors.New("The input color converter, data mode, force-grayscale, background color, and source row hook settings must be made before the first resize")
+	}
+	return nil
+}
+
+// SetTargetRowAlignment makes each row of the images returned by the
+// ResizeTo* methods start at a multiple of n bytes, by padding the rows if
+// necessary, so that the images can be handed to APIs that require it
+// (e.g. 4 for BMP files, or 64 for some GPU uploads). The images' Stride
+// fields tell how long the rows really are. This does not apply to FPImage
+// images. The default is 1 (no padding).
+func (fp *FPObject) SetTargetRowAlignment(n int) {
+	fp.dstRowAlignment = n
+}
+
+// SetAreaAverage enables area-averaging mode, in which each target pixel is
+// the exact average of the part of the source image that it covers,
+// weighted by how much of each source pixel is covered. The filter and blur
+// settings are ignored. Unlike MakePixelMixingFilter, which approximates
+// this with a filter function, the result does not depend on floating point
+// tie-breaking at awkward scale factors, so it may be preferable for
+// scientific or measurement uses. It is meant for reducing the size of an
+// image; when enlarging, most target pixels are copies of one source pixel.
+//
+// It can't be used with PixelAlignCorners.
+func (fp *FPObject) SetAreaAverage(enable bool) {
+	fp.areaAverage = enable
+}
+
+// SetPixelAlignment sets the convention used to map the source image onto the
+// target image (or onto the rectangle set by SetTargetBoundsAdvanced): a
+// PixelAlign* constant. The default is PixelAlignCenters, which treats pixels
+// as little squares, and maps the edges of the images to each other. With
+// PixelAlignCorners, the center of the top-left source pixel is mapped to
+// the center of the top-left target pixel, and likewise for the
+// bottom-right pixels.
+func (fp *FPObject) SetPixelAlignment(n int) {
+	fp.pixelAlignment = n
+}
+
+// SetDataMode tells fpresize whether the image contains non-color data,
+// such as a depth map, heightmap, or normal map, instead of colors.
+//
+// In data mode, no color conversion is done (it is as if
+// SetInputColorConverter(nil) and SetOutputColorConverter(nil) had been
+// called), and the alpha channel, if any, is treated as just another data
+// channel: it is not used to weight the other channels.
+//
+// In data mode, the resized image should be returned in a format whose alpha
+// channel is not associated with the other channels: FPImage, NRGBA,
+// NRGBA64, Gray, or Gray16.
+//
+// This must be called before calling the first Resize method.
+func (fp *FPObject) SetDataMode(enable bool) {
+	fp.srcSettingChanged()
+	fp.dataMode = enable
+	if enable {
+		fp.SetInputColorConverter(nil)
+		fp.SetOutputColorConverter(nil)
+	}
+}
+
+// SetForceGrayscale tells fpresize to convert the image to grayscale, as it
+// is read. The gray level is the luminance of the color, calculated (after
+// the input color conversion) using the Rec. 709 coefficients that are
+// appropriate for linear sRGB colors.
+//
+// Since the resized image is then known to be grayscale, ResizeToImage with
+// ResizeFlagGrayOK will return an image.Gray or image.Gray16 if the image is
+// opaque. This has no effect in data mode.
+//
+// This must be called before calling the first Resize method.
+func (fp *FPObject) SetForceGrayscale(enable bool) {
+	fp.srcSettingChanged()
+	fp.forceGray = enable
+}
+
+// SetDataRange sets the range of values that the samples represent, in data
+// mode. min is the value of a sample of 0, and max is the value of a sample
+// whose value is the maximum possible for the image type. The default is
+// (0,1). A normal map would usually use (-1,1).
+//
+// The range affects vector renormalization, and the samples in an image
+// returned by Resize(), which will be in the range [min,max].
+func (fp *FPObject) SetDataRange(min, max float64) {
+	fp.dataMin = min
+	fp.dataMax = max
+}
+
+// SetRenormalizeVectors, if enabled, causes each pixel's first three samples
+// (R, G, B) to be treated as a vector, which is rescaled to unit length
+// after resizing. It is intended for normal maps, and has no effect unless
+// data mode is enabled.
+func (fp *FPObject) SetRenormalizeVectors(enable bool) {
+	fp.renormalize = enable
+}
+
+// Returns the data range, applying the default if necessary.
+func (fp *FPObject) getDataRange() (float32, float32) {
+	if fp.dataMin == fp.dataMax {
+		return 0.0, 1.0
+	}
+	return float32(fp.dataMin), float32(fp.dataMax)
+}
+
+// (This is a debugging method. Please don't use. For progress reporting, see
+// SetProgressFunc.)
 func (fp *FPObject) SetProgressCallback(fn func(format string, a ...interface{})) {
 	fp.progressCallback = fn
 }
@@ -596,11 +1447,40 @@ func (fp *FPObject) SetMaxWorkerThreads(n int) {
 	fp.maxWorkers = n
 }
 
-func (fp *FPObject) resizeMain() (*FPImage, error) {
-	var err error
-	var intermedFPImage *FPImage
-	var dstFPImage *FPImage
+// SetWorkers sets the exact number of worker goroutines to use, overriding
+// the default (which is based on GOMAXPROCS) and SetMaxWorkerThreads.
+// 0 means default.
+func (fp *FPObject) SetWorkers(n int) {
+	fp.exactWorkers = n
+}
+
+// Processing stages, for use with SetStageWorkers.
+const (
+	StageConvertSource = iota // Converting the source image to linear floating point
+	StageResample             // Resampling in each dimension
+	StageConvertTarget        // Converting to the target image format
+	numWorkStages
+)
+
+// SetStageWorkers sets the number of worker goroutines to use for just one
+// processing stage (a Stage* constant), overriding SetWorkers and
+// SetMaxWorkerThreads for that stage. 0 means use the general setting.
+//
+// The best amount of parallelism is not the same for every stage. The
+// vertical resampling pass tends to be limited by memory bandwidth, while
+// color conversion is mostly limited by computation.
+func (fp *FPObject) SetStageWorkers(stage int, n int) {
+	if stage < 0 || stage >= numWorkStages {
+		return
+	}
+	fp.stageWorkers[stage] = n
+}
 
+func (fp *FPObject) setNumWorkers() {
+	if fp.exactWorkers > 0 {
+		fp.numWorkers = fp.exactWorkers
+		return
+	}
 	fp.numWorkers = runtime.GOMAXPROCS(0)
 	if fp.numWorkers < 1 {
 		fp.numWorkers = 1
@@ -608,12 +1488,170 @@ func (fp *FPObject) resizeMain() (*FPImage, error) {
 	if fp.maxWorkers > 0 && fp.numWorkers > fp.maxWorkers {
 		fp.numWorkers = fp.maxWorkers
 	}
+}
 
-	if int64(fp.dstCanvasW)*int64(fp.dstCanvasH) > maxImagePixels {
+// Returns the number of workers to use for the given stage.
+// setNumWorkers must have been called first.
+func (fp *FPObject) workersFor(stage int) int {
+	if fp.stageWorkers[stage] > 0 {
+		return fp.stageWorkers[stage]
+	}
+	return fp.numWorkers
+}
+
+// Resize src in both dimensions, using the already-configured fp.channelInfo.
+func (fp *FPObject) resizeImageN(src *FPImageN) *FPImageN {
+	var intermed *FPImageN
+	var dst *FPImageN
+
+	if fp.srcMask != nil {
+		return fp.resizeImageNMasked(src)
+	}
+
+	// For large reductions, first reduce the image quickly, then resize the
+	// smaller image with a copy of fp whose source size is changed.
+	preW, preH := fp.preReduceSize(false), fp.preReduceSize(true)
+	if preW != fp.srcW || preH != fp.srcH {
+		fp.progressMsgf("Pre-reducing, %dx%d -> %dx%d", fp.srcW, fp.srcH, preW, preH)
+		sub := *fp
+		sub.srcW, sub.srcH = preW, preH
+		sub.preReduce = PreReduceNever
+		return sub.resizeImageN(fp.preReduceImage(src, preW, preH))
+	}
+
+	if fp.planar && !fp.useAlphaWeighting() {
+		if src.NumChannels == 1 {
+			dst = fp.resizePlaneN(src)
+		} else {
+			dst = fp.resizePlanes(src)
+		}
+		dst.Rect = fp.dstBounds
+		return dst
+	}
+
+	// When changing the width, the relevant samples are close together in memory.
+	// When changing the height, they are much farther apart. On a modern computer,
+	// due to caching, that makes changing the width much faster than the height.
+	// So it is beneficial to resize the height first if we are increasing the
+	// image size, and the width first if we are reducing it.
+	//
+	// If only part of the target image is needed, the first pass can skip the
+	// lines that the second pass won't use.
+	//
+	// Likewise, the lines that are fully transparent can be skipped (see
+	// fpsparse.go).
+	sp := fp.findSparseLines(src)
+	if fp.dstCanvasW > fp.srcW {
+		vWeights := fp.createWeightList(true)
+		hWeights := fp.createWeightList(false)
+		var colsUsed, rowsUsed []bool
+		if sp != nil {
+			vWeights = sp.filterWeights(vWeights, true)
+			hWeights = sp.filterWeights(hWeights, false)
+			rowsUsed = dstLinesUsed(vWeights, fp.dstCanvasH)
+		}
+		if fp.dstROISet || sp != nil {
+			colsUsed = srcLinesUsed(hWeights, fp.srcW)
+		}
+		intermed = fp.resizeHeight(src, vWeights, colsUsed)
+		if fp.useAlphaWeighting() {
+			fp.renormalizeAlpha(intermed)
+		}
+		dst = fp.resizeWidth(intermed, hWeights, rowsUsed)
+	} else {
+		hWeights := fp.createWeightList(false)
+		vWeights := fp.createWeightList(true)
+		var rowsUsed, colsUsed []bool
+		if sp != nil {
+			hWeights = sp.filterWeights(hWeights, false)
+			vWeights = sp.filterWeights(vWeights, true)
+			colsUsed = dstLinesUsed(hWeights, fp.dstCanvasW)
+		}
+		if fp.dstROISet || sp != nil {
+			rowsUsed = srcLinesUsed(vWeights, fp.srcH)
+		}
+		intermed = fp.resizeWidth(src, hWeights, rowsUsed)
+		if fp.useAlphaWeighting() {
+			fp.renormalizeAlpha(intermed)
+		}
+		dst = fp.resizeHeight(intermed, vWeights, colsUsed)
+	}
+	fp.releaseSamples(intermed.Pix)
+
+	dst.Rect = fp.dstBounds
+	return dst
+}
+
+// ResizeN resizes an image that was selected by SetSourceImageN, and returns
+// an image with the same number of channels.
+func (fp *FPObject) ResizeN() (*FPImageN, error) {
+	if fp.srcFPImageN == nil {
+		return nil, errors.New("ResizeN requires a source image set by SetSourceImageN")
+	}
+	nch := fp.srcFPImageN.NumChannels
+	if nch < 1 {
+		return nil, errors.New("Invalid number of channels")
+	}
+
+	err := fp.validateSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	fp.setNumWorkers()
+	fp.startWeightLog()
+	fp.warnFilterScale()
+
+	if int64(fp.srcW)*int64(fp.srcH)*int64(nch) > 4*maxImagePixels {
+		return nil, errors.New("Source image too large to process")
+	}
+	if int64(fp.dstCanvasW)*int64(fp.dstCanvasH)*int64(nch) > 4*maxImagePixels {
 		return nil, errors.New("Target image too large")
 	}
 
-	// Make sure color correction is set up.
+	// The origin of the source image doesn't matter, but the code below
+	// assumes it is (0,0).
+	src := *fp.srcFPImageN
+	src.Rect = image.Rect(0, 0, fp.srcW, fp.srcH)
+
+	fp.channelInfo = make([]channelInfoType, nch)
+	for k := range fp.channelInfo {
+		fp.channelInfo[k].mustProcess = true
+	}
+
+	dst := fp.resizeImageN(&src)
+	if err = fp.ctxErr(); err != nil {
+		fp.releaseSamples(dst.Pix)
+		return nil, err
+	}
+	return dst, nil
+}
+
+// Checks the settings, and prepares for resizing an image.Image source.
+func (fp *FPObject) resizeSetup() error {
+	if fp.srcFPImageN != nil {
+		return errors.New("Source image was set by SetSourceImageN; use ResizeN")
+	}
+
+	err := fp.validateSettings()
+	if err != nil {
+		return err
+	}
+
+	fp.setNumWorkers()
+	fp.startWeightLog()
+	fp.warnFilterScale()
+
+	if int64(fp.dstCanvasW)*int64(fp.dstCanvasH) > maxImagePixels {
+		return errors.New("Target image too large")
+	}
+
+	fp.setDefaultColorConverters()
+	return nil
+}
+
+// Make sure color correction is set up.
+func (fp *FPObject) setDefaultColorConverters() {
 	if !fp.inputCCFSet {
 		// If the caller didn't set a color Converter, set it to sRGB.
 		fp.SetInputColorConverter(SRGBToLinear)
@@ -621,23 +1659,62 @@ func (fp *FPObject) resizeMain() (*FPImage, error) {
 	if !fp.outputCCFSet {
 		fp.SetOutputColorConverter(LinearTosRGB)
 	}
+}
 
-	if fp.srcFPImage == nil {
-		fp.srcFPImage = new(FPImage)
-		err = fp.convertSrc(fp.srcImage, fp.srcFPImage)
-		if err != nil {
-			return nil, err
-		}
+// Convert the source image to fp.srcFPImage, if that hasn't been done yet.
+func (fp *FPObject) convertSrcOnce() error {
+	if fp.srcFPImage != nil {
+		return nil
+	}
 
-		// Now that srcImage has been converted to srcFPImage, we don't need
-		// it anymore.
-		fp.srcImage = nil
+	srcFPImage := new(FPImage)
+	err := fp.convertSrc(srcFPImage)
+	if err != nil {
+		return err
+	}
+	fp.srcFPImage = srcFPImage
+
+	// Now that the source image has been converted to srcFPImage, we
+	// don't need it anymore.
+	fp.srcImage = nil
+	fp.srcRowReader = nil
+	return nil
+}
+
+// Analyze converts the source image to fpresize's internal format, and
+// examines it, so that HasTransparency and HasColor can be used before the
+// image is resized. The converted image is saved, so this does not make
+// the resize any slower. The source image must have been set by
+// SetSourceImage or SetSourceRowReader, and the input color converter, data
+// mode, force-grayscale, background color, and source row hook settings
+// must be made before calling it.
+func (fp *FPObject) Analyze() error {
+	if fp.srcFPImageN != nil {
+		return errors.New("Source image was set by SetSourceImageN; use ResizeN")
+	}
+	if fp.srcIsEmpty() {
+		return ErrEmptySource
+	}
+	fp.setNumWorkers()
+	fp.setDefaultColorConverters()
+	err := fp.convertSrcOnce()
+	if err != nil {
+		return err
 	}
+	fp.setChannelInfo()
+	return nil
+}
 
-	fp.mustProcessTransparency = (fp.srcHasTransparency || fp.virtualPixels == VirtualPixelsTransparent)
+// Set fp.mustProcess* and fp.channelInfo, based on what we know about the
+// source image.
+func (fp *FPObject) setChannelInfo() {
+	fp.mustProcessTransparency = (fp.srcHasTransparency && !fp.usesBackground()) ||
+		fp.getVirtualPixels() == VirtualPixelsTransparent
 	fp.mustProcessColor = fp.srcHasColor
+	fp.addChannelOrderInfo()
 
 	// Set the .channelInfo fields
+	fp.channelInfo = make([]channelInfoType, 4)
 	for k := 0; k < 4; k++ {
 		if k == 3 {
 			fp.channelInfo[k].mustProcess = fp.mustProcessTransparency
@@ -647,23 +1724,86 @@ func (fp *FPObject) resizeMain() (*FPImage, error) {
 			fp.channelInfo[k].mustProcess = true
 		}
 	}
+}
 
-	// When changing the width, the relevant samples are close together in memory.
-	// When changing the height, they are much farther apart. On a modern computer,
-	// due to caching, that makes changing the width much faster than the height.
-	// So it is beneficial to resize the height first if we are increasing the
-	// image size, and the width first if we are reducing it.
-	if fp.dstCanvasW > fp.srcW {
-		intermedFPImage = fp.resizeHeight(fp.srcFPImage)
-		dstFPImage = fp.resizeWidth(intermedFPImage)
-	} else {
-		intermedFPImage = fp.resizeWidth(fp.srcFPImage)
-		dstFPImage = fp.resizeHeight(intermedFPImage)
+func (fp *FPObject) resizeMain() (*FPImage, error) {
+	var err error
+
+	err = fp.resizeSetup()
+	if err != nil {
+		return nil, err
 	}
 
-	dstFPImage.Rect = fp.dstBounds
+	err = fp.convertSrcOnce()
+	if err != nil {
+		return nil, err
+	}
 
-	return dstFPImage, nil
+	fp.setChannelInfo()
+	fp.applyTargetHints()
+
+	src := fp.srcFPImage.asFPImageN()
+	if fp.mustFindLuminance() {
+		// Only the luminance needs to be resized.
+		src = fp.luminanceImage(src)
+		defer fp.releaseSamples(src.Pix)
+		fp.mustProcessColor = false
+		fp.channelInfo[1].mustProcess = false
+		fp.channelInfo[2].mustProcess = false
+	}
+
+	dstN := fp.resizeImageN(src)
+	if err = fp.ctxErr(); err != nil {
+		fp.releaseSamples(dstN.Pix)
+		return nil, err
+	}
+	return dstN.asFPImage(), nil
+}
+
+// Don't process the channels that the target image won't use.
+func (fp *FPObject) applyTargetHints() {
+	if fp.dstHints&ResizeFlagDropAlpha != 0 && fp.mustProcessTransparency {
+		fp.mustProcessTransparency = false
+		fp.channelInfo[3].mustProcess = false
+	}
+}
+
+// Returns a copy of src (a converted source image) whose first channel is
+// the luminance of each pixel, and whose alpha channel is unchanged. The
+// other color channels are not set.
+func (fp *FPObject) luminanceImage(src *FPImageN) *FPImageN {
+	dst := &FPImageN{Rect: src.Rect, Stride: src.Stride, NumChannels: 4}
+	dst.Pix = fp.allocSamples(len(src.Pix))
+	for j := 0; j < src.Rect.Dy(); j++ {
+		for i := 0; i < src.Rect.Dx(); i++ {
+			s := src.Pix[j*src.Stride+i*4 : j*src.Stride+i*4+4]
+			d := dst.Pix[j*dst.Stride+i*4 : j*dst.Stride+i*4+4]
+			d[0] = 0.2126*s[0] + 0.7152*s[1] + 0.0722*s[2]
+			d[3] = s[3]
+		}
+	}
+	return dst
+}
+
+// Resize the image, and convert it to the format selected by prepare.
+func (fp *FPObject) resizeToFormat(prepare dstPrepareFunc) (image.Image, error) {
+	if fp.pipelined {
+		return fp.resizePipelined(prepare)
+	}
+
+	dstFPImage, err := fp.resizeMain()
+	if err != nil {
+		return nil, err
+	}
+	dst := fp.convertDst(prepare, dstFPImage)
+	if _, ok := dst.(*FPImage); !ok {
+		// dstFPImage is no longer needed.
+		fp.releaseSamples(dstFPImage.Pix)
+	}
+	if err = fp.ctxErr(); err != nil {
+		return nil, err
+	}
+	return dst, nil
 }
 
 // Resize resizes the image, and returns a pointer to an image that
@@ -673,28 +1813,142 @@ func (fp *FPObject) resizeMain() (*FPImage, error) {
 // This method may be slow. You should almost always use ResizeToImage,
 // ResizeToNRGBA, ResizeToRGBA, ResizeToNRGBA64, or ResizeToRGBA64 instead.
 func (fp *FPObject) Resize() (*FPImage, error) {
+	dst, err := fp.resizeToFormat(fp.prepareDst_FP)
+	if err != nil {
+		return nil, err
+	}
+	return dst.(*FPImage), nil
+}
+
+// ResizeToLinear resizes the image, and returns it in the form that
+// fpresize uses internally, before any post-processing is done: the colors
+// are in the colorspace in which the resizing was performed (normally
+// linear light), alpha is associated (premultiplied), and samples are not
+// clamped. Note that this is not the form that FPImage normally uses, so the
+// At method of the returned image will not return correct colors.
+//
+// This lets you do your own linear-light processing (compositing, analysis,
+// etc.) on the resized image. When you are done, pass it to one of the
+// Finalize* methods to convert it to the final colorspace and format.
+func (fp *FPObject) ResizeToLinear() (*FPImage, error) {
 	dstFPImage, err := fp.resizeMain()
 	if err != nil {
 		return nil, err
 	}
 
-	fp.convertDst_FP(dstFPImage)
+	// Channels that we skipped are not valid. Make them valid, so that the
+	// caller can treat the image like any other.
+	if !fp.mustProcessColor || !fp.mustProcessTransparency {
+		for j := 0; j < dstFPImage.Rect.Dy(); j++ {
+			for i := 0; i < dstFPImage.Rect.Dx(); i++ {
+				sam := dstFPImage.Pix[j*dstFPImage.Stride+i*4 : j*dstFPImage.Stride+i*4+4]
+				if !fp.mustProcessColor {
+					sam[1] = sam[0]
+					sam[2] = sam[0]
+				}
+				if !fp.mustProcessTransparency {
+					sam[3] = 1.0
+				}
+			}
+		}
+	}
 	return dstFPImage, nil
 }
 
+// The caller may have changed the image returned by ResizeToLinear in any
+// way, so stop assuming that some channels don't need to be processed.
+func (fp *FPObject) prepareFinalize(im *FPImage) error {
+	if fp.numWorkers < 1 || im == nil {
+		return errors.New("Finalize requires an image returned by ResizeToLinear")
+	}
+	fp.mustProcessColor = true
+	fp.mustProcessTransparency = true
+	return fp.ctxErr()
+}
+
+// Finalize converts an image returned by ResizeToLinear to the format
+// returned by Resize(). The conversion is done in-place.
+func (fp *FPObject) Finalize(im *FPImage) error {
+	err := fp.prepareFinalize(im)
+	if err != nil {
+		return err
+	}
+
+	fp.convertDst_FP(im)
+	return fp.ctxErr()
+}
+
+// FinalizeToNRGBA converts an image returned by ResizeToLinear to NRGBA
+// format. im's pixels may be modified.
+func (fp *FPObject) FinalizeToNRGBA(im *FPImage) (*image.NRGBA, error) {
+	err := fp.prepareFinalize(im)
+	if err != nil {
+		return nil, err
+	}
+
+	dst := fp.convertDst_NRGBA(im)
+	if err = fp.ctxErr(); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// FinalizeToRGBA converts an image returned by ResizeToLinear to RGBA
+// format. im's pixels may be modified.
+func (fp *FPObject) FinalizeToRGBA(im *FPImage) (*image.RGBA, error) {
+	err := fp.prepareFinalize(im)
+	if err != nil {
+		return nil, err
+	}
+
+	dst := fp.convertDst_RGBA(im)
+	if err = fp.ctxErr(); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// FinalizeToNRGBA64 converts an image returned by ResizeToLinear to NRGBA64
+// format. im's pixels may be modified.
+func (fp *FPObject) FinalizeToNRGBA64(im *FPImage) (*image.NRGBA64, error) {
+	err := fp.prepareFinalize(im)
+	if err != nil {
+		return nil, err
+	}
+
+	dst := fp.convertDst_NRGBA64(im)
+	if err = fp.ctxErr(); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// FinalizeToRGBA64 converts an image returned by ResizeToLinear to RGBA64
+// format. im's pixels may be modified.
+func (fp *FPObject) FinalizeToRGBA64(im *FPImage) (*image.RGBA64, error) {
+	err := fp.prepareFinalize(im)
+	if err != nil {
+		return nil, err
+	}
+
+	dst := fp.convertDst_RGBA64(im)
+	if err = fp.ctxErr(); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
 // ResizeNRGBA resizes the image, and returns a pointer to an image that
 // uses the NRGBA format.
 //
 // Use this if you intend to write the image to an 8-bits-per-sample PNG
 // file.
 func (fp *FPObject) ResizeToNRGBA() (*image.NRGBA, error) {
-	dstFPImage, err := fp.resizeMain()
+	dst, err := fp.resizeToFormat(fp.prepareDst_NRGBA)
 	if err != nil {
 		return nil, err
 	}
-
-	nrgba := fp.convertDst_NRGBA(dstFPImage)
-	return nrgba, nil
+	return dst.(*image.NRGBA), nil
 }
 
 // ResizeRGBA resizes the image, and returns a pointer to an image that
@@ -702,13 +1956,11 @@ func (fp *FPObject) ResizeToNRGBA() (*image.NRGBA, error) {
 //
 // Use this if you intend to write the image to a JPEG file.
 func (fp *FPObject) ResizeToRGBA() (*image.RGBA, error) {
-	dstFPImage, err := fp.resizeMain()
+	dst, err := fp.resizeToFormat(fp.prepareDst_RGBA)
 	if err != nil {
 		return nil, err
 	}
-
-	rgba := fp.convertDst_RGBA(dstFPImage)
-	return rgba, nil
+	return dst.(*image.RGBA), nil
 }
 
 // ResizeNRGBA resizes the image, and returns a pointer to an image that
@@ -717,13 +1969,11 @@ func (fp *FPObject) ResizeToRGBA() (*image.RGBA, error) {
 // Use this if you intend to write the image to a 16-bits-per-sample PNG
 // file.
 func (fp *FPObject) ResizeToNRGBA64() (*image.NRGBA64, error) {
-	dstFPImage, err := fp.resizeMain()
+	dst, err := fp.resizeToFormat(fp.prepareDst_NRGBA64)
 	if err != nil {
 		return nil, err
 	}
-
-	nrgba64 := fp.convertDst_NRGBA64(dstFPImage)
-	return nrgba64, nil
+	return dst.(*image.NRGBA64), nil
 }
 
 // ResizeRGBA64 resizes the image, and returns a pointer to an image that
@@ -733,13 +1983,87 @@ func (fp *FPObject) ResizeToNRGBA64() (*image.NRGBA64, error) {
 // may be the method to use if you are going to further process the image,
 // instead of simply writing it to a file.
 func (fp *FPObject) ResizeToRGBA64() (*image.RGBA64, error) {
-	dstFPImage, err := fp.resizeMain()
+	dst, err := fp.resizeToFormat(fp.prepareDst_RGBA64)
+	if err != nil {
+		return nil, err
+	}
+	return dst.(*image.RGBA64), nil
+}
+
+// ResizeToCMYK resizes the image, and returns a pointer to an image that
+// uses the CMYK format.
+//
+// The image is resized in the usual (linear RGB) way, converted to the
+// target colorspace, then converted to CMYK using the same simple formula
+// as color.RGBToCMYK. No color profile is involved. Since CMYK has no alpha
+// channel, any transparency is composited over white.
+func (fp *FPObject) ResizeToCMYK() (*image.CMYK, error) {
+	dst, err := fp.resizeToFormat(fp.prepareDst_CMYK)
+	if err != nil {
+		return nil, err
+	}
+	return dst.(*image.CMYK), nil
+}
+
+// ResizeToGray resizes the image, and returns a pointer to an image that
+// uses the Gray format, whether or not the source image is grayscale. Only
+// the luminance is resized, as with ResizeFlagGray (except in pipelined
+// mode, in which the luminance is computed after resizing), and any
+// transparency is composited over black. In data mode, or if the channel
+// order has been set by SetChannelOrder, the first channel is used.
+func (fp *FPObject) ResizeToGray() (*image.Gray, error) {
+	dst, err := fp.resizeToGrayFormat(fp.prepareDst_Gray)
 	if err != nil {
 		return nil, err
 	}
+	return dst.(*image.Gray), nil
+}
+
+// ResizeToGray16 is like ResizeToGray, but returns an image that uses the
+// Gray16 format.
+func (fp *FPObject) ResizeToGray16() (*image.Gray16, error) {
+	dst, err := fp.resizeToGrayFormat(fp.prepareDst_Gray16)
+	if err != nil {
+		return nil, err
+	}
+	return dst.(*image.Gray16), nil
+}
+
+// Resize the luminance of the image, and convert it to the grayscale format
+// selected by prepare.
+func (fp *FPObject) resizeToGrayFormat(prepare dstPrepareFunc) (image.Image, error) {
+	fp.dstHints = ResizeFlagGray | ResizeFlagDropAlpha
+	defer func() {
+		fp.dstHints = 0
+		fp.setChannelInfo()
+	}()
+
+	return fp.resizeToFormat(func(r image.Rectangle) *convertDstWorkContext {
+		wc := prepare(r)
+		if fp.mustFindLuminance() {
+			fp.addFindLuminance(wc)
+		}
+		return wc
+	})
+}
 
-	rgba64 := fp.convertDst_RGBA64(dstFPImage)
-	return rgba64, nil
+// Reports whether only the luminance is wanted (see ResizeFlagGray), but the
+// color channels were resized anyway, which happens in pipelined mode.
+func (fp *FPObject) mustFindLuminance() bool {
+	return fp.dstHints&ResizeFlagGray != 0 && fp.mustProcessColor && !fp.dataMode && !fp.useChannelOrder()
+}
+
+// Make wc.cvtRowFn find the luminance of each row before converting it.
+func (fp *FPObject) addFindLuminance(wc *convertDstWorkContext) {
+	cvtRowFn := wc.cvtRowFn
+	wc.cvtRowFn = func(fp *FPObject, wc *convertDstWorkContext, j int) {
+		row := wc.src.Pix[j*wc.src.Stride : j*wc.src.Stride+4*wc.src.Rect.Dx()]
+		for i := 0; i < len(row); i += 4 {
+			v := 0.2126*row[i] + 0.7152*row[i+1] + 0.0722*row[i+2]
+			row[i], row[i+1], row[i+2] = v, v, v
+		}
+		cvtRowFn(fp, wc, j)
+	}
 }
 
 const (
@@ -750,43 +2074,120 @@ const (
 	ResizeFlagUnassocAlpha = 0x00000002
 	// Indicates that you prefer 16-bit images ([N]RGBA64/Gray16 to [N]RGBA/Gray).
 	ResizeFlag16Bit = 0x00000004
+	// Indicates that you prefer an image.Paletted to be returned, if the
+	// source image was an image.Paletted, or a palette was set by
+	// SetTargetPalette (or will be made, see SetPaletteSize). Each pixel is set to the nearest color in the
+	// palette. This takes precedence over the other flags.
+	ResizeFlagPalettedOK = 0x00000008
+	// Indicates that you want an image.CMYK to be returned, regardless of
+	// the other flags (except ResizeFlagPalettedOK). See ResizeToCMYK.
+	ResizeFlagCMYK = 0x00000010
+	// Indicates that you want a grayscale image. If the image is opaque, an
+	// image.Gray or image.Gray16 is returned. Only the luminance is resized,
+	// which is faster than resizing the color channels. (In pipelined mode,
+	// the color channels are resized, and the luminance is found afterward.)
+	// ResizeFlagGrayOK is only a preference, and may
+	// return a color image. SetForceGrayscale is similar, but converts the
+	// source image permanently.
+	ResizeFlagGray = 0x00000020
+	// Indicates that the alpha channel is not wanted, so the returned image
+	// is opaque. Any transparency is composited over black, and the alpha
+	// channel is not resized.
+	ResizeFlagDropAlpha = 0x00000040
 )
 
+// SetTargetPalette sets the palette to use for image.Paletted images
+// returned by ResizeToImage with ResizeFlagPalettedOK. It may have up to 256
+// colors. If it is nil (the default), the source image's palette is used,
+// if it has one. This can be any fixed palette, such as a web-safe palette.
+//
+// Each pixel is set to the palette color that is nearest to it in linear
+// light (after undoing the output color conversion on the palette), which
+// is more accurate than comparing the colors in the target colorspace. See
+// also SetPaletteDither.
+func (fp *FPObject) SetTargetPalette(p color.Palette) {
+	fp.dstPalette = p
+}
+
+// Returns the palette to use for a paletted target image, or nil.
+func (fp *FPObject) targetPalette() color.Palette {
+	if len(fp.dstPalette) > 0 {
+		return fp.dstPalette
+	}
+	if fp.paletteSize > 0 && fp.dstFPImage != nil {
+		return fp.makePalette(fp.dstFPImage, fp.paletteSize)
+	}
+	if len(fp.srcPalette) > 0 && len(fp.srcPalette) <= 256 {
+		return fp.srcPalette
+	}
+	return nil
+}
+
 // ResizeToImage resize the image and returns an image.Image interface whose
 // underlying type may vary depending on the source image type, and other
 // things. The logic to use is determined by the 'flags' parameter.
 //
 // 'flags' is a bitwise combination of ResizeFlag* constants.
 func (fp *FPObject) ResizeToImage(flags uint32) (image.Image, error) {
-	var err error
+	return fp.resizeWithFlags(flags, fp.resizeToFormat)
+}
 
-	dstFPImage, err := fp.resizeMain()
-	if err != nil {
-		return nil, err
-	}
+// Resize the image with resize (resizeToFormat or resizePipelined), to the
+// format chosen by flags, as described for ResizeToImage.
+func (fp *FPObject) resizeWithFlags(flags uint32,
+	resize func(prepare dstPrepareFunc) (image.Image, error)) (image.Image, error) {
+	// The format can't be chosen until we know whether the image has color
+	// and transparency, so choose it from inside resize.
+	fp.dstHints = flags & (ResizeFlagGray | ResizeFlagDropAlpha)
+	defer func() {
+		if fp.dstHints != 0 {
+			// Don't let the flags affect HasColor, HasTransparency, or the
+			// next resize.
+			fp.dstHints = 0
+			fp.setChannelInfo()
+		}
+	}()
 
-	if !fp.mustProcessColor && !fp.mustProcessTransparency && flags&ResizeFlagGrayOK != 0 {
-		if flags&ResizeFlag16Bit != 0 {
-			gray16 := fp.convertDst_Gray16(dstFPImage)
-			return gray16, nil
+	prepareFormat := func(r image.Rectangle) *convertDstWorkContext {
+		if flags&ResizeFlagPalettedOK != 0 {
+			if p := fp.targetPalette(); p != nil {
+				return fp.prepareDst_Paletted(r, p)
+			}
+		}
+
+		if flags&ResizeFlagCMYK != 0 {
+			return fp.prepareDst_CMYK(r)
+		}
+
+		gray := !fp.mustProcessColor || fp.channelOrderIsGray() || fp.mustFindLuminance()
+		opaque := !fp.mustProcessTransparency || (fp.useChannelOrder() && fp.channelOrder[3] == ChannelOne)
+		if gray && opaque && flags&(ResizeFlagGrayOK|ResizeFlagGray) != 0 {
+			if flags&ResizeFlag16Bit != 0 {
+				return fp.prepareDst_Gray16(r)
+			}
+			return fp.prepareDst_Gray(r)
+		}
+
+		if (flags & ResizeFlagUnassocAlpha) != 0 {
+			if flags&ResizeFlag16Bit != 0 {
+				return fp.prepareDst_NRGBA64(r)
+			}
+			return fp.prepareDst_NRGBA(r)
 		}
-		gray := fp.convertDst_Gray(dstFPImage)
-		return gray, nil
-	}
 
-	if (flags & ResizeFlagUnassocAlpha) != 0 {
 		if flags&ResizeFlag16Bit != 0 {
-			nrgba64 := fp.convertDst_NRGBA64(dstFPImage)
-			return nrgba64, nil
+			return fp.prepareDst_RGBA64(r)
 		}
-		nrgba := fp.convertDst_NRGBA(dstFPImage)
-		return nrgba, nil
+		return fp.prepareDst_RGBA(r)
 	}
 
-	if flags&ResizeFlag16Bit != 0 {
-		rgba64 := fp.convertDst_RGBA64(dstFPImage)
-		return rgba64, nil
+	prepare := func(r image.Rectangle) *convertDstWorkContext {
+		wc := prepareFormat(r)
+		if fp.mustFindLuminance() {
+			fp.addFindLuminance(wc)
+		}
+		return wc
 	}
-	rgba := fp.convertDst_RGBA(dstFPImage)
-	return rgba, nil
+
+	return resize(prepare)
 }
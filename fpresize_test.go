@@ -9,12 +9,19 @@ import "testing"
 import "fmt"
 import "os"
 import "bytes"
-import "io/ioutil"
+import "context"
+import "errors"
 import "runtime"
+import "math"
+import "strings"
+import "time"
+import "sync/atomic"
 import "image"
+import "image/color"
 import "image/draw"
 import "image/png"
 import _ "image/jpeg"
+import "github.com/jsummers/fpresize/metrics"
 
 func readImageFromFile(t *testing.T, srcFilename string) image.Image {
 	var err error
@@ -57,33 +64,29 @@ func writeImageToFile(t *testing.T, img image.Image, dstFilename string) {
 	}
 }
 
+// The largest difference, on a scale of 0 to 1, that will be tolerated
+// between an expected and an actual image. The expected images may have been
+// made with a different version of Go, whose floating point code or
+// JPEG decoder behaves slightly differently.
+const compareTolerance = 2.5 / 255.0
+
 func compareFiles(t *testing.T, expectedFN string, actualFN string) {
-	var expectedBytes []byte
-	var actualBytes []byte
-	var err error
+	var expectedImg image.Image
+	var actualImg image.Image
 
-	expectedBytes, err = ioutil.ReadFile(expectedFN)
-	if err != nil {
-		t.Logf("Failed to open for compare: %s\n", err.Error())
-		t.Fail()
-		return
-	}
+	expectedImg = readImageFromFile(t, expectedFN)
+	actualImg = readImageFromFile(t, actualFN)
 
-	actualBytes, err = ioutil.ReadFile(actualFN)
+	d, err := metrics.Compare(expectedImg, actualImg)
 	if err != nil {
-		t.Logf("Failed to open for compare: %s\n", err.Error())
-		t.FailNow()
-		return
-	}
-
-	if len(expectedBytes) != len(actualBytes) {
-		t.Logf("%s and %s differ in size\n", expectedFN, actualFN)
+		t.Logf("%s and %s: %s\n", expectedFN, actualFN, err.Error())
 		t.Fail()
 		return
 	}
 
-	if 0 != bytes.Compare(actualBytes, expectedBytes) {
-		t.Logf("%s and %s differ\n", expectedFN, actualFN)
+	if !d.Within(compareTolerance) {
+		t.Logf("%s and %s differ (max difference %.5f at %d,%d)\n", expectedFN, actualFN,
+			d.Max, d.MaxX, d.MaxY)
 		t.Fail()
 		return
 	}
@@ -477,3 +480,3530 @@ func TestMain(t *testing.T) {
 	opts.bounds.Max.Y = 17
 	runFileTest(t, opts)
 }
+
+// Verify that ResizeToLinear followed by FinalizeToNRGBA gives the same
+// result as ResizeToNRGBA.
+func TestLinear(t *testing.T) {
+	src := readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%crgb8a.png", os.PathSeparator, os.PathSeparator))
+
+	fp := New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 20, 18))
+	expected, err := fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	fp = New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 20, 18))
+	lin, err := fp.ResizeToLinear()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	actual, err := fp.FinalizeToNRGBA(lin)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	if !bytes.Equal(expected.Pix, actual.Pix) {
+		t.Logf("ResizeToLinear+FinalizeToNRGBA differs from ResizeToNRGBA\n")
+		t.Fail()
+	}
+
+	var fp2 FPObject
+	if fp2.Finalize(lin) == nil {
+		t.Logf("Finalize without ResizeToLinear did not fail\n")
+		t.Fail()
+	}
+}
+
+func TestResizeN(t *testing.T) {
+	// A 5-channel image. Channel 4 duplicates channel 1, and channel 2 is
+	// constant.
+	src := NewFPImageN(image.Rect(3, 4, 23, 19), 5)
+	for j := 0; j < src.Rect.Dy(); j++ {
+		for i := 0; i < src.Rect.Dx(); i++ {
+			sam := src.Pix[j*src.Stride+i*5 : j*src.Stride+i*5+5]
+			sam[0] = float32(i) / 20.0
+			sam[1] = float32((i*7+j*3)%11) / 10.0
+			sam[2] = 0.25
+			sam[3] = float32(j) / 15.0
+			sam[4] = sam[1]
+		}
+	}
+
+	fp := new(FPObject)
+	fp.SetSourceImageN(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 13, 31))
+	dst, err := fp.ResizeN()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if dst.NumChannels != 5 || dst.Rect != image.Rect(0, 0, 13, 31) {
+		t.Fatalf("ResizeN: bad result format\n")
+	}
+
+	for j := 0; j < dst.Rect.Dy(); j++ {
+		for i := 0; i < dst.Rect.Dx(); i++ {
+			sam := dst.Pix[j*dst.Stride+i*5 : j*dst.Stride+i*5+5]
+			if sam[1] != sam[4] || sam[2] < 0.2499 || sam[2] > 0.2501 {
+				t.Fatalf("ResizeN: incorrect samples at (%d,%d): %v\n", i, j, sam)
+			}
+		}
+	}
+
+	if _, err = fp.ResizeToRGBA(); err == nil {
+		t.Logf("ResizeToRGBA did not fail with an FPImageN source\n")
+		t.Fail()
+	}
+}
+
+func TestDataMode(t *testing.T) {
+	// A checkerboard of two different unit vectors, encoded as a normal map.
+	src := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for j := 0; j < 16; j++ {
+		for i := 0; i < 16; i++ {
+			if (i+j)%2 == 0 {
+				src.Pix[src.PixOffset(i, j)+0] = 255
+				src.Pix[src.PixOffset(i, j)+1] = 0
+			} else {
+				src.Pix[src.PixOffset(i, j)+0] = 0
+				src.Pix[src.PixOffset(i, j)+1] = 255
+			}
+			src.Pix[src.PixOffset(i, j)+2] = 0
+			// Alpha is data, not transparency.
+			src.Pix[src.PixOffset(i, j)+3] = 0
+		}
+	}
+
+	fp := New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 5, 5))
+	fp.SetDataMode(true)
+	fp.SetDataRange(-1.0, 1.0)
+	fp.SetRenormalizeVectors(true)
+	dst, err := fp.Resize()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	for j := 0; j < 5; j++ {
+		for i := 0; i < 5; i++ {
+			sam := dst.Pix[j*dst.Stride+i*4 : j*dst.Stride+i*4+4]
+			lenSq := sam[0]*sam[0] + sam[1]*sam[1] + sam[2]*sam[2]
+			if lenSq < 0.999 || lenSq > 1.001 {
+				t.Fatalf("Data mode: vector at (%d,%d) not normalized: %v\n", i, j, sam)
+			}
+			if sam[3] != -1.0 {
+				t.Fatalf("Data mode: alpha at (%d,%d) altered: %v\n", i, j, sam[3])
+			}
+		}
+	}
+}
+
+func TestLUTCache(t *testing.T) {
+	gamma := 2.2
+	closure := func(s []float32) {
+		for k := range s {
+			s[k] = float32(math.Pow(float64(s[k]), gamma))
+		}
+	}
+
+	if _, ok := makeLUTCacheKey(SRGBToLinear, 0, lutKindInput32, 256); !ok {
+		t.Logf("SRGBToLinear is not shareable\n")
+		t.Fail()
+	}
+	if _, ok := makeLUTCacheKey(SRGBToLinear, CCFFlagNoSharedCache, lutKindInput32, 256); ok {
+		t.Logf("CCFFlagNoSharedCache was ignored\n")
+		t.Fail()
+	}
+	if _, ok := makeLUTCacheKey(closure, 0, lutKindInput32, 256); ok {
+		t.Logf("A closure was considered shareable\n")
+		t.Fail()
+	}
+
+	key, _ := makeLUTCacheKey(LinearTosRGB, 0, lutKindOutput32, 9885)
+	tbl1 := getSharedLUT(key, func() interface{} { return make([]float32, 9885) }).([]float32)
+	tbl2 := getSharedLUT(key, func() interface{} { return nil }).([]float32)
+	if &tbl1[0] != &tbl2[0] {
+		t.Logf("Shared LUT was not reused\n")
+		t.Fail()
+	}
+	SetSharedLUTCache(false)
+	SetSharedLUTCache(true)
+}
+
+func TestColorLUT(t *testing.T) {
+	var numCalls int
+	var numSamples int
+	ccf := func(s []float32) {
+		numCalls++
+		numSamples += len(s)
+		SRGBToLinear(s)
+	}
+	lut := NewColorLUT(ccf)
+
+	src := image.NewNRGBA(image.Rect(0, 0, 3, 3))
+	for k := range src.Pix {
+		src.Pix[k] = uint8(k * 7)
+	}
+
+	for n := 0; n < 3; n++ {
+		fp := New(src)
+		fp.SetMaxWorkerThreads(1)
+		fp.SetTargetBounds(image.Rect(0, 0, 2, 2))
+		fp.SetInputColorLUT(lut)
+		_, err := fp.ResizeToNRGBA()
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+	}
+
+	// The converter should only have been called once, to make the table.
+	if numCalls != 1 || numSamples != 256 {
+		t.Logf("ColorLUT: converter called %d times, for %d samples\n", numCalls, numSamples)
+		t.Fail()
+	}
+}
+
+// The output lookup tables must depend on the output color converter, not
+// on the input one.
+func TestOutputLUTConverter(t *testing.T) {
+	var numCalls int
+	ccf := func(s []float32) {
+		numCalls++
+		LinearTosRGB(s)
+	}
+	lut := NewColorLUT(ccf)
+
+	src := image.NewGray(image.Rect(0, 0, 100, 100))
+	for k := range src.Pix {
+		src.Pix[k] = 128
+	}
+
+	// No input converter, but an output table.
+	for n := 0; n < 3; n++ {
+		fp := New(src)
+		fp.SetMaxWorkerThreads(1)
+		fp.SetTargetBounds(image.Rect(0, 0, 100, 100))
+		fp.SetInputColorConverter(nil)
+		fp.SetOutputColorLUT(lut)
+		_, err := fp.ResizeToNRGBA()
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+	}
+	if numCalls != 1 {
+		t.Logf("Output ColorLUT: converter called %d times\n", numCalls)
+		t.Fail()
+	}
+
+	// An input converter, but no output converter.
+	fp := New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 100, 100))
+	fp.SetOutputColorConverter(nil)
+	dst, err := fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	// 128 in sRGB is about 0.216 in linear light.
+	if v := dst.Pix[0]; v < 54 || v > 56 {
+		t.Logf("No output converter: got %d, expected 55\n", v)
+		t.Fail()
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 37, 23))
+	for k := range src.Pix {
+		src.Pix[k] = uint8(k * 13)
+	}
+
+	resize := func(configure func(fp *FPObject)) *image.NRGBA {
+		fp := New(src)
+		fp.SetTargetBounds(image.Rect(0, 0, 19, 41))
+		configure(fp)
+		dst, err := fp.ResizeToNRGBA()
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		return dst
+	}
+
+	ref := resize(func(fp *FPObject) { fp.SetWorkers(1) })
+	configs := []func(fp *FPObject){
+		func(fp *FPObject) { fp.SetWorkers(7) },
+		func(fp *FPObject) {
+			fp.SetWorkers(2)
+			fp.SetStageWorkers(StageConvertSource, 3)
+			fp.SetStageWorkers(StageResample, 1)
+			fp.SetStageWorkers(StageConvertTarget, 5)
+		},
+	}
+	for n, configure := range configs {
+		dst := resize(configure)
+		if !bytes.Equal(dst.Pix, ref.Pix) {
+			t.Logf("Workers: config %d: results differ\n", n)
+			t.Fail()
+		}
+	}
+}
+
+func TestPipelined(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(3, 5, 83, 105))
+	for k := range src.Pix {
+		src.Pix[k] = uint8(k * 29)
+	}
+	opaque := image.NewYCbCr(image.Rect(0, 0, 40, 70), image.YCbCrSubsampleRatio420)
+	for k := range opaque.Y {
+		opaque.Y[k] = uint8(k * 7)
+	}
+
+	type testCase struct {
+		src     image.Image
+		dstRect image.Rectangle
+		flags   uint32
+		exact   bool
+	}
+	tests := []testCase{
+		{src, image.Rect(0, 0, 30, 70), ResizeFlagUnassocAlpha, true},
+		{src, image.Rect(0, 0, 90, 130), 0, false},
+		{opaque, image.Rect(0, 0, 17, 33), 0, true},
+		{opaque, image.Rect(0, 0, 50, 100), ResizeFlagUnassocAlpha | ResizeFlag16Bit, false},
+	}
+
+	for n, tc := range tests {
+		fp := New(tc.src)
+		fp.SetTargetBounds(tc.dstRect)
+		ref, err := fp.ResizeToImage(tc.flags)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+
+		fp = New(tc.src)
+		fp.SetTargetBounds(tc.dstRect)
+		fp.SetPipelined(true)
+		dst, err := fp.ResizeToImage(tc.flags)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+
+		d, err := metrics.Compare(ref, dst)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		if (tc.exact && d.NumDiffering != 0) || !d.Within(compareTolerance) {
+			t.Logf("Pipelined: test %d: results differ (max %v)\n", n, d.Max)
+			t.Fail()
+		}
+	}
+}
+
+// A RowReader that reads from an NRGBA image, for testing.
+type testRowReader struct {
+	im      *image.NRGBA
+	lastRow int
+	failAt  int
+	t       *testing.T
+}
+
+func (r *testRowReader) Bounds() image.Rectangle {
+	return r.im.Bounds()
+}
+
+func (r *testRowReader) ReadRow(y int, dst []float32) error {
+	if y <= r.lastRow {
+		r.t.Errorf("RowReader: row %d read after row %d\n", y, r.lastRow)
+	}
+	r.lastRow = y
+	if y == r.failAt {
+		return fmt.Errorf("read error at row %d", y)
+	}
+	for i := 0; i < r.im.Rect.Dx(); i++ {
+		for k := 0; k < 4; k++ {
+			dst[i*4+k] = float32(r.im.Pix[r.im.PixOffset(r.im.Rect.Min.X+i, y)+k]) / 255.0
+		}
+	}
+	return nil
+}
+
+func TestRowReader(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 10, 60, 90))
+	for k := range src.Pix {
+		src.Pix[k] = uint8(k * 31)
+	}
+	dstRect := image.Rect(0, 0, 25, 37)
+
+	fp := New(src)
+	fp.SetTargetBounds(dstRect)
+	ref, err := fp.ResizeToNRGBA64()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	for _, pipelined := range []bool{false, true} {
+		rr := &testRowReader{im: src, lastRow: -1, failAt: -1, t: t}
+		fp = new(FPObject)
+		fp.SetSourceRowReader(rr)
+		fp.SetTargetBounds(dstRect)
+		fp.SetPipelined(pipelined)
+		dst, err := fp.ResizeToNRGBA64()
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+
+		d, err := metrics.Compare(ref, dst)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		if !d.Within(compareTolerance) {
+			t.Logf("RowReader: pipelined=%v: results differ (max %v)\n", pipelined, d.Max)
+			t.Fail()
+		}
+
+		// Errors from the RowReader should be returned.
+		rr = &testRowReader{im: src, lastRow: -1, failAt: 50, t: t}
+		fp = new(FPObject)
+		fp.SetSourceRowReader(rr)
+		fp.SetTargetBounds(dstRect)
+		fp.SetPipelined(pipelined)
+		_, err = fp.ResizeToNRGBA64()
+		if err == nil {
+			t.Logf("RowReader: pipelined=%v: error not returned\n", pipelined)
+			t.Fail()
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 250, 120))
+	for k := range src.Pix {
+		src.Pix[k] = uint8(k * 7)
+	}
+
+	for _, pipelined := range []bool{false, true} {
+		var steps []string
+		var last Progress
+
+		fp := New(src)
+		fp.SetTargetBounds(image.Rect(0, 0, 90, 200))
+		fp.SetPipelined(pipelined)
+		fp.SetProgressFunc(func(p Progress) {
+			if p.Done == 0 {
+				if last.Done != last.Total {
+					t.Logf("Progress: step %q did not finish\n", last.Step)
+					t.Fail()
+				}
+				steps = append(steps, StageName(p.Stage)+": "+p.Step)
+			} else if p.Step != last.Step || p.Done < last.Done || p.Done > p.Total {
+				t.Logf("Progress: bad report %+v after %+v\n", p, last)
+				t.Fail()
+			}
+			last = p
+		})
+		_, err := fp.ResizeToNRGBA()
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		if last.Done != last.Total {
+			t.Logf("Progress: step %q did not finish\n", last.Step)
+			t.Fail()
+		}
+
+		expected := "convert source: Converting source image," +
+			"resample: Changing width,resample: Changing height,convert target: Converting to target format"
+		if pipelined {
+			expected = "resample: Resizing in bands"
+		}
+		if strings.Join(steps, ",") != expected {
+			t.Logf("Progress: pipelined=%v: got steps %q\n", pipelined, steps)
+			t.Fail()
+		}
+	}
+}
+
+func TestForceGrayscale(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 20, 10))
+	for k := 0; k < len(src.Pix); k += 4 {
+		// Pure red
+		src.Pix[k] = 255
+		src.Pix[k+3] = 255
+	}
+
+	for _, pipelined := range []bool{false, true} {
+		fp := New(src)
+		fp.SetTargetBounds(image.Rect(0, 0, 7, 5))
+		fp.SetForceGrayscale(true)
+		fp.SetPipelined(pipelined)
+		dst, err := fp.ResizeToImage(ResizeFlagGrayOK)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		gray, ok := dst.(*image.Gray)
+		if !ok {
+			t.Logf("ForceGrayscale: pipelined=%v: got %T, expected *image.Gray\n", pipelined, dst)
+			t.Fail()
+			continue
+		}
+		// The luminance of red is 0.2126, which is 127 in sRGB.
+		for _, v := range gray.Pix {
+			if v != 127 {
+				t.Logf("ForceGrayscale: pipelined=%v: got %d, expected 127\n", pipelined, v)
+				t.Fail()
+				break
+			}
+		}
+	}
+}
+
+func TestPixelAlignment(t *testing.T) {
+	src := image.NewGray(image.Rect(0, 0, 3, 1))
+	copy(src.Pix, []uint8{0, 100, 200})
+
+	resize := func(alignment int) []uint8 {
+		fp := New(src)
+		fp.SetInputColorConverter(nil)
+		fp.SetOutputColorConverter(nil)
+		fp.SetFilter(MakeTriangleFilter())
+		fp.SetPixelAlignment(alignment)
+		fp.SetTargetBounds(image.Rect(0, 0, 5, 1))
+		dst, err := fp.ResizeToImage(ResizeFlagGrayOK)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		return dst.(*image.Gray).Pix
+	}
+
+	// With corners aligned, the target pixels are exactly halfway between
+	// the source pixels.
+	pix := resize(PixelAlignCorners)
+	if !bytes.Equal(pix, []uint8{0, 50, 100, 150, 200}) {
+		t.Logf("PixelAlignment: corners: got %v\n", pix)
+		t.Fail()
+	}
+
+	// With centers aligned, the edge pixels are a mix of the edge source
+	// pixels and the (nonexistent) pixels beyond them.
+	pix = resize(PixelAlignCenters)
+	if pix[0] != 0 || pix[4] != 200 || pix[1] <= 0 || pix[1] >= 50 {
+		t.Logf("PixelAlignment: centers: got %v\n", pix)
+		t.Fail()
+	}
+}
+
+// Verify that the settings can be made in any order, and that invalid
+// combinations are reported.
+func TestSettingsOrder(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 16, 12))
+	for k := range src.Pix {
+		src.Pix[k] = uint8(k * 11)
+	}
+	dstRect := image.Rect(0, 0, 10, 9)
+
+	resize := func(configure func(fp *FPObject)) []uint8 {
+		fp := New(src)
+		configure(fp)
+		dst, err := fp.ResizeToNRGBA()
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		return dst.Pix
+	}
+
+	a := resize(func(fp *FPObject) {
+		fp.SetTargetBoundsAdvanced(dstRect, 1, 1, 9, 8)
+		fp.SetVirtualPixels(VirtualPixelsNone)
+	})
+	b := resize(func(fp *FPObject) {
+		fp.SetVirtualPixels(VirtualPixelsNone)
+		fp.SetTargetBoundsAdvanced(dstRect, 1, 1, 9, 8)
+	})
+	if !bytes.Equal(a, b) {
+		t.Logf("SettingsOrder: SetVirtualPixels before SetTargetBoundsAdvanced: results differ\n")
+		t.Fail()
+	}
+
+	a = resize(func(fp *FPObject) {
+		fp.SetTargetBounds(dstRect)
+		fp.SetVirtualPixels(VirtualPixelsTransparent)
+	})
+	b = resize(func(fp *FPObject) {
+		fp.SetVirtualPixels(VirtualPixelsTransparent)
+		fp.SetTargetBounds(dstRect)
+	})
+	if !bytes.Equal(a, b) {
+		t.Logf("SettingsOrder: SetVirtualPixels before SetTargetBounds: results differ\n")
+		t.Fail()
+	}
+
+	badConfigs := []func(fp *FPObject){
+		func(fp *FPObject) {},
+		func(fp *FPObject) { fp.SetTargetBoundsAdvanced(dstRect, 5, 1, 2, 8) },
+		func(fp *FPObject) {
+			fp.SetTargetBounds(dstRect)
+			fp.SetVirtualPixels(99)
+		},
+		func(fp *FPObject) {
+			fp.SetTargetBounds(dstRect)
+			fp.SetPixelAlignment(99)
+		},
+		func(fp *FPObject) {
+			fp.SetTargetBounds(dstRect)
+			fp.ResizeToNRGBA()
+			fp.SetForceGrayscale(true)
+		},
+	}
+	for n, configure := range badConfigs {
+		fp := New(src)
+		configure(fp)
+		_, err := fp.ResizeToNRGBA()
+		if err == nil {
+			t.Logf("SettingsOrder: bad config %d: no error\n", n)
+			t.Fail()
+		}
+	}
+}
+
+func TestPaletted(t *testing.T) {
+	src := readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%cp8.png", os.PathSeparator, os.PathSeparator))
+	srcPal, ok := src.(*image.Paletted)
+	if !ok {
+		t.Fatalf("p8.png is not paletted\n")
+	}
+
+	for _, pipelined := range []bool{false, true} {
+		fp := New(src)
+		fp.SetTargetBounds(image.Rect(0, 0, 19, 17))
+		fp.SetPipelined(pipelined)
+		dst, err := fp.ResizeToImage(ResizeFlagPalettedOK | ResizeFlagGrayOK)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		dstPal, ok := dst.(*image.Paletted)
+		if !ok {
+			t.Logf("Paletted: got %T, expected *image.Paletted\n", dst)
+			t.Fail()
+			continue
+		}
+		if len(dstPal.Palette) != len(srcPal.Palette) {
+			t.Logf("Paletted: target palette differs from source palette\n")
+			t.Fail()
+		}
+	}
+
+	// A caller-supplied palette, with a non-paletted source image.
+	pal := color.Palette{color.NRGBA{0, 0, 0, 255}, color.NRGBA{255, 255, 255, 255}}
+	fp := New(readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%crgb8.png", os.PathSeparator, os.PathSeparator)))
+	fp.SetTargetBounds(image.Rect(0, 0, 20, 20))
+	fp.SetTargetPalette(pal)
+	dst, err := fp.ResizeToImage(ResizeFlagPalettedOK)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	dstPal, ok := dst.(*image.Paletted)
+	if !ok {
+		t.Fatalf("Paletted: got %T, expected *image.Paletted\n", dst)
+	}
+	for _, v := range dstPal.Pix {
+		if v > 1 {
+			t.Logf("Paletted: invalid palette index %d\n", v)
+			t.Fail()
+			break
+		}
+	}
+}
+
+func absdiff(a, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+func TestCMYK(t *testing.T) {
+	// A solid CMYK image should resize to (nearly) the same color.
+	src := image.NewCMYK(image.Rect(0, 0, 10, 10))
+	for i := 0; i < len(src.Pix); i += 4 {
+		src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3] = 0, 128, 200, 40
+	}
+
+	for _, pipelined := range []bool{false, true} {
+		fp := New(src)
+		fp.SetTargetBounds(image.Rect(0, 0, 7, 5))
+		fp.SetPipelined(pipelined)
+		dst, err := fp.ResizeToImage(ResizeFlagCMYK | ResizeFlagGrayOK)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		dstCMYK, ok := dst.(*image.CMYK)
+		if !ok {
+			t.Fatalf("CMYK: got %T, expected *image.CMYK\n", dst)
+		}
+		r0, g0, b0, _ := src.At(0, 0).RGBA()
+		r1, g1, b1, _ := dstCMYK.At(3, 2).RGBA()
+		if absdiff(r0, r1) > 0x200 || absdiff(g0, g1) > 0x200 || absdiff(b0, b1) > 0x200 {
+			t.Logf("CMYK: color changed: %v -> %v\n", src.At(0, 0), dstCMYK.At(3, 2))
+			t.Fail()
+		}
+	}
+
+	// Transparent pixels become white.
+	fp := New(image.NewNRGBA(image.Rect(0, 0, 10, 10)))
+	fp.SetTargetBounds(image.Rect(0, 0, 5, 5))
+	dst, err := fp.ResizeToCMYK()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if c := dst.CMYKAt(2, 2); c != (color.CMYK{0, 0, 0, 0}) {
+		t.Logf("CMYK: transparent pixel is %v, expected white\n", c)
+		t.Fail()
+	}
+}
+
+func TestBGRA(t *testing.T) {
+	src := readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%crgb8a.png", os.PathSeparator, os.PathSeparator))
+
+	fp := New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 23, 19))
+	ref, err := fp.ResizeToRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	for _, bottomUp := range []bool{false, true} {
+		for _, pipelined := range []bool{false, true} {
+			fp := New(src)
+			fp.SetTargetBounds(image.Rect(0, 0, 23, 19))
+			fp.SetPipelined(pipelined)
+			dst, err := fp.ResizeToBGRA(bottomUp)
+			if err != nil {
+				t.Fatalf("%s\n", err.Error())
+			}
+			for y := 0; y < 19; y++ {
+				for x := 0; x < 23; x++ {
+					if dst.At(x, y) != ref.At(x, y) {
+						t.Fatalf("BGRA(bottomUp=%v): pixel (%d,%d) is %v, expected %v\n",
+							bottomUp, x, y, dst.At(x, y), ref.At(x, y))
+					}
+				}
+			}
+			// Check the byte order of the first pixel in memory.
+			y := 0
+			if bottomUp {
+				y = 18
+			}
+			c := ref.RGBAAt(0, y)
+			if dst.Pix[0] != c.B || dst.Pix[2] != c.R {
+				t.Logf("BGRA(bottomUp=%v): wrong byte order\n", bottomUp)
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestRowAlignment(t *testing.T) {
+	src := readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%crgb8a.png", os.PathSeparator, os.PathSeparator))
+
+	fp := New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 13, 7))
+	ref, err := fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	for _, pipelined := range []bool{false, true} {
+		fp := New(src)
+		fp.SetTargetBounds(image.Rect(0, 0, 13, 7))
+		fp.SetTargetRowAlignment(64)
+		fp.SetPipelined(pipelined)
+		dst, err := fp.ResizeToNRGBA()
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		if dst.Stride != 64 {
+			t.Logf("RowAlignment: stride is %d, expected 64\n", dst.Stride)
+			t.Fail()
+		}
+		for y := 0; y < 7; y++ {
+			for x := 0; x < 13; x++ {
+				if dst.At(x, y) != ref.At(x, y) {
+					t.Fatalf("RowAlignment: pixel (%d,%d) differs\n", x, y)
+				}
+			}
+		}
+
+		cmyk, err := fp.ResizeToImage(ResizeFlagCMYK)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		if cmyk.(*image.CMYK).Stride != 64 {
+			t.Logf("RowAlignment: CMYK stride is %d, expected 64\n", cmyk.(*image.CMYK).Stride)
+			t.Fail()
+		}
+	}
+}
+
+func TestResizeToBuffer(t *testing.T) {
+	src := readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%crgb8a.png", os.PathSeparator, os.PathSeparator))
+
+	fp := New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 11, 9))
+	ref, err := fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	const stride = 50
+	buf := make([]uint8, stride*9)
+	for i := range buf {
+		buf[i] = 0x55
+	}
+	err = fp.ResizeToBuffer(buf, stride, PixelFormatNRGBA)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	dst := &image.NRGBA{Pix: buf, Stride: stride, Rect: image.Rect(0, 0, 11, 9)}
+	for y := 0; y < 9; y++ {
+		for x := 0; x < 11; x++ {
+			if dst.At(x, y) != ref.At(x, y) {
+				t.Fatalf("ResizeToBuffer: pixel (%d,%d) differs\n", x, y)
+			}
+		}
+		if buf[y*stride+44] != 0x55 {
+			t.Fatalf("ResizeToBuffer: padding was overwritten\n")
+		}
+	}
+
+	if fp.ResizeToBuffer(buf, 40, PixelFormatNRGBA) == nil {
+		t.Logf("ResizeToBuffer: small stride was accepted\n")
+		t.Fail()
+	}
+	if fp.ResizeToBuffer(buf[:stride*8], stride, PixelFormatNRGBA) == nil {
+		t.Logf("ResizeToBuffer: small buffer was accepted\n")
+		t.Fail()
+	}
+
+	// The gray formats use the luminance, as ResizeToGray does.
+	gray, err := fp.ResizeToGray()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	err = fp.ResizeToBuffer(buf, stride, PixelFormatGray)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	for y := 0; y < 9; y++ {
+		if !bytes.Equal(buf[y*stride:y*stride+11], gray.Pix[y*gray.Stride:y*gray.Stride+11]) {
+			t.Fatalf("ResizeToBuffer: gray row %d differs from ResizeToGray\n", y)
+		}
+	}
+}
+
+func TestSetFilterByName(t *testing.T) {
+	fp := New(image.NewGray(image.Rect(0, 0, 10, 10)))
+	fp.SetTargetBounds(image.Rect(0, 0, 5, 5))
+	for _, name := range FilterNames() {
+		if err := fp.SetFilterByName(name); err != nil {
+			t.Logf("%s\n", err.Error())
+			t.Fail()
+		}
+	}
+	if err := fp.SetFilterByName("Lanczos3"); err != nil {
+		t.Logf("SetFilterByName: %s\n", err.Error())
+		t.Fail()
+	}
+	if fp.SetFilterByName("no-such-filter") == nil {
+		t.Logf("SetFilterByName: unknown filter was accepted\n")
+		t.Fail()
+	}
+
+	RegisterFilter("test-custom", MakeTriangleFilter)
+	if _, err := FilterByName("test-custom"); err != nil {
+		t.Logf("RegisterFilter: %s\n", err.Error())
+		t.Fail()
+	}
+}
+
+func TestDefaultFilter(t *testing.T) {
+	src := readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%crgb8.png", os.PathSeparator, os.PathSeparator))
+
+	fp := New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 17, 13))
+	fp.SetFilter(MakeTriangleFilter())
+	ref, err := fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	SetDefaultFilter(MakeTriangleFilter())
+	defer SetDefaultFilter(nil)
+
+	fp = New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 17, 13))
+	dst, err := fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if !bytes.Equal(dst.Pix, ref.Pix) {
+		t.Logf("DefaultFilter: default filter was not used\n")
+		t.Fail()
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	src := readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%crgb8a.png", os.PathSeparator, os.PathSeparator))
+
+	fp := New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, src.Bounds().Dx()/2, src.Bounds().Dy()/4))
+	expected := float64(src.Bounds().Dy()/4) / float64(src.Bounds().Dy())
+	if sf := fp.ScaleFactor(true); math.Abs(sf-expected) > 0.000001 {
+		t.Logf("Analyze: ScaleFactor is %v before resize, expected %v\n", sf, expected)
+		t.Fail()
+	}
+	err := fp.Analyze()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if !fp.HasTransparency() || !fp.HasColor() {
+		t.Logf("Analyze: rgb8a.png should have transparency and color\n")
+		t.Fail()
+	}
+	dst, err := fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	fp = New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, src.Bounds().Dx()/2, src.Bounds().Dy()/4))
+	ref, err := fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if !bytes.Equal(dst.Pix, ref.Pix) {
+		t.Logf("Analyze: the resized image changed\n")
+		t.Fail()
+	}
+
+	fp = New(readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%cg8.png", os.PathSeparator, os.PathSeparator)))
+	err = fp.Analyze()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if fp.HasTransparency() || fp.HasColor() {
+		t.Logf("Analyze: g8.png should have no transparency or color\n")
+		t.Fail()
+	}
+}
+
+func TestAnalyzeSource(t *testing.T) {
+	tests := []struct {
+		fn              string
+		hasTransparency bool
+		isGrayscale     bool
+		bitDepth        int
+	}{
+		{"g8.png", false, true, 8},
+		{"g16.png", false, true, 16},
+		{"rgb8.png", false, false, 8},
+		{"rgb8a.png", true, false, 8},
+		{"rgb16a.png", true, false, 16},
+		{"p8t.png", true, false, 8},
+	}
+
+	for _, tt := range tests {
+		fp := New(readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%c%s", os.PathSeparator, os.PathSeparator, tt.fn)))
+		info, err := fp.AnalyzeSource()
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		if info.HasTransparency != tt.hasTransparency || info.IsGrayscale != tt.isGrayscale ||
+			info.BitDepth != tt.bitDepth {
+			t.Logf("AnalyzeSource(%s): got %+v\n", tt.fn, *info)
+			t.Fail()
+		}
+
+		// It should still work after a resize.
+		fp.SetTargetBounds(image.Rect(0, 0, 10, 10))
+		_, err = fp.ResizeToNRGBA()
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		if _, err = fp.AnalyzeSource(); err != nil {
+			t.Logf("AnalyzeSource(%s) after resize: %s\n", tt.fn, err.Error())
+			t.Fail()
+		}
+	}
+}
+
+func TestRegionOfInterest(t *testing.T) {
+	src := readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%crgb8a.png", os.PathSeparator, os.PathSeparator))
+	roi := image.Rect(13, 4, 31, 17)
+
+	for _, corners := range []bool{false, true} {
+		fp := New(src)
+		fp.SetTargetBoundsAdvanced(image.Rect(5, 0, 45, 30), 6.5, 1.25, 40.0, 28.0)
+		if corners {
+			fp.SetPixelAlignment(PixelAlignCorners)
+		}
+		ref, err := fp.ResizeToNRGBA()
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+
+		for _, pipelined := range []bool{false, true} {
+			fp.SetPipelined(pipelined)
+			fp.SetTargetRegionOfInterest(roi)
+			dst, err := fp.ResizeToNRGBA()
+			if err != nil {
+				t.Fatalf("%s\n", err.Error())
+			}
+			if dst.Bounds() != roi {
+				t.Fatalf("RegionOfInterest: bounds are %v, expected %v\n", dst.Bounds(), roi)
+			}
+			for y := roi.Min.Y; y < roi.Max.Y; y++ {
+				for x := roi.Min.X; x < roi.Max.X; x++ {
+					if dst.At(x, y) != ref.At(x, y) {
+						t.Fatalf("RegionOfInterest: pixel (%d,%d) is %v, expected %v\n",
+							x, y, dst.At(x, y), ref.At(x, y))
+					}
+				}
+			}
+			fp.SetTargetRegionOfInterest(image.Rectangle{})
+		}
+
+		fp.SetTargetRegionOfInterest(image.Rect(100, 100, 110, 110))
+		if _, err = fp.ResizeToNRGBA(); err == nil {
+			t.Logf("RegionOfInterest: region outside the target was accepted\n")
+			t.Fail()
+		}
+	}
+}
+
+func TestRegionOfInterestOrder(t *testing.T) {
+	src := readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%crgb8.png", os.PathSeparator, os.PathSeparator))
+	roi := image.Rect(2, 2, 6, 6)
+
+	// The region of interest may be set before the target bounds, and is
+	// kept when they are set again.
+	fp := New(src)
+	fp.SetTargetRegionOfInterest(roi)
+	fp.SetTargetBounds(image.Rect(0, 0, 32, 32))
+	dst, err := fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if dst.Bounds() != roi {
+		t.Errorf("RegionOfInterest: bounds are %v, expected %v\n", dst.Bounds(), roi)
+	}
+
+	fp.SetTargetBoundsAdvanced(image.Rect(0, 0, 20, 20), 1.0, 1.0, 19.0, 19.0)
+	dst, err = fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if dst.Bounds() != roi {
+		t.Errorf("RegionOfInterest: bounds are %v, expected %v\n", dst.Bounds(), roi)
+	}
+}
+
+func TestRequestTile(t *testing.T) {
+	src := readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%crgb8.png", os.PathSeparator, os.PathSeparator))
+	bounds := image.Rect(0, 0, src.Bounds().Dx()*3, src.Bounds().Dy()*2)
+
+	fp := New(src)
+	fp.SetTargetBounds(bounds)
+	ref, err := fp.ResizeToRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	fp = New(src)
+	fp.SetTargetBounds(bounds)
+	fp.SetPipelined(true)
+	const tileSize = 32
+	for y0 := 0; y0 < bounds.Max.Y; y0 += tileSize {
+		for x0 := 0; x0 < bounds.Max.X; x0 += tileSize {
+			r := image.Rect(x0, y0, x0+tileSize, y0+tileSize).Intersect(bounds)
+			tile, err := fp.RequestTile(r, 0)
+			if err != nil {
+				t.Fatalf("%s\n", err.Error())
+			}
+			if tile.Bounds() != r {
+				t.Fatalf("RequestTile: bounds are %v, expected %v\n", tile.Bounds(), r)
+			}
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					if tile.At(x, y) != ref.At(x, y) {
+						t.Fatalf("RequestTile: pixel (%d,%d) differs\n", x, y)
+					}
+				}
+			}
+		}
+	}
+
+	// The region of interest setting should be unchanged.
+	dst, err := fp.ResizeToRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if dst.Bounds() != bounds {
+		t.Logf("RequestTile: region of interest was changed\n")
+		t.Fail()
+	}
+}
+
+func TestResizedView(t *testing.T) {
+	src := readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%crgb8a.png", os.PathSeparator, os.PathSeparator))
+	bounds := image.Rect(10, 20, 10+src.Bounds().Dx()*2, 20+src.Bounds().Dy()*5)
+
+	fp := New(src)
+	fp.SetTargetBounds(bounds)
+	ref, err := fp.ResizeToRGBA64()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	fp = New(src)
+	fp.SetTargetBounds(bounds)
+	rv := NewResizedView(fp)
+	if rv.Bounds() != bounds {
+		t.Fatalf("ResizedView: bounds are %v, expected %v\n", rv.Bounds(), bounds)
+	}
+	// Visit the bands out of order, and more than once.
+	for _, y := range []int{bounds.Max.Y - 1, bounds.Min.Y, bounds.Min.Y + 100, bounds.Max.Y - 1, bounds.Min.Y + 70} {
+		for x := bounds.Min.X; x < bounds.Max.X; x += 7 {
+			if rv.At(x, y) != ref.At(x, y) {
+				t.Fatalf("ResizedView: pixel (%d,%d) is %v, expected %v\n", x, y, rv.At(x, y), ref.At(x, y))
+			}
+		}
+	}
+	if rv.Err() != nil {
+		t.Logf("ResizedView: %s\n", rv.Err().Error())
+		t.Fail()
+	}
+}
+
+func TestAreaAverage(t *testing.T) {
+	// A 6x1 image, with sample values 0 to 5, reduced to 4x1. Each target
+	// pixel covers 1.5 source pixels.
+	src := NewFPImageN(image.Rect(0, 0, 6, 1), 1)
+	for i := range src.Pix {
+		src.Pix[i] = float32(i)
+	}
+	expected := []float32{0.5 / 1.5, 2.5 / 1.5, 5.0 / 1.5, 7.0 / 1.5}
+
+	fp := new(FPObject)
+	fp.SetSourceImageN(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 4, 1))
+	fp.SetAreaAverage(true)
+	dst, err := fp.ResizeN()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	for i := range expected {
+		if math.Abs(float64(dst.Pix[i]-expected[i])) > 0.00001 {
+			t.Logf("AreaAverage: sample %d is %v, expected %v\n", i, dst.Pix[i], expected[i])
+			t.Fail()
+		}
+	}
+
+	fp.SetPixelAlignment(PixelAlignCorners)
+	if _, err = fp.ResizeN(); err == nil {
+		t.Logf("AreaAverage: PixelAlignCorners was accepted\n")
+		t.Fail()
+	}
+}
+
+func TestYCbCr(t *testing.T) {
+	src := image.NewYCbCr(image.Rect(1, 0, 40, 31), image.YCbCrSubsampleRatio420)
+	gray := image.NewGray(src.Rect)
+	for y := src.Rect.Min.Y; y < src.Rect.Max.Y; y++ {
+		for x := src.Rect.Min.X; x < src.Rect.Max.X; x++ {
+			v := uint8((x*x + 7*y) % 256)
+			src.Y[src.YOffset(x, y)] = v
+			gray.Pix[gray.PixOffset(x, y)] = v
+			src.Cb[src.COffset(x, y)] = 100
+			src.Cr[src.COffset(x, y)] = 150
+		}
+	}
+
+	fp := New(src)
+	fp.SetInputColorConverter(nil)
+	fp.SetOutputColorConverter(nil)
+	fp.SetTargetBounds(image.Rect(0, 0, 17, 12))
+	dst, err := fp.ResizeToYCbCr()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if dst.SubsampleRatio != image.YCbCrSubsampleRatio420 || dst.Rect != image.Rect(0, 0, 17, 12) {
+		t.Fatalf("YCbCr: got subsample ratio %v, bounds %v", dst.SubsampleRatio, dst.Rect)
+	}
+
+	// The Y plane should be resized as a grayscale image would be, and the
+	// uniform chroma planes should be unchanged.
+	fp = New(gray)
+	fp.SetInputColorConverter(nil)
+	fp.SetOutputColorConverter(nil)
+	fp.SetTargetBounds(image.Rect(0, 0, 17, 12))
+	expected, err := fp.ResizeToImage(ResizeFlagGrayOK)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	for y := 0; y < 12; y++ {
+		for x := 0; x < 17; x++ {
+			e := expected.(*image.Gray).GrayAt(x, y).Y
+			if absdiff(uint32(dst.Y[dst.YOffset(x, y)]), uint32(e)) > 1 {
+				t.Fatalf("YCbCr: Y at (%d,%d) is %d, expected %d", x, y, dst.Y[dst.YOffset(x, y)], e)
+			}
+			if dst.Cb[dst.COffset(x, y)] != 100 || dst.Cr[dst.COffset(x, y)] != 150 {
+				t.Fatalf("YCbCr: chroma at (%d,%d) is %d,%d", x, y, dst.Cb[dst.COffset(x, y)], dst.Cr[dst.COffset(x, y)])
+			}
+		}
+	}
+
+	// With color correction, the image is converted to RGB and back.
+	fp = New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 17, 12))
+	dst, err = fp.ResizeToYCbCr()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if dst.SubsampleRatio != image.YCbCrSubsampleRatio444 {
+		t.Errorf("YCbCr with color correction: got subsample ratio %v", dst.SubsampleRatio)
+	}
+}
+
+// The settings that change the colors must not be ignored when a YCbCr
+// image's planes are resized directly.
+func TestYCbCrAdjustments(t *testing.T) {
+	src := image.NewYCbCr(image.Rect(0, 0, 16, 16), image.YCbCrSubsampleRatio420)
+	for i := range src.Y {
+		src.Y[i] = 100
+	}
+	for i := range src.Cb {
+		src.Cb[i], src.Cr[i] = 128, 128
+	}
+	zero := func(y int, samples []float32) {
+		for i := range samples {
+			samples[i] = 0.0
+		}
+	}
+
+	tests := []struct {
+		name      string
+		configure func(fp *FPObject)
+		y         uint8
+	}{
+		{"output row hook", func(fp *FPObject) { fp.SetOutputRowHook(zero) }, 0},
+		{"source row hook", func(fp *FPObject) { fp.SetSourceRowHook(zero) }, 0},
+		{"exposure", func(fp *FPObject) { fp.SetExposure(1.0) }, 200},
+	}
+	for _, tc := range tests {
+		fp := New(src)
+		fp.SetInputColorConverter(nil)
+		fp.SetOutputColorConverter(nil)
+		fp.SetTargetBounds(image.Rect(0, 0, 8, 8))
+		tc.configure(fp)
+		dst, err := fp.ResizeToYCbCr()
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		if v := dst.Y[dst.YOffset(3, 3)]; absdiff(uint32(v), uint32(tc.y)) > 1 {
+			t.Errorf("YCbCr with %s: Y is %d, expected %d\n", tc.name, v, tc.y)
+		}
+	}
+}
+
+func TestYCbCrChannelOrder(t *testing.T) {
+	// A reddish image.
+	src := image.NewYCbCr(image.Rect(0, 0, 16, 16), image.YCbCrSubsampleRatio420)
+	for i := range src.Y {
+		src.Y[i] = 100
+	}
+	for i := range src.Cb {
+		src.Cb[i], src.Cr[i] = 100, 200
+	}
+
+	newFP := func() *FPObject {
+		fp := New(src)
+		fp.SetInputColorConverter(nil)
+		fp.SetOutputColorConverter(nil)
+		fp.SetTargetBounds(image.Rect(0, 0, 8, 8))
+		fp.SetChannelOrder(ChannelBlue, ChannelGreen, ChannelRed, ChannelAlpha)
+		return fp
+	}
+
+	dst, err := newFP().ResizeToYCbCr()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	rgba, err := newFP().ResizeToRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	c := rgba.RGBAAt(3, 3)
+	y, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+	yi, ci := dst.YOffset(3, 3), dst.COffset(3, 3)
+	if absdiff(uint32(dst.Y[yi]), uint32(y)) > 2 || absdiff(uint32(dst.Cb[ci]), uint32(cb)) > 2 ||
+		absdiff(uint32(dst.Cr[ci]), uint32(cr)) > 2 {
+		t.Errorf("YCbCr with a channel order: got (%d,%d,%d), expected (%d,%d,%d)\n",
+			dst.Y[yi], dst.Cb[ci], dst.Cr[ci], y, cb, cr)
+	}
+}
+
+func TestPreReduce(t *testing.T) {
+	// A 400x300 image with a smooth gradient and some fine detail, reduced
+	// to 20x15 (a factor of 20).
+	src := NewFPImageN(image.Rect(0, 0, 400, 300), 1)
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 400; x++ {
+			src.Pix[y*src.Stride+x] = float32(x+y)/700.0 + 0.1*float32((x+y)%2)
+		}
+	}
+
+	resize := func(mode int) *FPImageN {
+		fp := new(FPObject)
+		fp.SetSourceImageN(src)
+		fp.SetTargetBounds(image.Rect(0, 0, 20, 15))
+		fp.SetPreReduce(mode)
+		dst, err := fp.ResizeN()
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		return dst
+	}
+
+	fast := resize(PreReduceAuto)
+	slow := resize(PreReduceNever)
+	for i := range slow.Pix {
+		if math.Abs(float64(fast.Pix[i]-slow.Pix[i])) > 0.002 {
+			t.Fatalf("PreReduce: sample %d is %v, expected about %v\n", i, fast.Pix[i], slow.Pix[i])
+		}
+	}
+
+	// Check the averaging itself.
+	fp := new(FPObject)
+	fp.channelInfo = []channelInfoType{{mustProcess: true}}
+	small := NewFPImageN(image.Rect(0, 0, 6, 2), 1)
+	for i := range small.Pix {
+		small.Pix[i] = float32(i)
+	}
+	avg := fp.preReduceImage(small, 3, 1)
+	expected := []float32{3.5, 5.5, 7.5}
+	for i := range expected {
+		if avg.Pix[i] != expected[i] {
+			t.Fatalf("PreReduce: average %d is %v, expected %v\n", i, avg.Pix[i], expected[i])
+		}
+	}
+}
+
+func TestPlanar(t *testing.T) {
+	srcImg := readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%crgb8a.png", os.PathSeparator, os.PathSeparator))
+
+	for _, size := range []image.Rectangle{image.Rect(0, 0, 23, 17), image.Rect(0, 0, 150, 101)} {
+		fp := New(srcImg)
+		fp.SetTargetBounds(size)
+		expected, err := fp.ResizeToNRGBA64()
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+
+		fp = New(srcImg)
+		fp.SetTargetBounds(size)
+		fp.SetPlanar(true)
+		actual, err := fp.ResizeToNRGBA64()
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+
+		for y := size.Min.Y; y < size.Max.Y; y++ {
+			for x := size.Min.X; x < size.Max.X; x++ {
+				e, a := expected.NRGBA64At(x, y), actual.NRGBA64At(x, y)
+				if absdiff(uint32(e.R), uint32(a.R)) > 2 || absdiff(uint32(e.G), uint32(a.G)) > 2 ||
+					absdiff(uint32(e.B), uint32(a.B)) > 2 || absdiff(uint32(e.A), uint32(a.A)) > 2 {
+					t.Fatalf("Planar: pixel (%d,%d) is %v, expected %v\n", x, y, a, e)
+				}
+			}
+		}
+	}
+}
+
+func TestDiskBacked(t *testing.T) {
+	srcImg := readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%crgb8a.png", os.PathSeparator, os.PathSeparator))
+
+	fp := New(srcImg)
+	fp.SetTargetBounds(image.Rect(0, 0, 40, 31))
+	expected, err := fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	// Make even small images disk-backed.
+	savedMin := diskBackedMinBytes
+	diskBackedMinBytes = 0
+	defer func() { diskBackedMinBytes = savedMin }()
+
+	fp = New(srcImg)
+	fp.SetTargetBounds(image.Rect(0, 0, 40, 31))
+	fp.SetDiskBacked(true, "")
+	actual, err := fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if !bytes.Equal(expected.Pix, actual.Pix) {
+		t.Errorf("DiskBacked: images differ\n")
+	}
+	// Only the converted source image should still be mapped.
+	if runtime.GOOS == "linux" && len(fp.mappedFiles) != 1 {
+		t.Errorf("DiskBacked: %d mapped files, expected 1\n", len(fp.mappedFiles))
+	}
+
+	// It can be resized again, until it is closed.
+	fp.SetTargetBounds(image.Rect(0, 0, 20, 15))
+	if _, err = fp.ResizeToNRGBA(); err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	// A disk-backed image returned by Resize can be released before Close.
+	im, err := fp.Resize()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if runtime.GOOS == "linux" && len(fp.mappedFiles) != 2 {
+		t.Errorf("DiskBacked: %d mapped files, expected 2\n", len(fp.mappedFiles))
+	}
+	fp.ReleaseImage(im)
+	if runtime.GOOS == "linux" && len(fp.mappedFiles) != 1 {
+		t.Errorf("DiskBacked: %d mapped files after ReleaseImage, expected 1\n", len(fp.mappedFiles))
+	}
+	if err = fp.Close(); err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if len(fp.mappedFiles) != 0 {
+		t.Errorf("DiskBacked: %d mapped files after Close\n", len(fp.mappedFiles))
+	}
+	if _, err = fp.ResizeToNRGBA(); err == nil {
+		t.Errorf("DiskBacked: resize after Close succeeded\n")
+	}
+}
+
+func TestGrayAndDropAlphaFlags(t *testing.T) {
+	srcImg := readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%crgb8.png", os.PathSeparator, os.PathSeparator))
+
+	// It should be the same as resizing a grayscale version of the image.
+	fp := New(srcImg)
+	fp.SetTargetBounds(image.Rect(0, 0, 30, 20))
+	fp.SetForceGrayscale(true)
+	expected, err := fp.ResizeToImage(ResizeFlagGrayOK)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	for _, pipelined := range []bool{false, true} {
+		fp = New(srcImg)
+		fp.SetTargetBounds(image.Rect(0, 0, 30, 20))
+		fp.SetPipelined(pipelined)
+		img, err := fp.ResizeToImage(ResizeFlagGray)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		gray, ok := img.(*image.Gray)
+		if !ok {
+			t.Fatalf("ResizeFlagGray (pipelined=%v): got %T, expected *image.Gray\n", pipelined, img)
+		}
+		if !fp.HasColor() {
+			t.Errorf("ResizeFlagGray (pipelined=%v): HasColor is false afterward\n", pipelined)
+		}
+		for i := range gray.Pix {
+			if absdiff(uint32(gray.Pix[i]), uint32(expected.(*image.Gray).Pix[i])) > 1 {
+				t.Fatalf("ResizeFlagGray (pipelined=%v): sample %d is %d, expected %d\n", pipelined,
+					i, gray.Pix[i], expected.(*image.Gray).Pix[i])
+			}
+		}
+	}
+
+	srcImg = readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%crgb8a.png", os.PathSeparator, os.PathSeparator))
+	fp = New(srcImg)
+	fp.SetTargetBounds(image.Rect(0, 0, 30, 20))
+	img, err := fp.ResizeToImage(ResizeFlagDropAlpha | ResizeFlagUnassocAlpha)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	nrgba := img.(*image.NRGBA)
+	for i := 3; i < len(nrgba.Pix); i += 4 {
+		if nrgba.Pix[i] != 255 {
+			t.Fatalf("ResizeFlagDropAlpha: alpha is %d\n", nrgba.Pix[i])
+		}
+	}
+	if !fp.HasTransparency() {
+		t.Errorf("ResizeFlagDropAlpha: HasTransparency is false afterward\n")
+	}
+}
+
+func TestFilterFVec(t *testing.T) {
+	srcImg := readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%crgb8.png", os.PathSeparator, os.PathSeparator))
+
+	resize := func(filter *Filter) *image.RGBA {
+		fp := New(srcImg)
+		fp.SetTargetBounds(image.Rect(0, 0, 40, 27))
+		fp.SetFilter(filter)
+		dst, err := fp.ResizeToRGBA()
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		return dst
+	}
+
+	expected := resize(MakeLanczosFilter(3))
+
+	var calls int
+	filter := MakeLanczosFilter(3)
+	filter.FVec = func(xs []float64, scaleFactor float64, out []float64) {
+		calls++
+		for i := range xs {
+			out[i] = filter.F(xs[i], scaleFactor)
+		}
+	}
+	actual := resize(filter)
+	if calls == 0 {
+		t.Errorf("FVec was not called\n")
+	}
+	if !bytes.Equal(expected.Pix, actual.Pix) {
+		t.Errorf("FVec: images differ\n")
+	}
+}
+
+func TestExportWeights(t *testing.T) {
+	srcImg := readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%crgb8.png", os.PathSeparator, os.PathSeparator))
+
+	fp := New(srcImg)
+	fp.SetTargetBounds(image.Rect(0, 0, 41, 30))
+	fp.SetFilter(MakeLanczosFilter(3))
+	var buf bytes.Buffer
+	err := fp.ExportWeights(&buf)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	expected, err := fp.ResizeToRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	// The imported weights should be used instead of the (different)
+	// filter.
+	fp = New(srcImg)
+	fp.SetTargetBounds(image.Rect(0, 0, 41, 30))
+	fp.SetFilter(MakeBoxAvgFilter())
+	err = fp.ImportWeights(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	actual, err := fp.ResizeToRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if !bytes.Equal(expected.Pix, actual.Pix) {
+		t.Errorf("ImportWeights: images differ\n")
+	}
+
+	// They shouldn't be used for a different geometry.
+	fp.SetTargetBounds(image.Rect(0, 0, 40, 30))
+	if wl := fp.importedWeightList(false); wl != nil {
+		t.Errorf("ImportWeights: weights used for the wrong geometry\n")
+	}
+
+	if err = fp.ImportWeights(bytes.NewReader(buf.Bytes()[:buf.Len()-5])); err == nil {
+		t.Errorf("ImportWeights: truncated file was accepted\n")
+	}
+}
+
+func TestExportWeightsPreReduced(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 800, 400))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i * 13)
+	}
+	size := image.Rect(0, 0, 40, 20)
+
+	// A reduction by 20x, which is pre-reduced by default.
+	fp := New(src)
+	fp.SetTargetBounds(size)
+	fp.SetFilter(MakeLanczosFilter(3))
+	var buf bytes.Buffer
+	err := fp.ExportWeights(&buf)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	expected, err := fp.ResizeToRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	fp = New(src)
+	fp.SetTargetBounds(size)
+	fp.SetFilter(MakeBoxAvgFilter())
+	err = fp.ImportWeights(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	p, err := fp.Plan()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if p.Horizontal.PreReducedFrom == 0 || !p.Horizontal.Imported || !p.Vertical.Imported {
+		t.Errorf("ImportWeights: weights not used for a pre-reduced image\n")
+	}
+	actual, err := fp.ResizeToRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if !bytes.Equal(expected.Pix, actual.Pix) {
+		t.Errorf("ImportWeights: images differ, for a pre-reduced image\n")
+	}
+}
+
+func TestEdgeModes(t *testing.T) {
+	// Each mode, for an image of 3 samples, at positions -4 to 6.
+	expected := map[int][]int{
+		VirtualPixelsReplicate: {0, 0, 0, 0, 0, 1, 2, 2, 2, 2, 2},
+		VirtualPixelsMirror:    {2, 2, 1, 0, 0, 1, 2, 2, 1, 0, 0},
+		VirtualPixelsTile:      {2, 0, 1, 2, 0, 1, 2, 0, 1, 2, 0},
+	}
+	for mode, e := range expected {
+		for i := range e {
+			if s := edgeSample(i-4, 3, mode); s != e[i] {
+				t.Errorf("edgeSample(%d, 3, %d) = %d, expected %d\n", i-4, mode, s, e[i])
+			}
+		}
+	}
+
+	// Map a solid image onto the middle of a larger canvas. With
+	// VirtualPixelsReplicate, the whole canvas should be filled.
+	src := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for i := range src.Pix {
+		src.Pix[i] = 200
+	}
+	for _, areaAverage := range []bool{false, true} {
+		fp := New(src)
+		fp.SetTargetBoundsAdvanced(image.Rect(0, 0, 20, 20), 5.5, 5.0, 14.5, 15.0)
+		fp.SetVirtualPixels(VirtualPixelsReplicate)
+		fp.SetAreaAverage(areaAverage)
+		dst, err := fp.ResizeToNRGBA()
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		for i := range dst.Pix {
+			if absdiff(uint32(dst.Pix[i]), 200) > 1 {
+				t.Fatalf("VirtualPixelsReplicate: byte %d is %d (area average %v)\n", i, dst.Pix[i], areaAverage)
+			}
+		}
+	}
+}
+
+func TestStrictTargetBounds(t *testing.T) {
+	src := image.NewGray(image.Rect(0, 0, 10, 10))
+
+	fp := New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 0, 5))
+	if _, err := fp.ResizeToRGBA(); err != nil {
+		t.Errorf("Empty target bounds were not adjusted: %s\n", err.Error())
+	}
+
+	fp.SetStrictTargetBounds(true)
+	if _, err := fp.ResizeToRGBA(); !errors.Is(err, ErrInvalidTargetBounds) {
+		t.Errorf("Strict target bounds: got error %v\n", err)
+	}
+	fp.SetTargetBounds(image.Rect(0, 0, 3, 5))
+	if _, err := fp.ResizeToRGBA(); err != nil {
+		t.Errorf("Strict target bounds: %s\n", err.Error())
+	}
+
+	fp = New(src)
+	fp.SetTargetBoundsAdvanced(image.Rect(0, 0, 5, 5), 0, 0, 1e-6, 5)
+	if _, err := fp.ResizeToRGBA(); !errors.Is(err, ErrInvalidTargetBounds) {
+		t.Errorf("Extreme scale factor: got error %v\n", err)
+	}
+}
+
+func TestDegenerateSource(t *testing.T) {
+	fp := New(image.NewRGBA(image.Rect(5, 5, 5, 9)))
+	fp.SetTargetBounds(image.Rect(0, 0, 4, 4))
+	if _, err := fp.ResizeToRGBA(); err != ErrEmptySource {
+		t.Errorf("Empty source: got error %v\n", err)
+	}
+	if err := fp.Analyze(); err != ErrEmptySource {
+		t.Errorf("Empty source, Analyze: got error %v\n", err)
+	}
+	fp = new(FPObject)
+	fp.SetSourceImageN(NewFPImageN(image.Rect(0, 0, 3, 0), 2))
+	fp.SetTargetBounds(image.Rect(0, 0, 4, 4))
+	if _, err := fp.ResizeN(); err != ErrEmptySource {
+		t.Errorf("Empty FPImageN source: got error %v\n", err)
+	}
+
+	// A 1-pixel image should become a solid image, with every filter and
+	// (opaque) edge mode.
+	src := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	src.Pix[0], src.Pix[1], src.Pix[2], src.Pix[3] = 10, 120, 250, 255
+	modes := []int{VirtualPixelsNone, VirtualPixelsReplicate, VirtualPixelsMirror, VirtualPixelsTile}
+	for _, name := range FilterNames() {
+		for _, mode := range modes {
+			for _, align := range []int{PixelAlignCenters, PixelAlignCorners} {
+				fp = New(src)
+				fp.SetTargetBounds(image.Rect(0, 0, 5, 3))
+				fp.SetFilterByName(name)
+				fp.SetVirtualPixels(mode)
+				fp.SetPixelAlignment(align)
+				dst, err := fp.ResizeToNRGBA()
+				if err != nil {
+					t.Fatalf("1-pixel source, %s: %s\n", name, err.Error())
+				}
+				for i := range dst.Pix {
+					if absdiff(uint32(dst.Pix[i]), uint32(src.Pix[i%4])) > 1 {
+						t.Fatalf("1-pixel source, %s, edge mode %d, alignment %d: byte %d is %d\n",
+							name, mode, align, i, dst.Pix[i])
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	src := image.NewGray(image.Rect(0, 0, 2000, 100))
+	fp := New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 50, 300))
+	fp.SetFilterByName("mitchell")
+	fp.SetStageWorkers(StageResample, 3)
+	p, err := fp.Plan()
+	if err != nil {
+		t.Fatalf("Plan: %s\n", err.Error())
+	}
+	t.Logf("%s", p.String())
+
+	// The width is reduced by a factor of 40, so it is pre-reduced.
+	if p.Horizontal.PreReducedFrom != 2000 || p.Horizontal.SourceSize != 200 || p.Horizontal.Filter != "mitchell" {
+		t.Errorf("Plan: horizontal: got %+v\n", p.Horizontal)
+	}
+	if p.Vertical.PreReducedFrom != 0 || p.Vertical.ScaleFactor != 3.0 || p.Vertical.Radius != 2.0 {
+		t.Errorf("Plan: vertical: got %+v\n", p.Vertical)
+	}
+	if !p.WidthFirst {
+		t.Errorf("Plan: expected width first\n")
+	}
+	// A gray opaque image only needs one channel.
+	if !p.Channels[0] || p.Channels[1] || p.Channels[2] || p.Channels[3] {
+		t.Errorf("Plan: got channels %v\n", p.Channels)
+	}
+	if !p.InputLUT || !p.OutputLUT {
+		t.Errorf("Plan: expected lookup tables\n")
+	}
+	if p.Workers[StageResample] != 3 {
+		t.Errorf("Plan: got workers %v\n", p.Workers)
+	}
+
+	// The weight counts should match the exported weights.
+	var buf bytes.Buffer
+	fp.SetPreReduce(PreReduceNever)
+	if err := fp.ExportWeights(&buf); err != nil {
+		t.Fatalf("ExportWeights: %s\n", err.Error())
+	}
+	p, err = fp.Plan()
+	if err != nil {
+		t.Fatalf("Plan: %s\n", err.Error())
+	}
+	want := len(weightsMagic) + 2*29 + 12*(p.Horizontal.Weights+p.Vertical.Weights)
+	if buf.Len() != want {
+		t.Errorf("Plan: weights don't match ExportWeights (%d bytes, expected %d)\n", buf.Len(), want)
+	}
+
+	// Without pre-reduction, each target sample in the width uses about 160
+	// source samples (the filter's width is 4, times the reduction factor).
+	// Enlarging the height uses at most 4.
+	if p.Horizontal.MaxTaps < 150 || p.Horizontal.MaxTaps > 162 || p.Vertical.MaxTaps != 4 {
+		t.Errorf("Plan: got max taps %d, %d\n", p.Horizontal.MaxTaps, p.Vertical.MaxTaps)
+	}
+	if p.Vertical.AvgTaps*float64(p.Vertical.TargetSize) != float64(p.Vertical.Weights) ||
+		p.Horizontal.AvgTaps > float64(p.Horizontal.MaxTaps) {
+		t.Errorf("Plan: got average taps %g, %g\n", p.Horizontal.AvgTaps, p.Vertical.AvgTaps)
+	}
+
+	// A tiny image is enlarged height first, without an output lookup table.
+	fp = New(image.NewNRGBA(image.Rect(0, 0, 4, 4)))
+	fp.SetTargetBounds(image.Rect(0, 0, 8, 8))
+	p, err = fp.Plan()
+	if err != nil {
+		t.Fatalf("Plan: %s\n", err.Error())
+	}
+	if p.WidthFirst || p.OutputLUT || p.Horizontal.Filter != "lanczos2" || !p.Channels[3] {
+		t.Errorf("Plan: small image: got %+v\n", p)
+	}
+}
+
+func TestWeightImage(t *testing.T) {
+	fp := New(image.NewNRGBA(image.Rect(0, 0, 10, 4)))
+	fp.SetTargetBounds(image.Rect(0, 0, 5, 8))
+	fp.SetFilterByName("triangle")
+
+	// Reducing 10 -> 5 with a triangle filter, target sample 2 is centered
+	// between source samples 4 and 5, and has a radius of 2 source samples.
+	im, err := fp.WeightImage(false)
+	if err != nil {
+		t.Fatalf("WeightImage: %s\n", err.Error())
+	}
+	if im.Rect.Dx() != 10 || im.Rect.Dy() != 5 {
+		t.Fatalf("WeightImage: got size %v\n", im.Rect)
+	}
+	row := im.Pix[2*im.Stride : 2*im.Stride+10]
+	if row[4] != row[5] || row[4] <= row[3] || row[3] <= 128 || row[2] != 128 || row[7] != 128 {
+		t.Errorf("WeightImage: got row %v\n", row)
+	}
+
+	var buf bytes.Buffer
+	if err := fp.WriteWeightCSV(&buf, true); err != nil {
+		t.Fatalf("WriteWeightCSV: %s\n", err.Error())
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 9 || lines[0] != "dst,0,1,2,3" {
+		t.Fatalf("WriteWeightCSV: got %q\n", buf.String())
+	}
+	// Each row of weights should add up to 1.
+	for _, line := range lines[1:] {
+		var sum float64
+		for _, field := range strings.Split(line, ",")[1:] {
+			var v float64
+			fmt.Sscan(field, &v)
+			sum += v
+		}
+		if math.Abs(sum-1.0) > 0.0001 {
+			t.Errorf("WriteWeightCSV: weights in %q add up to %v\n", line, sum)
+		}
+	}
+}
+
+func TestEncodeResized(t *testing.T) {
+	for _, fn := range []string{"rgb8a", "g8", "rgb16a"} {
+		src := readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%c%s.png", os.PathSeparator, os.PathSeparator, fn))
+		// A height that isn't a multiple of the band height
+		r := image.Rect(5, 7, 5+53, 7+77)
+
+		fp := New(src)
+		fp.SetTargetBounds(r)
+		var buf bytes.Buffer
+		if err := fp.EncodeResized(&buf, "png", nil); err != nil {
+			t.Fatalf("EncodeResized(%s): %s\n", fn, err.Error())
+		}
+		got, err := png.Decode(&buf)
+		if err != nil {
+			t.Fatalf("EncodeResized(%s): %s\n", fn, err.Error())
+		}
+
+		// It should match a pipelined resize to an image.
+		fp = New(src)
+		fp.SetTargetBounds(r)
+		fp.SetPipelined(true)
+		expected, err := fp.ResizeToImage(ResizeFlagGrayOK | ResizeFlagUnassocAlpha)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		if fmt.Sprintf("%T", got) != fmt.Sprintf("%T", expected) {
+			t.Errorf("EncodeResized(%s): got %T, expected %T\n", fn, got, expected)
+		}
+		if got.Bounds().Size() != r.Size() {
+			t.Fatalf("EncodeResized(%s): got size %v\n", fn, got.Bounds())
+		}
+		for y := 0; y < r.Dy(); y++ {
+			for x := 0; x < r.Dx(); x++ {
+				c1 := color.NRGBAModel.Convert(got.At(got.Bounds().Min.X+x, got.Bounds().Min.Y+y))
+				c2 := color.NRGBAModel.Convert(expected.At(r.Min.X+x, r.Min.Y+y))
+				if c1 != c2 {
+					t.Fatalf("EncodeResized(%s): pixel (%d,%d) is %v, expected %v\n", fn, x, y, c1, c2)
+				}
+			}
+		}
+	}
+
+	src := readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%crgb8.png", os.PathSeparator, os.PathSeparator))
+	fp := New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 40, 70))
+	var buf bytes.Buffer
+	if err := fp.EncodeResized(&buf, "jpeg", &EncodeOptions{Quality: 95}); err != nil {
+		t.Fatalf("EncodeResized(jpeg): %s\n", err.Error())
+	}
+	got, format, err := image.Decode(&buf)
+	if err != nil || format != "jpeg" || got.Bounds() != image.Rect(0, 0, 40, 70) {
+		t.Errorf("EncodeResized(jpeg): got %v, %q, %v\n", got.Bounds(), format, err)
+	}
+
+	// Nothing should be written if the image can't be resized.
+	fp = New(src)
+	buf.Reset()
+	if err := fp.EncodeResized(&buf, "png", nil); err == nil || buf.Len() != 0 {
+		t.Errorf("EncodeResized: no target bounds: got %v, %d bytes\n", err, buf.Len())
+	}
+	if err := fp.EncodeResized(&buf, "bmp", nil); err == nil {
+		t.Errorf("EncodeResized: no error for unsupported format\n")
+	}
+
+	// If the resize fails after the first band, the error is returned.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fp = New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 40, 5*pipelineBandHeight))
+	fp.SetContext(ctx)
+	fp.SetProgressFunc(func(p Progress) {
+		if p.Stage == StageResample && p.Done > 0 {
+			cancel()
+		}
+	})
+	buf.Reset()
+	if err := fp.EncodeResized(&buf, "png", nil); err != context.Canceled {
+		t.Errorf("EncodeResized, canceled partway through: got %v\n", err)
+	}
+}
+
+func TestTargetPhysicalSize(t *testing.T) {
+	fp := New(image.NewNRGBA(image.Rect(0, 0, 600, 400)))
+
+	// A width of 1 inch at 100 DPI
+	if err := fp.SetTargetPhysicalSize(25.4, 0, 100); err != nil {
+		t.Fatalf("SetTargetPhysicalSize: %s\n", err.Error())
+	}
+	if fp.dstBounds != image.Rect(0, 0, 100, 67) {
+		t.Errorf("SetTargetPhysicalSize(width): got %v\n", fp.dstBounds)
+	}
+	if err := fp.SetTargetPhysicalSize(50, 100, 254); err != nil || fp.dstBounds != image.Rect(0, 0, 500, 1000) {
+		t.Errorf("SetTargetPhysicalSize(width, height): got %v, %v\n", fp.dstBounds, err)
+	}
+
+	// Keeping the physical size requires the source DPI.
+	if err := fp.SetTargetPhysicalSize(0, 0, 150); err == nil {
+		t.Errorf("SetTargetPhysicalSize: no error for unknown source DPI\n")
+	}
+	fp.SetSourceDPI(300)
+	if err := fp.SetTargetPhysicalSize(0, 0, 150); err != nil || fp.dstBounds != image.Rect(0, 0, 300, 200) {
+		t.Errorf("SetTargetPhysicalSize(new DPI): got %v, %v\n", fp.dstBounds, err)
+	}
+	if err := fp.SetTargetPhysicalSize(10, 10, 0); err == nil {
+		t.Errorf("SetTargetPhysicalSize: no error for DPI 0\n")
+	}
+}
+
+func TestPaletteDither(t *testing.T) {
+	// A black and white palette, and a solid sRGB gray that is 21.6% as
+	// bright as white.
+	pal := color.Palette{color.NRGBA{0, 0, 0, 255}, color.NRGBA{255, 255, 255, 255}}
+	src := image.NewGray(image.Rect(0, 0, 32, 32))
+	for i := range src.Pix {
+		src.Pix[i] = 128
+	}
+
+	for _, dither := range []bool{false, true} {
+		fp := New(src)
+		fp.SetTargetBounds(image.Rect(0, 0, 16, 16))
+		fp.SetTargetPalette(pal)
+		fp.SetPaletteDither(dither)
+		dst, err := fp.ResizeToImage(ResizeFlagPalettedOK)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		var white int
+		for _, v := range dst.(*image.Paletted).Pix {
+			white += int(v)
+		}
+
+		if !dither {
+			// In linear light, the gray is nearer to black.
+			if white != 0 {
+				t.Errorf("PaletteDither: without dithering, %d pixels are white\n", white)
+			}
+			continue
+		}
+		// With dithering, the average brightness should be about right:
+		// 3 or 4 pixels of each 16.
+		if white < 3*16 || white > 4*16 {
+			t.Errorf("PaletteDither: %d of 256 pixels are white\n", white)
+		}
+	}
+
+	// The pattern depends only on the offset.
+	resize := func(dx, dy int) []uint8 {
+		fp := New(src)
+		fp.SetTargetBounds(image.Rect(0, 0, 16, 16))
+		fp.SetTargetPalette(pal)
+		fp.SetPaletteDither(true)
+		fp.SetPaletteDitherOffset(dx, dy)
+		dst, err := fp.ResizeToImage(ResizeFlagPalettedOK)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		return dst.(*image.Paletted).Pix
+	}
+	if !bytes.Equal(resize(1, 2), resize(1, 2)) {
+		t.Errorf("PaletteDither: the same offset gave different images\n")
+	}
+	if bytes.Equal(resize(0, 0), resize(1, 2)) {
+		t.Errorf("PaletteDither: different offsets gave the same image\n")
+	}
+	if !bytes.Equal(resize(0, 0), resize(4, -4)) {
+		t.Errorf("PaletteDither: offsets that differ by 4 gave different images\n")
+	}
+}
+
+func TestPaletteSize(t *testing.T) {
+	// Three colors, with sharp edges that become gradients when resized.
+	src := image.NewNRGBA(image.Rect(0, 0, 60, 60))
+	clrs := []color.NRGBA{{200, 30, 30, 255}, {20, 180, 60, 255}, {40, 40, 220, 255}}
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 60; x++ {
+			src.SetNRGBA(x, y, clrs[x/20])
+		}
+	}
+
+	for _, n := range []int{3, 16} {
+		fp := New(src)
+		fp.SetTargetBounds(image.Rect(0, 0, 45, 45))
+		fp.SetPaletteSize(n)
+		dst, err := fp.ResizeToImage(ResizeFlagPalettedOK)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		dstPal, ok := dst.(*image.Paletted)
+		if !ok {
+			t.Fatalf("PaletteSize: got %T, expected *image.Paletted\n", dst)
+		}
+		if len(dstPal.Palette) > n {
+			t.Errorf("PaletteSize: got %d colors, expected at most %d\n", len(dstPal.Palette), n)
+		}
+		if n < 16 {
+			continue
+		}
+		// With enough colors, the middle of each stripe should be close to
+		// the original color.
+		for i, c := range clrs {
+			got := color.NRGBAModel.Convert(dstPal.At(i*15+7, 20)).(color.NRGBA)
+			if absdiff(uint32(got.R), uint32(c.R)) > 2 || absdiff(uint32(got.G), uint32(c.G)) > 2 ||
+				absdiff(uint32(got.B), uint32(c.B)) > 2 {
+				t.Errorf("PaletteSize(%d): stripe %d is %v, expected %v\n", n, i, got, c)
+			}
+		}
+	}
+}
+
+func TestTargetCover(t *testing.T) {
+	fp := New(image.NewNRGBA(image.Rect(10, 0, 110, 50)))
+
+	// With no regions, the crop is centered.
+	if err := fp.SetTargetCover(25, 25); err != nil {
+		t.Fatalf("SetTargetCover: %s\n", err.Error())
+	}
+	if fp.dstBounds != image.Rect(0, 0, 25, 25) || fp.dstOffsetX != -12.5 || fp.dstOffsetY != 0.0 ||
+		fp.dstTrueW != 50.0 || fp.dstTrueH != 25.0 {
+		t.Errorf("SetTargetCover(centered): got %v %g,%g %g×%g\n", fp.dstBounds,
+			fp.dstOffsetX, fp.dstOffsetY, fp.dstTrueW, fp.dstTrueH)
+	}
+
+	// A region near the right edge, and a less important one at the left
+	regions := []Region{
+		{image.Rect(90, 10, 105, 20), 2.0},
+		{image.Rect(10, 0, 20, 50), 1.0},
+	}
+	fp.SetRegionProvider(RegionProviderFunc(func(src image.Image) ([]Region, error) {
+		return regions, nil
+	}))
+	if err := fp.SetTargetCover(50, 50); err != nil {
+		t.Fatalf("SetTargetCover: %s\n", err.Error())
+	}
+	// The window is moved just far enough to contain the first region:
+	// source columns 45 to 95 (x=55 to 105).
+	if fp.dstOffsetX != -45.0 || fp.dstTrueW != 100.0 {
+		t.Errorf("SetTargetCover(regions): got offset %g, width %g\n", fp.dstOffsetX, fp.dstTrueW)
+	}
+
+	// A region that fits with the image centered doesn't move it.
+	regions = []Region{{image.Rect(50, 0, 70, 10), 1.0}}
+	if err := fp.SetTargetCover(50, 50); err != nil || fp.dstOffsetX != -25.0 {
+		t.Errorf("SetTargetCover(central region): got offset %g, %v\n", fp.dstOffsetX, err)
+	}
+
+	providerErr := errors.New("provider error")
+	fp.SetRegionProvider(RegionProviderFunc(func(src image.Image) ([]Region, error) {
+		return nil, providerErr
+	}))
+	if err := fp.SetTargetCover(50, 50); err != providerErr {
+		t.Errorf("SetTargetCover: got error %v, expected the provider's error\n", err)
+	}
+}
+
+func TestFocalPoint(t *testing.T) {
+	fp := New(image.NewNRGBA(image.Rect(0, 0, 100, 50)))
+	// The focal point takes precedence over the provider, which isn't called.
+	fp.SetRegionProvider(RegionProviderFunc(func(src image.Image) ([]Region, error) {
+		return nil, errors.New("provider called")
+	}))
+
+	// A point 3/4 of the way across stays 3/4 of the way across.
+	fp.SetFocalPoint(0.75, 0.2)
+	if err := fp.SetTargetCover(40, 40); err != nil {
+		t.Fatalf("SetTargetCover: %s\n", err.Error())
+	}
+	// The point is at source x=75, which is mapped to 75*0.8 + offset.
+	if got := 75.0*fp.dstTrueW/100.0 + fp.dstOffsetX; math.Abs(got-30.0) > 1.0e-9 || fp.dstOffsetY != 0.0 {
+		t.Errorf("SetFocalPoint: point mapped to x=%g (offset %g,%g)\n", got, fp.dstOffsetX, fp.dstOffsetY)
+	}
+
+	// A vertical crop; out of range values are clamped.
+	fp.SetFocalPoint(0.5, 2.0)
+	if err := fp.SetTargetCover(50, 10); err != nil || fp.dstOffsetY != -15.0 || fp.dstOffsetX != 0.0 {
+		t.Errorf("SetFocalPoint(bottom): got offset %g,%g, %v\n", fp.dstOffsetX, fp.dstOffsetY, err)
+	}
+}
+
+func TestGravity(t *testing.T) {
+	fp := New(image.NewNRGBA(image.Rect(0, 0, 100, 50)))
+	for _, tc := range []struct {
+		name    string
+		offsetX float64
+	}{{"ne", -50.0}, {"W", 0.0}, {"south", -25.0}} {
+		g, err := GravityByName(tc.name)
+		if err != nil {
+			t.Fatalf("GravityByName: %s\n", err.Error())
+		}
+		fp.SetGravity(g)
+		if err := fp.SetTargetCover(50, 50); err != nil || fp.dstOffsetX != tc.offsetX {
+			t.Errorf("SetGravity(%s): got offset %g, expected %g (%v)\n", tc.name, fp.dstOffsetX, tc.offsetX, err)
+		}
+	}
+	if _, err := GravityByName("up"); err == nil {
+		t.Errorf("GravityByName: no error for an invalid name\n")
+	}
+
+	// A flat image with a detailed, colorful area near its right edge
+	src := image.NewNRGBA(image.Rect(0, 0, 400, 100))
+	draw.Draw(src, src.Bounds(), image.NewUniform(color.NRGBA{128, 128, 128, 255}), image.ZP, draw.Src)
+	for y := 20; y < 80; y++ {
+		for x := 320; x < 380; x++ {
+			if (x/4+y/4)%2 == 0 {
+				src.SetNRGBA(x, y, color.NRGBA{255, 0, 0, 255})
+			}
+		}
+	}
+	fp = New(src)
+	fp.SetGravity(GravityAuto)
+	if err := fp.SetTargetCover(50, 50); err != nil {
+		t.Fatalf("SetTargetCover: %s\n", err.Error())
+	}
+	// The crop window (in source pixels) should contain x=320 to 380.
+	winX1 := -fp.dstOffsetX * 400.0 / fp.dstTrueW
+	winX2 := winX1 + 100.0
+	if winX1 > 320.0 || winX2 < 380.0 {
+		t.Errorf("GravityAuto: got crop window x=%g to %g\n", winX1, winX2)
+	}
+}
+
+func TestComputeFitSize(t *testing.T) {
+	for _, tc := range []struct {
+		srcW, srcH, maxW, maxH int
+		allowEnlarge           bool
+		w, h                   int
+	}{
+		{400, 300, 200, 200, false, 200, 150},
+		{300, 400, 200, 200, false, 150, 200},
+		{400, 300, 200, 0, false, 200, 150},
+		{400, 300, 0, 30, false, 40, 30},
+		{4000, 10, 100, 100, false, 100, 1},     // At least 1 pixel
+		{1001, 1000, 100, 100, false, 100, 100}, // Rounded up, not past the box
+		{333, 1000, 0, 100, false, 33, 100},
+		{200, 100, 400, 400, false, 200, 100}, // Already fits
+		{200, 100, 400, 400, true, 400, 200},
+		{200, 100, 0, 0, true, 200, 100},
+		{0, 100, 50, 50, true, 0, 0},
+	} {
+		r := ComputeFitSize(tc.srcW, tc.srcH, tc.maxW, tc.maxH, tc.allowEnlarge)
+		if r != image.Rect(0, 0, tc.w, tc.h) {
+			t.Errorf("ComputeFitSize(%d, %d, %d, %d, %v): got %v, expected %d×%d\n",
+				tc.srcW, tc.srcH, tc.maxW, tc.maxH, tc.allowEnlarge, r, tc.w, tc.h)
+		}
+	}
+}
+
+func TestOutputRowHook(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 40))
+	draw.Draw(src, src.Bounds(), image.NewUniform(color.NRGBA{200, 100, 50, 255}), image.ZP, draw.Src)
+
+	for _, pipelined := range []bool{false, true} {
+		fp := New(src)
+		fp.SetTargetBounds(image.Rect(0, 10, 40, 50))
+		fp.SetPipelined(pipelined)
+		// Remove the red from the bottom half, and make the top half too
+		// bright (which should be clamped).
+		fp.SetOutputRowHook(func(y int, samples []float32) {
+			for i := 0; i < len(samples); i += 4 {
+				if y >= 30 {
+					samples[i] = 0.0
+				} else {
+					samples[i] = 2.0
+				}
+			}
+		})
+		dst, err := fp.ResizeToNRGBA()
+		if err != nil {
+			t.Fatalf("ResizeToNRGBA: %s\n", err.Error())
+		}
+		for _, y := range []int{10, 29, 30, 49} {
+			c := dst.NRGBAAt(20, y)
+			expectR := uint8(255)
+			if y >= 30 {
+				expectR = 0
+			}
+			if c.R != expectR || c.G != 100 || c.B != 50 || c.A != 255 {
+				t.Errorf("OutputRowHook(pipelined=%v): row %d: got %v\n", pipelined, y, c)
+			}
+		}
+	}
+}
+
+func TestSourceRowHook(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 5, 32, 37))
+	draw.Draw(src, src.Bounds(), image.NewUniform(color.RGBA{255, 255, 255, 255}), image.ZP, draw.Src)
+
+	for _, pipelined := range []bool{false, true} {
+		fp := New(src)
+		fp.SetTargetBounds(image.Rect(0, 0, 32, 32))
+		fp.SetPipelined(pipelined)
+		// Make the image 1/4 as bright, in linear light, and make the
+		// bottom half transparent.
+		fp.SetSourceRowHook(func(y int, samples []float32) {
+			for i := range samples {
+				if i%4 != 3 {
+					samples[i] *= 0.25
+				}
+				if y >= 21 {
+					samples[i] = 0.0
+				}
+			}
+		})
+		dst, err := fp.ResizeToNRGBA()
+		if err != nil {
+			t.Fatalf("ResizeToNRGBA: %s\n", err.Error())
+		}
+		// 0.25 in linear light is 137 in sRGB.
+		if c := dst.NRGBAAt(16, 4); c != (color.NRGBA{137, 137, 137, 255}) {
+			t.Errorf("SourceRowHook(pipelined=%v): top half: got %v\n", pipelined, c)
+		}
+		if c := dst.NRGBAAt(16, 28); c.A != 0 {
+			t.Errorf("SourceRowHook(pipelined=%v): bottom half: got %v\n", pipelined, c)
+		}
+	}
+
+	// The hook can't be changed after the source image is converted.
+	fp := New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 16, 16))
+	if _, err := fp.ResizeToNRGBA(); err != nil {
+		t.Fatalf("ResizeToNRGBA: %s\n", err.Error())
+	}
+	fp.SetSourceRowHook(func(y int, samples []float32) {})
+	if _, err := fp.ResizeToNRGBA(); err == nil {
+		t.Errorf("SetSourceRowHook: no error for a late setting\n")
+	}
+}
+
+func TestExposureLevels(t *testing.T) {
+	// Sample 137 is about 0.25 in linear light.
+	src := image.NewGray(image.Rect(0, 0, 16, 16))
+	for i := range src.Pix {
+		src.Pix[i] = 137
+	}
+
+	for _, tc := range []struct {
+		ev           float64
+		black, white float64
+		expect       uint8
+	}{
+		{0.0, 0.0, 1.0, 137},
+		{1.0, 0.0, 1.0, 188},     // 0.5
+		{-1.0, 0.0, 1.0, 99},     // 0.125
+		{0.0, 0.125, 0.625, 137}, // (0.25-0.125)/0.5 = 0.25
+		{1.0, 0.0, 0.25, 255},
+		{0.0, 0.5, 1.0, 0},
+	} {
+		fp := New(src)
+		fp.SetTargetBounds(image.Rect(0, 0, 8, 8))
+		fp.SetExposure(tc.ev)
+		fp.SetLevels(tc.black, tc.white)
+		dst, err := fp.ResizeToImage(ResizeFlagGrayOK)
+		if err != nil {
+			t.Fatalf("ResizeToImage: %s\n", err.Error())
+		}
+		g := dst.(*image.Gray)
+		if absdiff(uint32(g.Pix[0]), uint32(tc.expect)) > 1 {
+			t.Errorf("SetExposure(%g), SetLevels(%g, %g): got %d, expected %d\n",
+				tc.ev, tc.black, tc.white, g.Pix[0], tc.expect)
+		}
+	}
+
+	fp := New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 8, 8))
+	fp.SetLevels(0.5, 0.5)
+	if _, err := fp.ResizeToRGBA(); err == nil {
+		t.Errorf("SetLevels: no error for invalid levels\n")
+	}
+}
+
+func TestChannelOrder(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	draw.Draw(src, src.Bounds(), image.NewUniform(color.NRGBA{200, 100, 50, 128}), image.ZP, draw.Src)
+
+	for _, tc := range []struct {
+		order  [4]int
+		flags  uint32
+		expect color.Color
+	}{
+		{[4]int{ChannelBlue, ChannelGreen, ChannelRed, ChannelAlpha}, ResizeFlagUnassocAlpha, color.NRGBA{50, 100, 200, 128}},
+		{[4]int{ChannelGreen, ChannelGreen, ChannelGreen, ChannelOne}, ResizeFlagGrayOK, color.Gray{100}},
+		{[4]int{ChannelAlpha, ChannelAlpha, ChannelAlpha, ChannelOne}, ResizeFlagGray, color.Gray{128}},
+		{[4]int{ChannelRed, ChannelGreen, ChannelBlue, ChannelRed}, ResizeFlagUnassocAlpha, color.NRGBA{200, 100, 50, 200}},
+	} {
+		for _, pipelined := range []bool{false, true} {
+			fp := New(src)
+			fp.SetTargetBounds(image.Rect(0, 0, 8, 8))
+			fp.SetChannelOrder(tc.order[0], tc.order[1], tc.order[2], tc.order[3])
+			fp.SetPipelined(pipelined)
+			dst, err := fp.ResizeToImage(tc.flags)
+			if err != nil {
+				t.Fatalf("ResizeToImage: %s\n", err.Error())
+			}
+			got := dst.At(4, 4)
+			if fmt.Sprintf("%T", got) != fmt.Sprintf("%T", tc.expect) {
+				t.Errorf("SetChannelOrder(%v, pipelined=%v): got a %T image\n", tc.order, pipelined, dst)
+				continue
+			}
+			r1, g1, b1, a1 := got.RGBA()
+			r2, g2, b2, a2 := tc.expect.RGBA()
+			if absdiff(r1, r2) > 257 || absdiff(g1, g2) > 257 || absdiff(b1, b2) > 257 || absdiff(a1, a2) > 257 {
+				t.Errorf("SetChannelOrder(%v, pipelined=%v): got %v, expected %v\n", tc.order, pipelined, got, tc.expect)
+			}
+		}
+	}
+
+	fp := New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 8, 8))
+	fp.SetChannelOrder(ChannelRed, ChannelGreen, ChannelBlue, 7)
+	if _, err := fp.ResizeToRGBA(); err == nil {
+		t.Errorf("SetChannelOrder: no error for an invalid channel\n")
+	}
+}
+
+func TestOutputLUT16(t *testing.T) {
+	// A gradient of all 65536 gray values
+	src := image.NewGray16(image.Rect(0, 0, 256, 256))
+	for i := 0; i < 65536; i++ {
+		src.Pix[i*2] = uint8(i >> 8)
+		src.Pix[i*2+1] = uint8(i)
+	}
+
+	resize := func(noCache bool, ccf ColorConverter) *image.Gray16 {
+		fp := New(src)
+		fp.SetTargetBounds(src.Bounds())
+		fp.SetOutputColorConverter(ccf)
+		if noCache {
+			fp.SetOutputColorConverterFlags(CCFFlagNoCache)
+		}
+		dst, err := fp.ResizeToImage(ResizeFlagGrayOK | ResizeFlag16Bit)
+		if err != nil {
+			t.Fatalf("ResizeToImage: %s\n", err.Error())
+		}
+		return dst.(*image.Gray16)
+	}
+
+	gamma := func(s []float32) {
+		for i := range s {
+			s[i] = float32(math.Pow(float64(s[i]), 1.0/2.2))
+		}
+	}
+	for _, ccf := range []ColorConverter{LinearTosRGB, gamma} {
+		exact := resize(true, ccf)
+		fast := resize(false, ccf)
+		maxDiff := uint32(0)
+		for i := 0; i < len(exact.Pix); i += 2 {
+			d := absdiff(uint32(exact.Pix[i])<<8|uint32(exact.Pix[i+1]), uint32(fast.Pix[i])<<8|uint32(fast.Pix[i+1]))
+			if d > maxDiff {
+				maxDiff = d
+			}
+		}
+		if maxDiff > 1 {
+			t.Errorf("16-bit output lookup table: max difference %d\n", maxDiff)
+		}
+	}
+}
+
+func TestSparseAlpha(t *testing.T) {
+	// A mostly transparent image, with an opaque sprite and a faint
+	// translucent dot.
+	srcImg := image.NewNRGBA(image.Rect(0, 0, 60, 40))
+	for y := 12; y < 22; y++ {
+		for x := 20; x < 35; x++ {
+			srcImg.SetNRGBA(x, y, color.NRGBA{uint8(x * 7), uint8(y * 11), 200, 255})
+		}
+	}
+	srcImg.SetNRGBA(50, 33, color.NRGBA{255, 0, 0, 3})
+
+	fp := New(srcImg)
+	fp.setNumWorkers()
+	fp.convertSrcOnce()
+	fp.setChannelInfo()
+	sp := fp.findSparseLines(fp.srcFPImage.asFPImageN())
+	if sp == nil {
+		t.Fatalf("No empty lines found\n")
+	}
+	if !sp.rowEmpty[0] || sp.rowEmpty[12] || sp.rowEmpty[33] || !sp.colEmpty[0] || sp.colEmpty[50] {
+		t.Errorf("Wrong empty lines\n")
+	}
+
+	for _, size := range []image.Rectangle{image.Rect(0, 0, 23, 17), image.Rect(0, 0, 150, 90)} {
+		for _, premult := range []bool{false, true} {
+			resize := func(planar bool) image.Image {
+				fp := New(srcImg)
+				fp.SetTargetBounds(size)
+				// Planar mode doesn't skip anything.
+				fp.SetPlanar(planar)
+				var im image.Image
+				var err error
+				if premult {
+					im, err = fp.ResizeToRGBA()
+				} else {
+					im, err = fp.ResizeToNRGBA()
+				}
+				if err != nil {
+					t.Fatalf("%s\n", err.Error())
+				}
+				return im
+			}
+			expected, actual := resize(true), resize(false)
+
+			for y := size.Min.Y; y < size.Max.Y; y++ {
+				for x := size.Min.X; x < size.Max.X; x++ {
+					er, eg, eb, ea := expected.At(x, y).RGBA()
+					ar, ag, ab, aa := actual.At(x, y).RGBA()
+					if absdiff(er, ar) > 257 || absdiff(eg, ag) > 257 ||
+						absdiff(eb, ab) > 257 || absdiff(ea, aa) > 257 {
+						t.Fatalf("%v: pixel (%d,%d) is %v, expected %v\n", size, x, y,
+							actual.At(x, y), expected.At(x, y))
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestTrimTransparent(t *testing.T) {
+	srcImg := image.NewNRGBA(image.Rect(10, 20, 60, 60))
+	for y := 30; y < 35; y++ {
+		for x := 15; x < 40; x++ {
+			srcImg.SetNRGBA(x, y, color.NRGBA{255, 128, 0, 255})
+		}
+	}
+	srcImg.SetNRGBA(45, 50, color.NRGBA{0, 0, 255, 1})
+
+	if r := OpaqueBounds(srcImg); r != image.Rect(15, 30, 46, 51) {
+		t.Errorf("OpaqueBounds: got %v\n", r)
+	}
+	if r := TrimTransparentBorders(srcImg, 2).Bounds(); r != image.Rect(13, 28, 48, 53) {
+		t.Errorf("TrimTransparentBorders: got %v\n", r)
+	}
+	// The padding doesn't extend beyond the image.
+	if r := TrimTransparentBorders(srcImg, 100).Bounds(); r != srcImg.Bounds() {
+		t.Errorf("TrimTransparentBorders, large padding: got %v\n", r)
+	}
+	if r := OpaqueBounds(image.NewNRGBA(image.Rect(0, 0, 8, 8))); !r.Empty() {
+		t.Errorf("OpaqueBounds, transparent image: got %v\n", r)
+	}
+
+	pal := image.NewPaletted(image.Rect(0, 0, 20, 20), color.Palette{color.Transparent, color.Black})
+	pal.SetColorIndex(3, 7, 1)
+	pal.SetColorIndex(12, 9, 1)
+	if r := OpaqueBounds(pal); r != image.Rect(3, 7, 13, 10) {
+		t.Errorf("OpaqueBounds, paletted image: got %v\n", r)
+	}
+
+	fp := New(srcImg)
+	r, err := fp.TrimSource(0)
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if r != image.Rect(15, 30, 46, 51) {
+		t.Errorf("TrimSource: got %v\n", r)
+	}
+	fp.SetTargetBounds(image.Rect(0, 0, r.Dx(), r.Dy()))
+	dst, err := fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if c := dst.NRGBAAt(0, 0); c != (color.NRGBA{255, 128, 0, 255}) {
+		t.Errorf("TrimSource: corner pixel is %v\n", c)
+	}
+	if _, err = fp.TrimSource(0); err == nil {
+		t.Errorf("TrimSource after resizing: expected an error\n")
+	}
+}
+
+func TestWindowFunctions(t *testing.T) {
+	near := func(a, b float64) bool {
+		return math.Abs(a-b) < 1.0e-9
+	}
+
+	if !near(Jinc(0.0), 1.0) || !near(Jinc(1.2196698912665045), 0.0) || !near(Jinc(-0.5), Jinc(0.5)) {
+		t.Errorf("Jinc: wrong value\n")
+	}
+	// Values from Abramowitz and Stegun, table 9.8
+	if !near(BesselI0(0.0), 1.0) || !near(BesselI0(1.0), 1.266065877752) ||
+		!near(BesselI0(5.0)/27.239871823604, 1.0) {
+		t.Errorf("BesselI0: wrong value\n")
+	}
+
+	windows := map[string]func(x float64) float64{
+		"lanczos":  LanczosWindow,
+		"hann":     HannWindow,
+		"hamming":  HammingWindow,
+		"blackman": BlackmanWindow,
+		"kaiser":   func(x float64) float64 { return KaiserWindow(x, 6.0) },
+	}
+	for name, w := range windows {
+		if !near(w(0.0), 1.0) {
+			t.Errorf("%s window: w(0) is %v\n", name, w(0.0))
+		}
+		if w(1.5) != 0.0 || w(-1.5) != 0.0 {
+			t.Errorf("%s window: nonzero outside of the window\n", name)
+		}
+		for x := 0.1; x < 1.0; x += 0.1 {
+			if !near(w(x), w(-x)) || w(x) > w(x-0.1) {
+				t.Errorf("%s window: wrong shape at %v\n", name, x)
+			}
+		}
+	}
+	if !near(HammingWindow(1.0), 0.08) || !near(BlackmanWindow(0.5), 0.34) {
+		t.Errorf("Window functions: wrong value\n")
+	}
+
+	f1 := MakeLanczosFilter(3)
+	f2 := MakeWindowedSincFilter(3.0, LanczosWindow)
+	for x := 0.0; x < 3.5; x += 0.05 {
+		if !near(f1.F(x, 1.0), f2.F(x, 1.0)) {
+			t.Fatalf("Windowed sinc filter: wrong value at %v\n", x)
+		}
+	}
+	if f2.Radius(1.0) != 3.0 {
+		t.Errorf("Windowed sinc filter: wrong radius\n")
+	}
+}
+
+func TestOutputColorspace(t *testing.T) {
+	srcImg := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+
+	fp := New(srcImg)
+	if fp.OutputColorspace() != ColorspaceSRGB {
+		t.Errorf("Default output colorspace is not sRGB\n")
+	}
+	lin := fp.OutputColorspace().Linear()
+	if lin.Gamma != 1.0 || lin.CICPTransfer != 8 || lin.CICPPrimaries != 1 || ColorspaceSRGB.Gamma != 2.2 {
+		t.Errorf("Linear: got %+v\n", lin)
+	}
+
+	fp.SetOutputColorConverter(LinearTosRGB)
+	if fp.OutputColorspace() != ColorspaceSRGB {
+		t.Errorf("Output colorspace with LinearTosRGB is not sRGB\n")
+	}
+	fp.SetInputColorConverter(nil)
+	fp.SetOutputColorConverter(nil)
+	if fp.OutputColorspace() != nil {
+		t.Errorf("Output colorspace without color converters is not unknown\n")
+	}
+
+	// A description set by SetOutputColorspace survives the default output
+	// color converter being set, when the image is resized.
+	tagged := &ColorspaceInfo{Name: "sRGB", ICCProfile: []byte{1, 2, 3}}
+	fp = New(srcImg)
+	fp.SetOutputColorspace(tagged)
+	fp.SetTargetBounds(image.Rect(0, 0, 4, 4))
+	_, err := fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if fp.OutputColorspace() != tagged {
+		t.Errorf("Output colorspace was not kept\n")
+	}
+
+	// It may be set before or after the converter that it describes.
+	fp.SetOutputColorConverter(func(s []float32) {})
+	if fp.OutputColorspace() != tagged {
+		t.Errorf("Output colorspace was not kept when the converter was changed\n")
+	}
+	fp.SetOutputColorspace(nil)
+	if fp.OutputColorspace() != nil {
+		t.Errorf("Output colorspace was not forgotten\n")
+	}
+}
+
+func TestReset(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 40, 30))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 7)
+	}
+	srcImg := readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%crgb8a.png", os.PathSeparator, os.PathSeparator))
+	size := image.Rect(0, 0, 19, 13)
+
+	fp := New(gray)
+	fp.SetFilter(MakeCubicFilter(1.0/3.0, 1.0/3.0))
+	fp.SetSourceDPI(300.0)
+	fp.SetTargetBounds(size)
+	_, err := fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	fp.Reset(srcImg, false)
+	if fp.srcDPI != 0.0 || fp.srcFPImage != nil || fp.srcW != srcImg.Bounds().Dx() {
+		t.Errorf("Reset did not forget the old source image\n")
+	}
+	fp.SetTargetBounds(size)
+	actual, err := fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	fp2 := New(srcImg)
+	fp2.SetFilter(MakeCubicFilter(1.0/3.0, 1.0/3.0))
+	fp2.SetTargetBounds(size)
+	expected, err := fp2.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if !bytes.Equal(actual.Pix, expected.Pix) {
+		t.Errorf("Reset: the image is not the same as with a new FPObject\n")
+	}
+
+	// Keep the weight lists, for another image of the same size.
+	if fp.importedWeightList(false) != nil {
+		t.Errorf("Reset(false) kept a weight list\n")
+	}
+	fp.Reset(srcImg, true)
+	if fp.importedWeightList(false) == nil || fp.importedWeightList(true) == nil {
+		t.Fatalf("Reset(true) did not keep the weight lists\n")
+	}
+	actual, err = fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if !bytes.Equal(actual.Pix, expected.Pix) {
+		t.Errorf("Reset with kept weights: the image is not the same as with a new FPObject\n")
+	}
+	// They are kept again by the next Reset, although they were not remade.
+	fp.Reset(gray, true)
+	fp.SetTargetBounds(image.Rect(0, 0, srcImg.Bounds().Dx(), 13))
+	if fp.importedWeightList(true) != nil {
+		t.Errorf("Kept weight list was used for a different geometry\n")
+	}
+	fp.Reset(srcImg, true)
+	fp.SetTargetBounds(size)
+	if fp.importedWeightList(false) == nil {
+		t.Errorf("Weight lists were not kept by the second Reset\n")
+	}
+}
+
+func TestAssocAlphaOutput(t *testing.T) {
+	// With no color correction, RGBA and RGBA64 images are made without
+	// converting to unassociated alpha. The result should match NRGBA and
+	// NRGBA64 images, premultiplied.
+	srcImg := image.NewNRGBA(image.Rect(0, 0, 40, 30))
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			srcImg.SetNRGBA(x, y, color.NRGBA{uint8(x * 6), uint8(y * 8), uint8((x + y) * 3), uint8(x * y % 256)})
+		}
+	}
+	graySrc := image.NewNRGBA(srcImg.Rect)
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			c := srcImg.NRGBAAt(x, y)
+			graySrc.SetNRGBA(x, y, color.NRGBA{c.R, c.R, c.R, c.A})
+		}
+	}
+
+	for n, src := range []image.Image{srcImg, graySrc} {
+		for _, adjust := range []bool{false, true} {
+			resize := func(deep, assoc bool) image.Image {
+				fp := New(src)
+				fp.SetTargetBounds(image.Rect(0, 0, 17, 45))
+				fp.SetInputColorConverter(nil)
+				fp.SetOutputColorConverter(nil)
+				if adjust {
+					fp.SetExposure(0.5)
+					fp.SetLevels(0.1, 0.8)
+				}
+				var im image.Image
+				var err error
+				switch {
+				case deep && assoc:
+					im, err = fp.ResizeToRGBA64()
+				case deep:
+					im, err = fp.ResizeToNRGBA64()
+				case assoc:
+					im, err = fp.ResizeToRGBA()
+				default:
+					im, err = fp.ResizeToNRGBA()
+				}
+				if err != nil {
+					t.Fatalf("%s\n", err.Error())
+				}
+				return im
+			}
+
+			for _, deep := range []bool{false, true} {
+				// Allow for the rounding of the unassociated samples.
+				tolerance := uint32(2 * 257)
+				if deep {
+					tolerance = 2
+				}
+				expected, actual := resize(deep, false), resize(deep, true)
+				b := expected.Bounds()
+				for y := b.Min.Y; y < b.Max.Y; y++ {
+					for x := b.Min.X; x < b.Max.X; x++ {
+						er, eg, eb, ea := expected.At(x, y).RGBA()
+						ar, ag, ab, aa := actual.At(x, y).RGBA()
+						if absdiff(er, ar) > tolerance || absdiff(eg, ag) > tolerance ||
+							absdiff(eb, ab) > tolerance || absdiff(ea, aa) > tolerance {
+							t.Fatalf("Image %d, adjust=%v, deep=%v: pixel (%d,%d) is %v, expected %v\n",
+								n, adjust, deep, x, y, actual.At(x, y), expected.At(x, y))
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestFilterScale(t *testing.T) {
+	src := image.NewGray(image.Rect(0, 0, 20, 20))
+	filter := MakeTriangleFilter()
+	filter.Name = "downscaler"
+	filter.Flags = func(scaleFactor float64) uint32 { return FilterFlagDownscaleOnly }
+
+	var warnings []string
+	fp := New(src)
+	fp.SetFilter(filter)
+	fp.SetProgressCallback(func(format string, a ...interface{}) {
+		msg := fmt.Sprintf(format, a...)
+		if strings.HasPrefix(msg, "Warning:") {
+			warnings = append(warnings, msg)
+		}
+	})
+	fp.SetTargetBounds(image.Rect(0, 0, 10, 40))
+
+	p, err := fp.Plan()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if p.Horizontal.FilterWarning != "" || p.Vertical.FilterWarning == "" {
+		t.Errorf("Wrong filter warnings in plan: %+q, %+q\n", p.Horizontal.FilterWarning,
+			p.Vertical.FilterWarning)
+	}
+	if _, err = fp.ResizeToRGBA(); err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "downscaler") {
+		t.Errorf("Wrong warnings: %q\n", warnings)
+	}
+
+	fp.SetStrictFilterScale(true)
+	if _, err = fp.ResizeToRGBA(); !errors.Is(err, ErrFilterScale) {
+		t.Errorf("Strict filter scale: got error %v\n", err)
+	}
+	fp.SetTargetBounds(image.Rect(0, 0, 10, 10))
+	if _, err = fp.ResizeToRGBA(); err != nil {
+		t.Errorf("Strict filter scale: %s\n", err.Error())
+	}
+
+	filter = MakeTriangleFilter()
+	filter.MinScaleFactor = 0.6
+	if filter.scaleFactorProblem(0.5) == "" || filter.scaleFactorProblem(0.7) != "" {
+		t.Errorf("MinScaleFactor not checked\n")
+	}
+	filter.MaxScaleFactor = 4.0
+	if filter.scaleFactorProblem(5.0) == "" || filter.scaleFactorProblem(2.0) != "" {
+		t.Errorf("MaxScaleFactor not checked\n")
+	}
+}
+
+func TestLinearRounding(t *testing.T) {
+	fp := New(image.NewGray(image.Rect(0, 0, 1, 1)))
+	fp.setDefaultColorConverters()
+
+	lin := make([]float32, 256)
+	for c := range lin {
+		lin[c] = float32(c) / 255.0
+	}
+	SRGBToLinear(lin)
+
+	// Each entry of the table should be the value nearest in linear light.
+	const tableSize = 9885
+	tbl := fp.buildOutputLUT_Xto8(tableSize, true)
+	for i := range tbl {
+		v := float32(i) / float32(tableSize-1)
+		best := 0
+		for c := range lin {
+			if math.Abs(float64(lin[c]-v)) < math.Abs(float64(lin[best]-v)) {
+				best = c
+			}
+		}
+		if int(tbl[i]) != best && math.Abs(float64(lin[best]-v)-math.Abs(float64(lin[tbl[i]]-v))) > 1e-6 {
+			t.Fatalf("Entry %d (%g) is %d, expected %d\n", i, v, tbl[i], best)
+		}
+	}
+
+	// Compared to normal rounding, samples should mostly be made darker. Some
+	// may be made lighter, because normal rounding may not use a lookup
+	// table, which has limited precision.
+	srcImg := image.NewGray16(image.Rect(0, 0, 256, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 256; x++ {
+			srcImg.SetGray16(x, y, color.Gray16{uint16(x*256 + y*16)})
+		}
+	}
+	var images [2]*image.NRGBA
+	for n := range images {
+		fp := New(srcImg)
+		fp.SetTargetBounds(image.Rect(0, 0, 256, 16))
+		fp.SetFilter(MakeBoxAvgFilter())
+		fp.SetLinearRounding(n == 1)
+		im, err := fp.ResizeToNRGBA()
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		images[n] = im
+	}
+	var nDarker, nLighter int
+	for i := range images[0].Pix {
+		normal, linear := images[0].Pix[i], images[1].Pix[i]
+		switch {
+		case linear+1 == normal:
+			nDarker++
+		case linear == normal+1:
+			nLighter++
+		case linear != normal:
+			t.Fatalf("Sample %d is %d, expected about %d\n", i, linear, normal)
+		}
+	}
+	if nDarker <= nLighter {
+		t.Errorf("Linear rounding made %d samples darker, and %d lighter\n", nDarker, nLighter)
+	}
+}
+
+func TestSourceMask(t *testing.T) {
+	// A flat image with some defective pixels, which are masked out.
+	srcImg := image.NewNRGBA(image.Rect(0, 0, 40, 30))
+	mask := image.NewGray(image.Rect(5, 5, 45, 35))
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			if (x*7+y*3)%11 == 5 {
+				srcImg.SetNRGBA(x, y, color.NRGBA{255, 0, 255, 255})
+				continue
+			}
+			srcImg.SetNRGBA(x, y, color.NRGBA{100, 150, 50, 255})
+			mask.SetGray(x+5, y+5, color.Gray{255})
+		}
+	}
+
+	for _, size := range []image.Rectangle{image.Rect(0, 0, 13, 9), image.Rect(0, 0, 90, 70)} {
+		fp := New(srcImg)
+		fp.SetTargetBounds(size)
+		fp.SetFilter(MakeGaussianFilter())
+		fp.SetSourceMask(mask)
+		im, err := fp.ResizeToNRGBA()
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		for y := size.Min.Y; y < size.Max.Y; y++ {
+			for x := size.Min.X; x < size.Max.X; x++ {
+				c := im.NRGBAAt(x, y)
+				if absdiff(uint32(c.R), 100) > 1 || absdiff(uint32(c.G), 150) > 1 ||
+					absdiff(uint32(c.B), 50) > 1 || c.A != 255 {
+					t.Fatalf("%v: pixel (%d,%d) is %v\n", size, x, y, c)
+				}
+			}
+		}
+	}
+
+	// With no valid pixels, the result is black (it would be transparent,
+	// if the image had transparency).
+	fp := New(srcImg)
+	fp.SetTargetBounds(image.Rect(0, 0, 10, 10))
+	fp.SetSourceMask(image.NewGray(srcImg.Rect))
+	im, err := fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if c := im.NRGBAAt(3, 3); c.A != 255 || c.R != 0 {
+		t.Errorf("Fully masked pixel is %v\n", c)
+	}
+
+	fp.SetSourceMask(image.NewGray(image.Rect(0, 0, 10, 10)))
+	if _, err = fp.ResizeToNRGBA(); err == nil {
+		t.Errorf("Mask of the wrong size was accepted\n")
+	}
+
+	// The mask can't be used in pipelined mode, which EncodeResized uses.
+	fp = New(srcImg)
+	fp.SetTargetBounds(image.Rect(0, 0, 10, 10))
+	fp.SetSourceMask(mask)
+	var buf bytes.Buffer
+	if err = fp.EncodeResized(&buf, "png", nil); err == nil {
+		t.Errorf("EncodeResized ignored the mask\n")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("EncodeResized wrote %d bytes, with an invalid mask\n", buf.Len())
+	}
+	fp.SetPipelined(true)
+	if _, err = fp.ResizeToNRGBA(); err == nil {
+		t.Errorf("Mask was accepted in pipelined mode\n")
+	}
+}
+
+func TestResizeLabels(t *testing.T) {
+	// Three regions: label 7 on the left, 200 on the right, and a square of
+	// label 40 in the middle.
+	src := image.NewGray(image.Rect(10, 10, 70, 50))
+	for y := 10; y < 50; y++ {
+		for x := 10; x < 70; x++ {
+			label := uint8(7)
+			if x >= 40 {
+				label = 200
+			}
+			if x >= 30 && x < 50 && y >= 20 && y < 40 {
+				label = 40
+			}
+			src.SetGray(x, y, color.Gray{label})
+		}
+	}
+
+	for _, size := range []image.Rectangle{image.Rect(0, 0, 15, 10), image.Rect(0, 0, 180, 120)} {
+		fp := New(src)
+		fp.SetTargetBounds(size)
+		fp.SetFilterByName("lanczos3")
+		im, err := fp.ResizeLabels()
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		dst := im.(*image.Gray)
+		for y := size.Min.Y; y < size.Max.Y; y++ {
+			for x := size.Min.X; x < size.Max.X; x++ {
+				switch dst.GrayAt(x, y).Y {
+				case 7, 40, 200:
+				default:
+					t.Fatalf("%v: pixel (%d,%d) has label %d\n", size, x, y, dst.GrayAt(x, y).Y)
+				}
+			}
+		}
+		w, h := size.Dx(), size.Dy()
+		if dst.GrayAt(0, 0).Y != 7 || dst.GrayAt(w-1, h-1).Y != 200 || dst.GrayAt(w/2, h/2).Y != 40 {
+			t.Errorf("%v: wrong labels\n", size)
+		}
+	}
+
+	p := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, color.White})
+	p.SetColorIndex(1, 1, 1)
+	p.SetColorIndex(2, 1, 1)
+	p.SetColorIndex(1, 2, 1)
+	p.SetColorIndex(2, 2, 1)
+	fp := New(p)
+	fp.SetTargetBounds(image.Rect(0, 0, 8, 8))
+	im, err := fp.ResizeLabels()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	dp, ok := im.(*image.Paletted)
+	if !ok || len(dp.Palette) != 2 || dp.ColorIndexAt(4, 4) != 1 || dp.ColorIndexAt(0, 0) != 0 {
+		t.Errorf("Paletted label map resized incorrectly\n")
+	}
+
+	fp = New(image.NewNRGBA(image.Rect(0, 0, 4, 4)))
+	fp.SetTargetBounds(image.Rect(0, 0, 8, 8))
+	if _, err = fp.ResizeLabels(); err == nil {
+		t.Errorf("ResizeLabels accepted an NRGBA image\n")
+	}
+}
+
+func TestAlphaWeighting(t *testing.T) {
+	// A cutout with hard edges: white and black stripes, then transparency.
+	cutout := image.NewNRGBA(image.Rect(0, 0, 61, 47))
+	for y := 0; y < 47; y++ {
+		for x := 0; x < 61; x++ {
+			if x+y/3 > 45 {
+				continue
+			}
+			v := uint8(255 * ((x / 2) % 2))
+			cutout.SetNRGBA(x, y, color.NRGBA{v, v, 255 - v, 255})
+		}
+	}
+	opaque := image.NewNRGBA(cutout.Rect)
+	for y := 0; y < 47; y++ {
+		for x := 0; x < 61; x++ {
+			c := cutout.NRGBAAt(x, y)
+			c.A = 255
+			opaque.SetNRGBA(x, y, c)
+		}
+	}
+
+	resize := func(src image.Image, alphaWeighting, pipelined bool) *image.NRGBA64 {
+		fp := New(src)
+		fp.SetTargetBounds(image.Rect(0, 0, 19, 15))
+		fp.SetFilterByName("lanczos3")
+		fp.SetAlphaWeighting(alphaWeighting)
+		fp.SetPipelined(pipelined)
+		im, err := fp.ResizeToNRGBA64()
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		return im
+	}
+
+	// Opaque images are not affected.
+	if !bytes.Equal(resize(opaque, false, false).Pix, resize(opaque, true, false).Pix) {
+		t.Errorf("Alpha weighting changed an opaque image\n")
+	}
+
+	normal, weighted := resize(cutout, false, false), resize(cutout, true, false)
+	if bytes.Equal(normal.Pix, weighted.Pix) {
+		t.Errorf("Alpha weighting made no difference\n")
+	}
+	// Away from the edge, the images are the same.
+	if absdiff(uint32(normal.NRGBA64At(2, 7).R), uint32(weighted.NRGBA64At(2, 7).R)) > 2 {
+		t.Errorf("Alpha weighting changed the interior: %v, %v\n", normal.NRGBA64At(2, 7),
+			weighted.NRGBA64At(2, 7))
+	}
+
+	pipelined := resize(cutout, true, true)
+	b := weighted.Rect
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			e, a := weighted.NRGBA64At(x, y), pipelined.NRGBA64At(x, y)
+			if absdiff(uint32(e.R), uint32(a.R)) > 2 || absdiff(uint32(e.G), uint32(a.G)) > 2 ||
+				absdiff(uint32(e.B), uint32(a.B)) > 2 || absdiff(uint32(e.A), uint32(a.A)) > 2 {
+				t.Fatalf("Pipelined alpha weighting: pixel (%d,%d) is %v, expected %v\n", x, y, a, e)
+			}
+		}
+	}
+}
+
+// A RowConverter that makes an RGB565 image.
+type rgb565Converter struct {
+	rect    image.Rectangle
+	pix     []uint16
+	rowSeen []int
+	fail    bool
+}
+
+func (c *rgb565Converter) Start(r image.Rectangle) error {
+	if c.fail {
+		return errors.New("test failure")
+	}
+	c.rect = r
+	c.pix = make([]uint16, r.Dx()*r.Dy())
+	c.rowSeen = make([]int, r.Dy())
+	return nil
+}
+
+func (c *rgb565Converter) ConvertRow(y int, samples []float32) {
+	j := y - c.rect.Min.Y
+	c.rowSeen[j]++
+	for i := 0; i < c.rect.Dx(); i++ {
+		r := uint16(samples[i*4]*31.0 + 0.5)
+		g := uint16(samples[i*4+1]*63.0 + 0.5)
+		b := uint16(samples[i*4+2]*31.0 + 0.5)
+		c.pix[j*c.rect.Dx()+i] = r<<11 | g<<5 | b
+	}
+}
+
+func TestResizeToConverter(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 60, 60))
+	for j := 0; j < 60; j++ {
+		for i := 0; i < 60; i++ {
+			src.SetNRGBA(i, j, color.NRGBA{uint8(i * 4), uint8(j * 4), uint8((i + j) * 2), 255})
+		}
+	}
+	dstRect := image.Rect(5, 10, 35, 33)
+
+	for _, pipelined := range []bool{false, true} {
+		fp := New(src)
+		fp.SetTargetBounds(dstRect)
+		fp.SetPipelined(pipelined)
+		ref, err := fp.ResizeToNRGBA()
+		if err != nil {
+			t.Fatalf("ResizeToNRGBA: %s\n", err.Error())
+		}
+
+		c := new(rgb565Converter)
+		err = fp.ResizeToConverter(c)
+		if err != nil {
+			t.Fatalf("ResizeToConverter: %s\n", err.Error())
+		}
+		if c.rect != dstRect {
+			t.Errorf("ResizeToConverter(pipelined=%v): got bounds %v\n", pipelined, c.rect)
+			continue
+		}
+		for j, n := range c.rowSeen {
+			if n != 1 {
+				t.Errorf("ResizeToConverter(pipelined=%v): row %d converted %d times\n", pipelined, j, n)
+			}
+		}
+		for y := dstRect.Min.Y; y < dstRect.Max.Y; y++ {
+			for x := dstRect.Min.X; x < dstRect.Max.X; x++ {
+				v := c.pix[(y-dstRect.Min.Y)*dstRect.Dx()+x-dstRect.Min.X]
+				rc := ref.NRGBAAt(x, y)
+				dr := float64(v>>11)/31.0 - float64(rc.R)/255.0
+				dg := float64((v>>5)&63)/63.0 - float64(rc.G)/255.0
+				if math.Abs(dr) > 1.0/62.0+1.0/510.0 || math.Abs(dg) > 1.0/126.0+1.0/510.0 {
+					t.Fatalf("ResizeToConverter(pipelined=%v): pixel (%d,%d) = %#04x, expected about %v\n",
+						pipelined, x, y, v, rc)
+				}
+			}
+		}
+	}
+
+	fp := New(src)
+	fp.SetTargetBounds(dstRect)
+	err := fp.ResizeToConverter(&rgb565Converter{fail: true})
+	if err == nil || err.Error() != "test failure" {
+		t.Errorf("ResizeToConverter: expected the Start error, got %v\n", err)
+	}
+}
+
+func TestLUTMode(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 40))
+	for j := 0; j < 40; j++ {
+		for i := 0; i < 40; i++ {
+			src.SetNRGBA(i, j, color.NRGBA{uint8(i * 6), uint8(j * 6), 100, 255})
+		}
+	}
+
+	// A color converter that takes a long time for each call, whatever the
+	// number of samples, like one that calls a color management library.
+	// maxLen is the most samples it was called with.
+	var maxLen int32
+	var sink float64
+	slowCCF := func(s []float32) {
+		if int32(len(s)) > atomic.LoadInt32(&maxLen) {
+			atomic.StoreInt32(&maxLen, int32(len(s)))
+		}
+		x := 1.0
+		for i := 0; i < 20000; i++ {
+			x = x*1.0000001 + 1.0e-9
+		}
+		if x < 0.0 {
+			sink = x
+		}
+		LinearTosRGB(s)
+	}
+
+	var ref *image.NRGBA
+	for _, mode := range []int{LUTModeDefault, LUTModeAlways, LUTModeNever, LUTModeAuto} {
+		maxLen = 0
+		fp := New(src)
+		fp.SetTargetBounds(image.Rect(0, 0, 40, 40))
+		fp.SetMaxWorkerThreads(1)
+		fp.SetOutputColorConverter(slowCCF)
+		fp.SetOutputLUTSizes(10000, 0)
+		fp.SetLUTMode(mode)
+		dst, err := fp.ResizeToNRGBA()
+		if err != nil {
+			t.Fatalf("ResizeToNRGBA: %s\n", err.Error())
+		}
+
+		// Only LUTModeAlways and LUTModeAuto should make a table, since the
+		// image is too small for the default threshold.
+		usedLUT := maxLen == 10000
+		expectLUT := mode == LUTModeAlways || mode == LUTModeAuto
+		if usedLUT != expectLUT {
+			t.Errorf("LUT mode %d: lookup table used = %v, expected %v\n", mode, usedLUT, expectLUT)
+		}
+
+		if ref == nil {
+			ref = dst
+			continue
+		}
+		for k := range dst.Pix {
+			if d := int(dst.Pix[k]) - int(ref.Pix[k]); d < -1 || d > 1 {
+				t.Errorf("LUT mode %d: sample %d is %d, expected %d\n", mode, k, dst.Pix[k], ref.Pix[k])
+				break
+			}
+		}
+	}
+	_ = sink
+
+	// With a low enough threshold, LUTModeDefault makes a table.
+	maxLen = 0
+	fp := New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 40, 40))
+	fp.SetMaxWorkerThreads(1)
+	fp.SetOutputColorConverter(slowCCF)
+	fp.SetOutputLUTSizes(10000, 0)
+	fp.SetLUTThreshold(0.1)
+	_, err := fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("ResizeToNRGBA: %s\n", err.Error())
+	}
+	if maxLen != 10000 {
+		t.Errorf("SetLUTThreshold: lookup table not used\n")
+	}
+}
+
+func TestResizeVolume(t *testing.T) {
+	// Eight slices, whose values are a ramp along the Z axis.
+	slices := make([]image.Image, 8)
+	for z := range slices {
+		im := image.NewGray(image.Rect(0, 0, 20, 20))
+		draw.Draw(im, im.Bounds(), image.NewUniform(color.Gray{uint8(10 + 20*z)}), image.ZP, draw.Src)
+		slices[z] = im
+	}
+
+	fp := New(slices[0])
+	fp.SetTargetBounds(image.Rect(0, 0, 10, 10))
+	fp.SetInputColorConverter(nil)
+	fp.SetOutputColorConverter(nil)
+	dst, err := fp.ResizeVolume(slices, 4, ResizeFlagGrayOK)
+	if err != nil {
+		t.Fatalf("ResizeVolume: %s\n", err.Error())
+	}
+	if len(dst) != 4 {
+		t.Fatalf("ResizeVolume: got %d slices, expected 4\n", len(dst))
+	}
+	for z, im := range dst {
+		g, ok := im.(*image.Gray)
+		if !ok {
+			t.Fatalf("ResizeVolume: slice %d has type %T, expected *image.Gray\n", z, im)
+		}
+		if g.Rect != image.Rect(0, 0, 10, 10) {
+			t.Errorf("ResizeVolume: slice %d has bounds %v\n", z, g.Rect)
+		}
+		// Target slice z is centered on source position 2z+0.5. Away from the
+		// ends of the stack, the ramp is interpolated exactly.
+		if z == 1 || z == 2 {
+			expected := 20 + 40*z
+			if v := int(g.GrayAt(5, 5).Y); v < expected-1 || v > expected+1 {
+				t.Errorf("ResizeVolume: slice %d has value %d, expected %d\n", z, v, expected)
+			}
+		}
+	}
+
+	// The slices must all have the same bounds.
+	slices[3] = image.NewGray(image.Rect(0, 0, 20, 21))
+	_, err = fp.ResizeVolume(slices, 4, 0)
+	if err == nil {
+		t.Errorf("ResizeVolume: expected an error for mismatched slices\n")
+	}
+}
+
+func TestContext(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 300, 200))
+	draw.Draw(src, src.Bounds(), image.NewUniform(color.NRGBA{200, 100, 50, 255}), image.ZP, draw.Src)
+
+	// An already-canceled context.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	fp := New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 100, 70))
+	fp.SetContext(ctx)
+	dst, err := fp.ResizeToNRGBA()
+	if err != context.Canceled || dst != nil {
+		t.Errorf("ResizeToNRGBA with a canceled context: got %v, %v\n", dst != nil, err)
+	}
+
+	// Cancel the context while resizing, in each stage. In pipelined mode,
+	// progress is only reported for the resample stage.
+	goroutines := runtime.NumGoroutine()
+	for _, pipelined := range []bool{false, true} {
+		for stage := StageConvertSource; stage <= StageConvertTarget; stage++ {
+			if pipelined && stage != StageResample {
+				continue
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			fp := New(src)
+			fp.SetTargetBounds(image.Rect(0, 0, 100, 70))
+			fp.SetPipelined(pipelined)
+			fp.SetContext(ctx)
+			fp.SetProgressFunc(func(p Progress) {
+				if p.Stage == stage && p.Done > 0 {
+					cancel()
+				}
+			})
+			_, err = fp.ResizeToRGBA()
+			if err != context.Canceled {
+				t.Errorf("ResizeToRGBA(pipelined=%v), canceled in stage %d: got %v\n", pipelined, stage, err)
+			}
+			cancel()
+
+			// The FPObject can still be used.
+			fp.SetContext(context.Background())
+			fp.SetProgressFunc(nil)
+			dst, err := fp.ResizeToNRGBA()
+			if err != nil {
+				t.Fatalf("ResizeToNRGBA after cancellation: %s\n", err.Error())
+			}
+			if c := dst.NRGBAAt(50, 35); c != (color.NRGBA{200, 100, 50, 255}) {
+				t.Errorf("ResizeToNRGBA after cancellation: got %v\n", c)
+			}
+		}
+	}
+	// The workers exit soon after they are told to stop.
+	for i := 0; i < 100 && runtime.NumGoroutine() > goroutines; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("Cancellation left %d goroutines running\n", n-goroutines)
+	}
+}
+
+func TestResizeToGray(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 60, 40))
+	for j := 0; j < 40; j++ {
+		for i := 0; i < 60; i++ {
+			src.SetNRGBA(i, j, color.NRGBA{uint8(i * 4), uint8(j * 6), 200, 255})
+		}
+	}
+
+	fp := New(src)
+	fp.SetTargetBounds(image.Rect(0, 0, 30, 20))
+	ref, err := fp.ResizeToImage(ResizeFlagGray)
+	if err != nil {
+		t.Fatalf("ResizeToImage: %s\n", err.Error())
+	}
+	refGray, ok := ref.(*image.Gray)
+	if !ok {
+		t.Fatalf("ResizeToImage(ResizeFlagGray): got %T\n", ref)
+	}
+	if !fp.HasColor() {
+		t.Errorf("ResizeToGray: HasColor should not be affected\n")
+	}
+
+	for _, pipelined := range []bool{false, true} {
+		fp.SetPipelined(pipelined)
+		dst, err := fp.ResizeToGray()
+		if err != nil {
+			t.Fatalf("ResizeToGray: %s\n", err.Error())
+		}
+		for k := range dst.Pix {
+			if d := int(dst.Pix[k]) - int(refGray.Pix[k]); d < -1 || d > 1 {
+				t.Errorf("ResizeToGray(pipelined=%v): sample %d is %d, expected %d\n", pipelined, k,
+					dst.Pix[k], refGray.Pix[k])
+				break
+			}
+		}
+
+		dst16, err := fp.ResizeToGray16()
+		if err != nil {
+			t.Fatalf("ResizeToGray16: %s\n", err.Error())
+		}
+		for y := 0; y < 20; y++ {
+			for x := 0; x < 30; x++ {
+				v16, v8 := int(dst16.Gray16At(x, y).Y), int(refGray.GrayAt(x, y).Y)
+				if d := v16/257 - v8; d < -1 || d > 1 {
+					t.Fatalf("ResizeToGray16(pipelined=%v): pixel (%d,%d) is %d, expected about %d\n",
+						pipelined, x, y, v16, v8*257)
+				}
+			}
+		}
+	}
+
+	// A transparent image still gives a Gray image, composited over black.
+	trans := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	draw.Draw(trans, trans.Bounds(), image.NewUniform(color.NRGBA{255, 255, 255, 128}), image.ZP, draw.Src)
+	fp = New(trans)
+	fp.SetTargetBounds(image.Rect(0, 0, 10, 10))
+	fp.SetOutputColorConverter(nil)
+	fp.SetInputColorConverter(nil)
+	dst, err := fp.ResizeToGray()
+	if err != nil {
+		t.Fatalf("ResizeToGray: %s\n", err.Error())
+	}
+	if v := dst.GrayAt(5, 5).Y; v < 127 || v > 129 {
+		t.Errorf("ResizeToGray(transparent): got %d, expected 128\n", v)
+	}
+}
+
+func TestResizeInto(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 60, 40))
+	for j := 0; j < 40; j++ {
+		for i := 0; i < 60; i++ {
+			src.SetNRGBA(i, j, color.NRGBA{uint8(i * 4), uint8(j * 6), 200, 255})
+		}
+	}
+	fp := New(src)
+	r := image.Rect(10, 10, 40, 30)
+	fp.SetTargetBounds(r)
+	ref, err := fp.ResizeToRGBA()
+	if err != nil {
+		t.Fatalf("ResizeToRGBA: %s\n", err.Error())
+	}
+
+	// Write into the middle of a larger image.
+	blue := color.RGBA{0, 0, 255, 255}
+	dst := image.NewRGBA(image.Rect(0, 0, 50, 50))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(blue), image.ZP, draw.Src)
+	err = fp.ResizeInto(dst)
+	if err != nil {
+		t.Fatalf("ResizeInto: %s\n", err.Error())
+	}
+	for y := 0; y < 50; y++ {
+		for x := 0; x < 50; x++ {
+			expected := blue
+			if (image.Point{x, y}).In(r) {
+				expected = ref.RGBAAt(x, y)
+			}
+			if c := dst.RGBAAt(x, y); c != expected {
+				t.Fatalf("ResizeInto: pixel (%d,%d) is %v, expected %v\n", x, y, c, expected)
+			}
+		}
+	}
+
+	// A Gray image gets the luminance.
+	refGray, err := fp.ResizeToGray()
+	if err != nil {
+		t.Fatalf("ResizeToGray: %s\n", err.Error())
+	}
+	dstGray := image.NewGray(r)
+	err = fp.ResizeInto(dstGray)
+	if err != nil {
+		t.Fatalf("ResizeInto: %s\n", err.Error())
+	}
+	if !bytes.Equal(dstGray.Pix, refGray.Pix) {
+		t.Errorf("ResizeInto(Gray): the image differs from ResizeToGray's\n")
+	}
+
+	err = fp.ResizeInto(image.NewRGBA(image.Rect(0, 0, 30, 20)))
+	if err == nil {
+		t.Errorf("ResizeInto: expected an error for a target image that is too small\n")
+	}
+	err = fp.ResizeInto(image.NewPaletted(r, color.Palette{blue}))
+	if err == nil {
+		t.Errorf("ResizeInto: expected an error for an unsupported type\n")
+	}
+}
+
+func TestSourceRegion(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 80, 60))
+	for j := 0; j < 60; j++ {
+		for i := 0; i < 80; i++ {
+			src.SetNRGBA(i, j, color.NRGBA{uint8(i * 3), uint8(j * 4), uint8((i * j) % 256), 255})
+		}
+	}
+	region := image.Rect(30, 10, 70, 40)
+
+	// The result should be the same as resizing a copy of the region.
+	crop := image.NewNRGBA(image.Rect(0, 0, 40, 30))
+	draw.Draw(crop, crop.Bounds(), src, region.Min, draw.Src)
+	fp := New(crop)
+	fp.SetTargetBounds(image.Rect(0, 0, 20, 15))
+	ref, err := fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("ResizeToNRGBA: %s\n", err.Error())
+	}
+
+	fp = New(src)
+	err = fp.SetSourceRegion(region.Union(image.Rect(30, 10, 90, 20)))
+	if err != nil {
+		t.Fatalf("SetSourceRegion: %s\n", err.Error())
+	}
+	// A region of the region.
+	err = fp.SetSourceRegion(region)
+	if err != nil {
+		t.Fatalf("SetSourceRegion: %s\n", err.Error())
+	}
+	fp.SetTargetBounds(image.Rect(0, 0, 20, 15))
+	dst, err := fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("ResizeToNRGBA: %s\n", err.Error())
+	}
+	if !bytes.Equal(dst.Pix, ref.Pix) {
+		t.Errorf("SetSourceRegion: the image differs from one made from a copy of the region\n")
+	}
+
+	err = fp.SetSourceRegion(region)
+	if err == nil {
+		t.Errorf("SetSourceRegion: expected an error after resizing\n")
+	}
+	fp = New(src)
+	err = fp.SetSourceRegion(image.Rect(100, 100, 120, 120))
+	if err == nil {
+		t.Errorf("SetSourceRegion: expected an error for a region outside the image\n")
+	}
+}
+
+func TestSetSourceImageAgain(t *testing.T) {
+	srcImg := readImageFromFile(t, fmt.Sprintf("testdata%csrcimg%crgb8a.png", os.PathSeparator, os.PathSeparator))
+	gray := image.NewGray(image.Rect(0, 0, 40, 30))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 7)
+	}
+	size := image.Rect(0, 0, 19, 13)
+
+	fp := New(srcImg)
+	fp.SetFilter(MakeCubicFilter(1.0/3.0, 1.0/3.0))
+	fp.SetTargetBounds(size)
+	_, err := fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	// Reuse fp, with its settings, for a grayscale opaque image.
+	fp.SetSourceImage(gray)
+	if fp.srcFPImage != nil || fp.HasTransparency() || fp.HasColor() {
+		t.Errorf("SetSourceImage did not forget the old source image\n")
+	}
+	actual, err := fp.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	fp2 := New(gray)
+	fp2.SetFilter(MakeCubicFilter(1.0/3.0, 1.0/3.0))
+	fp2.SetTargetBounds(size)
+	expected, err := fp2.ResizeToNRGBA()
+	if err != nil {
+		t.Fatalf("%s\n", err.Error())
+	}
+	if !bytes.Equal(actual.Pix, expected.Pix) {
+		t.Errorf("Resizing a second source image gave a different result\n")
+	}
+}
+
+func TestBackgroundColor(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 30, 20))
+	for i := 0; i < len(src.Pix); i += 4 {
+		src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3] = 255, 0, 0, 128
+	}
+
+	// Red over white, blended in linear light.
+	a := float32(128) / 255.0
+	expected := []float32{1.0, 1.0 - a, 1.0 - a}
+	LinearTosRGB(expected)
+
+	for _, pipelined := range []bool{false, true} {
+		fp := New(src)
+		fp.SetBackgroundColor(color.White)
+		fp.SetPipelined(pipelined)
+		fp.SetTargetBounds(image.Rect(0, 0, 15, 10))
+		im, err := fp.ResizeToImage(0)
+		if err != nil {
+			t.Fatalf("%s\n", err.Error())
+		}
+		if fp.HasTransparency() {
+			t.Errorf("SetBackgroundColor (pipelined=%v): the image should be opaque\n", pipelined)
+		}
+		rgba, ok := im.(*image.RGBA)
+		if !ok {
+			t.Fatalf("SetBackgroundColor (pipelined=%v): got a %T, expected an *image.RGBA\n", pipelined, im)
+		}
+		for k := 0; k < 3; k++ {
+			v := rgba.Pix[rgba.PixOffset(7, 5)+k]
+			if math.Abs(float64(v)-float64(expected[k])*255.0) > 1.0 {
+				t.Errorf("SetBackgroundColor (pipelined=%v): sample %d is %d, expected %.1f\n", pipelined, k, v,
+					expected[k]*255.0)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// ◄◄◄ fpsparse.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements skipping the fully transparent parts of an image.
+//
+// Sprite sheets, cut-out product photos, and the like are often mostly
+// transparent. With associated alpha, every sample of a fully transparent
+// pixel is 0, so such pixels contribute nothing when the image is
+// resampled. The source rows and columns that are entirely transparent are
+// found after the source image is converted, and the weights that refer to
+// them are removed from the weight lists. Lines of the intermediate image
+// that then have no weights at all are known to be 0, and are skipped by
+// the second pass; the output converters skip rows that are fully
+// transparent. The result is the same as if nothing were skipped.
+
+// The rows and columns of a converted source image whose samples are all 0.
+type sparseMap struct {
+	rowEmpty []bool
+	colEmpty []bool
+}
+
+// Returns the sparseMap for src, or nil if it has no empty rows or
+// columns, or it isn't worth looking for them. Only the channels that are
+// being processed are examined.
+func (fp *FPObject) findSparseLines(src *FPImageN) *sparseMap {
+	nch := src.NumChannels
+	if nch != 4 || fp.dataMode || !fp.channelInfo[3].mustProcess {
+		return nil
+	}
+
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	sp := &sparseMap{rowEmpty: make([]bool, h), colEmpty: make([]bool, w)}
+	for i := range sp.colEmpty {
+		sp.colEmpty[i] = true
+	}
+	var nEmptyRows, nEmptyCols int
+	for j := 0; j < h; j++ {
+		row := src.Pix[j*src.Stride : j*src.Stride+w*nch]
+		empty := true
+		for i := 0; i < w; i++ {
+			for k := 0; k < nch; k++ {
+				if fp.channelInfo[k].mustProcess && row[i*nch+k] != 0.0 {
+					empty = false
+					sp.colEmpty[i] = false
+					break
+				}
+			}
+		}
+		sp.rowEmpty[j] = empty
+		if empty {
+			nEmptyRows++
+		}
+	}
+	for _, empty := range sp.colEmpty {
+		if empty {
+			nEmptyCols++
+		}
+	}
+
+	if nEmptyRows == 0 && nEmptyCols == 0 {
+		return nil
+	}
+	fp.progressMsgf("Skipping %d empty rows and %d empty columns", nEmptyRows, nEmptyCols)
+	return sp
+}
+
+// Returns a copy of weightList without the weights that refer to an empty
+// source line (a row if isVertical is set, otherwise a column), or to a
+// virtual pixel.
+func (sp *sparseMap) filterWeights(weightList []fpWeight, isVertical bool) []fpWeight {
+	empty := sp.colEmpty
+	if isVertical {
+		empty = sp.rowEmpty
+	}
+	filtered := make([]fpWeight, 0, len(weightList))
+	for _, wt := range weightList {
+		if wt.srcSamIdx >= 0 && !empty[wt.srcSamIdx] {
+			filtered = append(filtered, wt)
+		}
+	}
+	return filtered
+}
+
+// Returns a slice that tells which of the n target rows or columns are
+// given a value by weightList. The others will be 0.
+func dstLinesUsed(weightList []fpWeight, n int) []bool {
+	used := make([]bool, n)
+	for i := range weightList {
+		used[weightList[i].dstSamIdx] = true
+	}
+	return used
+}
+
+// Reports whether row j of wc.src is fully transparent, and will be
+// converted to pixels whose samples are all 0, so the output converter can
+// just clear the target row.
+func (fp *FPObject) dstRowIsEmpty(wc *convertDstWorkContext, j int) bool {
+	if !fp.mustProcessTransparency || fp.dataMode || fp.hasAdjustments() ||
+		fp.outputRowHook != nil || wc.channels != nil {
+		return false
+	}
+	w := wc.src.Rect.Dx()
+	row := wc.src.Pix[j*wc.src.Stride : j*wc.src.Stride+w*4]
+	for i := 0; i < w; i++ {
+		if row[i*4+3] > 0.0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Sets the first n bytes of target row dj to 0.
+func (wc *convertDstWorkContext) clearDstRow(dj int, n int) {
+	row := wc.dstPix[wc.dstRowPos(dj) : wc.dstRowPos(dj)+n]
+	for i := range row {
+		row[i] = 0
+	}
+}
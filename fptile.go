@@ -0,0 +1,144 @@
+// ◄◄◄ fptile.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements resizing one region of the target image at a time.
+
+import "errors"
+import "image"
+import "image/color"
+import "sync"
+
+// RequestTile resizes only the part of the target image that is inside r,
+// and returns it, as ResizeToImage(flags) would. It is like calling
+// SetTargetRegionOfInterest(r) and ResizeToImage(flags), except that it
+// does not change the region of interest setting.
+//
+// This lets an FPObject act as a tile server for a pan-and-zoom viewer:
+// set the target bounds to the size of the whole zoomed image, then request
+// the tiles that are visible. The source image is converted once, by the
+// first request, and saved, so each tile only costs the resampling needed for
+// its own region. Pipelined mode is not used, since it does not save the
+// converted source image.
+//
+// The FPObject is not safe for concurrent use, so tiles must be requested
+// one at a time.
+func (fp *FPObject) RequestTile(r image.Rectangle, flags uint32) (image.Image, error) {
+	if r.Empty() {
+		return nil, errors.New("Empty tile rectangle")
+	}
+
+	savedPipelined := fp.pipelined
+	savedROI := fp.dstROI
+	defer func() {
+		fp.pipelined = savedPipelined
+		fp.SetTargetRegionOfInterest(savedROI)
+	}()
+
+	fp.pipelined = false
+	fp.SetTargetRegionOfInterest(r)
+	return fp.ResizeToImage(flags)
+}
+
+// The number of rows in each band computed by a ResizedView.
+const resizedViewBandHeight = 64
+
+// The number of bands a ResizedView keeps.
+const resizedViewMaxBands = 4
+
+type resizedViewBand struct {
+	n   int // The band number
+	img image.Image
+}
+
+// ResizedView is an image.Image that presents the resized version of an
+// FPObject's source image, without computing the whole thing. The pixels
+// are computed as they are asked for, in bands of full-width rows (using
+// RequestTile), and the most recently used bands are kept. This is useful
+// if only a small part of a large resized image will be read.
+//
+// Pixels are returned in color.RGBA64 form.
+//
+// While a ResizedView is being used, the FPObject's settings should not be
+// changed, and it should not be used to resize anything else. A ResizedView
+// may be used by more than one goroutine.
+type ResizedView struct {
+	fp     *FPObject
+	bounds image.Rectangle
+	mutex  sync.Mutex
+	bands  []*resizedViewBand // Most recently used first
+	err    error
+}
+
+// NewResizedView returns a ResizedView of fp's resized image. The target
+// bounds must already be set.
+func NewResizedView(fp *FPObject) *ResizedView {
+	rv := new(ResizedView)
+	rv.fp = fp
+	rv.bounds = fp.dstFullBounds
+	return rv
+}
+
+func (rv *ResizedView) ColorModel() color.Model {
+	return color.RGBA64Model
+}
+
+func (rv *ResizedView) Bounds() image.Rectangle {
+	return rv.bounds
+}
+
+func (rv *ResizedView) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(rv.bounds)) {
+		return color.RGBA64{}
+	}
+
+	rv.mutex.Lock()
+	defer rv.mutex.Unlock()
+
+	band, err := rv.getBand((y - rv.bounds.Min.Y) / resizedViewBandHeight)
+	if err != nil {
+		if rv.err == nil {
+			rv.err = err
+		}
+		return color.RGBA64{}
+	}
+	return band.At(x, y)
+}
+
+// Err returns the first error that happened while computing pixels, or
+// nil. Pixels that could not be computed are returned as transparent
+// black.
+func (rv *ResizedView) Err() error {
+	rv.mutex.Lock()
+	defer rv.mutex.Unlock()
+	return rv.err
+}
+
+// Returns band number n, computing it if necessary. rv.mutex must be
+// locked.
+func (rv *ResizedView) getBand(n int) (image.Image, error) {
+	for i, b := range rv.bands {
+		if b.n == n {
+			// Move it to the front of the list.
+			copy(rv.bands[1:i+1], rv.bands[:i])
+			rv.bands[0] = b
+			return b.img, nil
+		}
+	}
+
+	y0 := rv.bounds.Min.Y + n*resizedViewBandHeight
+	r := image.Rect(rv.bounds.Min.X, y0, rv.bounds.Max.X, y0+resizedViewBandHeight).Intersect(rv.bounds)
+	img, err := rv.fp.RequestTile(r, ResizeFlag16Bit)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &resizedViewBand{n: n, img: img}
+	if len(rv.bands) < resizedViewMaxBands {
+		rv.bands = append(rv.bands, nil)
+	}
+	copy(rv.bands[1:], rv.bands[:len(rv.bands)-1])
+	rv.bands[0] = b
+	return img, nil
+}
@@ -0,0 +1,180 @@
+// ◄◄◄ fptrim.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements trimming the transparent borders of an image, and
+// selecting a region of the source image.
+
+import "errors"
+import "image"
+
+// OpaqueBounds returns the smallest rectangle that contains all of the
+// pixels of im that are not fully transparent, or an empty rectangle if
+// there are none.
+func OpaqueBounds(im image.Image) image.Rectangle {
+	b := im.Bounds()
+	if o, ok := im.(interface {
+		Opaque() bool
+	}); ok && o.Opaque() {
+		return b
+	}
+
+	// Reports whether pixel (x,y) is not fully transparent.
+	visible := func(x, y int) bool {
+		_, _, _, a := im.At(x, y).RGBA()
+		return a != 0
+	}
+	switch m := im.(type) {
+	case *image.NRGBA:
+		visible = func(x, y int) bool { return m.Pix[m.PixOffset(x, y)+3] != 0 }
+	case *image.RGBA:
+		visible = func(x, y int) bool { return m.Pix[m.PixOffset(x, y)+3] != 0 }
+	case *image.Alpha:
+		visible = func(x, y int) bool { return m.Pix[m.PixOffset(x, y)] != 0 }
+	case *image.Paletted:
+		// Look up the transparency of each palette entry once.
+		pv := make([]bool, 256)
+		for n, c := range m.Palette {
+			_, _, _, a := c.RGBA()
+			pv[n] = a != 0
+		}
+		visible = func(x, y int) bool { return pv[m.Pix[m.PixOffset(x, y)]] }
+	}
+
+	rowVisible := func(y int) bool {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if visible(x, y) {
+				return true
+			}
+		}
+		return false
+	}
+	colVisible := func(x, y0, y1 int) bool {
+		for y := y0; y < y1; y++ {
+			if visible(x, y) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Move each edge inward until it reaches a visible pixel. The rows are
+	// done first, so that the columns only need to be searched between them.
+	r := b
+	for r.Min.Y < r.Max.Y && !rowVisible(r.Min.Y) {
+		r.Min.Y++
+	}
+	if r.Min.Y == r.Max.Y {
+		return image.Rectangle{}
+	}
+	for !rowVisible(r.Max.Y - 1) {
+		r.Max.Y--
+	}
+	for !colVisible(r.Min.X, r.Min.Y, r.Max.Y) {
+		r.Min.X++
+	}
+	for !colVisible(r.Max.X-1, r.Min.Y, r.Max.Y) {
+		r.Max.X--
+	}
+	return r
+}
+
+// An image.Image that is the part of another image within a rectangle, for
+// images that don't have a SubImage method.
+type croppedImage struct {
+	image.Image
+	r image.Rectangle
+}
+
+func (c *croppedImage) Bounds() image.Rectangle {
+	return c.r
+}
+
+// TrimTransparentBorders returns the part of im within OpaqueBounds(im),
+// enlarged by padding pixels on each side (but not beyond im's bounds). The
+// coordinates of the pixels are not changed, so the returned image's origin
+// is usually not (0,0). If im is fully transparent, it is returned as-is.
+//
+// The returned image shares im's pixels. If im has a SubImage method, it is
+// used, so the returned image has the same type as im.
+func TrimTransparentBorders(im image.Image, padding int) image.Image {
+	r := OpaqueBounds(im)
+	if r.Empty() {
+		return im
+	}
+	if padding > 0 {
+		r = r.Inset(-padding).Intersect(im.Bounds())
+	}
+	return subImage(im, r)
+}
+
+// Returns the part of im within r, which must be inside im's bounds,
+// sharing im's pixels. If im has a SubImage method, it is used, so the
+// returned image has the same type as im.
+func subImage(im image.Image, r image.Rectangle) image.Image {
+	if r == im.Bounds() {
+		return im
+	}
+	if s, ok := im.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return s.SubImage(r)
+	}
+	return &croppedImage{Image: im, r: r}
+}
+
+// TrimSource replaces the source image with its part that is not
+// transparent, with the given amount of transparent padding (see
+// TrimTransparentBorders), and returns its bounds. It is a common first step
+// when resizing logos and sprites, whose canvas often has wide empty
+// margins.
+//
+// The trimming is done immediately, so the target bounds should be set
+// afterward, from the returned bounds. The source image must have been set
+// by SetSourceImage, and it must not have been resized yet.
+func (fp *FPObject) TrimSource(padding int) (image.Rectangle, error) {
+	if fp.srcImage == nil {
+		return image.Rectangle{}, errors.New("TrimSource requires a source image set by SetSourceImage")
+	}
+	if fp.srcFPImage != nil {
+		return image.Rectangle{}, errors.New("TrimSource must be called before the first resize")
+	}
+	trimmed := TrimTransparentBorders(fp.srcImage, padding)
+	if trimmed.Bounds() != fp.srcBounds {
+		fp.progressMsgf("Trimming %dx%d -> %dx%d", fp.srcW, fp.srcH, trimmed.Bounds().Dx(),
+			trimmed.Bounds().Dy())
+		fp.SetSourceImage(trimmed)
+	}
+	return fp.srcBounds, nil
+}
+
+// SetSourceRegion selects the part of the source image within r (in the
+// source image's coordinate system) to be resized, so that the region is
+// scaled to the target bounds, as if it were the whole image. This is how
+// to crop and scale an image in one step, for example to make square
+// thumbnails. The region shares the source image's pixels, so nothing is
+// copied.
+//
+// r is clipped to the source image's bounds, and must not be empty after
+// that. Selecting a region replaces the source image with the region, so
+// calling SetSourceRegion again selects a region of the region. The source
+// image must have been set by SetSourceImage, and it must not have been
+// resized yet.
+func (fp *FPObject) SetSourceRegion(r image.Rectangle) error {
+	if fp.srcImage == nil {
+		return errors.New("SetSourceRegion requires a source image set by SetSourceImage")
+	}
+	if fp.srcFPImage != nil {
+		return errors.New("SetSourceRegion must be called before the first resize")
+	}
+	r = r.Intersect(fp.srcBounds)
+	if r.Empty() {
+		return errors.New("The source region does not overlap the source image")
+	}
+	if r != fp.srcBounds {
+		fp.progressMsgf("Selecting source region %v", r)
+		fp.SetSourceImage(subImage(fp.srcImage, r))
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+// ◄◄◄ fpvolume.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements resizing volumes: stacks of slices, which are also
+// resampled along the Z axis.
+
+import "errors"
+import "image"
+
+// The resized source slices, and the weights for one target slice.
+type volumeWorkContext struct {
+	slices  []*FPImage // The source slices, resized in X and Y
+	weights []fpWeight // The weights for dst, along the Z axis
+	dst     *FPImage
+}
+
+// Read row numbers from workQueue, and compute those rows of wc.dst. A
+// negative number means stop.
+func volumeWorker(wc *volumeWorkContext, workQueue chan int) {
+	n := 4 * wc.dst.Rect.Dx()
+	for {
+		j := <-workQueue
+		if j < 0 {
+			return
+		}
+
+		dstRow := wc.dst.Pix[j*wc.dst.Stride : j*wc.dst.Stride+n]
+		for _, w := range wc.weights {
+			src := wc.slices[w.srcSamIdx]
+			srcRow := src.Pix[j*src.Stride : j*src.Stride+n]
+			for i := range dstRow {
+				dstRow[i] += w.weight * srcRow[i]
+			}
+		}
+	}
+}
+
+// Returns the weights for resampling n slices to depth slices, grouped by
+// target slice, without the ones for virtual pixels. The Z axis uses the
+// settings for the vertical dimension.
+func (fp *FPObject) volumeWeights(n int, depth int) [][]fpWeight {
+	zfp := *fp
+	zfp.srcH = n
+	zfp.dstCanvasH = depth
+	zfp.dstTrueH = float64(depth)
+	zfp.dstOffsetY = 0.0
+
+	zw := make([][]fpWeight, depth)
+	for _, w := range zfp.computeWeightList(true) {
+		if w.srcSamIdx >= 0 && w.dstSamIdx >= 0 {
+			zw[w.dstSamIdx] = append(zw[w.dstSamIdx], w)
+		}
+	}
+	return zw
+}
+
+// ResizeVolume resizes a volume, such as the slices of a CT scan or of a
+// microscope's Z stack. The source slices must all have the same bounds.
+// Each one is resized to the target bounds, and then the stack is
+// resampled along the Z axis, from len(slices) slices to depth slices, so
+// that each target slice is filtered from the nearby source slices, instead
+// of being a copy of one of them. The target slices are in the format
+// chosen by flags, as for ResizeToImage, and all have the same type.
+//
+// The Z axis uses the settings for the vertical dimension: its filter and
+// blur (a FilterGetter or BlurGetter is called with isVertical set), pixel
+// alignment, and virtual pixels. The source slices become fp's source
+// image in turn (see Reset), so the settings that Reset clears, such as a
+// source mask, are not used. Pipelined mode is not used. All of the resized
+// slices are kept in memory, at 16 bytes per pixel, until the target slices
+// have been made.
+func (fp *FPObject) ResizeVolume(slices []image.Image, depth int, flags uint32) ([]image.Image, error) {
+	if len(slices) < 1 {
+		return nil, errors.New("No source slices")
+	}
+	if depth < 1 {
+		return nil, errors.New("Invalid target depth")
+	}
+	b := slices[0].Bounds()
+	for _, s := range slices {
+		if s.Bounds() != b {
+			return nil, errors.New("The source slices do not all have the same bounds")
+		}
+	}
+
+	resized := make([]*FPImage, len(slices))
+	defer func() {
+		for _, im := range resized {
+			if im != nil {
+				fp.releaseSamples(im.Pix)
+			}
+		}
+	}()
+
+	// Resize each slice in X and Y. Whether the target slices need color and
+	// transparency depends on all of the source slices.
+	var hasColor, hasTransparency bool
+	for z, s := range slices {
+		fp.progressMsgf("Resizing slice %d of %d", z+1, len(slices))
+		fp.Reset(s, true)
+		_, err := fp.resizeWithFlags(flags, func(prepare dstPrepareFunc) (image.Image, error) {
+			im, err := fp.ResizeToLinear()
+			resized[z] = im
+			hasColor = hasColor || fp.mustProcessColor
+			hasTransparency = hasTransparency || fp.mustProcessTransparency
+			return nil, err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	zw := fp.volumeWeights(len(slices), depth)
+
+	// The last target slice that uses each source slice, so that the source
+	// slices can be released as soon as possible.
+	lastUse := make([]int, len(slices))
+	for z := range zw {
+		for _, w := range zw[z] {
+			lastUse[w.srcSamIdx] = z
+		}
+	}
+
+	dstSlices := make([]image.Image, depth)
+	r := resized[0].Rect
+	nw := fp.workersFor(StageResample)
+	pt := fp.startProgress(StageResample, "Resampling along the Z axis", depth)
+	for z := range zw {
+		wc := &volumeWorkContext{slices: resized, weights: zw[z]}
+		wc.dst = &FPImage{Rect: r, Stride: 4 * r.Dx()}
+		wc.dst.Pix = fp.allocSamples(wc.dst.Stride * r.Dy())
+
+		workQueue := make(chan int)
+		for i := 0; i < nw; i++ {
+			go volumeWorker(wc, workQueue)
+		}
+		for j := 0; j < r.Dy(); j++ {
+			workQueue <- j
+		}
+		for i := 0; i < nw; i++ {
+			workQueue <- -1
+		}
+
+		for _, w := range zw[z] {
+			if lastUse[w.srcSamIdx] == z && resized[w.srcSamIdx] != nil {
+				fp.releaseSamples(resized[w.srcSamIdx].Pix)
+				resized[w.srcSamIdx] = nil
+			}
+		}
+
+		dst, err := fp.resizeWithFlags(flags, func(prepare dstPrepareFunc) (image.Image, error) {
+			fp.mustProcessColor = hasColor
+			fp.mustProcessTransparency = hasTransparency
+			return fp.convertDst(prepare, wc.dst), nil
+		})
+		if err == nil {
+			err = fp.ctxErr()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := dst.(*FPImage); !ok {
+			fp.releaseSamples(wc.dst.Pix)
+		}
+		dstSlices[z] = dst
+		pt.add(1)
+	}
+	pt.finish()
+	return dstSlices, nil
+}
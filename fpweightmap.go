@@ -0,0 +1,118 @@
+// ◄◄◄ fpweightmap.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements debugging views of the weight lists.
+
+import "bufio"
+import "errors"
+import "image"
+import "io"
+import "math"
+import "strconv"
+
+// Returns the weight list for the given dimension as a matrix, indexed by
+// target sample and then source sample. Weights that refer to the same
+// source sample (as with some VirtualPixels settings) are added together.
+func (fp *FPObject) weightMatrix(isVertical bool) ([][]float64, error) {
+	err := fp.validateSettings()
+	if err != nil {
+		return nil, err
+	}
+	if fp.srcW < 1 || fp.srcH < 1 {
+		return nil, errors.New("Source image not set")
+	}
+	srcN, dstN := fp.srcW, fp.dstCanvasW
+	if isVertical {
+		srcN, dstN = fp.srcH, fp.dstCanvasH
+	}
+	if int64(srcN)*int64(dstN) > maxImagePixels {
+		return nil, errors.New("Weight matrix too large")
+	}
+
+	m := make([][]float64, dstN)
+	for j := range m {
+		m[j] = make([]float64, srcN)
+	}
+	for _, wt := range fp.createWeightList(isVertical) {
+		if wt.srcSamIdx >= 0 {
+			// Not a (transparent) virtual pixel
+			m[wt.dstSamIdx][wt.srcSamIdx] += float64(wt.weight)
+		}
+	}
+	return m, nil
+}
+
+// WeightImage returns a picture of the weights that would be used to resize
+// the given dimension of the image, for checking that a (custom) filter
+// behaves as expected. Pixel (x,y) shows the weight of source sample x in
+// target sample y. A weight of 0 is mid-gray, and the other weights are
+// scaled so that the largest positive or negative weight is white or black.
+//
+// Weights given to transparent virtual pixels (see SetVirtualPixels) are
+// not shown, but they make the weights in that row add up to less than 1.
+// WriteWeightCSV will show the exact values.
+func (fp *FPObject) WeightImage(isVertical bool) (*image.Gray, error) {
+	m, err := fp.weightMatrix(isVertical)
+	if err != nil {
+		return nil, err
+	}
+	var srcN int
+	if len(m) > 0 {
+		srcN = len(m[0])
+	}
+	dst := image.NewGray(image.Rect(0, 0, srcN, len(m)))
+
+	var maxAbs float64
+	for _, row := range m {
+		for _, v := range row {
+			maxAbs = math.Max(maxAbs, math.Abs(v))
+		}
+	}
+	if maxAbs == 0.0 {
+		maxAbs = 1.0
+	}
+
+	for j, row := range m {
+		dstRow := dst.Pix[j*dst.Stride : j*dst.Stride+srcN]
+		for i, v := range row {
+			dstRow[i] = uint8(math.Floor(127.5 + 127.5*v/maxAbs + 0.5))
+		}
+	}
+	return dst, nil
+}
+
+// WriteWeightCSV writes the weights that would be used to resize the given
+// dimension of the image to w, in CSV format. There is a line for each
+// target sample, containing the index of the target sample, and then the
+// weight of each source sample. The first line is a header, listing the
+// source sample indices.
+func (fp *FPObject) WriteWeightCSV(w io.Writer, isVertical bool) error {
+	m, err := fp.weightMatrix(isVertical)
+	if err != nil {
+		return err
+	}
+	var srcN int
+	if len(m) > 0 {
+		srcN = len(m[0])
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString("dst")
+	for i := 0; i < srcN; i++ {
+		bw.WriteByte(',')
+		bw.WriteString(strconv.Itoa(i))
+	}
+	bw.WriteByte('\n')
+
+	for j, row := range m {
+		bw.WriteString(strconv.Itoa(j))
+		for _, v := range row {
+			bw.WriteByte(',')
+			bw.WriteString(strconv.FormatFloat(v, 'g', -1, 32))
+		}
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
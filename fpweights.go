@@ -0,0 +1,245 @@
+// ◄◄◄ fpweights.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements saving, loading, and keeping precomputed weight
+// lists.
+
+import "bufio"
+import "encoding/binary"
+import "errors"
+import "io"
+import "math"
+import "sync"
+
+// The first bytes of a weight list file, including the format version.
+const weightsMagic = "FPRW\x01"
+
+// A weight list, and the geometry it was made for.
+type weightTable struct {
+	isVertical bool
+	srcN       int
+	dstCanvasN int
+	dstTrueN   float64
+	dstOffset  float64
+	weights    []fpWeight
+}
+
+// Returns the geometry of the given dimension, as a weightTable with no
+// weights.
+func (fp *FPObject) weightGeometry(isVertical bool) *weightTable {
+	if isVertical {
+		return &weightTable{isVertical: true, srcN: fp.srcH, dstCanvasN: fp.dstCanvasH,
+			dstTrueN: fp.dstTrueH, dstOffset: fp.dstOffsetY}
+	}
+	return &weightTable{isVertical: false, srcN: fp.srcW, dstCanvasN: fp.dstCanvasW,
+		dstTrueN: fp.dstTrueW, dstOffset: fp.dstOffsetX}
+}
+
+func (wt *weightTable) sameGeometry(g *weightTable) bool {
+	return wt.isVertical == g.isVertical && wt.srcN == g.srcN && wt.dstCanvasN == g.dstCanvasN &&
+		wt.dstTrueN == g.dstTrueN && wt.dstOffset == g.dstOffset
+}
+
+// Returns the imported (or kept, see Reset) weight list for the given
+// dimension, if there is one that was made for the current geometry.
+func (fp *FPObject) importedWeightList(isVertical bool) []fpWeight {
+	if len(fp.importedWeights) == 0 && len(fp.keptWeights) == 0 {
+		return nil
+	}
+	g := fp.weightGeometry(isVertical)
+	for _, tables := range [][]*weightTable{fp.importedWeights, fp.keptWeights} {
+		for _, wt := range tables {
+			if wt.sameGeometry(g) {
+				return wt.weights
+			}
+		}
+	}
+	return nil
+}
+
+// The most weight lists that are remembered for Reset to keep.
+const maxLoggedWeights = 8
+
+// A record of the weight lists made by an FPObject (and the copies of it
+// used to resize parts of the image, which share it), for Reset.
+type weightLog struct {
+	mu     sync.Mutex
+	tables []*weightTable
+}
+
+// Starts recording the weight lists that are made, if that hasn't been
+// started yet. This must be called before fp is copied.
+func (fp *FPObject) startWeightLog() {
+	if fp.weightLog == nil {
+		fp.weightLog = new(weightLog)
+	}
+}
+
+// Records a weight list that was just made, replacing any other one for the
+// same geometry.
+func (fp *FPObject) logWeights(isVertical bool, weights []fpWeight) {
+	wl := fp.weightLog
+	if wl == nil {
+		return
+	}
+	wt := fp.weightGeometry(isVertical)
+	wt.weights = weights
+
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	for i, t := range wl.tables {
+		if t.sameGeometry(wt) {
+			wl.tables = append(wl.tables[:i], wl.tables[i+1:]...)
+			break
+		}
+	}
+	if len(wl.tables) >= maxLoggedWeights {
+		wl.tables = wl.tables[1:]
+	}
+	wl.tables = append(wl.tables, wt)
+}
+
+// Returns the weight lists kept by fp, and those made since they were kept.
+func (fp *FPObject) weightsToKeep() []*weightTable {
+	keep := make([]*weightTable, 0, maxLoggedWeights)
+	var logged []*weightTable
+	if fp.weightLog != nil {
+		fp.weightLog.mu.Lock()
+		logged = fp.weightLog.tables
+		fp.weightLog.mu.Unlock()
+	}
+	// The kept ones first, since a new one for the same geometry
+	// replaces an old one.
+	for _, wt := range fp.keptWeights {
+		replaced := false
+		for _, t := range logged {
+			if t.sameGeometry(wt) {
+				replaced = true
+			}
+		}
+		if !replaced {
+			keep = append(keep, wt)
+		}
+	}
+	keep = append(keep, logged...)
+	if len(keep) > maxLoggedWeights {
+		keep = keep[len(keep)-maxLoggedWeights:]
+	}
+	return keep
+}
+
+// ExportWeights writes the weight lists that would be used to resize the
+// image (one for each dimension) to w, in a compact binary format, so that
+// they can be loaded later by ImportWeights. The source image and target
+// bounds must be set, along with any settings that affect the weights
+// (filter, blur, pixel alignment, etc.). If the image will be pre-reduced
+// (see SetPreReduce), the weight lists are the ones for resampling the
+// pre-reduced image.
+//
+// Computing the weight lists is usually fast, but it may be a significant
+// part of the time needed to resize small images, or images with
+// expensive filters. An application that always resizes to the same sizes
+// can compute them ahead of time, and ship them.
+func (fp *FPObject) ExportWeights(w io.Writer) error {
+	err := fp.validateSettings()
+	if err != nil {
+		return err
+	}
+	if fp.srcW < 1 || fp.srcH < 1 {
+		return errors.New("Source image not set")
+	}
+
+	// The weights are made by a copy of fp whose source size is changed, if
+	// the image is pre-reduced, as they are when resizing.
+	sub := *fp
+	sub.srcW, sub.srcH = fp.resampledSrcSize()
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(weightsMagic)
+	for _, isVertical := range []bool{false, true} {
+		wt := sub.weightGeometry(isVertical)
+		wt.weights = sub.createWeightList(isVertical)
+
+		var hdr [1 + 4*3 + 8*2]byte
+		if isVertical {
+			hdr[0] = 1
+		}
+		binary.LittleEndian.PutUint32(hdr[1:], uint32(wt.srcN))
+		binary.LittleEndian.PutUint32(hdr[5:], uint32(wt.dstCanvasN))
+		binary.LittleEndian.PutUint64(hdr[9:], math.Float64bits(wt.dstTrueN))
+		binary.LittleEndian.PutUint64(hdr[17:], math.Float64bits(wt.dstOffset))
+		binary.LittleEndian.PutUint32(hdr[25:], uint32(len(wt.weights)))
+		bw.Write(hdr[:])
+
+		var rec [12]byte
+		for _, fw := range wt.weights {
+			binary.LittleEndian.PutUint32(rec[0:], uint32(int32(fw.srcSamIdx)))
+			binary.LittleEndian.PutUint32(rec[4:], uint32(int32(fw.dstSamIdx)))
+			binary.LittleEndian.PutUint32(rec[8:], math.Float32bits(fw.weight))
+			bw.Write(rec[:])
+		}
+	}
+	return bw.Flush()
+}
+
+// ImportWeights reads weight lists written by ExportWeights. When the image
+// is resized, they are used instead of computing new weight lists, if they
+// were made for the same source and target geometry (so they are ignored
+// if the geometry has changed). The filter, blur, and other settings that
+// affect the weights are not checked.
+//
+// It may be called more than once, to import weight lists for more than
+// one geometry. SetTargetBounds does not forget them.
+func (fp *FPObject) ImportWeights(r io.Reader) error {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(weightsMagic))
+	_, err := io.ReadFull(br, magic)
+	if err != nil || string(magic) != weightsMagic {
+		return errors.New("Not a weight list file, or unsupported version")
+	}
+
+	var tables []*weightTable
+	for k := 0; k < 2; k++ {
+		var hdr [1 + 4*3 + 8*2]byte
+		_, err = io.ReadFull(br, hdr[:])
+		if err != nil {
+			return errors.New("Weight list file is truncated")
+		}
+		wt := &weightTable{isVertical: hdr[0] == 1}
+		wt.srcN = int(binary.LittleEndian.Uint32(hdr[1:]))
+		wt.dstCanvasN = int(binary.LittleEndian.Uint32(hdr[5:]))
+		wt.dstTrueN = math.Float64frombits(binary.LittleEndian.Uint64(hdr[9:]))
+		wt.dstOffset = math.Float64frombits(binary.LittleEndian.Uint64(hdr[17:]))
+		count := int(binary.LittleEndian.Uint32(hdr[25:]))
+
+		if count > maxImagePixels {
+			return errors.New("Invalid weight list file")
+		}
+		wt.weights = make([]fpWeight, 0, count)
+		var rec [12]byte
+		for i := 0; i < count; i++ {
+			_, err = io.ReadFull(br, rec[:])
+			if err != nil {
+				return errors.New("Weight list file is truncated")
+			}
+			fw := fpWeight{
+				srcSamIdx: int(int32(binary.LittleEndian.Uint32(rec[0:]))),
+				dstSamIdx: int(int32(binary.LittleEndian.Uint32(rec[4:]))),
+				weight:    math.Float32frombits(binary.LittleEndian.Uint32(rec[8:])),
+			}
+			// Make sure a bad file can't cause an out-of-range access.
+			if fw.srcSamIdx >= wt.srcN || fw.dstSamIdx >= wt.dstCanvasN ||
+				(fw.srcSamIdx < 0) != (fw.dstSamIdx < 0) || fw.srcSamIdx < -1 || fw.dstSamIdx < -1 {
+				return errors.New("Invalid weight list file")
+			}
+			wt.weights = append(wt.weights, fw)
+		}
+		tables = append(tables, wt)
+	}
+
+	fp.importedWeights = append(fp.importedWeights, tables...)
+	return nil
+}
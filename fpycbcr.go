@@ -0,0 +1,162 @@
+// ◄◄◄ fpycbcr.go ►►►
+// Copyright © 2012 Jason Summers
+
+package fpresize
+
+// This file implements resizing to YCbCr images.
+
+import "image"
+import "image/color"
+
+// Returns the horizontal and vertical chroma subsampling factors for a
+// subsample ratio, or 0,0 if it is not supported.
+func chromaFactors(ratio image.YCbCrSubsampleRatio) (int, int) {
+	switch ratio {
+	case image.YCbCrSubsampleRatio444:
+		return 1, 1
+	case image.YCbCrSubsampleRatio422:
+		return 2, 1
+	case image.YCbCrSubsampleRatio420:
+		return 2, 2
+	case image.YCbCrSubsampleRatio440:
+		return 1, 2
+	case image.YCbCrSubsampleRatio411:
+		return 4, 1
+	case image.YCbCrSubsampleRatio410:
+		return 4, 2
+	}
+	return 0, 0
+}
+
+// Reports whether the source image can be resized one plane at a time: it
+// must be an image.YCbCr that hasn't been converted yet, and nothing may
+// need to be done to its colors.
+func (fp *FPObject) canResizePlanes() bool {
+	src, ok := fp.srcImage.(*image.YCbCr)
+	if !ok || fp.srcFPImage != nil {
+		return false
+	}
+	if hx, _ := chromaFactors(src.SubsampleRatio); hx == 0 {
+		return false
+	}
+	if !fp.inputCCFSet || fp.inputCCF != nil || !fp.outputCCFSet || fp.outputCCF != nil {
+		return false
+	}
+	if fp.dataMode || fp.forceGray || fp.getVirtualPixels() == VirtualPixelsTransparent || fp.srcMask != nil {
+		return false
+	}
+	if fp.sourceRowHook != nil || fp.outputRowHook != nil || fp.hasAdjustments() || fp.useChannelOrder() {
+		return false
+	}
+	return true
+}
+
+// Resize one plane of a YCbCr image. The plane's samples for pixel (x,y) of
+// the image are at (x/hx, y/hy), in plane coordinates. srcRect and dstRect
+// are the bounds of the planes, in plane coordinates.
+func (fp *FPObject) resizePlane(srcPix []uint8, srcStride int, srcRect image.Rectangle,
+	dstPix []uint8, dstStride int, dstRect image.Rectangle, hx, hy int) {
+	w, h := srcRect.Dx(), srcRect.Dy()
+	src := NewFPImageN(image.Rect(0, 0, w, h), 1)
+	for j := 0; j < h; j++ {
+		for i := 0; i < w; i++ {
+			src.Pix[j*src.Stride+i] = float32(srcPix[j*srcStride+i]) / 255.0
+		}
+	}
+
+	// Map the edges of the source plane to the target image, in the
+	// target image's coordinates, then convert to plane coordinates.
+	scaleX := fp.dstTrueW / float64(fp.srcW)
+	scaleY := fp.dstTrueH / float64(fp.srcH)
+	x1 := float64(fp.dstBounds.Min.X) + fp.dstOffsetX + float64(srcRect.Min.X*hx-fp.srcBounds.Min.X)*scaleX
+	x2 := float64(fp.dstBounds.Min.X) + fp.dstOffsetX + float64(srcRect.Max.X*hx-fp.srcBounds.Min.X)*scaleX
+	y1 := float64(fp.dstBounds.Min.Y) + fp.dstOffsetY + float64(srcRect.Min.Y*hy-fp.srcBounds.Min.Y)*scaleY
+	y2 := float64(fp.dstBounds.Min.Y) + fp.dstOffsetY + float64(srcRect.Max.Y*hy-fp.srcBounds.Min.Y)*scaleY
+
+	// Resize it with a copy of fp whose geometry has been changed to that
+	// of the plane.
+	sub := *fp
+	sub.srcW, sub.srcH = w, h
+	sub.dstBounds = dstRect
+	sub.dstCanvasW, sub.dstCanvasH = dstRect.Dx(), dstRect.Dy()
+	sub.dstOffsetX = x1/float64(hx) - float64(dstRect.Min.X)
+	sub.dstOffsetY = y1/float64(hy) - float64(dstRect.Min.Y)
+	sub.dstTrueW = (x2 - x1) / float64(hx)
+	sub.dstTrueH = (y2 - y1) / float64(hy)
+	sub.channelInfo = []channelInfoType{{mustProcess: true}}
+	dst := sub.resizeImageN(src)
+
+	for j := 0; j < dstRect.Dy(); j++ {
+		for i := 0; i < dstRect.Dx(); i++ {
+			v := dst.Pix[j*dst.Stride+i]
+			if v < 0.0 {
+				v = 0.0
+			} else if v > 1.0 {
+				v = 1.0
+			}
+			dstPix[j*dstStride+i] = uint8(v*255.0 + 0.5)
+		}
+	}
+	fp.releaseSamples(dst.Pix)
+}
+
+// Returns the bounds of a YCbCr image's chroma planes, in plane coordinates.
+func chromaRect(r image.Rectangle, hx, hy int) image.Rectangle {
+	return image.Rect(r.Min.X/hx, r.Min.Y/hy, (r.Max.X-1)/hx+1, (r.Max.Y-1)/hy+1)
+}
+
+// ResizeToYCbCr resizes the image, and returns a pointer to an image that
+// uses the YCbCr format.
+//
+// If the source image is an image.YCbCr, and color correction is disabled
+// (by setting both color converters to nil), the Y, Cb, and Cr planes are
+// resized directly, each at its own resolution, and the target image has
+// the same subsample ratio as the source. This is much faster than the
+// usual method, and is suitable for making JPEG thumbnails of JPEG images.
+// Anything else that would affect the colors (data mode, force-grayscale,
+// VirtualPixelsTransparent, a row hook, SetExposure or SetLevels, or a
+// channel order) disables this.
+//
+// Otherwise, the image is resized in the usual way, and converted to a
+// 4:4:4 YCbCr image. Since YCbCr has no alpha channel, any transparency is
+// composited over black.
+func (fp *FPObject) ResizeToYCbCr() (*image.YCbCr, error) {
+	if !fp.canResizePlanes() {
+		rgba, err := fp.ResizeToRGBA()
+		if err != nil {
+			return nil, err
+		}
+		dst := image.NewYCbCr(rgba.Rect, image.YCbCrSubsampleRatio444)
+		for y := rgba.Rect.Min.Y; y < rgba.Rect.Max.Y; y++ {
+			for x := rgba.Rect.Min.X; x < rgba.Rect.Max.X; x++ {
+				c := rgba.RGBAAt(x, y)
+				dst.Y[dst.YOffset(x, y)], dst.Cb[dst.COffset(x, y)], dst.Cr[dst.COffset(x, y)] =
+					color.RGBToYCbCr(c.R, c.G, c.B)
+			}
+		}
+		return dst, nil
+	}
+
+	err := fp.resizeSetup()
+	if err != nil {
+		return nil, err
+	}
+
+	src := fp.srcImage.(*image.YCbCr)
+	hx, hy := chromaFactors(src.SubsampleRatio)
+	dst := image.NewYCbCr(fp.dstBounds, src.SubsampleRatio)
+
+	srcYRect := src.Rect
+	fp.resizePlane(src.Y[src.YOffset(srcYRect.Min.X, srcYRect.Min.Y):], src.YStride, srcYRect,
+		dst.Y, dst.YStride, dst.Rect, 1, 1)
+
+	srcCRect := chromaRect(src.Rect, hx, hy)
+	dstCRect := chromaRect(dst.Rect, hx, hy)
+	cOffs := src.COffset(srcYRect.Min.X, srcYRect.Min.Y)
+	fp.resizePlane(src.Cb[cOffs:], src.CStride, srcCRect, dst.Cb, dst.CStride, dstCRect, hx, hy)
+	fp.resizePlane(src.Cr[cOffs:], src.CStride, srcCRect, dst.Cr, dst.CStride, dstCRect, hx, hy)
+	if err = fp.ctxErr(); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
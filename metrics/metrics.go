@@ -0,0 +1,298 @@
+// ◄◄◄ metrics/metrics.go ►►►
+// Copyright © 2012 Jason Summers
+
+// Package metrics computes measures of the difference between two images,
+// such as an image resized by fpresize and a reference image.
+//
+// Unless stated otherwise, measurements are made in linear light, with
+// associated alpha, assuming that the images use the sRGB colorspace.
+// Sample values are on a scale of 0.0 to 1.0.
+package metrics
+
+import "image"
+import "math"
+import "errors"
+import "sync"
+
+// ErrSizeMismatch is returned when the images to be compared do not have
+// the same dimensions.
+var ErrSizeMismatch = errors.New("metrics: images have different dimensions")
+
+var linearLUT []float64
+var linearLUTOnce sync.Once
+
+// Returns a table that converts a uint16 sRGB sample to linear light.
+func getLinearLUT() []float64 {
+	linearLUTOnce.Do(func() {
+		linearLUT = make([]float64, 65536)
+		for i := range linearLUT {
+			s := float64(i) / 65535.0
+			if s <= 0.0404482362771082 {
+				linearLUT[i] = s / 12.92
+			} else {
+				linearLUT[i] = math.Pow((s+0.055)/1.055, 2.4)
+			}
+		}
+	})
+	return linearLUT
+}
+
+// An image converted to linear light, with associated alpha.
+// There are 4 samples per pixel: R, G, B, A.
+type linearImage struct {
+	w, h int
+	pix  []float64
+}
+
+func toLinear(img image.Image) *linearImage {
+	lut := getLinearLUT()
+	b := img.Bounds()
+	li := new(linearImage)
+	li.w = b.Dx()
+	li.h = b.Dy()
+	li.pix = make([]float64, 4*li.w*li.h)
+
+	for j := 0; j < li.h; j++ {
+		for i := 0; i < li.w; i++ {
+			r, g, bl, a := img.At(b.Min.X+i, b.Min.Y+j).RGBA()
+			p := li.pix[4*(j*li.w+i) : 4*(j*li.w+i)+4]
+			p[3] = float64(a) / 65535.0
+			if a == 0 {
+				continue
+			}
+			// Convert to unassociated alpha, then to linear light, then back
+			// to associated alpha.
+			for k, v := range [3]uint32{r, g, bl} {
+				u := (v*65535 + a/2) / a
+				if u > 65535 {
+					u = 65535
+				}
+				p[k] = lut[u] * p[3]
+			}
+		}
+	}
+	return li
+}
+
+func convertPair(img1, img2 image.Image) (*linearImage, *linearImage, error) {
+	if img1.Bounds().Dx() != img2.Bounds().Dx() || img1.Bounds().Dy() != img2.Bounds().Dy() {
+		return nil, nil, ErrSizeMismatch
+	}
+	return toLinear(img1), toLinear(img2), nil
+}
+
+// MSE returns the mean squared difference between the samples of two images.
+// The alpha channel is included.
+func MSE(img1, img2 image.Image) (float64, error) {
+	li1, li2, err := convertPair(img1, img2)
+	if err != nil {
+		return 0.0, err
+	}
+	if len(li1.pix) == 0 {
+		return 0.0, nil
+	}
+
+	var sum float64
+	for k := range li1.pix {
+		d := li1.pix[k] - li2.pix[k]
+		sum += d * d
+	}
+	return sum / float64(len(li1.pix)), nil
+}
+
+// PSNR returns the peak signal-to-noise ratio of two images, in decibels.
+// Larger numbers mean the images are more similar. If the images are
+// identical, the result is +Inf.
+func PSNR(img1, img2 image.Image) (float64, error) {
+	mse, err := MSE(img1, img2)
+	if err != nil {
+		return 0.0, err
+	}
+	if mse == 0.0 {
+		return math.Inf(1), nil
+	}
+	return -10.0 * math.Log10(mse), nil
+}
+
+// Returns the luminance plane of a linear image. (Transparent areas are
+// treated as black.)
+func (li *linearImage) luminance() []float64 {
+	y := make([]float64, li.w*li.h)
+	for i := range y {
+		y[i] = 0.2126*li.pix[4*i] + 0.7152*li.pix[4*i+1] + 0.0722*li.pix[4*i+2]
+	}
+	return y
+}
+
+// A normalized Gaussian window with standard deviation 1.5, evaluated to
+// a radius of 5 (an 11x11 window when used in two dimensions).
+var ssimWindow = func() []float64 {
+	w := make([]float64, 11)
+	var sum float64
+	for i := range w {
+		x := float64(i - 5)
+		w[i] = math.Exp(-x * x / (2.0 * 1.5 * 1.5))
+		sum += w[i]
+	}
+	for i := range w {
+		w[i] /= sum
+	}
+	return w
+}()
+
+// Blur a plane with the SSIM window. Near the edges, the window is clipped
+// and renormalized.
+func blurPlane(src []float64, w, h int) []float64 {
+	tmp := make([]float64, w*h)
+	dst := make([]float64, w*h)
+	r := len(ssimWindow) / 2
+
+	for j := 0; j < h; j++ {
+		for i := 0; i < w; i++ {
+			var v, norm float64
+			for k := -r; k <= r; k++ {
+				if i+k >= 0 && i+k < w {
+					v += ssimWindow[k+r] * src[j*w+i+k]
+					norm += ssimWindow[k+r]
+				}
+			}
+			tmp[j*w+i] = v / norm
+		}
+	}
+	for j := 0; j < h; j++ {
+		for i := 0; i < w; i++ {
+			var v, norm float64
+			for k := -r; k <= r; k++ {
+				if j+k >= 0 && j+k < h {
+					v += ssimWindow[k+r] * tmp[(j+k)*w+i]
+					norm += ssimWindow[k+r]
+				}
+			}
+			dst[j*w+i] = v / norm
+		}
+	}
+	return dst
+}
+
+// SSIM returns the mean structural similarity index of two images, computed
+// from their luminance using the usual 11x11 Gaussian window. The result is
+// at most 1.0, which means the images are identical.
+func SSIM(img1, img2 image.Image) (float64, error) {
+	li1, li2, err := convertPair(img1, img2)
+	if err != nil {
+		return 0.0, err
+	}
+	w, h := li1.w, li1.h
+	if w*h == 0 {
+		return 1.0, nil
+	}
+
+	y1 := li1.luminance()
+	y2 := li2.luminance()
+
+	// Products needed to compute the local variances and covariance.
+	y11 := make([]float64, w*h)
+	y22 := make([]float64, w*h)
+	y12 := make([]float64, w*h)
+	for i := range y1 {
+		y11[i] = y1[i] * y1[i]
+		y22[i] = y2[i] * y2[i]
+		y12[i] = y1[i] * y2[i]
+	}
+
+	mu1 := blurPlane(y1, w, h)
+	mu2 := blurPlane(y2, w, h)
+	s11 := blurPlane(y11, w, h)
+	s22 := blurPlane(y22, w, h)
+	s12 := blurPlane(y12, w, h)
+
+	const c1 = 0.01 * 0.01
+	const c2 = 0.03 * 0.03
+
+	var sum float64
+	for i := range mu1 {
+		var1 := s11[i] - mu1[i]*mu1[i]
+		var2 := s22[i] - mu2[i]*mu2[i]
+		cov := s12[i] - mu1[i]*mu2[i]
+		sum += ((2.0*mu1[i]*mu2[i] + c1) * (2.0*cov + c2)) /
+			((mu1[i]*mu1[i] + mu2[i]*mu2[i] + c1) * (var1 + var2 + c2))
+	}
+	return sum / float64(w*h), nil
+}
+
+// Difference summarizes the per-pixel differences between two images, as
+// computed by Compare.
+type Difference struct {
+	// The largest difference between corresponding samples, and the position
+	// (relative to the images' origins) of a pixel where it occurs.
+	Max        float64
+	MaxX, MaxY int
+	// The mean, over all pixels, of the largest difference between the
+	// pixel's samples.
+	Mean float64
+	// The number of pixels that are not identical.
+	NumDiffering int
+}
+
+// Within reports whether no sample differs by more than tolerance.
+func (d *Difference) Within(tolerance float64) bool {
+	return d.Max <= tolerance
+}
+
+// Compare compares two images pixel by pixel.
+//
+// Unlike the other functions in this package, it compares the samples as
+// they are stored (with associated alpha), without converting them to
+// linear light. For sRGB images, that makes a given tolerance correspond
+// roughly to a given visual difference, regardless of brightness. This is
+// usually what is wanted when checking whether an image matches a reference
+// image "closely enough", for example when the images were produced on
+// platforms with slightly different floating point behavior.
+func Compare(img1, img2 image.Image) (*Difference, error) {
+	b1 := img1.Bounds()
+	b2 := img2.Bounds()
+	if b1.Dx() != b2.Dx() || b1.Dy() != b2.Dy() {
+		return nil, ErrSizeMismatch
+	}
+
+	d := new(Difference)
+	var sum float64
+
+	for j := 0; j < b1.Dy(); j++ {
+		for i := 0; i < b1.Dx(); i++ {
+			var s1, s2 [4]uint32
+			s1[0], s1[1], s1[2], s1[3] = img1.At(b1.Min.X+i, b1.Min.Y+j).RGBA()
+			s2[0], s2[1], s2[2], s2[3] = img2.At(b2.Min.X+i, b2.Min.Y+j).RGBA()
+
+			var pixelMax uint32
+			for k := 0; k < 4; k++ {
+				var diff uint32
+				if s1[k] > s2[k] {
+					diff = s1[k] - s2[k]
+				} else {
+					diff = s2[k] - s1[k]
+				}
+				if diff > pixelMax {
+					pixelMax = diff
+				}
+			}
+
+			if pixelMax == 0 {
+				continue
+			}
+			v := float64(pixelMax) / 65535.0
+			d.NumDiffering++
+			sum += v
+			if v > d.Max {
+				d.Max = v
+				d.MaxX = i
+				d.MaxY = j
+			}
+		}
+	}
+
+	if b1.Dx()*b1.Dy() > 0 {
+		d.Mean = sum / float64(b1.Dx()*b1.Dy())
+	}
+	return d, nil
+}
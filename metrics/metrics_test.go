@@ -0,0 +1,66 @@
+// ◄◄◄ metrics/metrics_test.go ►►►
+
+// Tests for the metrics package.
+
+package metrics
+
+import "testing"
+import "math"
+import "image"
+import "image/color"
+
+func makeTestImage(offset uint8) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 24, 20))
+	for j := 0; j < 20; j++ {
+		for i := 0; i < 24; i++ {
+			img.SetNRGBA(i, j, color.NRGBA{uint8(i*10) + offset, uint8(j * 12), uint8((i * j) % 256), 255})
+		}
+	}
+	return img
+}
+
+func TestMetrics(t *testing.T) {
+	img1 := makeTestImage(0)
+	img2 := makeTestImage(2)
+
+	psnr, err := PSNR(img1, img1)
+	if err != nil || !math.IsInf(psnr, 1) {
+		t.Errorf("PSNR of identical images: %v, %v", psnr, err)
+	}
+	ssim, err := SSIM(img1, img1)
+	if err != nil || math.Abs(ssim-1.0) > 1e-9 {
+		t.Errorf("SSIM of identical images: %v, %v", ssim, err)
+	}
+
+	psnr, _ = PSNR(img1, img2)
+	if psnr < 30.0 || math.IsInf(psnr, 1) {
+		t.Errorf("PSNR of similar images: %v", psnr)
+	}
+	ssim, _ = SSIM(img1, img2)
+	if ssim > 1.0 || ssim < 0.95 {
+		t.Errorf("SSIM of similar images: %v", ssim)
+	}
+
+	_, err = PSNR(img1, image.NewNRGBA(image.Rect(0, 0, 5, 5)))
+	if err != ErrSizeMismatch {
+		t.Errorf("PSNR of different-sized images did not fail")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	img1 := makeTestImage(0)
+	img2 := makeTestImage(2)
+
+	d, err := Compare(img1, img1)
+	if err != nil || d.Max != 0.0 || d.NumDiffering != 0 || !d.Within(0.0) {
+		t.Errorf("Compare of identical images: %+v, %v", d, err)
+	}
+
+	d, _ = Compare(img1, img2)
+	if d.Max < 1.99/255.0 || d.Max > 2.01/255.0 {
+		t.Errorf("Compare: incorrect maximum difference %v", d.Max)
+	}
+	if d.NumDiffering != 24*20 || d.Within(1.0/255.0) || !d.Within(2.5/255.0) {
+		t.Errorf("Compare: incorrect result %+v", d)
+	}
+}
@@ -0,0 +1,112 @@
+// ◄◄◄ testpattern/testpattern.go ►►►
+// Copyright © 2012 Jason Summers
+
+// Package testpattern generates synthetic images that are useful for
+// evaluating resampling filters, such as zone plates and frequency sweeps.
+//
+// Patterns that contain fine detail will reveal aliasing (moiré) when they
+// are reduced, and patterns with sharp edges will reveal ringing.
+//
+// Unless stated otherwise, sample values are not gamma corrected: a value
+// of 0.5 is stored as 0x8000, whatever colorspace the image is assumed to
+// be in.
+package testpattern
+
+import "image"
+import "image/color"
+import "math"
+
+// Converts a value from 0.0 to 1.0 to a uint16 sample.
+func toSample16(v float64) uint16 {
+	if v <= 0.0 {
+		return 0
+	}
+	if v >= 1.0 {
+		return 65535
+	}
+	return uint16(v*65535.0 + 0.5)
+}
+
+// ZonePlate returns a circular zone plate. The spatial frequency increases
+// linearly with the distance from the center of the image, reaching the
+// Nyquist limit (0.5 cycles per pixel) at the midpoint of the longer edges.
+func ZonePlate(w, h int) *image.Gray16 {
+	img := image.NewGray16(image.Rect(0, 0, w, h))
+	size := float64(w)
+	if h > w {
+		size = float64(h)
+	}
+	cx := float64(w) / 2.0
+	cy := float64(h) / 2.0
+
+	for j := 0; j < h; j++ {
+		for i := 0; i < w; i++ {
+			x := float64(i) + 0.5 - cx
+			y := float64(j) + 0.5 - cy
+			v := 0.5 + 0.5*math.Cos(math.Pi*(x*x+y*y)/size)
+			img.SetGray16(i, j, color.Gray16{toSample16(v)})
+		}
+	}
+	return img
+}
+
+// Sweep returns a horizontal sine-wave frequency sweep. The frequency
+// increases linearly from 0 at the left edge to the Nyquist limit at the
+// right edge. Every row is the same.
+func Sweep(w, h int) *image.Gray16 {
+	img := image.NewGray16(image.Rect(0, 0, w, h))
+	row := make([]uint16, w)
+	for i := range row {
+		x := float64(i) + 0.5
+		row[i] = toSample16(0.5 + 0.5*math.Cos(math.Pi*x*x/(2.0*float64(w))))
+	}
+	for j := 0; j < h; j++ {
+		for i := 0; i < w; i++ {
+			img.SetGray16(i, j, color.Gray16{row[i]})
+		}
+	}
+	return img
+}
+
+// Checkerboard returns a black and white checkerboard whose squares are
+// cellSize pixels on a side. The upper-left square is white.
+func Checkerboard(w, h int, cellSize int) *image.Gray {
+	if cellSize < 1 {
+		cellSize = 1
+	}
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for j := 0; j < h; j++ {
+		for i := 0; i < w; i++ {
+			if (i/cellSize+j/cellSize)%2 == 0 {
+				img.Pix[img.PixOffset(i, j)] = 255
+			}
+		}
+	}
+	return img
+}
+
+// Gradient returns a horizontal gradient from color c0 at the left edge to
+// c1 at the right edge. The colors are interpolated in the image's own
+// colorspace, with unassociated alpha.
+func Gradient(w, h int, c0, c1 color.Color) *image.NRGBA64 {
+	img := image.NewNRGBA64(image.Rect(0, 0, w, h))
+	n0 := color.NRGBA64Model.Convert(c0).(color.NRGBA64)
+	n1 := color.NRGBA64Model.Convert(c1).(color.NRGBA64)
+
+	lerp := func(a, b uint16, t float64) uint16 {
+		return toSample16((float64(a) + t*(float64(b)-float64(a))) / 65535.0)
+	}
+
+	for i := 0; i < w; i++ {
+		var t float64
+		if w > 1 {
+			t = float64(i) / float64(w-1)
+		}
+		c := color.NRGBA64{lerp(n0.R, n1.R, t), lerp(n0.G, n1.G, t),
+			lerp(n0.B, n1.B, t), lerp(n0.A, n1.A, t)}
+		for j := 0; j < h; j++ {
+			img.SetNRGBA64(i, j, c)
+		}
+	}
+	return img
+}
@@ -0,0 +1,307 @@
+// ◄◄◄ thumbhttp/thumbhttp.go ►►►
+// Copyright © 2012 Jason Summers
+
+// Package thumbhttp provides an http.Handler that resizes images on
+// request, for making thumbnails.
+//
+// The source image is either sent in the body of a POST or PUT request, or
+// fetched by a caller-supplied function. The resize is controlled by query
+// parameters:
+//
+//	w, h     Target width and height, in pixels. At least one is required.
+//	fit      How to fit the image to a w×h box, if both are given:
+//	         "contain" (the default) preserves the aspect ratio, making the
+//	         image as large as will fit in the box; "cover" preserves the
+//	         aspect ratio, and crops the image to fill the box; "stretch"
+//	         resizes to exactly w×h.
+//	format   "png" or "jpeg". Default is the source image's format (PNG if
+//	         that can't be written).
+//	quality  JPEG quality, from 1 to 100.
+//
+// The handler enforces limits on the size of the source file, the number of
+// pixels in the source image, and the dimensions of the target image, so
+// that a request can't make it use an unreasonable amount of memory.
+package thumbhttp
+
+import "io"
+import "io/ioutil"
+import "bytes"
+import "fmt"
+import "math"
+import "net/http"
+import "net/url"
+import "strconv"
+import "image"
+import _ "image/png"
+import _ "image/jpeg"
+import _ "image/gif"
+import "github.com/jsummers/fpresize"
+import "github.com/jsummers/fpresize/fpfile"
+
+// Default limits, used when the corresponding Handler field is 0.
+const (
+	DefaultMaxSourceBytes  = 32 * 1024 * 1024
+	DefaultMaxSourcePixels = 50 * 1000 * 1000
+	DefaultMaxTargetSize   = 4096
+)
+
+// Fit modes.
+const (
+	FitContain = "contain"
+	FitCover   = "cover"
+	FitStretch = "stretch"
+)
+
+// Handler is an http.Handler that resizes images. The zero value is usable,
+// and reads the source image from the request body.
+type Handler struct {
+	// If not nil, Fetch returns the source image file for a request (for
+	// example, by opening a file named in the URL). If nil, the source image
+	// is read from the body of a POST or PUT request.
+	Fetch func(r *http.Request) (io.ReadCloser, error)
+
+	// Limits. 0 means to use the default.
+	MaxSourceBytes  int64 // Size of the source file, in bytes
+	MaxSourcePixels int64 // Width times height of the source image
+	MaxTargetSize   int   // Width or height of the target image
+
+	// If not nil, Configure is called with the FPObject before the image is
+	// resized, so that other settings (the filter, etc.) can be changed.
+	Configure func(fp *fpresize.FPObject)
+}
+
+// Spec is a parsed resize request.
+type Spec struct {
+	Width   int
+	Height  int
+	Fit     string
+	Format  string
+	Quality int
+}
+
+// An error that should be reported to the client with a particular HTTP
+// status code.
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+func badRequest(format string, a ...interface{}) error {
+	return &httpError{http.StatusBadRequest, fmt.Sprintf(format, a...)}
+}
+
+// ParseSpec reads a resize request from URL query parameters.
+func ParseSpec(q url.Values) (*Spec, error) {
+	var err error
+	spec := new(Spec)
+
+	getInt := func(name string) (int, error) {
+		s := q.Get(name)
+		if s == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return 0, badRequest("Invalid %s parameter", name)
+		}
+		return n, nil
+	}
+
+	if spec.Width, err = getInt("w"); err != nil {
+		return nil, err
+	}
+	if spec.Height, err = getInt("h"); err != nil {
+		return nil, err
+	}
+	if spec.Width == 0 && spec.Height == 0 {
+		return nil, badRequest("The w or h parameter is required")
+	}
+	if spec.Quality, err = getInt("quality"); err != nil {
+		return nil, err
+	}
+	if spec.Quality > 100 {
+		return nil, badRequest("Invalid quality parameter")
+	}
+
+	spec.Fit = q.Get("fit")
+	switch spec.Fit {
+	case "":
+		spec.Fit = FitContain
+	case FitContain, FitCover, FitStretch:
+	default:
+		return nil, badRequest("Invalid fit parameter")
+	}
+
+	spec.Format = q.Get("format")
+	if spec.Format != "" && fpfile.FormatByFilename("."+spec.Format) == "" {
+		return nil, badRequest("Unsupported format")
+	}
+	return spec, nil
+}
+
+// Calculate the target canvas size, and the size of the rectangle that the
+// source image is mapped to (which is larger than the canvas in cover mode).
+func (spec *Spec) targetSize(srcW, srcH int) (canvasW, canvasH int, imgW, imgH float64, err error) {
+	if spec.Width == 0 || spec.Height == 0 || spec.Fit == FitStretch {
+		canvasW, canvasH, err = fpfile.TargetSize(srcW, srcH, spec.Width, spec.Height)
+		return canvasW, canvasH, float64(canvasW), float64(canvasH), err
+	}
+
+	scaleX := float64(spec.Width) / float64(srcW)
+	scaleY := float64(spec.Height) / float64(srcH)
+
+	if spec.Fit == FitCover {
+		scale := math.Max(scaleX, scaleY)
+		return spec.Width, spec.Height, float64(srcW) * scale, float64(srcH) * scale, nil
+	}
+
+	scale := math.Min(scaleX, scaleY)
+	canvasW = int(0.5 + float64(srcW)*scale)
+	canvasH = int(0.5 + float64(srcH)*scale)
+	if canvasW < 1 {
+		canvasW = 1
+	}
+	if canvasH < 1 {
+		canvasH = 1
+	}
+	return canvasW, canvasH, float64(canvasW), float64(canvasH), nil
+}
+
+// Read the source image.
+func (h *Handler) readSource(r *http.Request) ([]byte, error) {
+	var src io.ReadCloser
+	var err error
+
+	if h.Fetch != nil {
+		src, err = h.Fetch(r)
+		if err != nil {
+			return nil, &httpError{http.StatusNotFound, err.Error()}
+		}
+	} else {
+		if r.Method != "POST" && r.Method != "PUT" {
+			return nil, &httpError{http.StatusMethodNotAllowed, "The image must be sent with POST or PUT"}
+		}
+		src = r.Body
+	}
+	defer src.Close()
+
+	maxBytes := h.MaxSourceBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxSourceBytes
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(src, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, &httpError{http.StatusRequestEntityTooLarge, "Source image file too large"}
+	}
+	return data, nil
+}
+
+// Decode and resize the image. Returns the resized image, and its format.
+func (h *Handler) resize(spec *Spec, data []byte) (image.Image, string, error) {
+	// Check the image dimensions before decoding the whole thing.
+	cfg, srcFormat, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", &httpError{http.StatusUnsupportedMediaType, "Unrecognized image format"}
+	}
+	maxPixels := h.MaxSourcePixels
+	if maxPixels <= 0 {
+		maxPixels = DefaultMaxSourcePixels
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxPixels {
+		return nil, "", &httpError{http.StatusRequestEntityTooLarge, "Source image too large"}
+	}
+
+	canvasW, canvasH, imgW, imgH, err := spec.targetSize(cfg.Width, cfg.Height)
+	if err != nil {
+		return nil, "", badRequest("%s", err.Error())
+	}
+	maxSize := h.MaxTargetSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxTargetSize
+	}
+	if canvasW > maxSize || canvasH > maxSize {
+		return nil, "", badRequest("Target image too large")
+	}
+
+	format := fpfile.FormatByFilename("." + spec.Format)
+	if spec.Format == "" {
+		format = fpfile.FormatByFilename("." + srcFormat)
+		if format == "" {
+			format = "png"
+		}
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", &httpError{http.StatusUnsupportedMediaType, err.Error()}
+	}
+
+	opts := &fpfile.Options{Width: canvasW, Height: canvasH}
+	opts.Configure = func(fp *fpresize.FPObject) {
+		if spec.Fit == FitCover {
+			// Center the image on the canvas. The parts that don't fit are
+			// cropped off.
+			x1 := (float64(canvasW) - imgW) / 2.0
+			y1 := (float64(canvasH) - imgH) / 2.0
+			fp.SetTargetBoundsAdvanced(image.Rect(0, 0, canvasW, canvasH), x1, y1, x1+imgW, y1+imgH)
+			fp.SetVirtualPixels(fpresize.VirtualPixelsNone)
+		}
+		// Only part of the source image is in memory at once, in
+		// floating-point format.
+		fp.SetPipelined(true)
+		if h.Configure != nil {
+			h.Configure(fp)
+		}
+	}
+
+	dst, err := fpfile.ResizeImage(src, format, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return dst, format, nil
+}
+
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request) error {
+	spec, err := ParseSpec(r.URL.Query())
+	if err != nil {
+		return err
+	}
+
+	data, err := h.readSource(r)
+	if err != nil {
+		return err
+	}
+
+	dst, format, err := h.resize(spec, data)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "image/"+format)
+	// If this fails, it's too late to send an error response, so ignore
+	// the error.
+	fpfile.Encode(w, dst, format, &fpfile.Options{Quality: spec.Quality})
+	return nil
+}
+
+// ServeHTTP resizes the image for a request, and writes it to w.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := h.serve(w, r)
+	if err == nil {
+		return
+	}
+
+	if he, ok := err.(*httpError); ok {
+		http.Error(w, he.msg, he.status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,92 @@
+// ◄◄◄ thumbhttp/thumbhttp_test.go ►►►
+
+// Tests for the thumbhttp package.
+
+package thumbhttp
+
+import "testing"
+import "bytes"
+import "image"
+import "image/color"
+import "image/png"
+import "image/jpeg"
+import "net/http"
+import "net/http/httptest"
+
+func makeTestPNG(t *testing.T, w, h int) []byte {
+	src := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for j := 0; j < h; j++ {
+		for i := 0; i < w; i++ {
+			src.SetNRGBA(i, j, color.NRGBA{uint8(i * 3), uint8(j * 5), 50, 255})
+		}
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func doRequest(h http.Handler, query string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/thumb?"+query, bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHandler(t *testing.T) {
+	h := new(Handler)
+	body := makeTestPNG(t, 80, 40)
+
+	type testCase struct {
+		query  string
+		format string
+		w, h   int
+	}
+	tests := []testCase{
+		{"w=20", "png", 20, 10},
+		{"w=20&h=20", "png", 20, 10},
+		{"w=20&h=20&fit=cover", "png", 20, 20},
+		{"w=20&h=20&fit=stretch&format=jpg&quality=80", "jpeg", 20, 20},
+	}
+	for _, tc := range tests {
+		rec := doRequest(h, tc.query, body)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: status %d: %s", tc.query, rec.Code, rec.Body.String())
+			continue
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "image/"+tc.format {
+			t.Errorf("%s: Content-Type %q", tc.query, ct)
+		}
+		var img image.Image
+		var err error
+		if tc.format == "jpeg" {
+			img, err = jpeg.Decode(rec.Body)
+		} else {
+			img, err = png.Decode(rec.Body)
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.query, err)
+			continue
+		}
+		if img.Bounds() != image.Rect(0, 0, tc.w, tc.h) {
+			t.Errorf("%s: wrong size %v", tc.query, img.Bounds())
+		}
+	}
+
+	// Errors
+	if rec := doRequest(h, "fit=cover", body); rec.Code != http.StatusBadRequest {
+		t.Errorf("Missing size: status %d", rec.Code)
+	}
+	if rec := doRequest(h, "w=100000", body); rec.Code != http.StatusBadRequest {
+		t.Errorf("Large target: status %d", rec.Code)
+	}
+	if rec := doRequest(h, "w=20", []byte("not an image")); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Bad image: status %d", rec.Code)
+	}
+	limited := &Handler{MaxSourcePixels: 1000}
+	if rec := doRequest(limited, "w=20", body); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Large source: status %d", rec.Code)
+	}
+}